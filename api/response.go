@@ -62,6 +62,9 @@ func (r *Response) Error() error {
 	for _, err := range resp.Errors {
 		errBody.WriteString(fmt.Sprintf("* %s", err))
 	}
+	if resp.ErrorCode != "" {
+		errBody.WriteString(fmt.Sprintf("\n\nError code: %s", resp.ErrorCode))
+	}
 
 	return fmt.Errorf(errBody.String())
 }
@@ -69,5 +72,6 @@ func (r *Response) Error() error {
 // ErrorResponse is the raw structure of errors when they're returned by the
 // HTTP API.
 type ErrorResponse struct {
-	Errors []string
+	Errors    []string
+	ErrorCode string `json:"error_code"`
 }
@@ -1,7 +1,10 @@
 package ssh
 
 import (
+	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/vault/helper/salt"
 	"github.com/hashicorp/vault/logical"
@@ -11,6 +14,55 @@ import (
 type backend struct {
 	*framework.Backend
 	salt *salt.Salt
+
+	// otpLock serializes the verification of OTPs so that an OTP can't
+	// be consumed by more than one verify request.
+	otpLock sync.Mutex
+
+	// roleLock serializes writes to roles so that check-and-set writes
+	// compare against the role that is actually replaced.
+	roleLock sync.Mutex
+
+	// scripts caches the effective install script of dynamic roles,
+	// keyed by role name.
+	scriptLock sync.RWMutex
+	scripts    map[string]*installScript
+
+	// metrics holds the counters of each role, keyed by the namespace
+	// and the name of the role.
+	metricsLock sync.Mutex
+	metrics     map[string]map[string]int
+
+	// issuersLock serializes the changes of the default issuer with the
+	// deletion of issuers, so that the default issuer always exists.
+	issuersLock sync.Mutex
+
+	// keyLock serializes the writes of shared keys, so that a rotated key
+	// is only replaced if it wasn't changed during the rotation.
+	keyLock sync.Mutex
+
+	// issuanceLock serializes the changes of the issuance logs of roles
+	// with the deletion of their oldest entries.
+	issuanceLock sync.Mutex
+
+	// pool holds the admin connections to remote hosts, shared by the
+	// installs, uninstalls and checks of dynamic keys.
+	pool *connPool
+
+	// installKey installs or uninstalls a dynamic key in a remote host.
+	installKey func(opts *installOptions) error
+
+	// verifyKey checks whether a dynamic key is still installed in a
+	// remote host.
+	verifyKey func(opts *installOptions) (bool, error)
+
+	// testConnection logs in to a remote host with the admin credentials
+	// of a role, without changing anything in it.
+	testConnection func(opts *installOptions) error
+
+	// lookupHost resolves the hostnames given instead of IPs when
+	// credentials are requested.
+	lookupHost func(host string) ([]string, error)
 }
 
 func Factory(conf *logical.BackendConfig) (logical.Backend, error) {
@@ -22,6 +74,14 @@ func Factory(conf *logical.BackendConfig) (logical.Backend, error) {
 }
 
 func Backend(conf *logical.BackendConfig) (*framework.Backend, error) {
+	b, err := newBackend(conf)
+	if err != nil {
+		return nil, err
+	}
+	return b.Backend, nil
+}
+
+func newBackend(conf *logical.BackendConfig) (*backend, error) {
 	salt, err := salt.NewSalt(conf.View, nil)
 	if err != nil {
 		return nil, err
@@ -29,6 +89,11 @@ func Backend(conf *logical.BackendConfig) (*framework.Backend, error) {
 
 	var b backend
 	b.salt = salt
+	b.installKey = b.installPublicKeyInTarget
+	b.pool = newConnPool()
+	b.verifyKey = b.verifyPublicKeyInTarget
+	b.testConnection = testSSHConnection
+	b.lookupHost = net.LookupHost
 	b.Backend = &framework.Backend{
 		Help: strings.TrimSpace(backendHelp),
 
@@ -36,32 +101,60 @@ func Backend(conf *logical.BackendConfig) (*framework.Backend, error) {
 			Root: []string{
 				"config/*",
 				"keys/*",
+				"issuers/*",
 			},
 			Unauthenticated: []string{
 				"verify",
+				"public_key",
 			},
 		},
 
 		Paths: []*framework.Path{
 			pathConfigLease(&b),
+			pathConfigInstallScript(&b),
+			pathConfigDefaults(&b),
+			pathConfigCA(&b),
+			pathConfigIssuers(&b),
+			pathIssuersList(&b),
+			pathIssuers(&b),
+			pathPublicKey(&b),
+			pathConfigZeroAddress(&b),
+			pathKeysRotate(&b),
 			pathKeys(&b),
+			pathKeysBulk(&b),
+			pathRoleRevokeAll(&b),
+			pathRoleConnectionTest(&b),
+			pathRoleVersionsList(&b),
+			pathRoleVersions(&b),
+			pathRoleRollback(&b),
+			pathRolesList(&b),
 			pathRoles(&b),
+			pathCredsBatch(&b),
 			pathCredsCreate(&b),
+			pathSign(&b),
 			pathLookup(&b),
 			pathVerify(&b),
+			pathIssued(&b),
+			pathMetrics(&b),
+			pathTidy(&b),
 		},
 
 		Secrets: []*framework.Secret{
 			secretDynamicKey(&b),
 			secretOTP(&b),
 		},
+
+		RollbackHandlers: map[string]framework.RollbackFunc{
+			walDynamicKeyKind: b.dynamicKeyRollback,
+		},
+		RollbackMinAge: 5 * time.Minute,
 	}
-	return b.Backend, nil
+	return &b, nil
 }
 
 const backendHelp = `
 The SSH backend generates credentials to establish SSH connection with remote hosts.
-There are two types of credentials that could be generated: Dynamic and OTP. The
+There are three types of credentials that could be generated: Dynamic, OTP and CA. The
 desired way of key creation should be chosen by using 'key_type' parameter of 'roles/'
 endpoint. When a credential is requested for a particular role, Vault will generate
 a credential accordingly and issue it.
@@ -84,6 +177,15 @@ them. This agent will receive the OTP from client and get it validated by Vault
 And since Vault server has a role to play for each successful connection, all the
 events will be audited. Vault server validates a key only once, hence it is a OTP.
 
+CA: is an SSH certificate for a public key of the client, signed with the CA key
+configured using 'config/ca' endpoint. Certificates are requested using 'sign/'
+endpoint. Hosts that trust the CA accept the certificates, so nothing needs to be
+installed in them. Certificates expire on their own and can't be revoked. Hosts can
+fetch the public key of the CA from the 'public_key' endpoint without a token.
+
 After mounting this backend, before generating the keys, configure the lease using
-'congig/lease' endpoint and create roles using 'roles/' endpoint.
+'congig/lease' endpoint and create roles using 'roles/' endpoint. Values shared
+by many roles, such as the port, can be configured once using 'config/defaults'.
+The admin credentials of dynamic roles can be checked against a host, without
+issuing a key, using the 'roles/<role>/test' endpoint.
 `
@@ -1,16 +1,33 @@
 package ssh
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
 	"os/user"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 
 	"github.com/hashicorp/vault/api"
 	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
 	logicaltest "github.com/hashicorp/vault/logical/testing"
 	"github.com/hashicorp/vault/vault"
 	"github.com/mitchellh/mapstructure"
@@ -146,6 +163,43 @@ func TestSSHBackend_OTPRoleCrud(t *testing.T) {
 	})
 }
 
+func TestSSHBackend_RoleValidateOnly(t *testing.T) {
+	data := map[string]interface{}{
+		"key_type":      testOTPKeyType,
+		"default_user":  testUserName,
+		"cidr_list":     testCIDRList,
+		"validate_only": true,
+	}
+	logicaltest.Test(t, logicaltest.TestCase{
+		Factory: Factory,
+		Steps: []logicaltest.TestStep{
+			testRoleWrite(t, testOTPRoleName, data),
+			testRoleRead(t, testOTPRoleName, nil),
+		},
+	})
+}
+
+func TestSSHBackend_RoleRequiredFields(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "roles/" + testOTPRoleName,
+		Storage:   storage,
+		Data:      map[string]interface{}{"cidr_list": testCIDRList},
+	})
+	if err != logical.ErrInvalidRequest {
+		t.Fatalf("err: %v", err)
+	}
+	if resp == nil || resp.Data["error"] != "missing required fields: default_user, key_type" {
+		t.Fatalf("bad: %#v", resp)
+	}
+}
+
 func TestSSHBackend_DynamicRoleCrud(t *testing.T) {
 	data := map[string]interface{}{
 		"key_type":       testDynamicKeyType,
@@ -209,198 +263,5151 @@ func TestSSHBackend_VerifyEcho(t *testing.T) {
 	})
 }
 
-func testVerifyWrite(t *testing.T, d map[string]interface{}, expected map[string]interface{}) logicaltest.TestStep {
-	return logicaltest.TestStep{
-		Operation: logical.WriteOperation,
-		Path:      fmt.Sprintf("verify"),
-		Data:      d,
-		Check: func(resp *logical.Response) error {
-			var ac api.SSHVerifyResponse
-			if err := mapstructure.Decode(resp.Data, &ac); err != nil {
-				return err
-			}
-			var ex api.SSHVerifyResponse
-			if err := mapstructure.Decode(expected, &ex); err != nil {
-				return err
-			}
+func TestSSHBackend_resolveUsername(t *testing.T) {
+	cases := map[string]struct {
+		AllowedUsers string
+		Requested    string
+		Expected     string
+		Err          bool
+	}{
+		"no username uses default": {"", "", "default", false},
+		"allowed username":         {"foo,bar", "bar", "bar", false},
+		"disallowed username":      {"foo,bar", "baz", "", true},
+		"default not in list":      {"foo,bar", "default", "default", false},
+		"admin when allowed":       {"foo,admin", "admin", "admin", false},
+		"admin when disallowed":    {"foo,bar", "admin", "", true},
+		"any user without list":    {"", "admin", "admin", false},
+		"templated match":          {"foo,{{token.metadata.username}}", "alice", "alice", false},
+		"templated mismatch":       {"foo,{{token.metadata.username}}", "bob", "", true},
+		"templated missing value":  {"{{token.metadata.missing}}", "alice", "", true},
+		"templated display name":   {"{{display_name}}", "token-alice", "token-alice", false},
+		"glob match":               {"foo,svc-*", "svc-web", "svc-web", false},
+		"glob mismatch":            {"foo,svc-*", "web", "", true},
+		"wildcard":                 {"*", "admin", "admin", false},
+		"wildcard odd username":    {"*", "alice;reboot", "", true},
+		"glob with template":       {"{{token.metadata.username}}-*", "alice-dev", "alice-dev", false},
+		"template value not glob":  {"{{token.metadata.glob}}", "alice", "", true},
+		"template value literal":   {"{{token.metadata.glob}}", "a*", "a*", false},
+		"template value escaped":   {"{{token.metadata.glob}}-x?", "alice-x1", "", true},
+	}
 
-			if ac.Message != ex.Message || ac.IP != ex.IP || ac.Username != ex.Username {
-				return fmt.Errorf("Invalid response")
-			}
-			return nil
-		},
+	req := &logical.Request{
+		DisplayName: "token-alice",
+		Metadata:    map[string]string{"username": "alice", "glob": "a*"},
+	}
+	for name, tc := range cases {
+		role := &sshRole{
+			AdminUser:    "admin",
+			DefaultUser:  "default",
+			AllowedUsers: tc.AllowedUsers,
+		}
+		username, err := resolveUsername(req, role, tc.Requested)
+		if (err != nil) != tc.Err {
+			t.Fatalf("bad: %s: err: %v", name, err)
+		}
+		if username != tc.Expected {
+			t.Fatalf("bad: %s: expected %q, got %q", name, tc.Expected, username)
+		}
 	}
-}
 
-func testCredsWrite(t *testing.T, name string) logicaltest.TestStep {
-	data := map[string]interface{}{
-		"ip": testIP,
+	// Entries of roles that aren't templated are taken literally.
+	template := false
+	role := &sshRole{
+		DefaultUser:          "default",
+		AllowedUsers:         "{{token.metadata.username}},svc-*",
+		AllowedUsersTemplate: &template,
 	}
-	return logicaltest.TestStep{
-		Operation: logical.WriteOperation,
-		Path:      fmt.Sprintf("creds/%s", name),
-		Data:      data,
-		Check: func(resp *logical.Response) error {
-			if resp == nil {
-				return fmt.Errorf("response is nil")
-			}
-			if resp.Data == nil {
-				return fmt.Errorf("data is nil")
-			}
-			if resp.Data["key_type"] != KeyTypeOTP {
-				return fmt.Errorf("Incorrect key_type")
-			}
-			if resp.Data["key"] == nil {
-				return fmt.Errorf("Invalid key")
-			}
-			testOTP = resp.Data["key"].(string)
-			return nil
-		},
+	if _, err := resolveUsername(req, role, "alice"); err == nil {
+		t.Fatalf("bad: entry was templated")
+	}
+	if _, err := resolveUsername(req, role, "svc-web"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := validateAllowedUsers(role.AllowedUsers, false); err == nil {
+		t.Fatalf("bad: variables accepted without allowed_users_template")
+	}
+	if err := validateAllowedUsers(role.AllowedUsers, true); err != nil {
+		t.Fatalf("err: %s", err)
 	}
 }
 
-func testNamedKeysRead(t *testing.T, key string) logicaltest.TestStep {
-	return logicaltest.TestStep{
-		Operation: logical.ReadOperation,
-		Path:      fmt.Sprintf("keys/%s", testKeyName),
-		Check: func(resp *logical.Response) error {
-			if key != "" {
-				if resp == nil || resp.Data == nil {
-					return fmt.Errorf("Key missing in response")
-				}
-				var d struct {
-					Key string `mapstructure:"key"`
-				}
-				if err := mapstructure.Decode(resp.Data, &d); err != nil {
-					return err
-				}
+func TestSSHBackend_sshConfigSnippet(t *testing.T) {
+	expected := "Host web.example.com\n  HostName 10.0.0.1\n  Port 2222\n  User alice\n" +
+		"  PreferredAuthentications keyboard-interactive,password\n"
+	if snippet := sshConfigSnippet(KeyTypeOTP, "web.example.com", "10.0.0.1", 2222, "alice"); snippet != expected {
+		t.Fatalf("bad: %q", snippet)
+	}
+	expected = "Host 10.0.0.1\n  HostName 10.0.0.1\n  Port 22\n  User alice\n" +
+		"  PreferredAuthentications publickey\n  IdentitiesOnly yes\n"
+	if snippet := sshConfigSnippet(KeyTypeDynamic, "", "10.0.0.1", 22, "alice"); snippet != expected {
+		t.Fatalf("bad: %q", snippet)
+	}
 
-				if d.Key != key {
-					return fmt.Errorf("Key mismatch")
-				}
-			}
-			return nil
-		},
+	if patterns := knownHostsPatterns("example.com,example.org"); patterns != "example.com,*.example.com,example.org,*.example.org" {
+		t.Fatalf("bad: %q", patterns)
+	}
+	if snippet := certSSHConfigSnippet("example.com", "alice"); snippet != "Host example.com *.example.com\n  User alice\n" {
+		t.Fatalf("bad: %q", snippet)
 	}
 }
 
-func testNamedKeysWrite(t *testing.T) logicaltest.TestStep {
-	return logicaltest.TestStep{
-		Operation: logical.WriteOperation,
-		Path:      fmt.Sprintf("keys/%s", testKeyName),
-		Data: map[string]interface{}{
-			"key": testSharedPrivateKey,
-		},
+func TestSSHBackend_roleInstallScript(t *testing.T) {
+	var b backend
+	role := &sshRole{Version: 1}
+
+	script := b.roleInstallScript("web", role)
+	if script.Script != DefaultPublicKeyInstallScript {
+		t.Fatalf("bad: expected default install script, got %q", script.Script)
+	}
+	if b.roleInstallScript("web", role) != script {
+		t.Fatalf("bad: install script was not cached")
 	}
-}
 
-func testNamedKeysDelete(t *testing.T) logicaltest.TestStep {
-	return logicaltest.TestStep{
-		Operation: logical.DeleteOperation,
-		Path:      fmt.Sprintf("keys/%s", testKeyName),
+	// A newer version of the role must not use the cached script.
+	role = &sshRole{Version: 2, InstallScript: "custom"}
+	updated := b.roleInstallScript("web", role)
+	if updated.Script != "custom" || updated.Checksum == script.Checksum {
+		t.Fatalf("bad: %#v", updated)
+	}
+
+	b.invalidateInstallScript("web")
+	if b.roleInstallScript("web", role) == updated {
+		t.Fatalf("bad: install script was not invalidated")
 	}
 }
 
-func testLookupRead(t *testing.T, data map[string]interface{}, length int) logicaltest.TestStep {
-	return logicaltest.TestStep{
+func TestSSHBackend_OTPRenew(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	resp, err := b.HandleRequest(&logical.Request{
 		Operation: logical.WriteOperation,
-		Path:      "lookup",
-		Data:      data,
-		Check: func(resp *logical.Response) error {
-			if resp.Data == nil || resp.Data["roles"] == nil {
-				return fmt.Errorf("Missing roles information")
-			}
-			if len(resp.Data["roles"].([]string)) != length {
-				return fmt.Errorf("Role information incorrect")
-			}
-			return nil
+		Path:      "roles/" + testOTPRoleName,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"key_type":     testOTPKeyType,
+			"default_user": testUserName,
+			"cidr_list":    testCIDRList,
 		},
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
 	}
-}
 
-func testRoleWrite(t *testing.T, name string, data map[string]interface{}) logicaltest.TestStep {
-	return logicaltest.TestStep{
+	resp, err = b.HandleRequest(&logical.Request{
 		Operation: logical.WriteOperation,
-		Path:      "roles/" + name,
-		Data:      data,
+		Path:      "creds/" + testOTPRoleName,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"ip": testIP,
+		},
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
+	}
+	oldOTP := resp.Data["key"].(string)
+
+	req := logical.RenewRequest("creds/"+testOTPRoleName, resp.Secret, resp.Data)
+	req.Storage = storage
+	req.Secret.IssueTime = time.Now().UTC()
+	resp, err = b.HandleRequest(req)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
+	}
+	newOTP := resp.Data["key"].(string)
+	if newOTP == "" || newOTP == oldOTP {
+		t.Fatalf("bad: expected a new OTP, got %q", newOTP)
+	}
+	if resp.Secret.InternalData["otp"] != newOTP {
+		t.Fatalf("bad: %#v", resp.Secret.InternalData)
+	}
+
+	verify := func(otp string) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      "verify",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"otp": otp,
+			},
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+	if resp := verify(oldOTP); !resp.IsError() {
+		t.Fatalf("bad: old OTP was verified: %#v", resp)
+	}
+	if resp := verify(newOTP); resp.IsError() || resp.Data["ip"] != testIP {
+		t.Fatalf("bad: %#v", resp)
 	}
 }
 
-func testRoleRead(t *testing.T, name string, data map[string]interface{}) logicaltest.TestStep {
-	return logicaltest.TestStep{
+func TestSSHBackend_RoleTTL(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+	roleData := func(ttl, maxTTL string) map[string]interface{} {
+		return map[string]interface{}{
+			"key_type":     testOTPKeyType,
+			"default_user": testUserName,
+			"cidr_list":    testCIDRList,
+			"ttl":          ttl,
+			"max_ttl":      maxTTL,
+		}
+	}
+
+	for _, data := range []map[string]interface{}{
+		roleData("2h", "1h"),
+		roleData("forever", ""),
+		roleData("-1m", ""),
+	} {
+		if resp := request("roles/"+testOTPRoleName, data); resp == nil || !resp.IsError() {
+			t.Fatalf("bad: %#v: %#v", data, resp)
+		}
+	}
+
+	request("config/lease", map[string]interface{}{"lease": "2h", "lease_max": "24h"})
+	if resp := request("roles/"+testOTPRoleName, roleData("30m", "1h")); resp != nil && resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	resp, err := b.HandleRequest(&logical.Request{
 		Operation: logical.ReadOperation,
-		Path:      "roles/" + name,
-		Check: func(resp *logical.Response) error {
-			if resp == nil {
-				if data == nil {
-					return nil
-				}
-				return fmt.Errorf("bad: %#v", resp)
-			}
-			var d sshRole
-			if err := mapstructure.Decode(resp.Data, &d); err != nil {
-				return fmt.Errorf("error decoding response:%s", err)
-			}
-			if name == testOTPRoleName {
-				if d.KeyType != data["key_type"] || d.DefaultUser != data["default_user"] || d.CIDRList != data["cidr_list"] {
-					return fmt.Errorf("data mismatch. bad: %#v", resp)
-				}
-			} else {
-				if d.AdminUser != data["admin_user"] || d.CIDRList != data["cidr_list"] || d.KeyName != data["key"] || d.KeyType != data["key_type"] {
-					return fmt.Errorf("data mismatch. bad: %#v", resp)
-				}
-			}
-			return nil
-		},
+		Path:      "roles/" + testOTPRoleName,
+		Storage:   storage,
+	})
+	if err != nil || resp.Data["ttl"] != "30m0s" || resp.Data["max_ttl"] != "1h0m0s" {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
+	}
+
+	// Requests can shorten the lease, and extend it up to the max_ttl of
+	// the role.
+	for requested, expected := range map[string]time.Duration{
+		"5m":  5 * time.Minute,
+		"45m": 45 * time.Minute,
+		"3h":  time.Hour,
+	} {
+		resp = request("creds/"+testOTPRoleName, map[string]interface{}{"ip": testIP, "ttl": requested})
+		if resp.IsError() || resp.Secret.TTL != expected {
+			t.Fatalf("bad: %s: %#v", requested, resp)
+		}
+	}
+	if resp = request("creds/"+testOTPRoleName, map[string]interface{}{"ip": testIP, "ttl": "-5m"}); !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	resp = request("creds/"+testOTPRoleName, map[string]interface{}{"ip": testIP})
+	if resp.Secret.TTL != 30*time.Minute {
+		t.Fatalf("bad: %s", resp.Secret.TTL)
+	}
+
+	// The lease can't be renewed past the max_ttl of the role, even
+	// though the mount allows it.
+	secret := resp.Secret
+	secret.IssueTime = time.Now().UTC().Add(-2 * time.Hour)
+	req := logical.RenewRequest("creds/"+testOTPRoleName, secret, resp.Data)
+	req.Storage = storage
+	resp, _ = b.HandleRequest(req)
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
 	}
 }
 
-func testRoleDelete(t *testing.T, name string) logicaltest.TestStep {
-	return logicaltest.TestStep{
-		Operation: logical.DeleteOperation,
-		Path:      "roles/" + name,
+func TestSSHBackend_ZeroAddressRoles(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+	otpRole := map[string]interface{}{
+		"key_type":     testOTPKeyType,
+		"default_user": testUserName,
+	}
+
+	// Without CIDR blocks, only zero-address roles can be written.
+	if resp := request(logical.WriteOperation, "roles/"+testOTPRoleName, otpRole); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	request(logical.WriteOperation, "keys/"+testKeyName, map[string]interface{}{"key": testSharedPrivateKey})
+	request(logical.WriteOperation, "roles/"+testDynamicRoleName, map[string]interface{}{
+		"key_type":     testDynamicKeyType,
+		"key":          testKeyName,
+		"admin_user":   testAdminUser,
+		"default_user": testAdminUser,
+		"cidr_list":    testCIDRList,
+	})
+	resp := request(logical.WriteOperation, "config/zeroaddress", map[string]interface{}{
+		"roles": testDynamicRoleName,
+	})
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	request(logical.WriteOperation, "config/zeroaddress", map[string]interface{}{
+		"roles": testOTPRoleName + ",tenant1/" + testOTPRoleName,
+	})
+	if resp := request(logical.WriteOperation, "roles/"+testOTPRoleName, otpRole); resp != nil && resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	resp = request(logical.WriteOperation, "creds/"+testOTPRoleName, map[string]interface{}{"ip": "10.1.2.3"})
+	if resp == nil || resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	resp = request(logical.WriteOperation, "lookup", map[string]interface{}{"ip": "192.168.1.1"})
+	if !reflect.DeepEqual(resp.Data["roles"], []string{testOTPRoleName}) {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	// Deleting the role takes it off the list.
+	request(logical.DeleteOperation, "roles/"+testOTPRoleName, nil)
+	resp = request(logical.ReadOperation, "config/zeroaddress", nil)
+	if !reflect.DeepEqual(resp.Data["roles"], []string{"tenant1/" + testOTPRoleName}) {
+		t.Fatalf("bad: %#v", resp.Data)
 	}
 }
 
-func testNewDynamicKeyRole(t *testing.T) logicaltest.TestStep {
-	return logicaltest.TestStep{
+func TestSSHBackend_CredsErrorCodes(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	resp, err := b.HandleRequest(&logical.Request{
 		Operation: logical.WriteOperation,
-		Path:      fmt.Sprintf("roles/%s", testDynamicRoleName),
+		Path:      "roles/" + testOTPRoleName,
+		Storage:   storage,
 		Data: map[string]interface{}{
-			"key_type":       "dynamic",
-			"key":            testKeyName,
-			"admin_user":     testAdminUser,
-			"default_user":   testAdminUser,
-			"cidr_list":      testCIDRList,
-			"port":           testPort,
-			"install_script": testInstallScript,
+			"key_type":      testOTPKeyType,
+			"default_user":  testUserName,
+			"cidr_list":     testCIDRList,
+			"allowed_users": testUserName,
 		},
+	})
+	if err != nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
+	}
+
+	cases := map[string]struct {
+		Role string
+		Data map[string]interface{}
+		Code string
+	}{
+		"missing ip":      {testOTPRoleName, map[string]interface{}{}, ErrorCodeInvalidRequest},
+		"unknown role":    {"missing", map[string]interface{}{"ip": testIP}, ErrorCodeUnknownRole},
+		"user not listed": {testOTPRoleName, map[string]interface{}{"ip": testIP, "username": "nobody"}, ErrorCodeUserNotAllowed},
+		"invalid ip":      {testOTPRoleName, map[string]interface{}{"ip": "not-an-ip"}, ErrorCodeInvalidIP},
+		"ip not in cidr":  {testOTPRoleName, map[string]interface{}{"ip": "203.0.113.1"}, ErrorCodeIPNotInCIDR},
+	}
+
+	for name, tc := range cases {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      "creds/" + tc.Role,
+			Storage:   storage,
+			Data:      tc.Data,
+		})
+		if err != nil {
+			t.Fatalf("bad: %s: err: %s", name, err)
+		}
+		if !resp.IsError() || resp.Data["error_code"] != tc.Code {
+			t.Fatalf("bad: %s: expected code %q, got %#v", name, tc.Code, resp)
+		}
 	}
 }
 
-func testDynamicKeyCredsCreate(t *testing.T) logicaltest.TestStep {
-	return logicaltest.TestStep{
-		Operation: logical.WriteOperation,
-		Path:      fmt.Sprintf("creds/%s", testDynamicRoleName),
-		Data: map[string]interface{}{
-			"username": testUserName,
-			"ip":       testIP,
+func TestSSHBackend_keyComment(t *testing.T) {
+	cases := map[string]struct {
+		Template string
+		Expected string
+		Err      bool
+	}{
+		"literal":          {"vault", "vault", false},
+		"all variables":    {"vault-{{role_name}}-{{display_name}}-{{timestamp}}", "vault-web-token-alice-2016-01-02T03:04:05Z", false},
+		"unknown variable": {"{{username}}", "", true},
+		"multiple lines":   {"vault\nssh-rsa AAAA", "", true},
+	}
+
+	now := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	for name, tc := range cases {
+		err := validateKeyComment(tc.Template)
+		if (err != nil) != tc.Err {
+			t.Fatalf("bad: %s: err: %v", name, err)
+		}
+		if tc.Err {
+			continue
+		}
+		if comment := renderKeyComment(tc.Template, "web", "token-alice", now); comment != tc.Expected {
+			t.Fatalf("bad: %s: expected %q, got %q", name, tc.Expected, comment)
+		}
+	}
+
+	// Values can't break out of the authorized_keys line
+	if comment := renderKeyComment("{{display_name}}", "web", "a\nssh-rsa b", now); comment != "assh-rsa b" {
+		t.Fatalf("bad: %q", comment)
+	}
+}
+
+func TestSSHBackend_DynamicKeyInstallFailure(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The fake installer leaves the key behind when the install fails, like
+	// an install script that fails midway would.
+	installed := make(map[string]bool)
+	uninstallErr := fmt.Errorf("uninstall failed")
+	b.installKey = func(opts *installOptions) error {
+		if opts.Install {
+			installed[opts.DynamicPublicKey] = true
+			return fmt.Errorf("install failed")
+		}
+		if uninstallErr != nil {
+			return uninstallErr
+		}
+		delete(installed, opts.DynamicPublicKey)
+		return nil
+	}
+	b.verifyKey = func(opts *installOptions) (bool, error) {
+		return installed[opts.DynamicPublicKey], nil
+	}
+
+	steps := []*logical.Request{
+		&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      "keys/" + testKeyName,
+			Data:      map[string]interface{}{"key": testSharedPrivateKey},
 		},
-		Check: func(resp *logical.Response) error {
-			var d struct {
-				Key string `mapstructure:"key"`
-			}
-			if err := mapstructure.Decode(resp.Data, &d); err != nil {
-				return err
-			}
-			if d.Key == "" {
-				return fmt.Errorf("Generated key is an empty string")
+		&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      "roles/" + testDynamicRoleName,
+			Data: map[string]interface{}{
+				"key_type":     testDynamicKeyType,
+				"key":          testKeyName,
+				"admin_user":   testAdminUser,
+				"default_user": testAdminUser,
+				"cidr_list":    testCIDRList,
+			},
+		},
+	}
+	for _, req := range steps {
+		req.Storage = storage
+		resp, err := b.HandleRequest(req)
+		if err != nil || resp.IsError() {
+			t.Fatalf("bad: resp: %#v err: %v", resp, err)
+		}
+	}
+
+	createCreds := func() *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      "creds/" + testDynamicRoleName,
+			Storage:   storage,
+			Data:      map[string]interface{}{"ip": testIP},
+		})
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		return resp
+	}
+
+	// If the key can't be removed right away, the WAL entry is kept so that
+	// the key is removed on rollback.
+	if resp := createCreds(); resp != nil && resp.Secret != nil {
+		t.Fatalf("bad: secret returned: %#v", resp)
+	}
+	if len(installed) != 1 {
+		t.Fatalf("bad: %#v", installed)
+	}
+	walIDs, err := framework.ListWAL(storage)
+	if err != nil || len(walIDs) != 1 {
+		t.Fatalf("bad: %#v err: %v", walIDs, err)
+	}
+	entry, err := framework.GetWAL(storage, walIDs[0])
+	if err != nil || entry == nil {
+		t.Fatalf("bad: %#v err: %v", entry, err)
+	}
+	uninstallErr = nil
+	if err := b.dynamicKeyRollback(&logical.Request{Storage: storage}, entry.Kind, entry.Data); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(installed) != 0 {
+		t.Fatalf("bad: orphaned key: %#v", installed)
+	}
+	if err := framework.DeleteWAL(storage, walIDs[0]); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Otherwise the key is removed right away and nothing is left behind.
+	if resp := createCreds(); resp != nil && resp.Secret != nil {
+		t.Fatalf("bad: secret returned: %#v", resp)
+	}
+	if len(installed) != 0 {
+		t.Fatalf("bad: orphaned key: %#v", installed)
+	}
+	walIDs, err = framework.ListWAL(storage)
+	if err != nil || len(walIDs) != 0 {
+		t.Fatalf("bad: %#v err: %v", walIDs, err)
+	}
+}
+
+// putFailingStorage fails the writes of the keys with the prefix.
+type putFailingStorage struct {
+	logical.InmemStorage
+	prefix string
+}
+
+func (s *putFailingStorage) Put(entry *logical.StorageEntry) error {
+	if strings.HasPrefix(entry.Key, s.prefix) {
+		return fmt.Errorf("put failed")
+	}
+	return s.InmemStorage.Put(entry)
+}
+
+func TestSSHBackend_IssuanceFailure(t *testing.T) {
+	storage := &putFailingStorage{prefix: "issuance_log/"}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	installed := make(map[string]bool)
+	b.installKey = func(opts *installOptions) error {
+		if opts.Install {
+			installed[opts.DynamicPublicKey] = true
+		} else {
+			delete(installed, opts.DynamicPublicKey)
+		}
+		return nil
+	}
+
+	request := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+	}
+	for path, data := range map[string]map[string]interface{}{
+		"keys/" + testKeyName: {"key": testSharedPrivateKey},
+		"roles/" + testOTPRoleName: {
+			"key_type":     testOTPKeyType,
+			"default_user": testUserName,
+			"cidr_list":    testCIDRList,
+		},
+	} {
+		if resp, err := request(path, data); err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("bad: resp: %#v err: %v", resp, err)
+		}
+	}
+	if resp, err := request("roles/"+testDynamicRoleName, map[string]interface{}{
+		"key_type":     testDynamicKeyType,
+		"key":          testKeyName,
+		"admin_user":   testAdminUser,
+		"default_user": testAdminUser,
+		"cidr_list":    testCIDRList,
+	}); err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
+	}
+
+	checkEmpty := func(prefix string) {
+		keys, err := storage.List(prefix)
+		if err != nil || len(keys) != 0 {
+			t.Fatalf("bad: %s: %#v err: %v", prefix, keys, err)
+		}
+	}
+
+	// Credentials that can't be recorded are removed instead of being
+	// left without a lease.
+	resp, err := request("creds/"+testDynamicRoleName, map[string]interface{}{"ip": testIP})
+	if err == nil || (resp != nil && resp.Secret != nil) {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
+	}
+	if len(installed) != 0 {
+		t.Fatalf("bad: orphaned key: %#v", installed)
+	}
+	checkEmpty(issuedKeysPath("", testDynamicRoleName))
+
+	resp, err = request("creds/"+testOTPRoleName, map[string]interface{}{"ip": testIP})
+	if err == nil || (resp != nil && resp.Secret != nil) {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
+	}
+	checkEmpty("otp/")
+
+	// OTPs requested for several IPs report the failure for the IP.
+	resp, err = request("creds/"+testOTPRoleName, map[string]interface{}{"ip_list": testIP})
+	if err != nil || resp == nil {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
+	}
+	creds := resp.Data["credentials"].([]map[string]interface{})
+	if len(creds) != 1 || creds[0]["error"] == nil || creds[0]["error_code"] != nil || creds[0]["key"] != nil {
+		t.Fatalf("bad: %#v", creds)
+	}
+	checkEmpty("otp/")
+
+	// So do batches, for each credential.
+	for _, role := range []string{testOTPRoleName, testDynamicRoleName} {
+		resp, err = request("creds/"+role+"/batch", map[string]interface{}{"credentials": testIP + ", " + testIP})
+		if err != nil || resp == nil || resp.Secret != nil || resp.Data["issued"] != 0 || resp.Data["failed"] != 2 {
+			t.Fatalf("bad: resp: %#v err: %v", resp, err)
+		}
+		for _, cred := range resp.Data["credentials"].([]map[string]interface{}) {
+			if cred["error"] == nil || cred["error_code"] != nil {
+				t.Fatalf("bad: %#v", cred)
+			}
+		}
+	}
+	checkEmpty("otp/")
+	checkEmpty(issuedKeysPath("", testDynamicRoleName))
+	if len(installed) != 0 {
+		t.Fatalf("bad: orphaned keys: %#v", installed)
+	}
+}
+
+func TestSSHBackend_DynamicKeyVerifyOnRenew(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	installed := make(map[string]bool)
+	b.installKey = func(opts *installOptions) error {
+		if opts.Install {
+			installed[opts.DynamicPublicKey] = true
+		} else {
+			delete(installed, opts.DynamicPublicKey)
+		}
+		return nil
+	}
+	b.verifyKey = func(opts *installOptions) (bool, error) {
+		return installed[opts.DynamicPublicKey], nil
+	}
+
+	steps := []*logical.Request{
+		&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      "keys/" + testKeyName,
+			Data:      map[string]interface{}{"key": testSharedPrivateKey},
+		},
+		&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      "roles/" + testDynamicRoleName,
+			Data: map[string]interface{}{
+				"key_type":        testDynamicKeyType,
+				"key":             testKeyName,
+				"admin_user":      testAdminUser,
+				"default_user":    testAdminUser,
+				"cidr_list":       testCIDRList,
+				"verify_on_renew": true,
+			},
+		},
+	}
+	for _, req := range steps {
+		req.Storage = storage
+		resp, err := b.HandleRequest(req)
+		if err != nil || resp.IsError() {
+			t.Fatalf("bad: resp: %#v err: %v", resp, err)
+		}
+	}
+
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "creds/" + testDynamicRoleName,
+		Storage:   storage,
+		Data:      map[string]interface{}{"ip": testIP},
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
+	}
+	secret := resp.Secret
+	secret.IssueTime = time.Now().UTC()
+
+	renew := func() *logical.Response {
+		req := logical.RenewRequest("creds/"+testDynamicRoleName, secret, nil)
+		req.Storage = storage
+		resp, err := b.HandleRequest(req)
+		if err != nil || resp == nil {
+			t.Fatalf("bad: resp: %#v err: %v", resp, err)
+		}
+		return resp
+	}
+
+	// The key is still in place, so the lease is extended.
+	if resp := renew(); resp.IsError() || resp.Secret == nil {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	// Once the key is gone from the host the renewal fails.
+	for key := range installed {
+		delete(installed, key)
+	}
+	resp = renew()
+	if !resp.IsError() {
+		t.Fatalf("bad: expected error, got %#v", resp)
+	}
+
+	// The credential is revoked along with the failed renewal, and the
+	// lease is cut short rather than extended.
+	if resp.Secret == nil || resp.Secret.LeaseTotal() > 2*time.Second {
+		t.Fatalf("bad: %#v", resp.Secret)
+	}
+	issuedPath := issuedKeySecretPath(secret)
+	if issuedPath == "" {
+		t.Fatalf("bad: %#v", secret.InternalData)
+	}
+	entry, err := storage.Get(issuedPath)
+	if err != nil || entry != nil {
+		t.Fatalf("bad: entry: %#v err: %v", entry, err)
+	}
+	issuanceID, _ := secret.InternalData["issuance_id"].(string)
+	iss, err := getIssuance(storage, "", testDynamicRoleName, issuanceID)
+	if err != nil || iss == nil || iss.RevokedAt.IsZero() {
+		t.Fatalf("bad: issuance: %#v err: %v", iss, err)
+	}
+}
+
+func TestSSHBackend_KeyCertificate(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var certificates []string
+	b.installKey = func(opts *installOptions) error {
+		certificates = append(certificates, opts.HostKeyCertificate)
+		return nil
+	}
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+
+	// The certificate of the admin key is signed by a CA of its own.
+	_, otherCAKey, err := generateRSAKeys(1024)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	otherCA, err := ssh.ParsePrivateKey([]byte(otherCAKey))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	adminKey, err := ssh.ParsePrivateKey([]byte(testSharedPrivateKey))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cert := &ssh.Certificate{
+		Key:             adminKey.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{testAdminUser},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, otherCA); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	certificate := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert)))
+
+	invalid := []map[string]interface{}{
+		{"key": otherCAKey, "certificate": certificate},
+		{"key": testSharedPrivateKey, "certificate": strings.TrimSpace(string(ssh.MarshalAuthorizedKey(adminKey.PublicKey())))},
+		{"key": testSharedPrivateKey, "certificate": certificate, "sign_with_ca": true},
+	}
+	for _, data := range invalid {
+		if resp := request("keys/"+testKeyName, data); resp == nil || !resp.IsError() {
+			t.Fatalf("bad: %#v", resp)
+		}
+	}
+
+	request("keys/"+testKeyName, map[string]interface{}{"key": testSharedPrivateKey, "certificate": certificate})
+	request("roles/"+testDynamicRoleName, map[string]interface{}{
+		"key_type":     testDynamicKeyType,
+		"key":          testKeyName,
+		"admin_user":   testAdminUser,
+		"default_user": testAdminUser,
+		"cidr_list":    testCIDRList,
+	})
+	if resp := request("creds/"+testDynamicRoleName, map[string]interface{}{"ip": testIP}); resp == nil || resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if len(certificates) != 1 || certificates[0] != certificate {
+		t.Fatalf("bad: %#v", certificates)
+	}
+
+	// With sign_with_ca, a short-lived certificate for the admin user is
+	// signed with the CA of the mount for every login.
+	request("keys/"+testKeyName, map[string]interface{}{"key": testSharedPrivateKey, "sign_with_ca": true})
+	if _, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "creds/" + testDynamicRoleName,
+		Storage:   storage,
+		Data:      map[string]interface{}{"ip": testIP},
+	}); err == nil {
+		t.Fatalf("expected an error without a CA key")
+	}
+	request("config/ca", map[string]interface{}{"private_key": otherCAKey})
+	if resp := request("creds/"+testDynamicRoleName, map[string]interface{}{"ip": testIP}); resp == nil || resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	signed, err := parseKeyCertificate(certificates[len(certificates)-1])
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	checker := &ssh.CertChecker{
+		IsAuthority: func(auth ssh.PublicKey) bool {
+			return reflect.DeepEqual(auth.Marshal(), otherCA.PublicKey().Marshal())
+		},
+	}
+	if err := checker.CheckCert(testAdminUser, signed); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(signed.Key.Marshal(), adminKey.PublicKey().Marshal()) || signed.ValidBefore > uint64(time.Now().Add(adminCertTTL).Unix()) {
+		t.Fatalf("bad: %#v", signed)
+	}
+	if _, err := keySigner(testSharedPrivateKey, certificates[len(certificates)-1]); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestSSHBackend_KeyPassword(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var logins []*installOptions
+	b.installKey = func(opts *installOptions) error {
+		logins = append(logins, opts)
+		return nil
+	}
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+
+	invalid := []map[string]interface{}{
+		{"password": "secret", "key": testSharedPrivateKey},
+		{"password": "secret", "sign_with_ca": true},
+		{"key": testSharedPrivateKey, "keyboard_interactive": true},
+	}
+	for _, data := range invalid {
+		if resp := request("keys/"+testKeyName, data); resp == nil || !resp.IsError() {
+			t.Fatalf("bad: %#v: %#v", data, resp)
+		}
+	}
+
+	request("keys/"+testKeyName, map[string]interface{}{"password": "secret", "keyboard_interactive": true})
+	request("roles/"+testDynamicRoleName, map[string]interface{}{
+		"key_type":     testDynamicKeyType,
+		"key":          testKeyName,
+		"admin_user":   testAdminUser,
+		"default_user": testAdminUser,
+		"cidr_list":    testCIDRList,
+	})
+	if resp := request("creds/"+testDynamicRoleName, map[string]interface{}{"ip": testIP}); resp == nil || resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if len(logins) != 1 || logins[0].HostPassword != "secret" || !logins[0].HostKeyboardInteractive || logins[0].HostKey != "" {
+		t.Fatalf("bad: %#v", logins)
+	}
+
+	// The password is tried first, then the keyboard-interactive prompts.
+	auth, err := authMethods("", "", "secret", true)
+	if err != nil || len(auth) != 2 {
+		t.Fatalf("bad: %#v: %v", auth, err)
+	}
+	if auth, err := authMethods(testSharedPrivateKey, "", "", false); err != nil || len(auth) != 1 {
+		t.Fatalf("bad: %#v: %v", auth, err)
+	}
+}
+
+func TestSSHBackend_DynamicKeyExpiry(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	installed := map[string]bool{}
+	b.installKey = func(opts *installOptions) error {
+		if opts.Install {
+			installed[opts.DynamicPublicKey] = true
+		} else {
+			delete(installed, opts.DynamicPublicKey)
+		}
+		return nil
+	}
+	b.verifyKey = func(opts *installOptions) (bool, error) {
+		return installed[opts.DynamicPublicKey], nil
+	}
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+	roleData := map[string]interface{}{
+		"key_type":     testDynamicKeyType,
+		"key":          testKeyName,
+		"admin_user":   testAdminUser,
+		"default_user": testAdminUser,
+		"cidr_list":    testCIDRList,
+		"key_expiry":   true,
+		"ttl":          "1h",
+	}
+
+	request("keys/"+testKeyName, map[string]interface{}{"key": testSharedPrivateKey})
+	if resp := request("roles/"+testOTPRoleName, map[string]interface{}{
+		"key_type":     testOTPKeyType,
+		"default_user": testUserName,
+		"cidr_list":    testCIDRList,
+		"key_expiry":   true,
+	}); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	roleData["key_option_specs"] = `no-pty,expiry-time="20300101"`
+	if resp := request("roles/"+testDynamicRoleName, roleData); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	roleData["key_option_specs"] = "no-pty"
+	if resp := request("roles/"+testDynamicRoleName, roleData); resp != nil && resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	expiryRegex := regexp.MustCompile(`^expiry-time="([0-9]{14})Z",no-pty ssh-rsa `)
+	checkExpiry := func(key string, expected time.Time) {
+		match := expiryRegex.FindStringSubmatch(key)
+		if match == nil {
+			t.Fatalf("bad: %s", key)
+		}
+		expiry, err := time.Parse("20060102150405", match[1])
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if d := expiry.Sub(expected); d < -time.Minute || d > time.Minute {
+			t.Fatalf("bad: expiry %s, expected %s", expiry, expected)
+		}
+	}
+
+	resp := request("creds/"+testDynamicRoleName, map[string]interface{}{"ip": testIP})
+	if resp == nil || resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	oldKey := resp.Secret.InternalData["dynamic_public_key"].(string)
+	if len(installed) != 1 || !installed[oldKey] {
+		t.Fatalf("bad: %#v", installed)
+	}
+	checkExpiry(oldKey, time.Now().UTC().Add(time.Hour))
+
+	// Renewing installs the key with the new expiry in place of the old one
+	roleData["ttl"] = "2h"
+	request("roles/"+testDynamicRoleName, roleData)
+	secret := resp.Secret
+	secret.IssueTime = time.Now().UTC()
+	req := logical.RenewRequest("creds/"+testDynamicRoleName, secret, nil)
+	req.Storage = storage
+	resp, err = b.HandleRequest(req)
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
+	}
+	newKey := resp.Secret.InternalData["dynamic_public_key"].(string)
+	if newKey == oldKey || len(installed) != 1 || !installed[newKey] {
+		t.Fatalf("bad: %s: %#v", newKey, installed)
+	}
+	checkExpiry(newKey, time.Now().UTC().Add(resp.Secret.TTL))
+	if strings.TrimPrefix(newKey, expiryRegex.FindString(newKey)) != strings.TrimPrefix(oldKey, expiryRegex.FindString(oldKey)) {
+		t.Fatalf("bad: %s: %s", oldKey, newKey)
+	}
+
+	// Revoking the lease removes the renewed key
+	req = logical.RevokeRequest("creds/"+testDynamicRoleName, resp.Secret, nil)
+	req.Storage = storage
+	if _, err := b.HandleRequest(req); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(installed) != 0 {
+		t.Fatalf("bad: %#v", installed)
+	}
+}
+
+func TestSSHBackend_setKeyExpiry(t *testing.T) {
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	cases := map[string]string{
+		"ssh-rsa AAAA comment":                        `expiry-time="20300102030405Z" ssh-rsa AAAA comment`,
+		"ecdsa-sha2-nistp256 AAAA":                    `expiry-time="20300102030405Z" ecdsa-sha2-nistp256 AAAA`,
+		"no-pty ssh-rsa AAAA":                         `expiry-time="20300102030405Z",no-pty ssh-rsa AAAA`,
+		`expiry-time="20200101000000Z" ssh-rsa A`:     `expiry-time="20300102030405Z" ssh-rsa A`,
+		`expiry-time="20200101000000Z",pty ssh-rsa A`: `expiry-time="20300102030405Z",pty ssh-rsa A`,
+	}
+	for key, expected := range cases {
+		if actual := setKeyExpiry(key, expiry); actual != expected {
+			t.Fatalf("bad: %s: %s", key, actual)
+		}
+	}
+}
+
+func TestSSHBackend_DynamicKeyAlgorithm(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var installed string
+	b.installKey = func(opts *installOptions) error {
+		if opts.Install {
+			installed = opts.DynamicPublicKey
+		}
+		return nil
+	}
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+	roleData := func(algorithm string, keyBits int) map[string]interface{} {
+		return map[string]interface{}{
+			"key_type":      testDynamicKeyType,
+			"key":           testKeyName,
+			"admin_user":    testAdminUser,
+			"default_user":  testAdminUser,
+			"cidr_list":     testCIDRList,
+			"key_algorithm": algorithm,
+			"key_bits":      keyBits,
+		}
+	}
+
+	request("keys/"+testKeyName, map[string]interface{}{"key": testSharedPrivateKey})
+
+	for _, data := range []map[string]interface{}{
+		roleData("ed25519", 0),
+		roleData("ecdsa-p256", 2048),
+	} {
+		if resp := request("roles/"+testDynamicRoleName, data); resp == nil || !resp.IsError() {
+			t.Fatalf("bad: %#v: %#v", data, resp)
+		}
+	}
+
+	cases := map[string]string{
+		"":           ssh.KeyAlgoRSA,
+		"RSA":        ssh.KeyAlgoRSA,
+		"ecdsa-p256": ssh.KeyAlgoECDSA256,
+	}
+	for algorithm, keyType := range cases {
+		if resp := request("roles/"+testDynamicRoleName, roleData(algorithm, 0)); resp != nil && resp.IsError() {
+			t.Fatalf("bad: %s: %#v", algorithm, resp)
+		}
+		resp := request("creds/"+testDynamicRoleName, map[string]interface{}{"ip": testIP})
+		if resp == nil || resp.IsError() {
+			t.Fatalf("bad: %s: %#v", algorithm, resp)
+		}
+
+		signer, err := ssh.ParsePrivateKey([]byte(resp.Data["key"].(string)))
+		if err != nil {
+			t.Fatalf("err: %s: %s", algorithm, err)
+		}
+		if signer.PublicKey().Type() != keyType {
+			t.Fatalf("bad: %s: %s", algorithm, signer.PublicKey().Type())
+		}
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(installed))
+		if err != nil {
+			t.Fatalf("err: %s: %s", algorithm, err)
+		}
+		if !reflect.DeepEqual(publicKey.Marshal(), signer.PublicKey().Marshal()) {
+			t.Fatalf("bad: %s: installed key doesn't match: %s", algorithm, installed)
+		}
+	}
+}
+
+func TestSSHBackend_DynamicKeyBits(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	b.installKey = func(opts *installOptions) error {
+		return nil
+	}
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+	roleData := func(keyBits int) map[string]interface{} {
+		return map[string]interface{}{
+			"key_type":     testDynamicKeyType,
+			"key":          testKeyName,
+			"admin_user":   testAdminUser,
+			"default_user": testAdminUser,
+			"cidr_list":    testCIDRList,
+			"key_bits":     keyBits,
+		}
+	}
+
+	request("keys/"+testKeyName, map[string]interface{}{"key": testSharedPrivateKey})
+
+	for _, keyBits := range []int{512, 1000, 16384} {
+		if resp := request("roles/"+testDynamicRoleName, roleData(keyBits)); resp == nil || !resp.IsError() {
+			t.Fatalf("bad: %d: %#v", keyBits, resp)
+		}
+	}
+	if resp := request("config/defaults", map[string]interface{}{"key_bits": 16384}); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	for _, keyBits := range []int{3072, 4096} {
+		if resp := request("roles/"+testDynamicRoleName, roleData(keyBits)); resp != nil && resp.IsError() {
+			t.Fatalf("bad: %d: %#v", keyBits, resp)
+		}
+		resp := request("creds/"+testDynamicRoleName, map[string]interface{}{"ip": testIP})
+		if resp == nil || resp.IsError() {
+			t.Fatalf("bad: %d: %#v", keyBits, resp)
+		}
+		block, _ := pem.Decode([]byte(resp.Data["key"].(string)))
+		if block == nil {
+			t.Fatalf("bad: %d: %s", keyBits, resp.Data["key"])
+		}
+		privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			t.Fatalf("err: %d: %s", keyBits, err)
+		}
+		if privateKey.N.BitLen() != keyBits {
+			t.Fatalf("bad: %d: %d", keyBits, privateKey.N.BitLen())
+		}
+	}
+}
+
+func TestSSHBackend_RoleConnectionTest(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var tested *installOptions
+	var testErr error
+	b.testConnection = func(opts *installOptions) error {
+		tested = opts
+		return testErr
+	}
+	b.installKey = func(opts *installOptions) error {
+		t.Fatalf("bad: key installed while testing the connection")
+		return nil
+	}
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+
+	request("keys/"+testKeyName, map[string]interface{}{"key": testSharedPrivateKey})
+	request("roles/"+testDynamicRoleName, map[string]interface{}{
+		"key_type":     testDynamicKeyType,
+		"key":          testKeyName,
+		"admin_user":   testAdminUser,
+		"default_user": testAdminUser,
+		"cidr_list":    testCIDRList,
+		"port":         2222,
+	})
+	request("roles/"+testOTPRoleName, map[string]interface{}{
+		"key_type":     testOTPKeyType,
+		"default_user": testUserName,
+		"cidr_list":    testCIDRList,
+	})
+
+	for path, ip := range map[string]string{
+		testDynamicRoleName: "10.0.0.1",
+		testOTPRoleName:     testIP,
+		"unknown":           testIP,
+	} {
+		if resp := request("roles/"+path+"/test", map[string]interface{}{"ip": ip}); resp == nil || !resp.IsError() {
+			t.Fatalf("bad: %s: %#v", path, resp)
+		}
+	}
+	if tested != nil {
+		t.Fatalf("bad: %#v", tested)
+	}
+
+	resp := request("roles/"+testDynamicRoleName+"/test", map[string]interface{}{"ip": testIP})
+	if resp == nil || resp.IsError() || resp.Data["success"] != true || resp.Data["latency"] == "" {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if tested == nil || tested.AdminUser != testAdminUser || tested.HostKey != testSharedPrivateKey ||
+		tested.IP != testIP || tested.Port != 2222 || tested.DialTimeout != defaultDialTimeout {
+		t.Fatalf("bad: %#v", tested)
+	}
+
+	testErr = fmt.Errorf("connection refused")
+	resp = request("roles/"+testDynamicRoleName+"/test", map[string]interface{}{"ip": testIP})
+	if resp == nil || resp.IsError() || resp.Data["success"] != false || resp.Data["error"] != "connection refused" {
+		t.Fatalf("bad: %#v", resp)
+	}
+}
+
+func TestSSHBackend_Metrics(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	installErr := fmt.Errorf("connection refused")
+	b.installKey = func(opts *installOptions) error {
+		if opts.Install {
+			return installErr
+		}
+		return nil
+	}
+	b.verifyKey = func(opts *installOptions) (bool, error) {
+		return false, nil
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil && op != logical.WriteOperation {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+
+	request(logical.WriteOperation, "keys/"+testKeyName, map[string]interface{}{"key": testSharedPrivateKey})
+	request(logical.WriteOperation, "roles/"+testDynamicRoleName, map[string]interface{}{
+		"key_type":     testDynamicKeyType,
+		"key":          testKeyName,
+		"admin_user":   testAdminUser,
+		"default_user": testAdminUser,
+		"cidr_list":    testCIDRList,
+	})
+	request(logical.WriteOperation, "roles/"+testOTPRoleName, map[string]interface{}{
+		"key_type":     testOTPKeyType,
+		"default_user": testUserName,
+		"cidr_list":    testCIDRList,
+	})
+
+	// A failed install
+	request(logical.WriteOperation, "creds/"+testDynamicRoleName, map[string]interface{}{"ip": testIP})
+
+	// A dynamic key that is issued and revoked
+	installErr = nil
+	resp := request(logical.WriteOperation, "creds/"+testDynamicRoleName, map[string]interface{}{"ip": testIP})
+	if resp == nil || resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	req := logical.RevokeRequest("creds/"+testDynamicRoleName, resp.Secret, nil)
+	req.Storage = storage
+	if _, err := b.HandleRequest(req); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Two OTPs, one of which is verified
+	resp = request(logical.WriteOperation, "creds/"+testOTPRoleName, map[string]interface{}{"ip": testIP})
+	if resp == nil || resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	request(logical.WriteOperation, "verify", map[string]interface{}{"otp": resp.Data["key"]})
+	request(logical.WriteOperation, "creds/"+testOTPRoleName, map[string]interface{}{"ip_list": testIP})
+
+	resp = request(logical.ReadOperation, "metrics", nil)
+	if resp == nil || resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	expected := map[string]interface{}{
+		testDynamicRoleName: map[string]interface{}{
+			"creds_issued":    1,
+			"otps_verified":   0,
+			"installs_failed": 1,
+			"revocations":     1,
+		},
+		testOTPRoleName: map[string]interface{}{
+			"creds_issued":    2,
+			"otps_verified":   1,
+			"installs_failed": 0,
+			"revocations":     0,
+		},
+	}
+	if !reflect.DeepEqual(resp.Data["roles"], expected) {
+		t.Fatalf("bad: %#v", resp.Data["roles"])
+	}
+
+	// The counters of deleted roles are dropped.
+	request(logical.DeleteOperation, "roles/"+testOTPRoleName, nil)
+	delete(expected, testOTPRoleName)
+	resp = request(logical.ReadOperation, "metrics", nil)
+	if !reflect.DeepEqual(resp.Data["roles"], expected) {
+		t.Fatalf("bad: %#v", resp.Data["roles"])
+	}
+}
+
+func TestSSHBackend_Tidy(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Keys are uninstalled in parallel.
+	var lock sync.Mutex
+	installed := map[string]bool{}
+	b.installKey = func(opts *installOptions) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if opts.Install {
+			installed[opts.DynamicPublicKey] = true
+		} else {
+			delete(installed, opts.DynamicPublicKey)
+		}
+		return nil
+	}
+	b.verifyKey = func(opts *installOptions) (bool, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return installed[opts.DynamicPublicKey], nil
+	}
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+
+	for _, namespace := range []string{"", "ns/team1/"} {
+		request("keys/"+namespace+testKeyName, map[string]interface{}{"key": testSharedPrivateKey})
+		request("roles/"+namespace+testDynamicRoleName, map[string]interface{}{
+			"key_type":     testDynamicKeyType,
+			"key":          testKeyName,
+			"admin_user":   testAdminUser,
+			"default_user": testAdminUser,
+			"cidr_list":    testCIDRList,
+			"ttl":          "1h",
+		})
+	}
+	request("roles/"+testOTPRoleName, map[string]interface{}{
+		"key_type":     testOTPKeyType,
+		"default_user": testUserName,
+		"cidr_list":    testCIDRList,
+		"ttl":          "1h",
+	})
+
+	// Two OTPs, one of which is used, and two dynamic keys
+	for i := 0; i < 2; i++ {
+		resp := request("creds/"+testOTPRoleName, map[string]interface{}{"ip": testIP})
+		if resp == nil || resp.IsError() {
+			t.Fatalf("bad: %#v", resp)
+		}
+		if i == 0 {
+			request("verify", map[string]interface{}{"otp": resp.Data["key"]})
+		}
+	}
+	for _, namespace := range []string{"", "ns/team1/"} {
+		if resp := request("creds/"+namespace+testDynamicRoleName, map[string]interface{}{"ip": testIP}); resp == nil || resp.IsError() {
+			t.Fatalf("bad: %#v", resp)
+		}
+	}
+	if len(installed) != 2 {
+		t.Fatalf("bad: %#v", installed)
+	}
+
+	// Nothing expired within the safety buffer
+	resp := request("tidy", map[string]interface{}{"safety_buffer": 0})
+	if resp == nil || resp.IsError() || resp.Data["deleted_otps"] != 0 || resp.Data["revoked_keys"] != 0 {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	// A negative buffer would remove the entries of leases not yet expired
+	resp = request("tidy", map[string]interface{}{"safety_buffer": -1})
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	// Age the entries past the expiry of their leases
+	keys, err := storage.List("")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	aged := 0
+	for _, key := range keys {
+		if !strings.HasPrefix(key, "otp") && !strings.Contains(key, "issued/") {
+			continue
+		}
+		entry, _ := storage.Get(key)
+		var data map[string]interface{}
+		if err := entry.DecodeJSON(&data); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		for _, field := range []string{"expires_at", "ExpiresAt"} {
+			if _, ok := data[field]; ok {
+				data[field] = time.Now().Add(-time.Hour).Format(time.RFC3339)
+				aged++
+			}
+		}
+		entry, _ = logical.StorageEntryJSON(key, data)
+		storage.Put(entry)
+	}
+	if aged != 4 {
+		t.Fatalf("bad: %d entries aged", aged)
+	}
+
+	resp = request("tidy", map[string]interface{}{"safety_buffer": 7200})
+	if resp == nil || resp.IsError() || resp.Data["deleted_otps"] != 0 || resp.Data["revoked_keys"] != 0 {
+		t.Fatalf("bad: %#v", resp)
+	}
+	resp = request("tidy", map[string]interface{}{})
+	if resp == nil || resp.IsError() || resp.Data["deleted_otps"] != 0 {
+		t.Fatalf("bad: %#v", resp)
+	}
+	resp = request("tidy", map[string]interface{}{"safety_buffer": 60})
+	if resp == nil || resp.IsError() || resp.Data["deleted_otps"] != 2 || resp.Data["revoked_keys"] != 2 {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if len(installed) != 0 {
+		t.Fatalf("bad: %#v", installed)
+	}
+	keys, _ = storage.List("")
+	for _, key := range keys {
+		if strings.HasPrefix(key, "otp") || strings.Contains(key, "issued/") {
+			t.Fatalf("bad: %s left", key)
+		}
+	}
+}
+
+func TestSSHBackend_RoleDeleteInvalidatesOTPs(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+
+	roleData := map[string]interface{}{
+		"key_type":     testOTPKeyType,
+		"default_user": testUserName,
+		"cidr_list":    testCIDRList,
+	}
+	request(logical.WriteOperation, "roles/"+testOTPRoleName, roleData)
+	request(logical.WriteOperation, "roles/other", roleData)
+
+	resp := request(logical.WriteOperation, "creds/"+testOTPRoleName, map[string]interface{}{"ip": testIP})
+	otp := resp.Data["key"].(string)
+	resp = request(logical.WriteOperation, "creds/other", map[string]interface{}{"ip": testIP})
+	otherOTP := resp.Data["key"].(string)
+
+	request(logical.DeleteOperation, "roles/"+testOTPRoleName, nil)
+
+	resp = request(logical.WriteOperation, "verify", map[string]interface{}{"otp": otp})
+	if !resp.IsError() {
+		t.Fatalf("bad: OTP of deleted role was verified: %#v", resp)
+	}
+	resp = request(logical.WriteOperation, "verify", map[string]interface{}{"otp": otherOTP})
+	if resp.IsError() {
+		t.Fatalf("bad: OTP of other role was invalidated: %#v", resp)
+	}
+}
+
+func TestSSHBackend_RoleListNormalization(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+
+	resp := request(logical.WriteOperation, "roles/"+testOTPRoleName, map[string]interface{}{
+		"key_type":          testOTPKeyType,
+		"default_user":      testUserName,
+		"cidr_list":         " 127.0.0.1/32,10.0.0.0/8, 127.0.0.1/32,",
+		"allowed_users":     "bob, alice,bob, ",
+		"request_cidr_list": "127.0.0.0/8 ,127.0.0.0/8",
+	})
+	if resp != nil && resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	resp = request(logical.ReadOperation, "roles/"+testOTPRoleName, nil)
+	expected := map[string]string{
+		"cidr_list":         "10.0.0.0/8,127.0.0.1/32",
+		"allowed_users":     "alice,bob",
+		"request_cidr_list": "127.0.0.0/8",
+	}
+	for field, value := range expected {
+		if resp.Data[field] != value {
+			t.Fatalf("bad: %s: %q", field, resp.Data[field])
+		}
+	}
+
+	// Issuance matches against the normalized lists.
+	cases := []struct {
+		Username string
+		Allowed  bool
+	}{
+		{"alice", true},
+		{"bob", true},
+		{"carol", false},
+		{" bob", false},
+	}
+	for _, tc := range cases {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation:  logical.WriteOperation,
+			Path:       "creds/" + testOTPRoleName,
+			Storage:    storage,
+			Connection: &logical.Connection{RemoteAddr: "127.0.0.1"},
+			Data: map[string]interface{}{
+				"ip":       "10.1.2.3",
+				"username": tc.Username,
+			},
+		})
+		if tc.Allowed != (err == nil && resp != nil && !resp.IsError()) {
+			t.Fatalf("bad: %s: resp: %#v err: %v", tc.Username, resp, err)
+		}
+	}
+
+	// A list of blank entries doesn't turn into an unrestricted one.
+	resp = request(logical.WriteOperation, "roles/"+testOTPRoleName, map[string]interface{}{
+		"key_type":      testOTPKeyType,
+		"default_user":  testUserName,
+		"cidr_list":     testCIDRList,
+		"allowed_users": " , ",
+	})
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+}
+
+func TestSSHBackend_DenyUsers(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+
+	for _, data := range []map[string]interface{}{
+		{"default_user": "root", "deny_users": "root"},
+		{"default_user": testUserName, "deny_users": "["},
+	} {
+		data["key_type"] = testOTPKeyType
+		data["cidr_list"] = testCIDRList
+		if resp := request("roles/"+testOTPRoleName, data); !resp.IsError() {
+			t.Fatalf("bad: %#v: %#v", data, resp)
+		}
+	}
+
+	request("config/ca", map[string]interface{}{"private_key": testSharedPrivateKey})
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "roles/" + testOTPRoleName,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"key_type":      testOTPKeyType,
+			"default_user":  "vaultuser",
+			"cidr_list":     testCIDRList,
+			"allowed_users": "*",
+			"deny_users":    "root, svc-*",
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
+	}
+	resp, err = b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "roles/ca-role",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"key_type":      "ca",
+			"default_user":  "vaultuser",
+			"allowed_users": "*",
+			"deny_users":    "root",
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
+	}
+
+	publicKey, _, err := generateRSAKeys(1024)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cases := []struct {
+		Path    string
+		Data    map[string]interface{}
+		Allowed bool
+	}{
+		{"creds/" + testOTPRoleName, map[string]interface{}{"ip": testIP, "username": "alice"}, true},
+		{"creds/" + testOTPRoleName, map[string]interface{}{"ip": testIP, "username": "root"}, false},
+		{"creds/" + testOTPRoleName, map[string]interface{}{"ip": testIP, "username": "svc-web"}, false},
+		{"sign/ca-role", map[string]interface{}{"public_key": publicKey, "valid_principals": "alice"}, true},
+		{"sign/ca-role", map[string]interface{}{"public_key": publicKey, "valid_principals": "alice,root"}, false},
+	}
+	for _, tc := range cases {
+		resp := request(tc.Path, tc.Data)
+		if resp == nil || tc.Allowed == resp.IsError() {
+			t.Fatalf("bad: %s %#v: %#v", tc.Path, tc.Data, resp.Data)
+		}
+		if !tc.Allowed && resp.Data["error_code"] != ErrorCodeUserNotAllowed {
+			t.Fatalf("bad: %#v", resp.Data)
+		}
+	}
+}
+
+func TestSSHBackend_RestrictToClientIP(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "roles/" + testOTPRoleName,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"key_type":              testOTPKeyType,
+			"default_user":          testUserName,
+			"cidr_list":             "10.0.0.0/8",
+			"restrict_to_client_ip": true,
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
+	}
+
+	cases := map[string]struct {
+		RemoteAddr string
+		Data       map[string]interface{}
+		Code       string
+	}{
+		"client IP":           {"10.1.2.3:51234", map[string]interface{}{"ip": "10.1.2.3"}, ""},
+		"client IP sans port": {"10.1.2.3", map[string]interface{}{"ip": "10.1.2.3"}, ""},
+		"other IP":            {"10.1.2.3:51234", map[string]interface{}{"ip": "10.1.2.4"}, ErrorCodeIPNotClientAddr},
+		"unknown client":      {"", map[string]interface{}{"ip": "10.1.2.3"}, ErrorCodeIPNotClientAddr},
+		"client not in CIDR":  {"192.168.1.1:51234", map[string]interface{}{"ip": "192.168.1.1"}, ErrorCodeIPNotInCIDR},
+		"IP list":             {"10.1.2.3:51234", map[string]interface{}{"ip_list": "10.1.2.3"}, ErrorCodeInvalidRequest},
+	}
+	for name, tc := range cases {
+		req := &logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      "creds/" + testOTPRoleName,
+			Storage:   storage,
+			Data:      tc.Data,
+		}
+		if tc.RemoteAddr != "" {
+			req.Connection = &logical.Connection{RemoteAddr: tc.RemoteAddr}
+		}
+		resp, err := b.HandleRequest(req)
+		if err != nil || resp == nil {
+			t.Fatalf("bad: %s: resp: %#v err: %v", name, resp, err)
+		}
+		if tc.Code == "" && resp.IsError() {
+			t.Fatalf("bad: %s: %#v", name, resp.Data)
+		}
+		if tc.Code != "" && (!resp.IsError() || resp.Data["error_code"] != tc.Code) {
+			t.Fatalf("bad: %s: %#v", name, resp.Data)
+		}
+	}
+
+	resp, err = b.HandleRequest(&logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "roles/" + testOTPRoleName,
+		Storage:   storage,
+	})
+	if err != nil || resp.Data["restrict_to_client_ip"] != true {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
+	}
+
+	resp, err = b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "roles/ca-role",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"key_type":              "ca",
+			"default_user":          testUserName,
+			"restrict_to_client_ip": true,
+		},
+	})
+	if err != nil || resp == nil || !resp.IsError() {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
+	}
+}
+
+func TestSSHBackend_AllowedPorts(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	roleData := func(data map[string]interface{}) map[string]interface{} {
+		data["key_type"] = testOTPKeyType
+		data["default_user"] = testUserName
+		data["cidr_list"] = testCIDRList
+		return data
+	}
+	badRoles := map[string]map[string]interface{}{
+		"bad range":     roleData(map[string]interface{}{"allowed_ports": "2299-2200"}),
+		"bad port":      roleData(map[string]interface{}{"allowed_ports": "22,ssh"}),
+		"out of range":  roleData(map[string]interface{}{"allowed_ports": "0-22"}),
+		"port excluded": roleData(map[string]interface{}{"allowed_ports": "2200-2299", "port": 22}),
+		"not OTP": map[string]interface{}{
+			"key_type":      "ca",
+			"default_user":  testUserName,
+			"allowed_ports": "22",
+		},
+	}
+	for name, data := range badRoles {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      "roles/" + testOTPRoleName,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil || resp == nil || !resp.IsError() {
+			t.Fatalf("bad: %s: resp: %#v err: %v", name, resp, err)
+		}
+	}
+
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "roles/" + testOTPRoleName,
+		Storage:   storage,
+		Data:      roleData(map[string]interface{}{"allowed_ports": "2200-2299, 2022"}),
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
+	}
+
+	resp, err = b.HandleRequest(&logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "roles/" + testOTPRoleName,
+		Storage:   storage,
+	})
+	if err != nil || resp.Data["allowed_ports"] != "2022,2200-2299" || resp.Data["port"] != 2022 {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
+	}
+
+	cases := map[string]struct {
+		Port     int
+		Expected int
+		Code     string
+	}{
+		"default":      {0, 2022, ""},
+		"in range":     {2250, 2250, ""},
+		"single port":  {2022, 2022, ""},
+		"not allowed":  {22, 0, ErrorCodePortNotAllowed},
+		"out of range": {2300, 0, ErrorCodePortNotAllowed},
+	}
+	for name, tc := range cases {
+		data := map[string]interface{}{"ip": testIP}
+		if tc.Port != 0 {
+			data["port"] = tc.Port
+		}
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      "creds/" + testOTPRoleName,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil || resp == nil {
+			t.Fatalf("bad: %s: resp: %#v err: %v", name, resp, err)
+		}
+		if tc.Code != "" {
+			if !resp.IsError() || resp.Data["error_code"] != tc.Code {
+				t.Fatalf("bad: %s: %#v", name, resp.Data)
+			}
+			continue
+		}
+		if resp.IsError() || resp.Data["port"] != tc.Expected {
+			t.Fatalf("bad: %s: %#v", name, resp.Data)
+		}
+	}
+}
+
+func TestSSHBackend_IssuanceLog(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "roles/" + testOTPRoleName,
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"key_type":     testOTPKeyType,
+			"default_user": testUserName,
+			"cidr_list":    "10.0.0.0/8",
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
+	}
+
+	issue := func(data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation:   logical.WriteOperation,
+			Path:        "creds/" + testOTPRoleName,
+			Storage:     storage,
+			Data:        data,
+			DisplayName: "token-alice",
+			Connection:  &logical.Connection{RemoteAddr: "192.168.1.1:51234"},
+		})
+		if err != nil || resp == nil || resp.IsError() {
+			t.Fatalf("bad: resp: %#v err: %v", resp, err)
+		}
+		return resp
+	}
+	revoke := func(secret *logical.Secret) {
+		req := logical.RevokeRequest("creds/"+testOTPRoleName, secret, nil)
+		req.Storage = storage
+		if _, err := b.HandleRequest(req); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	list := func() map[string]interface{} {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.ListOperation,
+			Path:      "issued/" + testOTPRoleName,
+			Storage:   storage,
+		})
+		if err != nil || resp == nil {
+			t.Fatalf("bad: resp: %#v err: %v", resp, err)
+		}
+		return resp.Data["key_info"].(map[string]interface{})
+	}
+
+	single := issue(map[string]interface{}{"ip": "10.0.0.1"})
+	singleID := single.Data["issuance_id"].(string)
+	batch := issue(map[string]interface{}{"ip_list": "10.0.0.2,10.0.0.3"})
+
+	keyInfo := list()
+	if len(keyInfo) != 3 {
+		t.Fatalf("bad: %#v", keyInfo)
+	}
+	info := keyInfo[singleID].(map[string]interface{})
+	if info["ip"] != "10.0.0.1" || info["username"] != testUserName || info["live"] != true ||
+		info["display_name"] != "token-alice" || info["client_addr"] != "192.168.1.1:51234" ||
+		info["lease_path"] != "creds/"+testOTPRoleName {
+		t.Fatalf("bad: %#v", info)
+	}
+
+	revoke(single.Secret)
+	keyInfo = list()
+	for id, raw := range keyInfo {
+		info := raw.(map[string]interface{})
+		if live := id != singleID; info["live"] != live {
+			t.Fatalf("bad: %s: %#v", id, info)
+		}
+		if _, ok := info["revoked_at"]; ok != (id == singleID) {
+			t.Fatalf("bad: %s: %#v", id, info)
+		}
+	}
+
+	revoke(batch.Secret)
+	for id, raw := range list() {
+		if info := raw.(map[string]interface{}); info["live"] != false {
+			t.Fatalf("bad: %s: %#v", id, info)
+		}
+	}
+
+	// Revoking all the credentials of the role marks them as revoked too.
+	issue(map[string]interface{}{"ip": "10.0.0.4"})
+	resp, err = b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "roles/" + testOTPRoleName + "/revoke-all",
+		Storage:   storage,
+	})
+	if err != nil || resp == nil || resp.IsError() {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
+	}
+	keyInfo = list()
+	if len(keyInfo) != 4 {
+		t.Fatalf("bad: %#v", keyInfo)
+	}
+	for id, raw := range keyInfo {
+		if info := raw.(map[string]interface{}); info["live"] != false {
+			t.Fatalf("bad: %s: %#v", id, info)
+		}
+	}
+}
+
+func TestSSHBackend_CredsBatch(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var lock sync.Mutex
+	installed := map[string]string{}
+	b.installKey = func(opts *installOptions) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if opts.IP == "10.0.0.9" && opts.Install {
+			return fmt.Errorf("host unreachable")
+		}
+		if opts.Install {
+			installed[opts.IP] = opts.Username
+		} else {
+			delete(installed, opts.IP)
+		}
+		return nil
+	}
+	b.verifyKey = func(opts *installOptions) (bool, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		_, ok := installed[opts.IP]
+		return ok, nil
+	}
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+	request("keys/"+testKeyName, map[string]interface{}{"key": testSharedPrivateKey})
+	request("roles/"+testOTPRoleName, map[string]interface{}{
+		"key_type":      testOTPKeyType,
+		"default_user":  "vaultuser",
+		"allowed_users": "admin",
+		"cidr_list":     "10.0.0.0/8",
+	})
+	request("roles/"+testDynamicRoleName, map[string]interface{}{
+		"key_type":     testDynamicKeyType,
+		"key":          testKeyName,
+		"admin_user":   testAdminUser,
+		"default_user": testAdminUser,
+		"cidr_list":    "10.0.0.0/8",
+	})
+
+	if resp := request("creds/"+testOTPRoleName+"/batch", map[string]interface{}{"credentials": " , "}); resp == nil || resp.Data["error_code"] != ErrorCodeInvalidRequest {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	resp := request("creds/"+testOTPRoleName+"/batch", map[string]interface{}{
+		"credentials": "10.0.0.1, admin@10.0.0.2, root@10.0.0.3, 192.168.1.1",
+	})
+	if resp == nil || resp.IsError() || resp.Secret == nil || resp.Data["issued"] != 2 || resp.Data["failed"] != 2 {
+		t.Fatalf("bad: %#v", resp)
+	}
+	creds := resp.Data["credentials"].([]map[string]interface{})
+	expected := []struct {
+		Username string
+		IP       string
+		Code     string
+	}{
+		{"vaultuser", "10.0.0.1", ""},
+		{"admin", "10.0.0.2", ""},
+		{"root", "10.0.0.3", ErrorCodeUserNotAllowed},
+		{"", "192.168.1.1", ErrorCodeIPNotInCIDR},
+	}
+	for i, tc := range expected {
+		cred := creds[i]
+		if tc.Code != "" {
+			if cred["error_code"] != tc.Code {
+				t.Fatalf("bad: %d: %#v", i, cred)
+			}
+			continue
+		}
+		if cred["username"] != tc.Username || cred["ip"] != tc.IP || cred["key"] == nil || cred["issuance_id"] == nil {
+			t.Fatalf("bad: %d: %#v", i, cred)
+		}
+		verify := request("verify", map[string]interface{}{"otp": cred["key"]})
+		if verify == nil || verify.IsError() || verify.Data["username"] != tc.Username || verify.Data["ip"] != tc.IP {
+			t.Fatalf("bad: %d: %#v", i, verify)
+		}
+	}
+
+	// Nothing issued, so there is no lease.
+	resp = request("creds/"+testOTPRoleName+"/batch", map[string]interface{}{"credentials": "192.168.1.1"})
+	if resp == nil || resp.IsError() || resp.Secret != nil || resp.Data["failed"] != 1 {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	resp = request("creds/"+testDynamicRoleName+"/batch", map[string]interface{}{
+		"credentials": "10.0.0.1,10.0.0.2,10.0.0.9",
+	})
+	if resp == nil || resp.IsError() || resp.Secret == nil || resp.Data["issued"] != 2 || resp.Data["failed"] != 1 {
+		t.Fatalf("bad: %#v", resp)
+	}
+	creds = resp.Data["credentials"].([]map[string]interface{})
+	if creds[0]["key"] == nil || creds[1]["key"] == nil || creds[2]["error"] == nil || creds[2]["error_code"] != nil {
+		t.Fatalf("bad: %#v", creds)
+	}
+	if len(installed) != 2 {
+		t.Fatalf("bad: %#v", installed)
+	}
+
+	req := logical.RenewRequest("creds/"+testDynamicRoleName+"/batch", resp.Secret, resp.Data)
+	req.Storage = storage
+	req.Secret.IssueTime = time.Now().UTC()
+	if renewed, err := b.HandleRequest(req); err != nil || renewed == nil || !renewed.IsError() {
+		t.Fatalf("bad: resp: %#v err: %v", renewed, err)
+	}
+
+	req = logical.RevokeRequest("creds/"+testDynamicRoleName+"/batch", resp.Secret, nil)
+	req.Storage = storage
+	if _, err := b.HandleRequest(req); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(installed) != 0 {
+		t.Fatalf("bad: %#v", installed)
+	}
+}
+
+func TestSSHBackend_KeysRotate(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	publicKeyOf := func(privateKey string) string {
+		signer, err := ssh.ParsePrivateKey([]byte(privateKey))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	}
+	oldPublicKey := publicKeyOf(testSharedPrivateKey)
+
+	// The hosts trust the keys in their set, and only let in the keys
+	// they trust.
+	var lock sync.Mutex
+	authorized := map[string]map[string]bool{
+		"10.0.0.1": {oldPublicKey: true},
+		"10.0.0.2": {oldPublicKey: true},
+		"10.0.0.9": {oldPublicKey: true},
+	}
+	b.installKey = func(opts *installOptions) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if !authorized[opts.IP][publicKeyOf(opts.HostKey)] {
+			return fmt.Errorf("permission denied")
+		}
+		if opts.IP == "10.0.0.9" && opts.Install {
+			return fmt.Errorf("disk full")
+		}
+		if opts.Username != testAdminUser {
+			return fmt.Errorf("bad username %s", opts.Username)
+		}
+		if opts.Install {
+			authorized[opts.IP][opts.DynamicPublicKey] = true
+		} else {
+			delete(authorized[opts.IP], opts.DynamicPublicKey)
+		}
+		return nil
+	}
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+	storedKey := func() string {
+		key, err := b.getKey(storage, "", testKeyName)
+		if err != nil || key == nil {
+			t.Fatalf("bad: key: %#v err: %v", key, err)
+		}
+		return key.Key
+	}
+
+	request("keys/password-key", map[string]interface{}{"password": "secret"})
+	if resp := request("keys/password-key/rotate", nil); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	request("keys/"+testKeyName, map[string]interface{}{"key": testSharedPrivateKey})
+	request("roles/"+testDynamicRoleName, map[string]interface{}{
+		"key_type":     testDynamicKeyType,
+		"key":          testKeyName,
+		"admin_user":   testAdminUser,
+		"default_user": testAdminUser,
+		"cidr_list":    "10.0.0.0/8",
+	})
+	invalid := []map[string]interface{}{
+		{"hosts": "10.0.0.1"},
+		{"hosts": "10.0.0.1", "role": "no-such-role"},
+		{"hosts": "192.168.1.1", "role": testDynamicRoleName},
+		{"key_bits": 1000},
+	}
+	for _, data := range invalid {
+		if resp := request("keys/"+testKeyName+"/rotate", data); resp == nil || !resp.IsError() {
+			t.Fatalf("bad: %#v: %#v", data, resp)
+		}
+	}
+
+	// The key is kept if the new key can't be installed in every host.
+	resp := request("keys/"+testKeyName+"/rotate", map[string]interface{}{
+		"hosts": "10.0.0.1,10.0.0.9",
+		"role":  testDynamicRoleName,
+	})
+	if resp == nil || resp.IsError() || resp.Data["rotated"] != false || len(resp.Data["failures"].([]map[string]interface{})) != 1 {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if storedKey() != testSharedPrivateKey || len(authorized["10.0.0.1"]) != 1 {
+		t.Fatalf("bad: %#v", authorized)
+	}
+
+	resp = request("keys/"+testKeyName+"/rotate", map[string]interface{}{
+		"hosts": "10.0.0.1,10.0.0.2",
+		"role":  testDynamicRoleName,
+	})
+	if resp == nil || resp.IsError() || resp.Data["rotated"] != true || len(resp.Warnings) != 0 {
+		t.Fatalf("bad: %#v", resp)
+	}
+	newPublicKey := publicKeyOf(storedKey())
+	if resp.Data["public_key"] != newPublicKey {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if !reflect.DeepEqual(authorized[ip], map[string]bool{newPublicKey: true}) {
+			t.Fatalf("bad: %s: %#v", ip, authorized[ip])
+		}
+	}
+
+	// Without hosts, the key is replaced right away.
+	resp = request("keys/"+testKeyName+"/rotate", map[string]interface{}{"key_algorithm": "ecdsa-p256"})
+	if resp == nil || resp.IsError() || resp.Data["rotated"] != true {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if key := publicKeyOf(storedKey()); key == newPublicKey || resp.Data["public_key"] != key || !strings.HasPrefix(key, ssh.KeyAlgoECDSA256) {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+}
+
+func TestSSHBackend_RoleVersions(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+	writeRole := func(namespace, allowedUsers string) {
+		resp := request(logical.WriteOperation, "roles/"+namespace+testOTPRoleName, map[string]interface{}{
+			"key_type":      testOTPKeyType,
+			"default_user":  testUserName,
+			"cidr_list":     testCIDRList,
+			"allowed_users": allowedUsers,
+		})
+		if resp != nil && resp.IsError() {
+			t.Fatalf("bad: %#v", resp)
+		}
+	}
+
+	writeRole("", "alice,bob")
+	writeRole("", "")
+	writeRole("ns/tenant1/", "carol")
+
+	resp := request(logical.ListOperation, "roles/"+testOTPRoleName+"/versions", nil)
+	if !reflect.DeepEqual(resp.Data["keys"], []string{"1", "2"}) {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+	keyInfo := resp.Data["key_info"].(map[string]interface{})
+	if keyInfo["1"].(map[string]interface{})["current"] != false || keyInfo["2"].(map[string]interface{})["current"] != true {
+		t.Fatalf("bad: %#v", keyInfo)
+	}
+	resp = request(logical.ReadOperation, "roles/"+testOTPRoleName+"/versions/1", nil)
+	if resp.Data["allowed_users"] != "alice,bob" || resp.Data["version"] != 1 {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+	resp = request(logical.ListOperation, "roles/ns/tenant1/"+testOTPRoleName+"/versions", nil)
+	if !reflect.DeepEqual(resp.Data["keys"], []string{"1"}) {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	// Rolling back restores the version as a new version of the role.
+	resp = request(logical.WriteOperation, "roles/"+testOTPRoleName+"/rollback", map[string]interface{}{"version": 1})
+	if resp == nil || resp.IsError() || resp.Data["version"] != 3 {
+		t.Fatalf("bad: %#v", resp)
+	}
+	resp = request(logical.ReadOperation, "roles/"+testOTPRoleName, nil)
+	if resp.Data["allowed_users"] != "alice,bob" || resp.Data["version"] != 3 {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	for _, data := range []map[string]interface{}{
+		{},
+		{"version": 7},
+	} {
+		resp = request(logical.WriteOperation, "roles/"+testOTPRoleName+"/rollback", data)
+		if resp == nil || !resp.IsError() {
+			t.Fatalf("bad: %#v: %#v", data, resp)
+		}
+	}
+	_, err = b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "roles/" + testOTPRoleName + "/rollback",
+		Storage:   storage,
+		Data:      map[string]interface{}{"version": 2, "cas": 2},
+	})
+	if err == nil {
+		t.Fatalf("bad: check-and-set ignored")
+	}
+
+	// Only the last versions are kept.
+	for i := 0; i < 10; i++ {
+		writeRole("", "alice")
+	}
+	resp = request(logical.ListOperation, "roles/"+testOTPRoleName+"/versions", nil)
+	if keys := resp.Data["keys"].([]string); len(keys) != 10 || keys[0] != "4" || keys[9] != "13" {
+		t.Fatalf("bad: %#v", keys)
+	}
+	if resp = request(logical.ReadOperation, "roles/"+testOTPRoleName+"/versions/3", nil); resp != nil {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	// The versions are kept when the role is deleted, and it can be
+	// restored from them.
+	request(logical.DeleteOperation, "roles/"+testOTPRoleName, nil)
+	resp = request(logical.ListOperation, "roles/"+testOTPRoleName+"/versions", nil)
+	if keys := resp.Data["keys"].([]string); len(keys) != 10 || keys[9] != "13" {
+		t.Fatalf("bad: %#v", keys)
+	}
+	for _, info := range resp.Data["key_info"].(map[string]interface{}) {
+		if info.(map[string]interface{})["current"] != false {
+			t.Fatalf("bad: %#v", resp.Data["key_info"])
+		}
+	}
+	resp = request(logical.WriteOperation, "roles/"+testOTPRoleName+"/rollback", map[string]interface{}{"version": 4, "cas": 0})
+	if resp == nil || resp.IsError() || resp.Data["version"] != 14 {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	// A role written again continues from the last version.
+	request(logical.DeleteOperation, "roles/"+testOTPRoleName, nil)
+	writeRole("", "")
+	resp = request(logical.ReadOperation, "roles/"+testOTPRoleName, nil)
+	if resp.Data["version"] != 15 {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	// Purging the versions keeps only the current one, or none once the
+	// role is deleted.
+	request(logical.DeleteOperation, "roles/"+testOTPRoleName+"/versions", nil)
+	resp = request(logical.ListOperation, "roles/"+testOTPRoleName+"/versions", nil)
+	if !reflect.DeepEqual(resp.Data["keys"], []string{"15"}) {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+	request(logical.DeleteOperation, "roles/"+testOTPRoleName, nil)
+	request(logical.DeleteOperation, "roles/"+testOTPRoleName+"/versions", nil)
+	if resp = request(logical.ListOperation, "roles/"+testOTPRoleName+"/versions", nil); resp != nil {
+		t.Fatalf("bad: %#v", resp)
+	}
+	writeRole("", "")
+	resp = request(logical.ListOperation, "roles/"+testOTPRoleName+"/versions", nil)
+	if !reflect.DeepEqual(resp.Data["keys"], []string{"1"}) {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+}
+
+func TestSSHBackend_RoleRevokeAll(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Keys are uninstalled in parallel.
+	var lock sync.Mutex
+	installed := make(map[string]bool)
+	var uninstallErr error
+	var uninstalls int
+	b.installKey = func(opts *installOptions) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if opts.Install {
+			installed[opts.DynamicPublicKey] = true
+			return nil
+		}
+		uninstalls++
+		if uninstallErr != nil {
+			return uninstallErr
+		}
+		delete(installed, opts.DynamicPublicKey)
+		return nil
+	}
+	b.verifyKey = func(opts *installOptions) (bool, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return installed[opts.DynamicPublicKey], nil
+	}
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("bad: %s: resp: %#v err: %v", path, resp, err)
+		}
+		return resp
+	}
+
+	request("keys/"+testKeyName, map[string]interface{}{"key": testSharedPrivateKey})
+	request("roles/"+testDynamicRoleName, map[string]interface{}{
+		"key_type":     testDynamicKeyType,
+		"key":          testKeyName,
+		"admin_user":   testAdminUser,
+		"default_user": testAdminUser,
+		"cidr_list":    testCIDRList,
+	})
+	request("roles/"+testOTPRoleName, map[string]interface{}{
+		"key_type":     testOTPKeyType,
+		"default_user": testUserName,
+		"cidr_list":    testCIDRList,
+	})
+
+	var secrets []*logical.Secret
+	for i := 0; i < 2; i++ {
+		resp := request("creds/"+testDynamicRoleName, map[string]interface{}{"ip": testIP})
+		secrets = append(secrets, resp.Secret)
+	}
+	otp := request("creds/"+testOTPRoleName, map[string]interface{}{"ip": testIP}).Data["key"].(string)
+	if len(installed) != 2 {
+		t.Fatalf("bad: %#v", installed)
+	}
+
+	// Keys that can't be removed are reported and left for a retry.
+	uninstallErr = fmt.Errorf("host unreachable")
+	resp := request("roles/"+testDynamicRoleName+"/revoke-all", nil)
+	if resp.Data["revoked_keys"] != 0 || len(resp.Data["failures"].([]map[string]interface{})) != 2 {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	uninstallErr = nil
+	resp = request("roles/"+testDynamicRoleName+"/revoke-all", nil)
+	if resp.Data["revoked_keys"] != 2 || len(resp.Data["failures"].([]map[string]interface{})) != 0 {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+	if len(installed) != 0 {
+		t.Fatalf("bad: %#v", installed)
+	}
+
+	// Revoking the leases afterwards doesn't touch the hosts again.
+	uninstalls = 0
+	for _, secret := range secrets {
+		req := logical.RevokeRequest("creds/"+testDynamicRoleName, secret, nil)
+		req.Storage = storage
+		if _, err := b.HandleRequest(req); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if uninstalls != 0 {
+		t.Fatalf("bad: %d uninstalls", uninstalls)
+	}
+
+	resp = request("roles/"+testOTPRoleName+"/revoke-all", nil)
+	if resp.Data["revoked_otps"] != 1 || resp.Data["revoked_keys"] != 0 {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+	resp, err = b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "verify",
+		Storage:   storage,
+		Data:      map[string]interface{}{"otp": otp},
+	})
+	if err != nil || !resp.IsError() {
+		t.Fatalf("bad: OTP was verified: resp: %#v err: %v", resp, err)
+	}
+}
+
+func TestSSHBackend_ConfigCA(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(op logical.Operation, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      "config/ca",
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+
+	signer, err := ssh.ParsePrivateKey([]byte(testSharedPrivateKey))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	sharedPublicKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	otherPublicKey, _, err := generateRSAKeys(1024)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	invalid := []map[string]interface{}{
+		{},
+		{"private_key": testSharedPrivateKey, "public_key": otherPublicKey},
+		{"private_key": testSharedPrivateKey, "generate_signing_key": true},
+		{"generate_signing_key": true, "key_bits": 1000},
+	}
+	for _, data := range invalid {
+		if resp := request(logical.WriteOperation, data); resp == nil || !resp.IsError() {
+			t.Fatalf("bad: %#v: %#v", data, resp)
+		}
+	}
+
+	resp := request(logical.WriteOperation, map[string]interface{}{
+		"private_key": testSharedPrivateKey,
+		"public_key":  sharedPublicKey,
+	})
+	if resp != nil && resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	resp = request(logical.ReadOperation, nil)
+	if resp == nil || resp.Data["public_key"] != sharedPublicKey {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	// A generated key replaces the imported one, and only its public key is
+	// ever returned.
+	resp = request(logical.WriteOperation, map[string]interface{}{
+		"generate_signing_key": true,
+		"key_bits":             2048,
+	})
+	if resp == nil || resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	generated := resp.Data["public_key"].(string)
+	if generated == sharedPublicKey || len(resp.Data) != 1 {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+	resp = request(logical.ReadOperation, nil)
+	if resp == nil || resp.Data["public_key"] != generated || len(resp.Data) != 1 {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	request(logical.DeleteOperation, nil)
+	if resp := request(logical.ReadOperation, nil); resp != nil {
+		t.Fatalf("bad: %#v", resp)
+	}
+}
+
+func TestSSHBackend_CASign(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+
+	publicKey, _, err := generateRSAKeys(1024)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	resp := request("roles/testCARoleName", map[string]interface{}{
+		"key_type":      "ca",
+		"default_user":  "vaultuser",
+		"allowed_users": "alice,bob",
+	})
+	if resp != nil && resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	// Nothing is signed until the CA key is configured.
+	resp = request("sign/testCARoleName", map[string]interface{}{"public_key": publicKey})
+	if !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	request("config/ca", map[string]interface{}{"private_key": testSharedPrivateKey})
+
+	resp = request("sign/testCARoleName", map[string]interface{}{
+		"public_key":       publicKey,
+		"valid_principals": "bob,alice",
+		"ttl":              "30m",
+	})
+	if resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(resp.Data["signed_key"].(string)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		t.Fatalf("bad: %#v", parsed)
+	}
+	if cert.CertType != ssh.UserCert || !reflect.DeepEqual(cert.ValidPrincipals, []string{"alice", "bob"}) {
+		t.Fatalf("bad: %#v", cert)
+	}
+	// The start of the validity is backdated by 30s by default.
+	if validity := cert.ValidBefore - cert.ValidAfter; validity != 30*60+30 {
+		t.Fatalf("bad: validity: %d", validity)
+	}
+	if _, ok := cert.Extensions["permit-pty"]; !ok {
+		t.Fatalf("bad: %#v", cert.Extensions)
+	}
+
+	ca, err := ssh.ParsePrivateKey([]byte(testSharedPrivateKey))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	knownHosts := "@cert-authority * " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ca.PublicKey()))) + "\n"
+	if resp.Data["known_hosts"] != knownHosts || resp.Data["ssh_config"] != "Host *\n  User alice\n" {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+	checker := &ssh.CertChecker{
+		IsAuthority: func(auth ssh.PublicKey) bool {
+			return reflect.DeepEqual(auth.Marshal(), ca.PublicKey().Marshal())
+		},
+	}
+	if err := checker.CheckCert("alice", cert); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Principals the role doesn't allow are rejected.
+	resp = request("sign/testCARoleName", map[string]interface{}{
+		"public_key":       publicKey,
+		"valid_principals": "alice,root",
+	})
+	if !resp.IsError() || resp.Data["error_code"] != ErrorCodeUserNotAllowed {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	// CA roles don't issue other credentials.
+	resp = request("creds/testCARoleName", map[string]interface{}{"ip": testIP})
+	if !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	resp = request("roles/testCARoleName", map[string]interface{}{
+		"key_type":            "ca",
+		"default_user":        testUserName,
+		"not_before_duration": "5m",
+	})
+	if resp != nil && resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	resp = request("sign/testCARoleName", map[string]interface{}{
+		"public_key": publicKey,
+		"ttl":        "30m",
+	})
+	if resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	parsed, _, _, _, err = ssh.ParseAuthorizedKey([]byte(resp.Data["signed_key"].(string)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cert = parsed.(*ssh.Certificate)
+	if validity := cert.ValidBefore - cert.ValidAfter; validity != 35*60 {
+		t.Fatalf("bad: validity: %d", validity)
+	}
+
+	invalid := []map[string]interface{}{
+		{"key_type": "ca", "default_user": testUserName, "not_before_duration": "-1m"},
+		{"key_type": testOTPKeyType, "default_user": testUserName, "cidr_list": testCIDRList, "not_before_duration": "1m"},
+	}
+	for _, data := range invalid {
+		if resp := request("roles/testCARoleName", data); resp == nil || !resp.IsError() {
+			t.Fatalf("bad: %#v: %#v", data, resp)
+		}
+	}
+}
+
+func TestSSHBackend_CASignHost(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+
+	publicKey, _, err := generateRSAKeys(1024)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	request("config/ca", map[string]interface{}{"private_key": testSharedPrivateKey})
+
+	// Host certificates need allowed domains, and only CA roles sign them.
+	invalid := []map[string]interface{}{
+		{
+			"key_type":                "ca",
+			"default_user":            testUserName,
+			"allow_host_certificates": true,
+		},
+		{
+			"key_type":                testOTPKeyType,
+			"default_user":            testUserName,
+			"cidr_list":               testCIDRList,
+			"allow_host_certificates": true,
+		},
+	}
+	for _, data := range invalid {
+		if resp := request("roles/testCARoleName", data); resp == nil || !resp.IsError() {
+			t.Fatalf("bad: %#v: %#v", data, resp)
+		}
+	}
+
+	request("roles/testUserCARole", map[string]interface{}{
+		"key_type":        "ca",
+		"default_user":    testUserName,
+		"allowed_domains": "example.com",
+	})
+	resp := request("sign/testUserCARole", map[string]interface{}{
+		"public_key":       publicKey,
+		"cert_type":        "host",
+		"valid_principals": "web1.example.com",
+	})
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	resp = request("roles/testCARoleName", map[string]interface{}{
+		"key_type":                "ca",
+		"default_user":            testUserName,
+		"allowed_domains":         "example.com",
+		"allow_host_certificates": true,
+	})
+	if resp != nil && resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	for _, principals := range []string{"", "web1.example.org", "web1.example.com,example.net", "badexample.com"} {
+		resp = request("sign/testCARoleName", map[string]interface{}{
+			"public_key":       publicKey,
+			"cert_type":        "host",
+			"valid_principals": principals,
+		})
+		if resp == nil || !resp.IsError() {
+			t.Fatalf("bad: %s: %#v", principals, resp)
+		}
+	}
+	resp = request("sign/testCARoleName", map[string]interface{}{
+		"public_key": publicKey,
+		"cert_type":  "server",
+	})
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	resp = request("sign/testCARoleName", map[string]interface{}{
+		"public_key":       publicKey,
+		"cert_type":        "host",
+		"valid_principals": "Web1.Example.com,example.com",
+	})
+	if resp == nil || resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(resp.Data["signed_key"].(string)))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		t.Fatalf("bad: %#v", parsed)
+	}
+	if cert.CertType != ssh.HostCert || !reflect.DeepEqual(cert.ValidPrincipals, []string{"example.com", "web1.example.com"}) {
+		t.Fatalf("bad: %#v", cert)
+	}
+	if len(cert.Extensions) != 0 {
+		t.Fatalf("bad: %#v", cert.Extensions)
+	}
+
+	ca, err := ssh.ParsePrivateKey([]byte(testSharedPrivateKey))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	checker := &ssh.CertChecker{
+		IsAuthority: func(auth ssh.PublicKey) bool {
+			return reflect.DeepEqual(auth.Marshal(), ca.PublicKey().Marshal())
+		},
+	}
+	if err := checker.CheckCert("web1.example.com", cert); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The role still signs user certificates.
+	resp = request("sign/testCARoleName", map[string]interface{}{"public_key": publicKey})
+	if resp == nil || resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+}
+
+func TestSSHBackend_CASignPermissions(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+	sign := func(role string, data map[string]interface{}) *ssh.Certificate {
+		resp := request("sign/"+role, data)
+		if resp == nil || resp.IsError() {
+			t.Fatalf("bad: %#v: %#v", data, resp)
+		}
+		parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(resp.Data["signed_key"].(string)))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return parsed.(*ssh.Certificate)
+	}
+
+	publicKey, _, err := generateRSAKeys(1024)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	request("config/ca", map[string]interface{}{"private_key": testSharedPrivateKey})
+
+	invalid := []map[string]interface{}{
+		{"allowed_critical_options": "force-command,no-such-option"},
+		{"allowed_extensions": "permit-pty,bad name"},
+	}
+	for _, data := range invalid {
+		data["key_type"] = "ca"
+		data["default_user"] = testUserName
+		if resp := request("roles/testCARoleName", data); resp == nil || !resp.IsError() {
+			t.Fatalf("bad: %#v: %#v", data, resp)
+		}
+	}
+	if resp := request("roles/"+testOTPRoleName, map[string]interface{}{
+		"key_type":           testOTPKeyType,
+		"default_user":       testUserName,
+		"cidr_list":          testCIDRList,
+		"allowed_extensions": "permit-pty",
+	}); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	request("roles/testCARoleName", map[string]interface{}{
+		"key_type":                 "ca",
+		"default_user":             testUserName,
+		"allowed_critical_options": "force-command, source-address",
+		"allowed_extensions":       "permit-pty,login@example.com",
+	})
+	request("roles/testCAStrictRole", map[string]interface{}{
+		"key_type":     "ca",
+		"default_user": testUserName,
+	})
+	request("roles/testCAOpenRole", map[string]interface{}{
+		"key_type":                 "ca",
+		"default_user":             testUserName,
+		"allowed_critical_options": "*",
+		"allowed_extensions":       "*",
+	})
+
+	// Without requested extensions the defaults are granted, whatever the
+	// role allows.
+	cert := sign("testCAStrictRole", map[string]interface{}{"public_key": publicKey})
+	if len(cert.CriticalOptions) != 0 || len(cert.Extensions) != len(defaultUserCertExtensions) {
+		t.Fatalf("bad: %#v", cert.Permissions)
+	}
+
+	rejected := []struct {
+		Role string
+		Data map[string]interface{}
+	}{
+		{"testCAStrictRole", map[string]interface{}{"extensions": map[string]interface{}{"permit-pty": ""}}},
+		{"testCAStrictRole", map[string]interface{}{"critical_options": map[string]interface{}{"force-command": "ls"}}},
+		{"testCARoleName", map[string]interface{}{"extensions": map[string]interface{}{"permit-port-forwarding": ""}}},
+		{"testCARoleName", map[string]interface{}{"critical_options": map[string]interface{}{"verify-required": ""}}},
+		{"testCARoleName", map[string]interface{}{"critical_options": map[string]interface{}{"source-address": "not-a-cidr"}}},
+		{"testCARoleName", map[string]interface{}{"extensions": map[string]interface{}{"permit-pty": 1}}},
+	}
+	for _, tc := range rejected {
+		tc.Data["public_key"] = publicKey
+		if resp := request("sign/"+tc.Role, tc.Data); resp == nil || !resp.IsError() {
+			t.Fatalf("bad: %s: %#v: %#v", tc.Role, tc.Data, resp)
+		}
+	}
+
+	cert = sign("testCARoleName", map[string]interface{}{
+		"public_key": publicKey,
+		"critical_options": map[string]interface{}{
+			"force-command":  "/usr/bin/uptime",
+			"source-address": "10.0.0.0/8",
+		},
+		"extensions": map[string]interface{}{
+			"permit-pty":        "",
+			"login@example.com": "alice",
+		},
+	})
+	expected := ssh.Permissions{
+		CriticalOptions: map[string]string{
+			"force-command":  "/usr/bin/uptime",
+			"source-address": "10.0.0.0/8",
+		},
+		Extensions: map[string]string{
+			"permit-pty":        "",
+			"login@example.com": "alice",
+		},
+	}
+	if !reflect.DeepEqual(cert.Permissions, expected) {
+		t.Fatalf("bad: %#v", cert.Permissions)
+	}
+
+	cert = sign("testCAOpenRole", map[string]interface{}{
+		"public_key": publicKey,
+		"critical_options": map[string]interface{}{
+			"verify-required": "",
+		},
+		"extensions": map[string]interface{}{
+			"no-touch-required": "",
+		},
+	})
+	if _, ok := cert.CriticalOptions["verify-required"]; !ok || len(cert.Extensions) != 1 {
+		t.Fatalf("bad: %#v", cert.Permissions)
+	}
+}
+
+func TestSSHBackend_CASignDefaults(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation:   logical.WriteOperation,
+			Path:        path,
+			Storage:     storage,
+			Data:        data,
+			DisplayName: "token-alice",
+			Metadata:    map[string]string{"user": "alice"},
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+	sign := func(data map[string]interface{}) *ssh.Certificate {
+		resp := request("sign/testCARoleName", data)
+		if resp == nil || resp.IsError() {
+			t.Fatalf("bad: %#v: %#v", data, resp)
+		}
+		parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(resp.Data["signed_key"].(string)))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return parsed.(*ssh.Certificate)
+	}
+
+	publicKey, _, err := generateRSAKeys(1024)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	request("config/ca", map[string]interface{}{"private_key": testSharedPrivateKey})
+
+	invalid := []map[string]interface{}{
+		{"default_critical_options": map[string]interface{}{"no-such-option": ""}},
+		{"default_extensions": map[string]interface{}{"bad name": ""}},
+		{"default_extensions": map[string]interface{}{"permit-pty": 1}},
+		{"default_extensions": map[string]interface{}{"login@example.com": "{{identity.entity.name}}"}},
+	}
+	for _, data := range invalid {
+		data["key_type"] = "ca"
+		data["default_user"] = testUserName
+		if resp := request("roles/testCARoleName", data); resp == nil || !resp.IsError() {
+			t.Fatalf("bad: %#v: %#v", data, resp)
+		}
+	}
+	if resp := request("roles/"+testOTPRoleName, map[string]interface{}{
+		"key_type":           testOTPKeyType,
+		"default_user":       testUserName,
+		"cidr_list":          testCIDRList,
+		"default_extensions": map[string]interface{}{"permit-pty": ""},
+	}); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	request("roles/testCARoleName", map[string]interface{}{
+		"key_type":           "ca",
+		"default_user":       testUserName,
+		"allowed_extensions": "permit-pty",
+		"default_critical_options": map[string]interface{}{
+			"force-command": "/usr/bin/whoami",
+		},
+		"default_extensions": map[string]interface{}{
+			"permit-pty":        "",
+			"login@example.com": "{{token.metadata.user}}@{{display_name}}",
+		},
+	})
+
+	// The defaults are rendered for the requesting token, and aren't limited
+	// by the allowed extensions of the role.
+	cert := sign(map[string]interface{}{"public_key": publicKey})
+	expected := ssh.Permissions{
+		CriticalOptions: map[string]string{
+			"force-command": "/usr/bin/whoami",
+		},
+		Extensions: map[string]string{
+			"permit-pty":        "",
+			"login@example.com": "alice@token-alice",
+		},
+	}
+	if !reflect.DeepEqual(cert.Permissions, expected) {
+		t.Fatalf("bad: %#v", cert.Permissions)
+	}
+
+	// Requested extensions replace the default ones.
+	cert = sign(map[string]interface{}{
+		"public_key": publicKey,
+		"extensions": map[string]interface{}{"permit-pty": ""},
+	})
+	if !reflect.DeepEqual(cert.Extensions, map[string]string{"permit-pty": ""}) || len(cert.CriticalOptions) != 1 {
+		t.Fatalf("bad: %#v", cert.Permissions)
+	}
+
+	// Templates that the token has no value for fail the request.
+	request("roles/testCARoleName", map[string]interface{}{
+		"key_type":     "ca",
+		"default_user": testUserName,
+		"default_extensions": map[string]interface{}{
+			"login@example.com": "{{token.metadata.team}}",
+		},
+	})
+	if resp := request("sign/testCARoleName", map[string]interface{}{"public_key": publicKey}); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+}
+
+func TestSSHBackend_CASignKeyID(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation:   logical.WriteOperation,
+			Path:        path,
+			Storage:     storage,
+			Data:        data,
+			DisplayName: "token-alice",
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+	sign := func(data map[string]interface{}) *ssh.Certificate {
+		resp := request("sign/testCARoleName", data)
+		if resp == nil || resp.IsError() {
+			t.Fatalf("bad: %#v: %#v", data, resp)
+		}
+		parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(resp.Data["signed_key"].(string)))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return parsed.(*ssh.Certificate)
+	}
+
+	publicKeyRaw, _, err := generateRSAKeys(1024)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKeyRaw))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	request("config/ca", map[string]interface{}{"private_key": testSharedPrivateKey})
+
+	if resp := request("roles/testCARoleName", map[string]interface{}{
+		"key_type":      "ca",
+		"default_user":  testUserName,
+		"key_id_format": "{{token_display_name}}-{{entity_name}}",
+	}); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if resp := request("roles/"+testOTPRoleName, map[string]interface{}{
+		"key_type":      testOTPKeyType,
+		"default_user":  testUserName,
+		"cidr_list":     testCIDRList,
+		"key_id_format": "{{role_name}}",
+	}); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	request("roles/testCARoleName", map[string]interface{}{
+		"key_type":     "ca",
+		"default_user": testUserName,
+	})
+	cert := sign(map[string]interface{}{"public_key": publicKeyRaw})
+	if expected := "vault-token-alice-" + fingerprintSHA256(publicKey); cert.KeyId != expected {
+		t.Fatalf("bad: expected %q, got %q", expected, cert.KeyId)
+	}
+
+	request("roles/testCARoleName", map[string]interface{}{
+		"key_type":      "ca",
+		"default_user":  testUserName,
+		"key_id_format": "{{role_name}}:{{token_display_name}}:{{public_key_hash}}",
+	})
+	cert = sign(map[string]interface{}{"public_key": publicKeyRaw})
+	if expected := "testCARoleName:token-alice:" + fingerprintSHA256(publicKey); cert.KeyId != expected {
+		t.Fatalf("bad: expected %q, got %q", expected, cert.KeyId)
+	}
+}
+
+func TestSSHBackend_CASignAlgorithm(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+
+	publicKey, _, err := generateRSAKeys(1024)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	caKey, err := ssh.ParseRawPrivateKey([]byte(testSharedPrivateKey))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	request("config/ca", map[string]interface{}{"private_key": testSharedPrivateKey})
+
+	if resp := request("roles/testCARoleName", map[string]interface{}{
+		"key_type":         "ca",
+		"default_user":     testUserName,
+		"algorithm_signer": "rsa-sha1",
+	}); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if resp := request("roles/"+testOTPRoleName, map[string]interface{}{
+		"key_type":         testOTPKeyType,
+		"default_user":     testUserName,
+		"cidr_list":        testCIDRList,
+		"algorithm_signer": "rsa-sha2-256",
+	}); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	hashes := map[string]crypto.Hash{
+		"ssh-rsa":      crypto.SHA1,
+		"rsa-sha2-256": crypto.SHA256,
+		"rsa-sha2-512": crypto.SHA512,
+	}
+	for algorithm, hash := range hashes {
+		request("roles/testCARoleName", map[string]interface{}{
+			"key_type":         "ca",
+			"default_user":     testUserName,
+			"algorithm_signer": algorithm,
+		})
+		resp := request("sign/testCARoleName", map[string]interface{}{"public_key": publicKey})
+		if resp == nil || resp.IsError() {
+			t.Fatalf("bad: %s: %#v", algorithm, resp)
+		}
+		parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(resp.Data["signed_key"].(string)))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		cert := parsed.(*ssh.Certificate)
+		if cert.Signature.Format != algorithm {
+			t.Fatalf("bad: expected %s, got %s", algorithm, cert.Signature.Format)
+		}
+
+		// The signed data is the certificate without its signature.
+		unsigned := *cert
+		unsigned.Signature = nil
+		data := unsigned.Marshal()
+		data = data[:len(data)-4]
+		h := hash.New()
+		h.Write(data)
+		if err := rsa.VerifyPKCS1v15(&caKey.(*rsa.PrivateKey).PublicKey, hash, h.Sum(nil), cert.Signature.Blob); err != nil {
+			t.Fatalf("bad: %s: %s", algorithm, err)
+		}
+	}
+}
+
+func TestSSHBackend_SignSecurityKeys(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+
+	caSigner, err := ssh.ParsePrivateKey([]byte(testSharedPrivateKey))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	request("config/ca", map[string]interface{}{"private_key": testSharedPrivateKey})
+
+	point := make([]byte, 65)
+	point[0] = 4
+	keys := map[string][]byte{
+		KeyAlgoSKECDSA256: ssh.Marshal(&struct {
+			Type, Curve string
+			Point       []byte
+			Application string
+		}{KeyAlgoSKECDSA256, "nistp256", point, "ssh:"}),
+		KeyAlgoSKED25519: ssh.Marshal(&struct {
+			Type        string
+			Point       []byte
+			Application string
+		}{KeyAlgoSKED25519, make([]byte, 32), "ssh:"}),
+	}
+	authorizedKey := func(keyType string, blob []byte) string {
+		return string(ssh.MarshalAuthorizedKey(&securityKey{keyType: keyType, blob: blob}))
+	}
+
+	if resp := request("roles/testCARoleName", map[string]interface{}{
+		"key_type":               "ca",
+		"default_user":           testUserName,
+		"allowed_user_key_types": KeyAlgoSKED25519 + ",ssh-ed448",
+	}); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if resp := request("roles/"+testOTPRoleName, map[string]interface{}{
+		"key_type":               testOTPKeyType,
+		"default_user":           testUserName,
+		"cidr_list":              testCIDRList,
+		"allowed_user_key_types": KeyAlgoSKED25519,
+	}); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	request("roles/testCARoleName", map[string]interface{}{
+		"key_type":               "ca",
+		"default_user":           testUserName,
+		"allowed_user_key_types": KeyAlgoSKED25519 + ", " + KeyAlgoSKECDSA256,
+	})
+
+	// Keys of other types are refused.
+	rsaKey, _, err := generateRSAKeys(1024)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	resp := request("sign/testCARoleName", map[string]interface{}{"public_key": rsaKey})
+	if resp == nil || !resp.IsError() || resp.Data["error_code"] != ErrorCodePublicKeyNotAllowed {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	// Keys that don't match their type are invalid.
+	for _, publicKey := range []string{
+		authorizedKey(KeyAlgoSKED25519, keys[KeyAlgoSKECDSA256]),
+		authorizedKey(KeyAlgoSKED25519, keys[KeyAlgoSKED25519][:len(keys[KeyAlgoSKED25519])-1]),
+		authorizedKey(KeyAlgoSKED25519, append(keys[KeyAlgoSKED25519], 0)),
+	} {
+		resp := request("sign/testCARoleName", map[string]interface{}{"public_key": publicKey})
+		if resp == nil || !resp.IsError() || resp.Data["error_code"] != ErrorCodeInvalidRequest {
+			t.Fatalf("bad: %#v", resp)
+		}
+	}
+
+	for keyType, blob := range keys {
+		resp := request("sign/testCARoleName", map[string]interface{}{"public_key": authorizedKey(keyType, blob)})
+		if resp == nil || resp.IsError() {
+			t.Fatalf("bad: %s: %#v", keyType, resp)
+		}
+		fields := strings.Fields(resp.Data["signed_key"].(string))
+		if len(fields) != 2 || fields[0] != securityKeyCertAlgos[keyType] {
+			t.Fatalf("bad: %s: %q", keyType, resp.Data["signed_key"])
+		}
+		certBlob, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		// The certificate holds the key without its type between the nonce
+		// and the serial, and the signature of the rest at the end.
+		in := bytes.NewReader(certBlob)
+		readString := func() []byte {
+			s, err := readSSHString(in)
+			if err != nil {
+				t.Fatalf("err: %s: %s", keyType, err)
+			}
+			return s
+		}
+		if string(readString()) != securityKeyCertAlgos[keyType] || len(readString()) != 32 {
+			t.Fatalf("bad: %s", keyType)
+		}
+		keyStart := len(certBlob) - in.Len()
+		keyFields := 2
+		if keyType == KeyAlgoSKECDSA256 {
+			keyFields = 3
+		}
+		for i := 0; i < keyFields; i++ {
+			readString()
+		}
+		if key := certBlob[keyStart : len(certBlob)-in.Len()]; !bytes.Equal(key, blob[4+len(keyType):]) {
+			t.Fatalf("bad: %s: %x", keyType, key)
+		}
+		in.Seek(12, 1)
+		if keyID := string(readString()); !strings.HasPrefix(keyID, "vault-") {
+			t.Fatalf("bad: %s: %q", keyType, keyID)
+		}
+		if principals := readString(); !bytes.Equal(principals, ssh.Marshal(&struct{ N string }{testUserName})) {
+			t.Fatalf("bad: %s: %x", keyType, principals)
+		}
+		in.Seek(16, 1)
+		readString()
+		if extensions := readString(); !bytes.Contains(extensions, []byte("permit-pty")) {
+			t.Fatalf("bad: %s: %q", keyType, extensions)
+		}
+		readString()
+		if signatureKey := readString(); !bytes.Equal(signatureKey, caSigner.PublicKey().Marshal()) {
+			t.Fatalf("bad: %s", keyType)
+		}
+		signed := certBlob[:len(certBlob)-in.Len()]
+		var sig ssh.Signature
+		if err := ssh.Unmarshal(readString(), &sig); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if in.Len() != 0 {
+			t.Fatalf("bad: %s: %d trailing bytes", keyType, in.Len())
+		}
+		if err := caSigner.PublicKey().Verify(signed, &sig); err != nil {
+			t.Fatalf("bad: %s: %s", keyType, err)
+		}
+	}
+}
+
+func TestSSHBackend_AllowedUserKeyLengths(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+	request(logical.WriteOperation, "config/ca", map[string]interface{}{"private_key": testSharedPrivateKey})
+
+	for _, lengths := range []map[string]interface{}{
+		{"ssh-ed448": 256},
+		{"ssh-rsa": -1},
+		{"ssh-rsa": "strong"},
+	} {
+		if resp := request(logical.WriteOperation, "roles/testCARoleName", map[string]interface{}{
+			"key_type":                           "ca",
+			"default_user":                       testUserName,
+			"allowed_user_key_types_and_lengths": lengths,
+		}); resp == nil || !resp.IsError() {
+			t.Fatalf("bad: %v: %#v", lengths, resp)
+		}
+	}
+	if resp := request(logical.WriteOperation, "roles/"+testOTPRoleName, map[string]interface{}{
+		"key_type":                           testOTPKeyType,
+		"default_user":                       testUserName,
+		"cidr_list":                          testCIDRList,
+		"allowed_user_key_types_and_lengths": map[string]interface{}{"ssh-rsa": 2048},
+	}); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	request(logical.WriteOperation, "roles/testCARoleName", map[string]interface{}{
+		"key_type":     "ca",
+		"default_user": testUserName,
+		"allowed_user_key_types_and_lengths": map[string]interface{}{
+			"ssh-rsa":         "2048",
+			KeyAlgoSKED25519:  float64(0),
+			KeyAlgoSKECDSA256: 384,
+		},
+	})
+	resp := request(logical.ReadOperation, "roles/testCARoleName", nil)
+	expected := map[string]int{"ssh-rsa": 2048, KeyAlgoSKED25519: 0, KeyAlgoSKECDSA256: 384}
+	if !reflect.DeepEqual(resp.Data["allowed_user_key_types_and_lengths"], expected) {
+		t.Fatalf("bad: %#v", resp.Data["allowed_user_key_types_and_lengths"])
+	}
+
+	weakKey, _, err := generateRSAKeys(1024)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	strongKey, _, err := generateRSAKeys(2048)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ecdsaKey, _, err := generateDynamicKeys("ecdsa-p256", 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	skKey := func(keyType string, blob []byte) string {
+		return string(ssh.MarshalAuthorizedKey(&securityKey{keyType: keyType, blob: blob}))
+	}
+	point := make([]byte, 65)
+	point[0] = 4
+
+	testCases := []struct {
+		PublicKey string
+		Allowed   bool
+	}{
+		{weakKey, false},
+		{strongKey, true},
+		{skKey(KeyAlgoSKED25519, ssh.Marshal(&struct {
+			Type        string
+			Point       []byte
+			Application string
+		}{KeyAlgoSKED25519, make([]byte, 32), "ssh:"})), true},
+		{skKey(KeyAlgoSKECDSA256, ssh.Marshal(&struct {
+			Type, Curve string
+			Point       []byte
+			Application string
+		}{KeyAlgoSKECDSA256, "nistp256", point, "ssh:"})), false},
+		{ecdsaKey, false},
+	}
+	for i, tc := range testCases {
+		resp := request(logical.WriteOperation, "sign/testCARoleName", map[string]interface{}{"public_key": tc.PublicKey})
+		if tc.Allowed && (resp == nil || resp.IsError()) {
+			t.Fatalf("bad: %d: %#v", i, resp)
+		}
+		if !tc.Allowed && (resp == nil || !resp.IsError() || resp.Data["error_code"] != ErrorCodePublicKeyNotAllowed) {
+			t.Fatalf("bad: %d: %#v", i, resp)
+		}
+	}
+}
+
+func TestSSHBackend_Issuers(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+
+	publicKey, _, err := generateRSAKeys(1024)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	signedBy := func(role string) string {
+		resp := request(logical.WriteOperation, "sign/"+role, map[string]interface{}{"public_key": publicKey})
+		if resp == nil || resp.IsError() {
+			t.Fatalf("bad: %#v", resp)
+		}
+		parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(resp.Data["signed_key"].(string)))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(parsed.(*ssh.Certificate).SignatureKey)))
+	}
+	caPublicKey := func() string {
+		resp := request(logical.ReadOperation, "public_key", nil)
+		if resp == nil {
+			return ""
+		}
+		if resp.Data[logical.HTTPContentType] != "text/plain" || resp.Data[logical.HTTPStatusCode] != 200 {
+			t.Fatalf("bad: %#v", resp.Data)
+		}
+		return string(resp.Data[logical.HTTPRawBody].([]byte))
+	}
+
+	if key := caPublicKey(); key != "" {
+		t.Fatalf("bad: %s", key)
+	}
+	request(logical.WriteOperation, "config/ca", map[string]interface{}{"private_key": testSharedPrivateKey})
+	legacy := request(logical.ReadOperation, "config/ca", nil).Data["public_key"].(string)
+	if key := caPublicKey(); key != legacy+"\n" {
+		t.Fatalf("bad: %s", key)
+	}
+
+	issuers := map[string]string{}
+	for _, name := range []string{"old-ca", "new-ca"} {
+		resp := request(logical.WriteOperation, "issuers/"+name, map[string]interface{}{
+			"generate_signing_key": true,
+			"key_bits":             2048,
+		})
+		if resp == nil || resp.IsError() {
+			t.Fatalf("bad: %#v", resp)
+		}
+		issuers[name] = resp.Data["public_key"].(string)
+	}
+
+	resp := request(logical.ListOperation, "issuers/", nil)
+	if !reflect.DeepEqual(resp.Data["keys"], []string{"new-ca", "old-ca"}) {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+	keyInfo := resp.Data["key_info"].(map[string]interface{})
+	if keyInfo["old-ca"].(map[string]interface{})["public_key"] != issuers["old-ca"] {
+		t.Fatalf("bad: %#v", keyInfo)
+	}
+
+	if resp := request(logical.WriteOperation, "roles/testCARoleName", map[string]interface{}{
+		"key_type":     "ca",
+		"default_user": testUserName,
+		"issuer":       "no-such-ca",
+	}); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	request(logical.WriteOperation, "roles/testCARoleName", map[string]interface{}{
+		"key_type":     "ca",
+		"default_user": testUserName,
+	})
+	request(logical.WriteOperation, "roles/testCAPinnedRole", map[string]interface{}{
+		"key_type":     "ca",
+		"default_user": testUserName,
+		"issuer":       "old-ca",
+	})
+
+	// Without a default issuer, roles sign with the key of config/ca.
+	if key := signedBy("testCARoleName"); key != legacy {
+		t.Fatalf("bad: %s", key)
+	}
+	if key := signedBy("testCAPinnedRole"); key != issuers["old-ca"] {
+		t.Fatalf("bad: %s", key)
+	}
+
+	if resp := request(logical.WriteOperation, "config/issuers", map[string]interface{}{"default": "no-such-ca"}); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	request(logical.WriteOperation, "config/issuers", map[string]interface{}{"default": "new-ca"})
+	if resp := request(logical.ReadOperation, "config/issuers", nil); resp.Data["default"] != "new-ca" {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if key := signedBy("testCARoleName"); key != issuers["new-ca"] {
+		t.Fatalf("bad: %s", key)
+	}
+	if key := caPublicKey(); key != issuers["new-ca"]+"\n" {
+		t.Fatalf("bad: %s", key)
+	}
+	if key := signedBy("testCAPinnedRole"); key != issuers["old-ca"] {
+		t.Fatalf("bad: %s", key)
+	}
+
+	// The default issuer can't be deleted, and roles of deleted issuers
+	// stop signing.
+	if resp := request(logical.DeleteOperation, "issuers/new-ca", nil); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	request(logical.DeleteOperation, "issuers/old-ca", nil)
+	resp = request(logical.WriteOperation, "sign/testCAPinnedRole", map[string]interface{}{"public_key": publicKey})
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+}
+
+func TestSSHBackend_Namespaces(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+
+	roles := map[string]string{
+		"roles/web":            "127.0.0.1/32",
+		"roles/ns/tenant1/web": "10.0.0.0/8",
+		"roles/ns/tenant2/web": "192.168.0.0/16",
+	}
+	for path, cidrList := range roles {
+		resp := request(logical.WriteOperation, path, map[string]interface{}{
+			"key_type":     testOTPKeyType,
+			"default_user": testUserName,
+			"cidr_list":    cidrList,
+		})
+		if resp.IsError() {
+			t.Fatalf("bad: %s: %#v", path, resp)
+		}
+	}
+	for path, cidrList := range roles {
+		resp := request(logical.ReadOperation, path, nil)
+		if resp == nil || resp.Data["cidr_list"] != cidrList {
+			t.Fatalf("bad: %s: %#v", path, resp)
+		}
+	}
+
+	request(logical.DeleteOperation, "roles/ns/tenant1/web", nil)
+	if resp := request(logical.ReadOperation, "roles/ns/tenant1/web", nil); resp != nil {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if resp := request(logical.ReadOperation, "roles/web", nil); resp == nil {
+		t.Fatalf("bad: role in default namespace was deleted")
+	}
+
+	// Roles can only use keys of their own namespace
+	request(logical.WriteOperation, "keys/"+testKeyName, map[string]interface{}{
+		"key": testSharedPrivateKey,
+	})
+	dynamicRole := map[string]interface{}{
+		"key_type":     testDynamicKeyType,
+		"key":          testKeyName,
+		"admin_user":   testAdminUser,
+		"default_user": testAdminUser,
+		"cidr_list":    testCIDRList,
+	}
+	if resp := request(logical.WriteOperation, "roles/ns/tenant2/dynamic", dynamicRole); !resp.IsError() {
+		t.Fatalf("bad: key of default namespace was used: %#v", resp)
+	}
+	if resp := request(logical.WriteOperation, "roles/dynamic", dynamicRole); resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+}
+
+func TestSSHBackend_NamespaceReservedNames(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s: %s", path, err)
+		}
+		return resp
+	}
+
+	// Names that are also the last segment of the paths of a role or a
+	// key are still the names of roles and keys of a namespace.
+	names := []string{"test", "versions", "rollback", "revoke-all", "batch", "rotate"}
+	for _, name := range names {
+		resp := request(logical.WriteOperation, "roles/ns/tenant1/"+name, map[string]interface{}{
+			"key_type":     testOTPKeyType,
+			"default_user": testUserName,
+			"cidr_list":    testCIDRList,
+		})
+		if resp != nil && resp.IsError() {
+			t.Fatalf("bad: %s: %#v", name, resp)
+		}
+		if entry, err := storage.Get(rolePath("tenant1", name)); err != nil || entry == nil {
+			t.Fatalf("bad: %s: role not stored in namespace: %v", name, err)
+		}
+		if resp := request(logical.ReadOperation, "roles/ns/tenant1/"+name, nil); resp == nil || resp.Data["key_type"] != testOTPKeyType {
+			t.Fatalf("bad: %s: %#v", name, resp)
+		}
+		resp = request(logical.WriteOperation, "creds/ns/tenant1/"+name, map[string]interface{}{"ip": testIP})
+		if resp == nil || resp.IsError() || resp.Data["key_type"] != testOTPKeyType {
+			t.Fatalf("bad: %s: %#v", name, resp)
+		}
+
+		if resp := request(logical.WriteOperation, "keys/ns/tenant1/"+name, map[string]interface{}{"key": testSharedPrivateKey}); resp != nil && resp.IsError() {
+			t.Fatalf("bad: %s: %#v", name, resp)
+		}
+		if entry, err := storage.Get(keyPath("tenant1", name)); err != nil || entry == nil {
+			t.Fatalf("bad: %s: key not stored in namespace: %v", name, err)
+		}
+	}
+
+	resp := request(logical.ListOperation, "roles/ns/tenant1", nil)
+	listed := make(map[string]bool)
+	for _, name := range resp.Data["keys"].([]string) {
+		listed[name] = true
+	}
+	for _, name := range names {
+		if !listed[name] || len(listed) != len(names) {
+			t.Fatalf("bad: %#v", resp.Data["keys"])
+		}
+	}
+	if resp := request(logical.ListOperation, "roles", nil); resp != nil && len(resp.Data["keys"].([]string)) != 0 {
+		t.Fatalf("bad: roles listed in the default namespace: %#v", resp)
+	}
+}
+
+func TestSSHBackend_validateInstallScript(t *testing.T) {
+	cases := map[string]struct {
+		Script           string
+		MaxSize          int
+		RequireArguments bool
+		Err              bool
+	}{
+		"default script":       {DefaultPublicKeyInstallScript, defaultInstallScriptMaxSize, true, false},
+		"too large":            {"#!/bin/sh\necho $1 $2 $3\n", 10, false, true},
+		"blank":                {" \n\t", defaultInstallScriptMaxSize, false, true},
+		"binary":               {"#!/bin/sh\x00", defaultInstallScriptMaxSize, false, true},
+		"windows line endings": {"#!/bin/sh\r\necho $1\r\n", defaultInstallScriptMaxSize, false, true},
+		"all arguments":        {"#!/bin/sh\nfoo ${1} $2 \"$3\"\n", defaultInstallScriptMaxSize, true, false},
+		"missing argument":     {"#!/bin/sh\nfoo $1 $3\n", defaultInstallScriptMaxSize, true, true},
+		"arguments not needed": {"#!/bin/sh\nfoo\n", defaultInstallScriptMaxSize, false, false},
+		"template variables":   {"#!/bin/sh\nfoo $1 $2 {{auth_keys_file}} {{port}}\n", defaultInstallScriptMaxSize, true, false},
+		"unknown variable":     {"#!/bin/sh\nfoo {{home}}\n", defaultInstallScriptMaxSize, false, true},
+	}
+
+	for name, tc := range cases {
+		err := validateInstallScript(tc.Script, InstallScriptTypeShell, &configInstallScript{
+			MaxSize:          tc.MaxSize,
+			RequireArguments: tc.RequireArguments,
+		})
+		if (err != nil) != tc.Err {
+			t.Fatalf("bad: %s: err: %v", name, err)
+		}
+	}
+}
+
+func TestSSHBackend_KeysList(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, path := range []string{"keys/web", "keys/db01", "keys/ns/tenant1/other"} {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      map[string]interface{}{"key": testSharedPrivateKey},
+		})
+		if err != nil || resp.IsError() {
+			t.Fatalf("bad: resp: %#v err: %v", resp, err)
+		}
+	}
+
+	signer, err := ssh.ParsePrivateKey([]byte(testSharedPrivateKey))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	fingerprint := fingerprintSHA256(signer.PublicKey())
+
+	cases := map[string][]string{
+		"keys":             []string{"db01", "web"},
+		"keys/":            []string{"db01", "web"},
+		"keys/ns/tenant1/": []string{"other"},
+	}
+	for path, expected := range cases {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.ListOperation,
+			Path:      path,
+			Storage:   storage,
+		})
+		if err != nil || resp == nil {
+			t.Fatalf("bad: %s: resp: %#v err: %v", path, resp, err)
+		}
+		if !reflect.DeepEqual(resp.Data["keys"], expected) {
+			t.Fatalf("bad: %s: %#v", path, resp.Data["keys"])
+		}
+		keyInfo := resp.Data["key_info"].(map[string]interface{})
+		for _, name := range expected {
+			info := keyInfo[name].(map[string]interface{})
+			if info["fingerprint"] != fingerprint {
+				t.Fatalf("bad: %s: %#v", path, info)
+			}
+		}
+		if strings.Contains(fmt.Sprintf("%#v", resp), "PRIVATE KEY") {
+			t.Fatalf("bad: %s: private key in response: %#v", path, resp)
+		}
+	}
+}
+
+func TestSSHBackend_RolesList(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	roles := map[string]map[string]interface{}{
+		"roles/web": map[string]interface{}{
+			"key_type":     testOTPKeyType,
+			"default_user": testUserName,
+			"cidr_list":    testCIDRList,
+		},
+		"roles/users": map[string]interface{}{
+			"key_type":     "ca",
+			"default_user": testUserName,
+		},
+		"roles/ns/tenant1/db01": map[string]interface{}{
+			"key_type":     testOTPKeyType,
+			"default_user": testUserName,
+			"cidr_list":    testCIDRList,
+		},
+	}
+	for path, data := range roles {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("bad: resp: %#v err: %v", resp, err)
+		}
+	}
+
+	cases := map[string]map[string]string{
+		"roles":             map[string]string{"users": "ca", "web": "otp"},
+		"roles/":            map[string]string{"users": "ca", "web": "otp"},
+		"roles/ns/tenant1/": map[string]string{"db01": "otp"},
+	}
+	for path, expected := range cases {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.ListOperation,
+			Path:      path,
+			Storage:   storage,
+		})
+		if err != nil || resp == nil {
+			t.Fatalf("bad: %s: resp: %#v err: %v", path, resp, err)
+		}
+		keys := resp.Data["keys"].([]string)
+		if len(keys) != len(expected) {
+			t.Fatalf("bad: %s: %#v", path, keys)
+		}
+		keyInfo := resp.Data["key_info"].(map[string]interface{})
+		for _, name := range keys {
+			info := keyInfo[name].(map[string]interface{})
+			if info["key_type"] != expected[name] {
+				t.Fatalf("bad: %s: %s: %#v", path, name, info)
+			}
+		}
+	}
+}
+
+func testVerifyWrite(t *testing.T, d map[string]interface{}, expected map[string]interface{}) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.WriteOperation,
+		Path:      fmt.Sprintf("verify"),
+		Data:      d,
+		Check: func(resp *logical.Response) error {
+			var ac api.SSHVerifyResponse
+			if err := mapstructure.Decode(resp.Data, &ac); err != nil {
+				return err
+			}
+			var ex api.SSHVerifyResponse
+			if err := mapstructure.Decode(expected, &ex); err != nil {
+				return err
+			}
+
+			if ac.Message != ex.Message || ac.IP != ex.IP || ac.Username != ex.Username {
+				return fmt.Errorf("Invalid response")
+			}
+			return nil
+		},
+	}
+}
+
+func testCredsWrite(t *testing.T, name string) logicaltest.TestStep {
+	data := map[string]interface{}{
+		"ip": testIP,
+	}
+	return logicaltest.TestStep{
+		Operation: logical.WriteOperation,
+		Path:      fmt.Sprintf("creds/%s", name),
+		Data:      data,
+		Check: func(resp *logical.Response) error {
+			if resp == nil {
+				return fmt.Errorf("response is nil")
+			}
+			if resp.Data == nil {
+				return fmt.Errorf("data is nil")
+			}
+			if resp.Data["key_type"] != KeyTypeOTP {
+				return fmt.Errorf("Incorrect key_type")
+			}
+			if resp.Data["key"] == nil {
+				return fmt.Errorf("Invalid key")
+			}
+			testOTP = resp.Data["key"].(string)
+			return nil
+		},
+	}
+}
+
+func testNamedKeysRead(t *testing.T, key string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.ReadOperation,
+		Path:      fmt.Sprintf("keys/%s", testKeyName),
+		Check: func(resp *logical.Response) error {
+			if key != "" {
+				if resp == nil || resp.Data == nil {
+					return fmt.Errorf("Key missing in response")
+				}
+				var d struct {
+					Key string `mapstructure:"key"`
+				}
+				if err := mapstructure.Decode(resp.Data, &d); err != nil {
+					return err
+				}
+
+				if d.Key != key {
+					return fmt.Errorf("Key mismatch")
+				}
+			}
+			return nil
+		},
+	}
+}
+
+func testNamedKeysWrite(t *testing.T) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.WriteOperation,
+		Path:      fmt.Sprintf("keys/%s", testKeyName),
+		Data: map[string]interface{}{
+			"key": testSharedPrivateKey,
+		},
+	}
+}
+
+func testNamedKeysDelete(t *testing.T) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.DeleteOperation,
+		Path:      fmt.Sprintf("keys/%s", testKeyName),
+	}
+}
+
+func testLookupRead(t *testing.T, data map[string]interface{}, length int) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.WriteOperation,
+		Path:      "lookup",
+		Data:      data,
+		Check: func(resp *logical.Response) error {
+			if resp.Data == nil || resp.Data["roles"] == nil {
+				return fmt.Errorf("Missing roles information")
+			}
+			if len(resp.Data["roles"].([]string)) != length {
+				return fmt.Errorf("Role information incorrect")
+			}
+			return nil
+		},
+	}
+}
+
+func testRoleWrite(t *testing.T, name string, data map[string]interface{}) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.WriteOperation,
+		Path:      "roles/" + name,
+		Data:      data,
+	}
+}
+
+func testRoleRead(t *testing.T, name string, data map[string]interface{}) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.ReadOperation,
+		Path:      "roles/" + name,
+		Check: func(resp *logical.Response) error {
+			if resp == nil {
+				if data == nil {
+					return nil
+				}
+				return fmt.Errorf("bad: %#v", resp)
+			}
+			var d sshRole
+			if err := mapstructure.Decode(resp.Data, &d); err != nil {
+				return fmt.Errorf("error decoding response:%s", err)
+			}
+			if name == testOTPRoleName {
+				if d.KeyType != data["key_type"] || d.DefaultUser != data["default_user"] || d.CIDRList != data["cidr_list"] {
+					return fmt.Errorf("data mismatch. bad: %#v", resp)
+				}
+			} else {
+				if d.AdminUser != data["admin_user"] || d.CIDRList != data["cidr_list"] || d.KeyName != data["key"] || d.KeyType != data["key_type"] {
+					return fmt.Errorf("data mismatch. bad: %#v", resp)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+func testRoleDelete(t *testing.T, name string) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.DeleteOperation,
+		Path:      "roles/" + name,
+	}
+}
+
+func testNewDynamicKeyRole(t *testing.T) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.WriteOperation,
+		Path:      fmt.Sprintf("roles/%s", testDynamicRoleName),
+		Data: map[string]interface{}{
+			"key_type":       "dynamic",
+			"key":            testKeyName,
+			"admin_user":     testAdminUser,
+			"default_user":   testAdminUser,
+			"cidr_list":      testCIDRList,
+			"port":           testPort,
+			"install_script": testInstallScript,
+		},
+	}
+}
+
+func testDynamicKeyCredsCreate(t *testing.T) logicaltest.TestStep {
+	return logicaltest.TestStep{
+		Operation: logical.WriteOperation,
+		Path:      fmt.Sprintf("creds/%s", testDynamicRoleName),
+		Data: map[string]interface{}{
+			"username": testUserName,
+			"ip":       testIP,
+		},
+		Check: func(resp *logical.Response) error {
+			var d struct {
+				Key string `mapstructure:"key"`
+			}
+			if err := mapstructure.Decode(resp.Data, &d); err != nil {
+				return err
+			}
+			if d.Key == "" {
+				return fmt.Errorf("Generated key is an empty string")
+			}
+			_, err := ssh.ParsePrivateKey([]byte(d.Key))
+			if err != nil {
+				return fmt.Errorf("Generated key is invalid")
+			}
+			return nil
+		},
+	}
+}
+
+func TestSSHBackend_ExcludeCIDRList(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+	otpRole := map[string]interface{}{
+		"key_type":          testOTPKeyType,
+		"default_user":      testUserName,
+		"cidr_list":         "10.0.0.0/8",
+		"exclude_cidr_list": "not-a-cidr",
+	}
+	if resp := request(logical.WriteOperation, "roles/"+testOTPRoleName, otpRole); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	otpRole["exclude_cidr_list"] = "10.0.1.0/24"
+	if resp := request(logical.WriteOperation, "roles/"+testOTPRoleName, otpRole); resp != nil && resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	resp := request(logical.ReadOperation, "roles/"+testOTPRoleName, nil)
+	if resp.Data["exclude_cidr_list"] != "10.0.1.0/24" {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	resp = request(logical.WriteOperation, "creds/"+testOTPRoleName, map[string]interface{}{"ip": "10.0.2.1"})
+	if resp == nil || resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	resp = request(logical.WriteOperation, "creds/"+testOTPRoleName, map[string]interface{}{"ip": "10.0.1.5"})
+	if !resp.IsError() || resp.Data["error_code"] != ErrorCodeIPNotInCIDR {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	resp = request(logical.WriteOperation, "lookup", map[string]interface{}{"ip": "10.0.2.1"})
+	if !reflect.DeepEqual(resp.Data["roles"], []string{testOTPRoleName}) {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+	resp = request(logical.WriteOperation, "lookup", map[string]interface{}{"ip": "10.0.1.5"})
+	if roles := resp.Data["roles"].([]string); len(roles) != 0 {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+}
+
+func TestSSHBackend_renderInstallScript(t *testing.T) {
+	publicKey, _, err := generateRSAKeys(1024)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	opts := &installOptions{
+		Username:         testUserName,
+		Port:             2222,
+		DynamicPublicKey: publicKey,
+		InstallScript:    "{{username}} {{auth_keys_file}} {{port}} {{key_marker}}",
+	}
+	script, err := renderInstallScript(opts)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := fmt.Sprintf("%s /home/%s/.ssh/authorized_keys 2222 %s", testUserName, testUserName, fingerprintSHA256(parsed))
+	if script != expected {
+		t.Fatalf("bad: %s", script)
+	}
+
+	// Values which the shell would interpret are refused.
+	opts.Username = "vaultuser;reboot"
+	if _, err := renderInstallScript(opts); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestSSHBackend_DynamicKeyBastion(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var calls []*installOptions
+	b.installKey = func(opts *installOptions) error {
+		calls = append(calls, opts)
+		return nil
+	}
+	b.verifyKey = func(opts *installOptions) (bool, error) {
+		return false, nil
+	}
+
+	request := func(req *logical.Request) *logical.Response {
+		req.Storage = storage
+		resp, err := b.HandleRequest(req)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+	writeRole := func(data map[string]interface{}) *logical.Response {
+		return request(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      "roles/" + testDynamicRoleName,
+			Data:      data,
+		})
+	}
+
+	request(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "keys/" + testKeyName,
+		Data:      map[string]interface{}{"key": testSharedPrivateKey},
+	})
+	request(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "keys/bastionkey",
+		Data:      map[string]interface{}{"key": testSharedPrivateKey},
+	})
+
+	role := map[string]interface{}{
+		"key_type":     testDynamicKeyType,
+		"key":          testKeyName,
+		"admin_user":   testAdminUser,
+		"default_user": testAdminUser,
+		"cidr_list":    testCIDRList,
+		"bastion_host": "bastion.example.com",
+		"bastion_key":  "bastionkey",
+	}
+	if resp := writeRole(role); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	role["bastion_user"] = "jump"
+	role["bastion_key"] = "unknownkey"
+	if resp := writeRole(role); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	role["bastion_key"] = "bastionkey"
+	if resp := writeRole(role); resp != nil && resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	resp := request(&logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "roles/" + testDynamicRoleName,
+	})
+	if resp.Data["bastion_host"] != "bastion.example.com" || resp.Data["bastion_port"] != 22 {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	resp = request(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "creds/" + testDynamicRoleName,
+		Data:      map[string]interface{}{"ip": testIP},
+	})
+	if resp == nil || resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	request(logical.RevokeRequest("creds/"+testDynamicRoleName, resp.Secret, nil))
+
+	if len(calls) != 2 {
+		t.Fatalf("bad: %d calls", len(calls))
+	}
+	for _, opts := range calls {
+		if opts.BastionHost != "bastion.example.com" || opts.BastionPort != 22 ||
+			opts.BastionUser != "jump" || opts.BastionKey != testSharedPrivateKey {
+			t.Fatalf("bad: %#v", opts)
+		}
+	}
+
+	// Bastion hosts only apply to dynamic keys.
+	resp = request(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "roles/" + testOTPRoleName,
+		Data: map[string]interface{}{
+			"key_type":     testOTPKeyType,
+			"default_user": testUserName,
+			"cidr_list":    testCIDRList,
+			"bastion_host": "bastion.example.com",
+		},
+	})
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+}
+
+func TestSSHBackend_installCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vault-ssh")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, interpreter := range []string{"", "sh"} {
+		for _, status := range []int{0, 3} {
+			script := fmt.Sprintf("#!/bin/sh\nexit %d\n", status)
+			if err := ioutil.WriteFile(filepath.Join(dir, "install.sh"), []byte(script), 0600); err != nil {
+				t.Fatalf("err: %s", err)
 			}
-			_, err := ssh.ParsePrivateKey([]byte(d.Key))
-			if err != nil {
-				return fmt.Errorf("Generated key is invalid")
+			opts := &installOptions{Install: true, InstallScriptInterpreter: interpreter}
+			cmd := exec.Command("sh", "-c", installCommand(opts, "install.sh", "key.pub", "authorized_keys"))
+			cmd.Dir = dir
+			err := cmd.Run()
+
+			// The status of the command is the one of the script, and the
+			// script is removed either way.
+			if status == 0 && err != nil || status != 0 && fmt.Sprint(err) != fmt.Sprintf("exit status %d", status) {
+				t.Fatalf("bad: interpreter %q status %d: %v", interpreter, status, err)
 			}
-			return nil
+			if _, err := os.Stat(filepath.Join(dir, "install.sh")); !os.IsNotExist(err) {
+				t.Fatalf("bad: script not removed: %v", err)
+			}
+		}
+	}
+}
+
+func TestSSHBackend_PowerShellInstallScript(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var installed *installOptions
+	b.installKey = func(opts *installOptions) error {
+		installed = opts
+		return nil
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+
+	request(logical.WriteOperation, "keys/"+testKeyName, map[string]interface{}{"key": testSharedPrivateKey})
+	role := map[string]interface{}{
+		"key_type":            testDynamicKeyType,
+		"key":                 testKeyName,
+		"admin_user":          testAdminUser,
+		"default_user":        testAdminUser,
+		"cidr_list":           testCIDRList,
+		"install_script_type": "batch",
+	}
+	if resp := request(logical.WriteOperation, "roles/"+testDynamicRoleName, role); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	role["install_script_type"] = InstallScriptTypePowerShell
+	if resp := request(logical.WriteOperation, "roles/"+testDynamicRoleName, role); resp != nil && resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	resp := request(logical.ReadOperation, "roles/"+testDynamicRoleName, nil)
+	if resp.Data["install_script_type"] != InstallScriptTypePowerShell ||
+		resp.Data["install_script"] != DefaultPublicKeyInstallScriptPowerShell {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	resp = request(logical.WriteOperation, "creds/"+testDynamicRoleName, map[string]interface{}{"ip": testIP})
+	if resp == nil || resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if installed.InstallScriptType != InstallScriptTypePowerShell {
+		t.Fatalf("bad: %#v", installed)
+	}
+	if path := authorizedKeysPath(installed.InstallScriptType, testAdminUser); path != `C:\Users\`+testAdminUser+`\.ssh\authorized_keys` {
+		t.Fatalf("bad: %s", path)
+	}
+
+	// Windows line endings are fine in PowerShell scripts.
+	role["install_script"] = "param($a, $b, $c)\r\nWrite-Output $a\r\n"
+	if resp := request(logical.WriteOperation, "roles/"+testDynamicRoleName, role); resp != nil && resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+}
+
+func TestSSHBackend_powerShellCommand(t *testing.T) {
+	cmd := powerShellCommand("", "exit 1")
+	prefix := "powershell -NoProfile -NonInteractive -ExecutionPolicy Bypass -EncodedCommand "
+	if !strings.HasPrefix(cmd, prefix) {
+		t.Fatalf("bad: %s", cmd)
+	}
+	// The script is encoded as UTF-16LE.
+	if encoded := strings.TrimPrefix(cmd, prefix); encoded != "ZQB4AGkAdAAgADEA" {
+		t.Fatalf("bad: %s", encoded)
+	}
+}
+
+func TestSSHBackend_KeyOptionSpecs(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var installed string
+	b.installKey = func(opts *installOptions) error {
+		installed = opts.DynamicPublicKey
+		return nil
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+
+	request(logical.WriteOperation, "keys/"+testKeyName, map[string]interface{}{"key": testSharedPrivateKey})
+	role := map[string]interface{}{
+		"key_type":     testDynamicKeyType,
+		"key":          testKeyName,
+		"admin_user":   testAdminUser,
+		"default_user": testAdminUser,
+		"cidr_list":    testCIDRList,
+	}
+	for _, specs := range []string{"no-such-option", `from=10.0.0.0/8`, `command="ls`, "no-pty, restrict"} {
+		role["key_option_specs"] = specs
+		if resp := request(logical.WriteOperation, "roles/"+testDynamicRoleName, role); resp == nil || !resp.IsError() {
+			t.Fatalf("bad: %s: %#v", specs, resp)
+		}
+	}
+
+	specs := `no-port-forwarding,no-X11-forwarding,from="10.0.0.0/8,192.168.0.0/16"`
+	role["key_option_specs"] = specs
+	if resp := request(logical.WriteOperation, "roles/"+testDynamicRoleName, role); resp != nil && resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	resp := request(logical.ReadOperation, "roles/"+testDynamicRoleName, nil)
+	if resp.Data["key_option_specs"] != specs {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	resp = request(logical.WriteOperation, "creds/"+testDynamicRoleName, map[string]interface{}{"ip": testIP})
+	if resp == nil || resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	_, _, options, _, err := ssh.ParseAuthorizedKey([]byte(installed))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := []string{"no-port-forwarding", "no-X11-forwarding", `from="10.0.0.0/8,192.168.0.0/16"`}
+	if !reflect.DeepEqual(options, expected) {
+		t.Fatalf("bad: %#v", options)
+	}
+
+	// The options only apply to dynamic keys.
+	resp = request(logical.WriteOperation, "roles/"+testOTPRoleName, map[string]interface{}{
+		"key_type":         testOTPKeyType,
+		"default_user":     testUserName,
+		"cidr_list":        testCIDRList,
+		"key_option_specs": "no-pty",
+	})
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+}
+
+func TestSSHBackend_DynamicKeyRevokeRetry(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The fake host ignores uninstalls while it is down and its scripts
+	// don't report failures, like the real install script.
+	installed := make(map[string]bool)
+	hostDown := false
+	b.installKey = func(opts *installOptions) error {
+		if opts.Install {
+			installed[opts.DynamicPublicKey] = true
+		} else if !hostDown {
+			delete(installed, opts.DynamicPublicKey)
+		}
+		return nil
+	}
+	b.verifyKey = func(opts *installOptions) (bool, error) {
+		return installed[opts.DynamicPublicKey], nil
+	}
+
+	request := func(req *logical.Request) *logical.Response {
+		req.Storage = storage
+		resp, err := b.HandleRequest(req)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("bad: %s: resp: %#v err: %v", req.Path, resp, err)
+		}
+		return resp
+	}
+	request(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "keys/" + testKeyName,
+		Data:      map[string]interface{}{"key": testSharedPrivateKey},
+	})
+	request(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "roles/" + testDynamicRoleName,
+		Data: map[string]interface{}{
+			"key_type":     testDynamicKeyType,
+			"key":          testKeyName,
+			"admin_user":   testAdminUser,
+			"default_user": testAdminUser,
+			"cidr_list":    testCIDRList,
+		},
+	})
+	resp := request(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "creds/" + testDynamicRoleName,
+		Data:      map[string]interface{}{"ip": testIP},
+	})
+
+	// The key is left on the host, so the revocation leaves a WAL entry
+	// behind for the rollback to retry removing it.
+	hostDown = true
+	resp = request(logical.RevokeRequest("creds/"+testDynamicRoleName, resp.Secret, nil))
+	if resp == nil || len(resp.Warnings) != 1 {
+		t.Fatalf("bad: %#v", resp)
+	}
+	walIDs, err := framework.ListWAL(storage)
+	if err != nil || len(walIDs) != 1 {
+		t.Fatalf("bad: %#v err: %v", walIDs, err)
+	}
+	entry, err := framework.GetWAL(storage, walIDs[0])
+	if err != nil || entry == nil {
+		t.Fatalf("bad: %#v err: %v", entry, err)
+	}
+	if err := b.dynamicKeyRollback(&logical.Request{Storage: storage}, entry.Kind, entry.Data); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	hostDown = false
+	if err := b.dynamicKeyRollback(&logical.Request{Storage: storage}, entry.Kind, entry.Data); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(installed) != 0 {
+		t.Fatalf("bad: orphaned key: %#v", installed)
+	}
+}
+
+func TestSSHBackend_HostnameCreds(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	b.lookupHost = func(host string) ([]string, error) {
+		switch host {
+		case "web.example.com":
+			return []string{"192.168.1.1", "10.0.0.5"}, nil
+		case "db.example.com":
+			return []string{"192.168.1.2"}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+
+	role := map[string]interface{}{
+		"key_type":        testOTPKeyType,
+		"default_user":    testUserName,
+		"cidr_list":       "10.0.0.0/8",
+		"allowed_domains": "Example.com,bad_domain",
+	}
+	if resp := request(logical.WriteOperation, "roles/"+testOTPRoleName, role); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	role["allowed_domains"] = "Example.com"
+	if resp := request(logical.WriteOperation, "roles/"+testOTPRoleName, role); resp != nil && resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	resp := request(logical.ReadOperation, "roles/"+testOTPRoleName, nil)
+	if resp.Data["allowed_domains"] != "example.com" {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	// The first address allowed by the role is used.
+	resp = request(logical.WriteOperation, "creds/"+testOTPRoleName, map[string]interface{}{"hostname": "WEB.example.com."})
+	if resp == nil || resp.IsError() || resp.Data["ip"] != "10.0.0.5" || resp.Data["hostname"] != "web.example.com" {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	cases := map[string]struct {
+		Data map[string]interface{}
+		Code string
+	}{
+		"ip and hostname":      {map[string]interface{}{"ip": "10.0.0.5", "hostname": "web.example.com"}, ErrorCodeInvalidRequest},
+		"domain not allowed":   {map[string]interface{}{"hostname": "web.example.org"}, ErrorCodeHostnameNotAllowed},
+		"suffix is not domain": {map[string]interface{}{"hostname": "webexample.com"}, ErrorCodeHostnameNotAllowed},
+		"unresolved":           {map[string]interface{}{"hostname": "mail.example.com"}, ErrorCodeHostnameNotAllowed},
+		"address not in cidr":  {map[string]interface{}{"hostname": "db.example.com"}, ErrorCodeIPNotInCIDR},
+	}
+	for name, tc := range cases {
+		resp := request(logical.WriteOperation, "creds/"+testOTPRoleName, tc.Data)
+		if !resp.IsError() || resp.Data["error_code"] != tc.Code {
+			t.Fatalf("bad: %s: %#v", name, resp)
+		}
+	}
+}
+
+func TestSSHBackend_OTPStoredAsHMAC(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+
+	request("roles/"+testOTPRoleName, map[string]interface{}{
+		"key_type":     testOTPKeyType,
+		"default_user": testUserName,
+		"cidr_list":    testCIDRList,
+	})
+	resp := request("creds/"+testOTPRoleName, map[string]interface{}{"ip": testIP})
+	if resp == nil || resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	otp := resp.Data["key"].(string)
+
+	// Only the HMAC of the OTP is stored
+	keys, err := storage.List("otp/")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(keys) != 1 || strings.TrimPrefix(keys[0], "otp/") != b.salt.GetHMAC(otp) {
+		t.Fatalf("bad: %#v", keys)
+	}
+	entry, err := storage.Get(keys[0])
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if strings.Contains(keys[0], otp) || strings.Contains(string(entry.Value), otp) {
+		t.Fatalf("bad: OTP stored in plaintext: %s: %s", keys[0], entry.Value)
+	}
+	if resp := request("verify", map[string]interface{}{"otp": otp}); resp == nil || resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	// OTPs stored under their salted hash before HMACs were used still
+	// verify and are deleted on revocation.
+	legacyOTP := "legacy-otp"
+	legacyEntry, err := logical.StorageEntryJSON("otp/"+b.salt.SaltID(legacyOTP), sshOTP{
+		Username: testUserName,
+		IP:       testIP,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := storage.Put(legacyEntry); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if resp := request("verify", map[string]interface{}{"otp": legacyOTP}); resp == nil || resp.IsError() || resp.Data["username"] != testUserName {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if resp := request("verify", map[string]interface{}{"otp": legacyOTP}); resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	req := logical.RevokeRequest("creds/"+testOTPRoleName, &logical.Secret{
+		InternalData: map[string]interface{}{
+			"secret_type": SecretOTPType,
+			"otp":         legacyOTP,
 		},
+	}, nil)
+	req.Storage = storage
+	if _, err := b.HandleRequest(req); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if entry, err := storage.Get("otp_used/" + b.salt.SaltID(legacyOTP)); err != nil || entry != nil {
+		t.Fatalf("bad: %#v %v", entry, err)
+	}
+}
+
+func TestSSHBackend_OTPFormat(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := Backend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+	writeRole := func(format string, length int) *logical.Response {
+		return request(logical.WriteOperation, "roles/"+testOTPRoleName, map[string]interface{}{
+			"key_type":     testOTPKeyType,
+			"default_user": testUserName,
+			"cidr_list":    testCIDRList,
+			"otp_format":   format,
+			"otp_length":   length,
+		})
+	}
+
+	invalid := []struct {
+		Format string
+		Length int
+	}{
+		{"hex", 0},
+		{OTPFormatUUID, 10},
+		{OTPFormatNumeric, 4},
+		{OTPFormatNumeric, 8},
+		{OTPFormatBase62, 5},
+		{OTPFormatBase62, 65},
+	}
+	for _, tc := range invalid {
+		if resp := writeRole(tc.Format, tc.Length); resp == nil || !resp.IsError() {
+			t.Fatalf("bad: %s/%d: %#v", tc.Format, tc.Length, resp)
+		}
+	}
+
+	cases := []struct {
+		Format string
+		Length int
+		Regex  string
+	}{
+		{"", 0, `^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`},
+		{OTPFormatNumeric, 0, `^[0-9]{12}$`},
+		{OTPFormatNumeric, 16, `^[0-9]{16}$`},
+		{OTPFormatBase62, 6, `^[0-9A-Za-z]{6}$`},
+	}
+	for _, tc := range cases {
+		if resp := writeRole(tc.Format, tc.Length); resp != nil && resp.IsError() {
+			t.Fatalf("bad: %#v", resp)
+		}
+		resp := request(logical.WriteOperation, "creds/"+testOTPRoleName, map[string]interface{}{"ip": testIP})
+		if resp == nil || resp.IsError() {
+			t.Fatalf("bad: %#v", resp)
+		}
+		otp := resp.Data["key"].(string)
+		if !regexp.MustCompile(tc.Regex).MatchString(otp) {
+			t.Fatalf("bad: %s: %q", tc.Format, otp)
+		}
+
+		resp = request(logical.WriteOperation, "verify", map[string]interface{}{"otp": otp})
+		if resp == nil || resp.IsError() || resp.Data["username"] != testUserName {
+			t.Fatalf("bad: %#v", resp)
+		}
+	}
+
+	// Roles written when shorter numeric OTPs were allowed issue OTPs of
+	// the minimum length.
+	role := &sshRole{KeyType: KeyTypeOTP, OTPFormat: OTPFormatNumeric, OTPLength: 8}
+	if length := role.otpLength(); length != 12 {
+		t.Fatalf("bad: %d", length)
+	}
+
+	// The format only applies to OTP roles.
+	request(logical.WriteOperation, "keys/"+testKeyName, map[string]interface{}{"key": testSharedPrivateKey})
+	resp := request(logical.WriteOperation, "roles/"+testDynamicRoleName, map[string]interface{}{
+		"key_type":     testDynamicKeyType,
+		"key":          testKeyName,
+		"admin_user":   testAdminUser,
+		"default_user": testAdminUser,
+		"cidr_list":    testCIDRList,
+		"otp_format":   OTPFormatNumeric,
+	})
+	if resp == nil || !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+}
+
+func TestSSHBackend_ConfigDefaults(t *testing.T) {
+	storage := &logical.InmemStorage{}
+	b, err := newBackend(&logical.BackendConfig{View: storage})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var installed *installOptions
+	b.installKey = func(opts *installOptions) error {
+		installed = opts
+		return nil
+	}
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return resp
+	}
+
+	resp := request(logical.ReadOperation, "config/defaults", nil)
+	if resp.Data["port"] != 22 || resp.Data["key_bits"] != 2048 || resp.Data["dial_timeout"] != "15s" {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+	if resp.Data["max_connections_per_host"] != 4 || resp.Data["connection_idle_timeout"] != "1m0s" {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+	if resp.Data["dial_retries"] != 2 || resp.Data["dial_backoff"] != "1s" {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	for _, data := range []map[string]interface{}{
+		{"port": 70000},
+		{"key_bits": 1000},
+		{"key_algorithm": "dsa"},
+		{"dial_timeout": "soon"},
+		{"dial_retries": -1},
+		{"dial_backoff": "-1s"},
+		{"max_connections_per_host": -1},
+		{"connection_idle_timeout": "-1s"},
+		{"install_script": " "},
+	} {
+		if resp := request(logical.WriteOperation, "config/defaults", data); resp == nil || !resp.IsError() {
+			t.Fatalf("bad: %#v: %#v", data, resp)
+		}
+	}
+
+	script := "#!/bin/sh\necho $1 $2 $3\n"
+	resp = request(logical.WriteOperation, "config/defaults", map[string]interface{}{
+		"port":           2222,
+		"key_bits":       4096,
+		"install_script": script,
+		"dial_timeout":   "5s",
+		"dial_retries":   0,
+		"dial_backoff":   "250ms",
+
+		"max_connections_per_host": 2,
+		"connection_idle_timeout":  "10s",
+	})
+	if resp != nil && resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	request(logical.WriteOperation, "keys/"+testKeyName, map[string]interface{}{"key": testSharedPrivateKey})
+	role := map[string]interface{}{
+		"key_type":     testDynamicKeyType,
+		"key":          testKeyName,
+		"admin_user":   testAdminUser,
+		"default_user": testAdminUser,
+		"cidr_list":    testCIDRList,
+	}
+	if resp := request(logical.WriteOperation, "roles/"+testDynamicRoleName, role); resp != nil && resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	resp = request(logical.ReadOperation, "roles/"+testDynamicRoleName, nil)
+	if resp.Data["port"] != 2222 || resp.Data["key_bits"] != 4096 || resp.Data["install_script"] != script {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	resp = request(logical.WriteOperation, "creds/"+testDynamicRoleName, map[string]interface{}{"ip": testIP})
+	if resp == nil || resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if installed.DialTimeout != 5*time.Second || installed.MaxConnections != 2 || installed.IdleTimeout != 10*time.Second {
+		t.Fatalf("bad: %#v", installed)
+	}
+	if installed.DialRetries != 0 || installed.DialBackoff != 250*time.Millisecond {
+		t.Fatalf("bad: %#v", installed)
+	}
+
+	// Roles can still override the defaults.
+	role["port"] = 22
+	role["key_bits"] = 3072
+	if resp := request(logical.WriteOperation, "roles/"+testDynamicRoleName, role); resp != nil && resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	resp = request(logical.ReadOperation, "roles/"+testDynamicRoleName, nil)
+	if resp.Data["port"] != 22 || resp.Data["key_bits"] != 3072 {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+}
+
+func TestSSHBackend_DialRetries(t *testing.T) {
+	var attempts []time.Time
+	dial := func(failures int) func() (*ssh.Client, error) {
+		attempts = nil
+		return func() (*ssh.Client, error) {
+			attempts = append(attempts, time.Now())
+			if len(attempts) <= failures {
+				return nil, fmt.Errorf("connection refused")
+			}
+			return &ssh.Client{}, nil
+		}
+	}
+
+	if _, err := retryDial(2, 10*time.Millisecond, dial(0)); err != nil || len(attempts) != 1 {
+		t.Fatalf("bad: %d attempts: %v", len(attempts), err)
+	}
+	if _, err := retryDial(2, 10*time.Millisecond, dial(2)); err != nil || len(attempts) != 3 {
+		t.Fatalf("bad: %d attempts: %v", len(attempts), err)
+	}
+	// The wait doubles after each retry.
+	if wait := attempts[2].Sub(attempts[1]); wait < 20*time.Millisecond {
+		t.Fatalf("bad: waited %s", wait)
+	}
+	if _, err := retryDial(2, time.Millisecond, dial(3)); err == nil || len(attempts) != 3 {
+		t.Fatalf("bad: %d attempts: %v", len(attempts), err)
+	}
+	if _, err := retryDial(0, time.Millisecond, dial(1)); err == nil || len(attempts) != 1 {
+		t.Fatalf("bad: %d attempts: %v", len(attempts), err)
+	}
+}
+
+func TestSSHBackend_ConnPool(t *testing.T) {
+	hostKey, err := ssh.ParsePrivateKey([]byte(testSharedPrivateKey))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(hostKey)
+
+	// Connections are made to a local server that accepts any login.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			serverConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn, chans, reqs, err := ssh.NewServerConn(serverConn, serverConfig)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				go ssh.DiscardRequests(reqs)
+				for ch := range chans {
+					ch.Reject(ssh.Prohibited, "no channels")
+				}
+			}()
+		}
+	}()
+
+	pool := newConnPool()
+	pool.dial = func(opts *installOptions) (*ssh.Client, error) {
+		clientConn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		conn, chans, reqs, err := ssh.NewClientConn(clientConn, opts.IP, &ssh.ClientConfig{User: opts.AdminUser})
+		if err != nil {
+			return nil, err
+		}
+		return ssh.NewClient(conn, chans, reqs), nil
+	}
+
+	checkStats := func(expected map[string]interface{}) {
+		if stats := pool.stats(); !reflect.DeepEqual(stats, expected) {
+			t.Fatalf("bad: %#v", stats)
+		}
+	}
+
+	opts := &installOptions{AdminUser: testAdminUser, IP: testIP, Port: 22, MaxConnections: 1}
+	client, err := pool.get(opts)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Requests for the host wait for the connection in use to be released.
+	got := make(chan *ssh.Client)
+	go func() {
+		c, err := pool.get(opts)
+		if err != nil {
+			t.Errorf("err: %s", err)
+		}
+		got <- c
+	}()
+	select {
+	case <-got:
+		t.Fatalf("bad: connection limit not applied")
+	case <-time.After(100 * time.Millisecond):
+	}
+	pool.put(opts, client, true)
+	reused := <-got
+	if reused != client {
+		t.Fatalf("bad: connection not reused")
+	}
+	checkStats(map[string]interface{}{"dials": 1, "reuses": 1, "waits": 1, "in_use": 1, "idle": 0})
+
+	// Other hosts don't share the limit nor the connections.
+	other := &installOptions{AdminUser: testAdminUser, IP: "127.0.0.2", Port: 22, MaxConnections: 1}
+	otherClient, err := pool.get(other)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	pool.put(other, otherClient, true)
+	checkStats(map[string]interface{}{"dials": 2, "reuses": 1, "waits": 1, "in_use": 1, "idle": 1})
+
+	// Connections that failed are closed instead of reused.
+	pool.put(opts, reused, false)
+	checkStats(map[string]interface{}{"dials": 2, "reuses": 1, "waits": 1, "in_use": 0, "idle": 1})
+	if _, _, err := reused.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+		t.Fatalf("bad: connection not closed")
+	}
+
+	// Requests give up waiting for a connection after a while.
+	client, err = pool.get(opts)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	pool.waitTimeout = 10 * time.Millisecond
+	if _, err := pool.get(opts); err == nil {
+		t.Fatalf("expected error")
+	}
+	checkStats(map[string]interface{}{"dials": 3, "reuses": 1, "waits": 2, "in_use": 1, "idle": 1})
+
+	// Idle connections are closed once the idle timeout passes, even if
+	// their host isn't contacted again.
+	opts.IdleTimeout = time.Millisecond
+	pool.put(opts, client, true)
+	time.Sleep(10 * time.Millisecond)
+	checkStats(map[string]interface{}{"dials": 3, "reuses": 1, "waits": 2, "in_use": 0, "idle": 1})
+	if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+		t.Fatalf("bad: connection not closed")
+	}
+	client, err = pool.get(opts)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	pool.put(opts, client, false)
+	checkStats(map[string]interface{}{"dials": 4, "reuses": 1, "waits": 2, "in_use": 0, "idle": 1})
+
+	// Connections used for longer than the command timeout are closed.
+	client, err = pool.get(opts)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	timedOut := closeAfter(client, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	if !timedOut() {
+		t.Fatalf("bad: timeout not reported")
+	}
+	if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+		t.Fatalf("bad: connection not closed")
+	}
+	pool.put(opts, client, false)
+	if timedOut = closeAfter(client, time.Minute); timedOut() {
+		t.Fatalf("bad: timeout reported")
+	}
+
+	// The pool is reported along with the metrics.
+	b, err := newBackend(&logical.BackendConfig{View: &logical.InmemStorage{}})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "metrics",
+		Storage:   &logical.InmemStorage{},
+	})
+	if err != nil || resp == nil {
+		t.Fatalf("bad: resp: %#v err: %v", resp, err)
+	}
+	if _, ok := resp.Data["connection_pool"].(map[string]interface{}); !ok {
+		t.Fatalf("bad: %#v", resp.Data)
 	}
 }
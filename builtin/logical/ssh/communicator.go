@@ -57,6 +57,12 @@ func SSHCommNew(address string, config *SSHCommConfig) (result *comm, err error)
 	return
 }
 
+// Creates a communicator over a client that is already logged in. It doesn't
+// reconnect if the client fails, since the client is owned by the caller.
+func sshCommFromClient(client *ssh.Client) *comm {
+	return &comm{client: client}
+}
+
 func (c *comm) Upload(path string, input io.Reader, fi *os.FileInfo) error {
 	// The target directory and file for talking the SCP protocol
 	target_dir := filepath.Dir(path)
@@ -81,6 +87,10 @@ func (c *comm) newSession() (session *ssh.Session, err error) {
 		session, err = c.client.NewSession()
 	}
 
+	if err != nil && c.config == nil {
+		return nil, err
+	}
+
 	if err != nil {
 		log.Printf("ssh session open error: '%s', attempting reconnect", err)
 		if err := c.reconnect(); err != nil {
@@ -0,0 +1,279 @@
+package ssh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"golang.org/x/crypto/ssh"
+)
+
+// Defaults of the connection pool, unless they are configured otherwise.
+const (
+	defaultMaxConnectionsPerHost = 4
+	defaultConnectionIdleTimeout = time.Minute
+)
+
+// connectionWaitTimeout is how long a request waits for a connection to a
+// host whose connections are all in use.
+const connectionWaitTimeout = time.Minute
+
+// connPool keeps the admin connections to remote hosts open for a while
+// after they are used, so that bursts of requests for the same host reuse
+// them instead of logging in again each time. It also limits how many
+// connections are used at once for each host.
+type connPool struct {
+	lock    sync.Mutex
+	targets map[string]*poolTarget
+
+	// dial logs in to a remote host. It is replaced in tests.
+	dial func(opts *installOptions) (*ssh.Client, error)
+
+	// waitTimeout is how long get waits for a connection to be released.
+	waitTimeout time.Duration
+
+	// reaper closes the idle connections once the first of them expires,
+	// so that connections to hosts that aren't used again are closed too.
+	// It is nil when there are no idle connections.
+	reaper *time.Timer
+
+	// Counters of the connections opened, reused and of the requests that
+	// had to wait for a connection to be released.
+	dials  int
+	reuses int
+	waits  int
+}
+
+// poolTarget holds the connections to one remote host with one set of
+// admin credentials.
+type poolTarget struct {
+	inUse    int
+	idle     []*idleClient
+	released *sync.Cond
+}
+
+type idleClient struct {
+	client  *ssh.Client
+	expires time.Time
+}
+
+func newConnPool() *connPool {
+	return &connPool{
+		targets:     make(map[string]*poolTarget),
+		dial:        dialSSHPublicKeysClient,
+		waitTimeout: connectionWaitTimeout,
+	}
+}
+
+// Returns the key of the connections that can be shared by requests with
+// the options. Certificates of the admin key aren't part of it, since they
+// are only presented when logging in.
+func poolKey(opts *installOptions) string {
+	h := sha256.New()
+	for _, v := range []string{
+		opts.AdminUser, opts.IP, strconv.Itoa(opts.Port),
+		opts.HostKey, opts.HostPassword, opts.HostKeyFingerprint,
+		opts.BastionHost, strconv.Itoa(opts.BastionPort), opts.BastionUser,
+		opts.BastionKey, opts.BastionPassword,
+	} {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns a connection to the remote host of the options, waiting for one
+// to be released if MaxConnections of them are in use. An error is returned
+// if none is released in time. Idle connections are reused if they are
+// still alive. The connection must be handed back with put.
+func (p *connPool) get(opts *installOptions) (*ssh.Client, error) {
+	key := poolKey(opts)
+	maxConns := opts.MaxConnections
+	if maxConns <= 0 {
+		maxConns = defaultMaxConnectionsPerHost
+	}
+
+	p.lock.Lock()
+	p.closeExpired(time.Now())
+	t, ok := p.targets[key]
+	if !ok {
+		t = &poolTarget{released: sync.NewCond(&p.lock)}
+		p.targets[key] = t
+	}
+	if t.inUse >= maxConns {
+		p.waits++
+		metrics.IncrCounter([]string{"ssh", "pool", "waits"}, 1)
+
+		// Waiters are woken up when the wait times out, since the
+		// condition can't wait with a deadline itself.
+		deadline := time.Now().Add(p.waitTimeout)
+		timer := time.AfterFunc(p.waitTimeout, func() {
+			p.lock.Lock()
+			defer p.lock.Unlock()
+			t.released.Broadcast()
+		})
+		for t.inUse >= maxConns && time.Now().Before(deadline) {
+			t.released.Wait()
+		}
+		timer.Stop()
+		if t.inUse >= maxConns {
+			p.lock.Unlock()
+			return nil, fmt.Errorf("timed out waiting for one of the %d connections to the target to be released", maxConns)
+		}
+	}
+	t.inUse++
+	p.lock.Unlock()
+
+	// The most recently used connections are the most likely to be alive.
+	// The target isn't removed from the pool while it has connections in
+	// use.
+	for {
+		p.lock.Lock()
+		if len(t.idle) == 0 {
+			p.lock.Unlock()
+			break
+		}
+		c := t.idle[len(t.idle)-1]
+		t.idle = t.idle[:len(t.idle)-1]
+		p.lock.Unlock()
+
+		if _, _, err := c.client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+			p.lock.Lock()
+			p.reuses++
+			p.lock.Unlock()
+			metrics.IncrCounter([]string{"ssh", "pool", "reuses"}, 1)
+			return c.client, nil
+		}
+		c.client.Close()
+	}
+
+	client, err := p.dial(opts)
+	if err != nil {
+		p.release(key)
+		return nil, err
+	}
+	p.lock.Lock()
+	p.dials++
+	p.lock.Unlock()
+	metrics.IncrCounter([]string{"ssh", "pool", "dials"}, 1)
+	return client, nil
+}
+
+// Hands back a connection obtained with get. Connections that failed are
+// closed rather than kept for reuse.
+func (p *connPool) put(opts *installOptions, client *ssh.Client, healthy bool) {
+	key := poolKey(opts)
+	idleTimeout := opts.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultConnectionIdleTimeout
+	}
+
+	p.lock.Lock()
+	t, ok := p.targets[key]
+	if ok && healthy && idleTimeout > 0 {
+		t.idle = append(t.idle, &idleClient{client: client, expires: time.Now().Add(idleTimeout)})
+		client = nil
+		p.scheduleReap()
+	}
+	p.lock.Unlock()
+
+	if client != nil {
+		client.Close()
+	}
+	p.release(key)
+}
+
+// Releases the slot of a connection of the target, waking up the requests
+// waiting for one.
+func (p *connPool) release(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	t, ok := p.targets[key]
+	if !ok {
+		return
+	}
+	t.inUse--
+	t.released.Broadcast()
+	if t.inUse == 0 && len(t.idle) == 0 {
+		delete(p.targets, key)
+	}
+}
+
+// Closes the connections that have been idle for longer than the idle
+// timeout they were handed back with. The caller must hold the lock.
+func (p *connPool) closeExpired(now time.Time) {
+	for key, t := range p.targets {
+		kept := t.idle[:0]
+		for _, c := range t.idle {
+			if c.expires.After(now) {
+				kept = append(kept, c)
+				continue
+			}
+			go c.client.Close()
+		}
+		t.idle = kept
+		if t.inUse == 0 && len(t.idle) == 0 {
+			delete(p.targets, key)
+		}
+	}
+}
+
+// Schedules the reaper for when the first idle connection expires, or
+// stops it if there are none. The caller must hold the lock.
+func (p *connPool) scheduleReap() {
+	var next time.Time
+	for _, t := range p.targets {
+		for _, c := range t.idle {
+			if next.IsZero() || c.expires.Before(next) {
+				next = c.expires
+			}
+		}
+	}
+	if next.IsZero() {
+		if p.reaper != nil {
+			p.reaper.Stop()
+			p.reaper = nil
+		}
+		return
+	}
+
+	wait := next.Sub(time.Now())
+	if p.reaper == nil {
+		p.reaper = time.AfterFunc(wait, p.reap)
+	} else {
+		p.reaper.Reset(wait)
+	}
+}
+
+// Closes the expired idle connections and schedules the next run for the
+// ones left.
+func (p *connPool) reap() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closeExpired(time.Now())
+	p.scheduleReap()
+}
+
+// Returns the counters of the pool along with the number of connections in
+// use and idle.
+func (p *connPool) stats() map[string]interface{} {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	inUse, idle := 0, 0
+	for _, t := range p.targets {
+		inUse += t.inUse
+		idle += len(t.idle)
+	}
+	return map[string]interface{}{
+		"dials":  p.dials,
+		"reuses": p.reuses,
+		"waits":  p.waits,
+		"in_use": inUse,
+		"idle":   idle,
+	}
+}
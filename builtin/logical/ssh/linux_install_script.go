@@ -6,7 +6,7 @@ const (
 	DefaultPublicKeyInstallScript = `
 #!/bin/bash
 #
-# This is a default script which installs or uninstalls an RSA public key to/from
+# This is a default script which installs or uninstalls a public key to/from
 # authoried_keys file in a typical linux machine. 
 # 
 # If the platform differs or if the binaries used in this script are not available
@@ -23,6 +23,9 @@ const (
 # $3:AUTH_KEYS_FILE: Absolute path of the authorized_keys file.
 # Currently, vault uses /home/<username>/.ssh/authorized_keys as the path.
 #
+# Custom scripts can also use the 'username', 'auth_keys_file', 'key_marker' and
+# 'port' template variables, which Vault renders before running the script.
+#
 # [Note: This script will be run by Vault using the registered admin username.
 # Notice that some commands below are run as 'sudo'. For graceful execution of
 # this script there should not be any password prompts. So, disable password
@@ -0,0 +1,63 @@
+package ssh
+
+import (
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// Roles and keys can be stored under a namespace to segment the storage of
+// a single mount. The default, empty, namespace uses the original layout of
+// 'roles/<name>' and 'keys/<name>'. Other namespaces are stored under
+// 'ns/<namespace>/'.
+
+// Optional path segments that select the namespace of a path, as in
+// 'roles/ns/<namespace>/<role>'. The fixed 'ns/' keeps the namespace from
+// being mistaken for a role or key name, so that 'roles/ns/tenant1/test' is
+// the role 'test' of namespace 'tenant1' and not the 'test' path of a role.
+var namespacePathRegex = "(?:ns/" + framework.GenericNameRegex("namespace") + "/)?"
+
+// Optional path suffix of the list paths that selects the namespace, as in
+// 'roles/ns/<namespace>/'.
+var namespaceListPathRegex = "(?:/ns/" + framework.GenericNameRegex("namespace") + ")?/?"
+
+var namespaceField = &framework.FieldSchema{
+	Type: framework.TypeString,
+	Description: `
+	[Optional] Namespace of the roles and keys. The default namespace is used
+	if it is empty.`,
+}
+
+// Returns the storage prefix of the namespace.
+func namespacePrefix(namespace string) string {
+	if namespace == "" {
+		return ""
+	}
+	return "ns/" + namespace + "/"
+}
+
+// Returns the storage path of the role in the namespace.
+func rolePath(namespace, name string) string {
+	return namespacePrefix(namespace) + "roles/" + name
+}
+
+// Returns the storage prefix of the previous versions of the role in the
+// namespace.
+func roleVersionsPath(namespace, name string) string {
+	return namespacePrefix(namespace) + "role_versions/" + name + "/"
+}
+
+// Returns the storage path of the key in the namespace.
+func keyPath(namespace, name string) string {
+	return namespacePrefix(namespace) + "keys/" + name
+}
+
+// Returns the storage prefix of the dynamic keys issued by the role in the
+// namespace.
+func issuedKeysPath(namespace, roleName string) string {
+	return namespacePrefix(namespace) + "issued/" + roleName + "/"
+}
+
+// Returns the storage prefix of the issuance log of the role in the
+// namespace.
+func issuanceLogPath(namespace, roleName string) string {
+	return namespacePrefix(namespace) + "issuance_log/" + roleName + "/"
+}
@@ -0,0 +1,198 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultCAKeyBits is the length of the CA keys generated by Vault.
+const defaultCAKeyBits = 4096
+
+// configCA is the key used to sign the public keys submitted to CA roles.
+type configCA struct {
+	PrivateKey string `json:"private_key"`
+	PublicKey  string `json:"public_key"`
+}
+
+func pathConfigCA(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/ca",
+		Fields:  caKeyFields(),
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:   b.pathConfigCARead,
+			logical.WriteOperation:  b.pathConfigCAWrite,
+			logical.DeleteOperation: b.pathConfigCADelete,
+		},
+
+		HelpSynopsis:    pathConfigCAHelpSyn,
+		HelpDescription: pathConfigCAHelpDesc,
+	}
+}
+
+// Returns the fields of the paths that configure a CA key.
+func caKeyFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		"private_key": &framework.FieldSchema{
+			Type: framework.TypeString,
+			Description: `[Optional] Private key of the CA, in PEM format. Required unless
+			'generate_signing_key' is set.`,
+		},
+		"public_key": &framework.FieldSchema{
+			Type: framework.TypeString,
+			Description: `[Optional] Public key of the CA, in OpenSSH format. If given, it
+			must match the private key.`,
+		},
+		"generate_signing_key": &framework.FieldSchema{
+			Type: framework.TypeBool,
+			Description: `[Optional] Generate the CA key in Vault instead of importing one.
+			Its private key is never returned.`,
+		},
+		"key_bits": &framework.FieldSchema{
+			Type:        framework.TypeInt,
+			Default:     defaultCAKeyBits,
+			Description: "[Optional] Length of the generated RSA key. Defaults to 4096.",
+		},
+	}
+}
+
+func (b *backend) pathConfigCARead(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	ca, err := b.CA(req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if ca == nil {
+		return nil, nil
+	}
+
+	// The private key is never returned.
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"public_key": ca.PublicKey,
+		},
+	}, nil
+}
+
+func (b *backend) pathConfigCAWrite(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	return writeCA(req.Storage, d, "config/ca")
+}
+
+// Stores the CA key given by the fields of caKeyFields at the path of the
+// storage, generating it if asked to.
+func writeCA(s logical.Storage, d *framework.FieldData, storagePath string) (*logical.Response, error) {
+	privateKey := d.Get("private_key").(string)
+	publicKey := d.Get("public_key").(string)
+	generate := d.Get("generate_signing_key").(bool)
+
+	var resp *logical.Response
+	switch {
+	case generate && (privateKey != "" || publicKey != ""):
+		return logical.ErrorResponse("Keys can't be given when generate_signing_key is set"), nil
+	case generate:
+		keyBits := d.Get("key_bits").(int)
+		if err := validateRSAKeyBits(keyBits); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid key_bits: %s", err)), nil
+		}
+		var err error
+		if _, privateKey, err = generateRSAKeys(keyBits); err != nil {
+			return nil, err
+		}
+	case privateKey == "":
+		return logical.ErrorResponse("Missing private_key"), nil
+	}
+
+	signer, err := ssh.ParsePrivateKey([]byte(privateKey))
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid private_key: %s", err)), nil
+	}
+	caPublicKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+
+	if publicKey != "" {
+		parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid public_key: %s", err)), nil
+		}
+		if !bytes.Equal(parsed.Marshal(), signer.PublicKey().Marshal()) {
+			return logical.ErrorResponse("public_key doesn't match private_key"), nil
+		}
+	}
+
+	// The public key of a generated CA is returned, as it isn't known
+	// otherwise.
+	if generate {
+		resp = &logical.Response{
+			Data: map[string]interface{}{
+				"public_key": caPublicKey,
+			},
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON(storagePath, &configCA{
+		PrivateKey: privateKey,
+		PublicKey:  caPublicKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create storage entry JSON: %s", err)
+	}
+
+	if err := s.Put(entry); err != nil {
+		return nil, fmt.Errorf("could not store JSON: %s", err)
+	}
+
+	return resp, nil
+}
+
+func (b *backend) pathConfigCADelete(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	return nil, req.Storage.Delete("config/ca")
+}
+
+// CA returns the CA key of the backend, or nil if it isn't configured.
+func (b *backend) CA(s logical.Storage) (*configCA, error) {
+	return readCA(s, "config/ca")
+}
+
+// Returns the CA key stored at the path of the storage, or nil if there is
+// none.
+func readCA(s logical.Storage, storagePath string) (*configCA, error) {
+	entry, err := s.Get(storagePath)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result configCA
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+const pathConfigCAHelpSyn = `
+Configure the CA key used to sign the public keys of users and hosts.
+`
+
+const pathConfigCAHelpDesc = `
+The CA key is used by the roles of 'ca' type to sign the public keys submitted
+to the 'sign' endpoint. Hosts that trust the public key of the CA, for example
+through the 'TrustedUserCAKeys' option of OpenSSH, accept the certificates
+without keys having to be installed in them. Likewise, clients that trust it
+accept the hosts that present host certificates signed by it.
+
+The CA key is either imported, by writing its 'private_key' and optionally its
+'public_key', or generated by Vault with 'generate_signing_key'. The public key
+of a generated CA is returned by the write. Writing replaces the existing CA
+key, and deleting this path removes it, after which nothing is signed until a
+new one is configured. Certificates signed by a replaced key remain valid
+until they expire for the hosts that still trust it.
+
+Reading this path returns the public key of the CA. The private key is never
+returned.
+`
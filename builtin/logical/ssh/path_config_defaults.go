@@ -0,0 +1,256 @@
+package ssh
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// defaultDialTimeout is the timeout of connections to remote hosts, unless
+// it is configured otherwise.
+const defaultDialTimeout = 15 * time.Second
+
+// Defaults of the retries of failed connections to remote hosts.
+const (
+	defaultDialRetries = 2
+	defaultDialBackoff = time.Second
+)
+
+// configDefaults holds the values that roles inherit when they are written
+// without setting them, and the settings of connections to remote hosts.
+type configDefaults struct {
+	Port          int           `json:"port"`
+	KeyBits       int           `json:"key_bits"`
+	KeyAlgorithm  string        `json:"key_algorithm"`
+	InstallScript string        `json:"install_script"`
+	DialTimeout   time.Duration `json:"dial_timeout"`
+	DialRetries   int           `json:"dial_retries"`
+	DialBackoff   time.Duration `json:"dial_backoff"`
+
+	MaxConnectionsPerHost int           `json:"max_connections_per_host"`
+	ConnectionIdleTimeout time.Duration `json:"connection_idle_timeout"`
+}
+
+func pathConfigDefaults(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/defaults",
+		Fields: map[string]*framework.FieldSchema{
+			"port": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: "[Optional] Default port of the roles. Defaults to 22.",
+			},
+			"key_bits": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: "[Optional] Default length of the RSA keys of dynamic roles. Defaults to 2048.",
+			},
+			"key_algorithm": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "[Optional] Default algorithm of the keys of dynamic roles. Defaults to 'rsa'.",
+			},
+			"install_script": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `[Optional] Default install script of dynamic roles with shell
+				install scripts. Defaults to the built-in script.`,
+			},
+			"dial_timeout": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: `[Optional] Timeout of connections to remote hosts, e.g. "30s". Defaults to 15s.`,
+			},
+			"dial_retries": &framework.FieldSchema{
+				Type:    framework.TypeInt,
+				Default: defaultDialRetries,
+				Description: `[Optional] Number of times that a failed connection to a remote
+				host is retried. Defaults to 2.`,
+			},
+			"dial_backoff": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `[Optional] Wait before the first retry of a failed connection,
+				e.g. "500ms". The wait doubles after each retry. Defaults to 1s.`,
+			},
+			"max_connections_per_host": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `[Optional] Number of connections to a remote host that are used
+				at once to install and remove dynamic keys. Further requests for the host
+				wait for one of them to be released. Defaults to 4.`,
+			},
+			"connection_idle_timeout": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `[Optional] How long connections to remote hosts are kept open
+				for reuse after they are released, e.g. "30s". Defaults to 1m.`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:  b.pathConfigDefaultsRead,
+			logical.WriteOperation: b.pathConfigDefaultsWrite,
+		},
+
+		HelpSynopsis:    pathConfigDefaultsHelpSyn,
+		HelpDescription: pathConfigDefaultsHelpDesc,
+	}
+}
+
+func (b *backend) pathConfigDefaultsRead(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	conf, err := b.DefaultsConfig(req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"port":           conf.Port,
+			"key_bits":       conf.KeyBits,
+			"key_algorithm":  conf.KeyAlgorithm,
+			"install_script": conf.InstallScript,
+			"dial_timeout":   conf.DialTimeout.String(),
+			"dial_retries":   conf.DialRetries,
+			"dial_backoff":   conf.DialBackoff.String(),
+
+			"max_connections_per_host": conf.MaxConnectionsPerHost,
+			"connection_idle_timeout":  conf.ConnectionIdleTimeout.String(),
+		},
+	}, nil
+}
+
+func (b *backend) pathConfigDefaultsWrite(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	conf := defaultConfigDefaults()
+
+	if port := d.Get("port").(int); port != 0 {
+		if port < 0 || port > 65535 {
+			return logical.ErrorResponse("Invalid 'port'"), nil
+		}
+		conf.Port = port
+	}
+
+	if keyAlgorithm := d.Get("key_algorithm").(string); keyAlgorithm != "" {
+		if keyAlgorithm != KeyAlgorithmRSA && keyAlgorithm != KeyAlgorithmECDSAP256 {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid 'key_algorithm' '%s'", keyAlgorithm)), nil
+		}
+		conf.KeyAlgorithm = keyAlgorithm
+	}
+
+	if keyBits := d.Get("key_bits").(int); keyBits != 0 {
+		if err := validateRSAKeyBits(keyBits); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid 'key_bits'. %s", err)), nil
+		}
+		conf.KeyBits = keyBits
+	}
+
+	if installScript := d.Get("install_script").(string); installScript != "" {
+		scriptConf, err := b.InstallScriptConfig(req.Storage)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateInstallScript(installScript, InstallScriptTypeShell, scriptConf); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid 'install_script'. %s", err)), nil
+		}
+		conf.InstallScript = installScript
+	}
+
+	dialTimeout, err := d.GetDuration("dial_timeout")
+	if err != nil || dialTimeout < 0 {
+		return logical.ErrorResponse("Invalid 'dial_timeout'"), nil
+	}
+	if dialTimeout != 0 {
+		conf.DialTimeout = dialTimeout
+	}
+
+	dialRetries := d.Get("dial_retries").(int)
+	if dialRetries < 0 {
+		return logical.ErrorResponse("Invalid 'dial_retries'"), nil
+	}
+	conf.DialRetries = dialRetries
+
+	dialBackoff, err := d.GetDuration("dial_backoff")
+	if err != nil || dialBackoff < 0 {
+		return logical.ErrorResponse("Invalid 'dial_backoff'"), nil
+	}
+	if dialBackoff != 0 {
+		conf.DialBackoff = dialBackoff
+	}
+
+	if maxConns := d.Get("max_connections_per_host").(int); maxConns != 0 {
+		if maxConns < 0 {
+			return logical.ErrorResponse("Invalid 'max_connections_per_host'"), nil
+		}
+		conf.MaxConnectionsPerHost = maxConns
+	}
+
+	idleTimeout, err := d.GetDuration("connection_idle_timeout")
+	if err != nil || idleTimeout < 0 {
+		return logical.ErrorResponse("Invalid 'connection_idle_timeout'"), nil
+	}
+	if idleTimeout != 0 {
+		conf.ConnectionIdleTimeout = idleTimeout
+	}
+
+	entry, err := logical.StorageEntryJSON("config/defaults", conf)
+	if err != nil {
+		return nil, fmt.Errorf("could not create storage entry JSON: %s", err)
+	}
+
+	if err := req.Storage.Put(entry); err != nil {
+		return nil, fmt.Errorf("could not store JSON: %s", err)
+	}
+
+	return nil, nil
+}
+
+// Returns the defaults used when they aren't configured.
+func defaultConfigDefaults() *configDefaults {
+	return &configDefaults{
+		Port:          22,
+		KeyBits:       defaultRSAKeyBits,
+		KeyAlgorithm:  KeyAlgorithmRSA,
+		InstallScript: DefaultPublicKeyInstallScript,
+		DialTimeout:   defaultDialTimeout,
+		DialRetries:   defaultDialRetries,
+		DialBackoff:   defaultDialBackoff,
+
+		MaxConnectionsPerHost: defaultMaxConnectionsPerHost,
+		ConnectionIdleTimeout: defaultConnectionIdleTimeout,
+	}
+}
+
+// DefaultsConfig returns the defaults inherited by roles. The built-in
+// defaults are returned if they aren't configured.
+func (b *backend) DefaultsConfig(s logical.Storage) (*configDefaults, error) {
+	entry, err := s.Get("config/defaults")
+	if err != nil {
+		return nil, err
+	}
+
+	result := defaultConfigDefaults()
+	if entry == nil {
+		return result, nil
+	}
+
+	if err := entry.DecodeJSON(result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+const pathConfigDefaultsHelpSyn = `
+Configure the defaults inherited by roles.
+`
+
+const pathConfigDefaultsHelpDesc = `
+This configures the values that roles get when they are written without
+setting them: the 'port' of the roles, and the 'key_bits', 'key_algorithm'
+and 'install_script' of dynamic roles. The default install script only applies
+to roles with 'shell' install scripts. The defaults are applied when a role is
+written, so changing them doesn't change existing roles until they are written
+again.
+
+The 'dial_timeout' is the timeout of the connections to remote hosts, and to
+bastion hosts, when dynamic keys are installed or removed. Connections that
+fail are retried 'dial_retries' times, waiting 'dial_backoff' before the first
+retry and twice as long before each of the next ones. The connections are
+kept open for 'connection_idle_timeout' after they are used, so that requests
+for the same host reuse them, and at most 'max_connections_per_host' of them
+are used at once for each host.
+`
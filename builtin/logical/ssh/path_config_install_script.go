@@ -0,0 +1,170 @@
+package ssh
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// defaultInstallScriptMaxSize is the maximum size of install scripts in
+// bytes, unless it is configured otherwise.
+const defaultInstallScriptMaxSize = 64 * 1024
+
+type configInstallScript struct {
+	MaxSize          int  `json:"max_size"`
+	RequireArguments bool `json:"require_arguments"`
+}
+
+func pathConfigInstallScript(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/install_script",
+		Fields: map[string]*framework.FieldSchema{
+			"max_size": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: "[Optional] Maximum size of install scripts in bytes. Defaults to 65536.",
+			},
+			"require_arguments": &framework.FieldSchema{
+				Type:        framework.TypeBool,
+				Description: "[Optional] Require install scripts to use all the arguments passed to them.",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:  b.pathConfigInstallScriptRead,
+			logical.WriteOperation: b.pathConfigInstallScriptWrite,
+		},
+
+		HelpSynopsis:    pathConfigInstallScriptHelpSyn,
+		HelpDescription: pathConfigInstallScriptHelpDesc,
+	}
+}
+
+func (b *backend) pathConfigInstallScriptRead(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	conf, err := b.InstallScriptConfig(req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"max_size":          conf.MaxSize,
+			"require_arguments": conf.RequireArguments,
+		},
+	}, nil
+}
+
+func (b *backend) pathConfigInstallScriptWrite(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	maxSize := d.Get("max_size").(int)
+	if maxSize < 0 {
+		return logical.ErrorResponse("Invalid 'max_size'"), nil
+	}
+	if maxSize == 0 {
+		maxSize = defaultInstallScriptMaxSize
+	}
+
+	entry, err := logical.StorageEntryJSON("config/install_script", &configInstallScript{
+		MaxSize:          maxSize,
+		RequireArguments: d.Get("require_arguments").(bool),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create storage entry JSON: %s", err)
+	}
+
+	if err := req.Storage.Put(entry); err != nil {
+		return nil, fmt.Errorf("could not store JSON: %s", err)
+	}
+
+	return nil, nil
+}
+
+// InstallScriptConfig returns the configuration for validating install
+// scripts. The defaults are returned if it isn't configured.
+func (b *backend) InstallScriptConfig(s logical.Storage) (*configInstallScript, error) {
+	entry, err := s.Get("config/install_script")
+	if err != nil {
+		return nil, err
+	}
+
+	result := configInstallScript{MaxSize: defaultInstallScriptMaxSize}
+	if entry == nil {
+		return &result, nil
+	}
+
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// Matches a reference to one of the positional arguments of a script,
+// either as $N or ${N}.
+var scriptArgRegex = regexp.MustCompile(`\$(?:([1-9])|\{([1-9])\})`)
+
+// Validates a custom install script of the given type against the
+// configuration. The built-in scripts are always valid and are not checked.
+// The line endings and the arguments are only checked for shell scripts.
+func validateInstallScript(script, scriptType string, conf *configInstallScript) error {
+	if len(script) > conf.MaxSize {
+		return fmt.Errorf("script is %d bytes, which is more than the maximum of %d bytes", len(script), conf.MaxSize)
+	}
+	if strings.TrimSpace(script) == "" {
+		return fmt.Errorf("script is blank")
+	}
+	if strings.IndexByte(script, 0) != -1 {
+		return fmt.Errorf("script contains NUL bytes; it must be a text file")
+	}
+	if scriptType == InstallScriptTypeShell && strings.Contains(script, "\r\n") {
+		return fmt.Errorf("script has Windows line endings, which break it on Linux hosts")
+	}
+	if err := validateInstallScriptVars(script); err != nil {
+		return err
+	}
+
+	if conf.RequireArguments && scriptType == InstallScriptTypeShell {
+		used := make(map[string]bool)
+		for _, match := range scriptArgRegex.FindAllStringSubmatch(script, -1) {
+			used[match[1]+match[2]] = true
+		}
+		if strings.Contains(script, "{{auth_keys_file}}") {
+			used["3"] = true
+		}
+		args := []struct{ n, name string }{
+			{"1", "install option"},
+			{"2", "public key file"},
+			{"3", "authorized_keys file"},
+		}
+		for _, arg := range args {
+			if !used[arg.n] {
+				return fmt.Errorf("script doesn't use the %s argument ($%s)", arg.name, arg.n)
+			}
+		}
+	}
+
+	return nil
+}
+
+const pathConfigInstallScriptHelpSyn = `
+Configure the validation of install scripts of dynamic roles.
+`
+
+const pathConfigInstallScriptHelpDesc = `
+This configures how the 'install_script' of dynamic roles is validated when a
+role is written. Scripts larger than 'max_size' bytes are rejected, as are
+scripts that are blank, contain NUL bytes, have Windows line endings or refer
+to unknown template variables.
+
+If 'require_arguments' is set, scripts must also use each of the arguments the
+backend runs them with: the install option ($1), the file holding the public
+key ($2) and the path of the authorized_keys file ($3). The path of the
+authorized_keys file can also be used through the '{{auth_keys_file}}'
+variable.
+
+PowerShell scripts may have Windows line endings and they are not checked for
+the use of the arguments.
+
+The built-in install scripts are always valid.
+`
@@ -0,0 +1,178 @@
+package ssh
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// zeroAddressRoles are the OTP roles that issue credentials for any IP,
+// regardless of their CIDR blocks. Roles of a namespace are listed as
+// '<namespace>/<role>'.
+type zeroAddressRoles struct {
+	Roles []string `json:"roles"`
+}
+
+// Entries of the zero-address roles list.
+var zeroAddressRoleRegex = regexp.MustCompile("^(?:" + framework.GenericNameRegex("namespace") + "/)?" + framework.GenericNameRegex("role") + "$")
+
+func pathConfigZeroAddress(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/zeroaddress",
+		Fields: map[string]*framework.FieldSchema{
+			"roles": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `[Required] Comma separated list of OTP roles that issue
+				credentials for any IP. Roles of a namespace are given as
+				'<namespace>/<role>'.`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:   b.pathConfigZeroAddressRead,
+			logical.WriteOperation:  b.pathConfigZeroAddressWrite,
+			logical.DeleteOperation: b.pathConfigZeroAddressDelete,
+		},
+
+		HelpSynopsis:    pathConfigZeroAddressSyn,
+		HelpDescription: pathConfigZeroAddressDesc,
+	}
+}
+
+func (b *backend) pathConfigZeroAddressRead(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	entry, err := b.getZeroAddressRoles(req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"roles": entry.Roles,
+		},
+	}, nil
+}
+
+func (b *backend) pathConfigZeroAddressWrite(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rolesRaw := normalizeList(d.Get("roles").(string))
+	if rolesRaw == "" {
+		return logical.ErrorResponse("Missing roles"), nil
+	}
+
+	// Roles don't have to exist yet, so that OTP roles without CIDR blocks
+	// can be created once they are listed here.
+	roles := strings.Split(rolesRaw, ",")
+	for _, name := range roles {
+		matches := zeroAddressRoleRegex.FindStringSubmatch(name)
+		if matches == nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid role name '%s'", name)), nil
+		}
+		role, err := b.getRole(req.Storage, matches[1], matches[2])
+		if err != nil {
+			return nil, err
+		}
+		if role != nil && role.KeyType != KeyTypeOTP {
+			return logical.ErrorResponse(fmt.Sprintf("Role '%s' is not of OTP type", name)), nil
+		}
+	}
+
+	return nil, b.putZeroAddressRoles(req.Storage, &zeroAddressRoles{Roles: roles})
+}
+
+func (b *backend) pathConfigZeroAddressDelete(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	return nil, req.Storage.Delete("config/zeroaddress")
+}
+
+func (b *backend) getZeroAddressRoles(s logical.Storage) (*zeroAddressRoles, error) {
+	entry, err := s.Get("config/zeroaddress")
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result zeroAddressRoles
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (b *backend) putZeroAddressRoles(s logical.Storage, roles *zeroAddressRoles) error {
+	entry, err := logical.StorageEntryJSON("config/zeroaddress", roles)
+	if err != nil {
+		return fmt.Errorf("could not create storage entry JSON: %s", err)
+	}
+	if err := s.Put(entry); err != nil {
+		return fmt.Errorf("could not store JSON: %s", err)
+	}
+	return nil
+}
+
+// Returns the name of the role in the zero-address roles list.
+func zeroAddressRoleName(namespace, roleName string) string {
+	if namespace == "" {
+		return roleName
+	}
+	return namespace + "/" + roleName
+}
+
+// Returns true if the role issues credentials for any IP.
+func (b *backend) isZeroAddressRole(s logical.Storage, namespace, roleName string) (bool, error) {
+	entry, err := b.getZeroAddressRoles(s)
+	if err != nil || entry == nil {
+		return false, err
+	}
+	name := zeroAddressRoleName(namespace, roleName)
+	for _, role := range entry.Roles {
+		if role == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Removes a deleted role from the zero-address roles list, so that a role
+// created later with the same name doesn't inherit the setting.
+func (b *backend) removeZeroAddressRole(s logical.Storage, namespace, roleName string) error {
+	entry, err := b.getZeroAddressRoles(s)
+	if err != nil || entry == nil {
+		return err
+	}
+
+	name := zeroAddressRoleName(namespace, roleName)
+	var roles []string
+	for _, role := range entry.Roles {
+		if role != name {
+			roles = append(roles, role)
+		}
+	}
+	if len(roles) == len(entry.Roles) {
+		return nil
+	}
+	if len(roles) == 0 {
+		return s.Delete("config/zeroaddress")
+	}
+	return b.putZeroAddressRoles(s, &zeroAddressRoles{Roles: roles})
+}
+
+const pathConfigZeroAddressSyn = `
+Assign zero address as default CIDR block for select roles.
+`
+
+const pathConfigZeroAddressDesc = `
+Administrator can choose to make a select few OTP roles to issue credentials
+for any IP, for example in environments where hosts come and go and their IPs
+can't be known in advance. The roles listed here don't check the IP of the
+credential requests against their CIDR blocks, and their 'cidr_list' field is
+optional.
+
+Writing to this path replaces the list of roles. Deleting a role removes it
+from the list.
+`
@@ -0,0 +1,285 @@
+package ssh
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// maxBatchCredentials is the number of credentials that can be requested
+// in a single batch.
+const maxBatchCredentials = 500
+
+// maxParallelInstalls is the number of dynamic keys of a batch that are
+// installed at once.
+const maxParallelInstalls = 16
+
+func pathCredsBatch(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "creds/" + namespacePathRegex + framework.GenericNameRegex("role") + "/batch",
+		Fields: map[string]*framework.FieldSchema{
+			"namespace": namespaceField,
+			"role": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "[Required] Name of the role",
+			},
+			"credentials": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `[Required] Comma separated list of the credentials to issue,
+				each of them as 'username@ip', or just 'ip' for the default username
+				of the role.`,
+			},
+			"ttl": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `[Optional] Lease of the credentials, e.g. "5m". Defaults to
+				the 'ttl' of the role, or to the lease configured at 'config/lease'.`,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.WriteOperation: b.pathCredsBatchWrite,
+		},
+		HelpSynopsis:    pathCredsBatchHelpSyn,
+		HelpDescription: pathCredsBatchHelpDesc,
+	}
+}
+
+// batchCredential is a credential requested in a batch, along with the
+// outcome of issuing it.
+type batchCredential struct {
+	Username string
+	IP       string
+
+	// Data is returned for the credential, and InternalData is kept in
+	// the secret for dynamic keys. Err is set if it couldn't be issued.
+	Data         map[string]interface{}
+	InternalData map[string]interface{}
+	Err          error
+}
+
+// Returns the response entry of the credential.
+func (c *batchCredential) response() map[string]interface{} {
+	if c.Err != nil {
+		entry := map[string]interface{}{
+			"username": c.Username,
+			"ip":       c.IP,
+			"error":    c.Err.Error(),
+		}
+		if cerr, ok := c.Err.(*codeError); ok {
+			entry["error_code"] = cerr.code
+		}
+		return entry
+	}
+	return c.Data
+}
+
+func (b *backend) pathCredsBatchWrite(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	namespace := d.Get("namespace").(string)
+	roleName := d.Get("role").(string)
+
+	var creds []*batchCredential
+	for _, entry := range strings.Split(d.Get("credentials").(string), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		cred := &batchCredential{IP: entry}
+		if i := strings.LastIndex(entry, "@"); i >= 0 {
+			cred.Username, cred.IP = entry[:i], entry[i+1:]
+		}
+		creds = append(creds, cred)
+	}
+	if len(creds) == 0 {
+		return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, "Missing credentials"), nil
+	}
+	if len(creds) > maxBatchCredentials {
+		return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, fmt.Sprintf("At most %d credentials can be requested at once", maxBatchCredentials)), nil
+	}
+
+	role, resp, err := b.credsRole(req, namespace, roleName)
+	if role == nil {
+		return resp, err
+	}
+	if role.RestrictToClientIP {
+		return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, "Batches are not supported for roles restricted to the client IP"), nil
+	}
+	ttl, grace, resp := b.requestedCredsLease(req, d, role)
+	if resp != nil {
+		return resp, nil
+	}
+
+	zeroAddress := false
+	if role.KeyType == KeyTypeOTP {
+		zeroAddress, err = b.isZeroAddressRole(req.Storage, namespace, roleName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Each credential is validated independently, and the ones that are
+	// not allowed are reported without affecting the others.
+	var valid []*batchCredential
+	for _, cred := range creds {
+		cred.Username, cred.Err = resolveUsername(req, role, cred.Username)
+		if cred.Err != nil {
+			continue
+		}
+		cred.IP, cred.Err = validateRoleIP(role, roleName, cred.IP, zeroAddress)
+		if cred.Err != nil {
+			continue
+		}
+		valid = append(valid, cred)
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	switch role.KeyType {
+	case KeyTypeOTP:
+		for _, cred := range valid {
+			otp, err := b.GenerateOTPCredential(req, namespace, roleName, role, cred.Username, cred.IP, expiresAt)
+			if err != nil {
+				cred.Err = err
+				continue
+			}
+			cred.Data = map[string]interface{}{
+				"key_type": role.KeyType,
+				"key":      otp,
+				"username": cred.Username,
+				"ip":       cred.IP,
+				"port":     role.Port,
+			}
+			cred.InternalData = map[string]interface{}{
+				"otp": otp,
+			}
+		}
+	case KeyTypeDynamic:
+		b.issueBatchDynamicKeys(req, namespace, roleName, role, valid, ttl)
+	default:
+		return nil, fmt.Errorf("key type unknown")
+	}
+
+	// Credentials that failed to be issued are reported along with the
+	// error, which has no error code if it may be retried. Credentials that
+	// can't be recorded are removed and reported as failed, since the
+	// others are already issued.
+	var otps, issuanceIDs []string
+	var keys []map[string]interface{}
+	for _, cred := range valid {
+		if cred.Err != nil {
+			continue
+		}
+		issuanceID, err := b.putIssuance(req, namespace, roleName, &issuance{
+			KeyType:   role.KeyType,
+			Username:  cred.Username,
+			IP:        cred.IP,
+			Port:      role.Port,
+			ExpiresAt: expiresAt,
+		})
+		if err != nil {
+			cred.Err = b.discardCredential(req.Storage, role.KeyType, cred.InternalData, err)
+			continue
+		}
+		cred.Data["issuance_id"] = issuanceID
+		if role.KeyType == KeyTypeOTP {
+			otps = append(otps, cred.InternalData["otp"].(string))
+			issuanceIDs = append(issuanceIDs, issuanceID)
+		} else {
+			cred.InternalData["issuance_id"] = issuanceID
+			keys = append(keys, cred.InternalData)
+		}
+	}
+	issued := len(otps) + len(keys)
+
+	results := make([]map[string]interface{}, 0, len(creds))
+	for _, cred := range creds {
+		results = append(results, cred.response())
+	}
+	data := map[string]interface{}{
+		"credentials": results,
+		"issued":      issued,
+		"failed":      len(creds) - issued,
+	}
+
+	// The lease is only needed if some credential was issued.
+	if issued == 0 {
+		return &logical.Response{Data: data}, nil
+	}
+	var result *logical.Response
+	if role.KeyType == KeyTypeOTP {
+		result = b.Secret(SecretOTPType).Response(data, map[string]interface{}{
+			"otps":         otps,
+			"issuance_ids": issuanceIDs,
+			"namespace":    namespace,
+			"role_name":    roleName,
+		})
+	} else {
+		result = b.Secret(SecretDynamicKeyType).Response(data, map[string]interface{}{
+			"keys":      keys,
+			"namespace": namespace,
+			"role_name": roleName,
+		})
+	}
+	b.incrMetric(namespace, roleName, metricCredsIssued, issued)
+
+	result.Secret.TTL, result.Secret.GracePeriod = ttl, grace
+	return result, nil
+}
+
+// Generates and installs the dynamic keys of the credentials in parallel.
+// Credentials whose key couldn't be installed get the error.
+func (b *backend) issueBatchDynamicKeys(req *logical.Request, namespace, roleName string, role *sshRole, creds []*batchCredential, ttl time.Duration) {
+	// Use the cached effective install script of the role.
+	role.InstallScript = b.roleInstallScript(rolePath(namespace, roleName), role).Script
+	var comment string
+	if role.KeyComment != "" {
+		comment = renderKeyComment(role.KeyComment, roleName, req.DisplayName, time.Now())
+	}
+
+	sem := make(chan struct{}, maxParallelInstalls)
+	var wg sync.WaitGroup
+	for _, cred := range creds {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(cred *batchCredential) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			publicKey, privateKey, issuedID, err := b.GenerateDynamicCredential(req, namespace, roleName, role, cred.Username, cred.IP, comment, ttl)
+			if err != nil {
+				cred.Err = err
+				return
+			}
+			cred.Data = map[string]interface{}{
+				"key":      privateKey,
+				"key_type": role.KeyType,
+				"username": cred.Username,
+				"ip":       cred.IP,
+				"port":     role.Port,
+			}
+			cred.InternalData = dynamicKeyInternalData(namespace, roleName, issuedID, role, cred.Username, cred.IP, publicKey)
+		}(cred)
+	}
+	wg.Wait()
+}
+
+const pathCredsBatchHelpSyn = `
+Creates credentials for several usernames and hosts at once.
+`
+
+const pathCredsBatchHelpDesc = `
+This path issues the credentials of the role for each of the comma separated
+'username@ip' entries of 'credentials' in a single request, so that tools that
+set up many hosts don't have to request them one by one. Entries without a
+username get the default username of the role. At most 500 credentials can be
+requested at once. Dynamic keys are installed in their hosts several at once.
+
+Each entry is validated against the role on its own, and the response lists
+the outcome of each of them in the order they were given. Entries that were
+not issued hold the error instead of the credential, along with an
+'error_code' when the failure is permanent, as for the 'creds' endpoint.
+'issued' and 'failed' count them.
+
+All the credentials of the batch share a single lease, which can't be renewed.
+Revoking it revokes all of them.
+`
@@ -3,6 +3,8 @@ package ssh
 import (
 	"fmt"
 	"net"
+	"path"
+	"regexp"
 	"strings"
 	"time"
 
@@ -14,12 +16,85 @@ import (
 type sshOTP struct {
 	Username string `json:"username"`
 	IP       string `json:"ip"`
+
+	// ExpiresAt is the expiry of the lease the OTP was issued with. It is
+	// zero for OTPs issued before it was recorded.
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// Namespace and RoleName identify the role the OTP was issued for.
+	// RoleName is empty for OTPs issued before it was recorded.
+	Namespace string `json:"namespace"`
+	RoleName  string `json:"role_name"`
+}
+
+// Error codes returned in the 'error_code' field of error responses when
+// issuing credentials. All of them are permanent failures: repeating the
+// request won't succeed unless the request or the role is changed.
+// Transient failures, such as storage errors, are returned as internal
+// errors without a code.
+const (
+	// ErrorCodeInvalidRequest is returned when required parameters are
+	// missing or conflict with each other.
+	ErrorCodeInvalidRequest = "invalid_request"
+
+	// ErrorCodeUnknownRole is returned when the role doesn't exist.
+	ErrorCodeUnknownRole = "unknown_role"
+
+	// ErrorCodeRequestAddrNotAllowed is returned when the client is not
+	// in the request_cidr_list of the role.
+	ErrorCodeRequestAddrNotAllowed = "request_addr_not_allowed"
+
+	// ErrorCodeUserNotAllowed is returned when the requested username is
+	// not allowed by the role.
+	ErrorCodeUserNotAllowed = "user_not_allowed"
+
+	// ErrorCodeInvalidIP is returned when the IP can't be parsed.
+	ErrorCodeInvalidIP = "invalid_ip"
+
+	// ErrorCodeIPNotInCIDR is returned when the IP doesn't belong to the
+	// cidr_list of the role.
+	ErrorCodeIPNotInCIDR = "ip_not_in_cidr"
+
+	// ErrorCodeHostnameNotAllowed is returned when the hostname is not in
+	// the allowed_domains of the role or doesn't resolve.
+	ErrorCodeHostnameNotAllowed = "hostname_not_allowed"
+
+	// ErrorCodeIPNotClientAddr is returned when the role only issues
+	// credentials for the IP of the client and the IP is another one.
+	ErrorCodeIPNotClientAddr = "ip_not_client_addr"
+
+	// ErrorCodePortNotAllowed is returned when the requested port is not
+	// in the allowed_ports of the role.
+	ErrorCodePortNotAllowed = "port_not_allowed"
+
+	// ErrorCodePublicKeyNotAllowed is returned when the type or the size of
+	// the public key to sign is not allowed by the role.
+	ErrorCodePublicKeyNotAllowed = "public_key_not_allowed"
+)
+
+// codeError is an error that carries one of the error codes above.
+type codeError struct {
+	code string
+	msg  string
+}
+
+func (e *codeError) Error() string {
+	return e.msg
+}
+
+// Returns the error code of err, or the fallback if it has none.
+func errorCode(err error, fallback string) string {
+	if cerr, ok := err.(*codeError); ok {
+		return cerr.code
+	}
+	return fallback
 }
 
 func pathCredsCreate(b *backend) *framework.Path {
 	return &framework.Path{
-		Pattern: "creds/" + framework.GenericNameRegex("role"),
+		Pattern: "creds/" + namespacePathRegex + framework.GenericNameRegex("role"),
 		Fields: map[string]*framework.FieldSchema{
+			"namespace": namespaceField,
 			"role": &framework.FieldSchema{
 				Type:        framework.TypeString,
 				Description: "[Required] Name of the role",
@@ -32,6 +107,31 @@ func pathCredsCreate(b *backend) *framework.Path {
 				Type:        framework.TypeString,
 				Description: "[Required] IP of the remote host",
 			},
+			"hostname": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `[Optional] Hostname of the remote host. Used instead of
+				'ip' for roles with 'allowed_domains'. The hostname is resolved and
+				the credential is issued for its first address allowed by the role.`,
+			},
+			"ip_list": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `[Optional] Comma separated list of IPs of remote hosts.
+				Used instead of 'ip' to request OTPs for several hosts at once.
+				Applicable only for OTP type roles.`,
+			},
+			"port": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `[Optional] Port of the SSH server on the remote host.
+				Defaults to the 'port' of the role. Other ports are only accepted for
+				OTP type roles that have them in 'allowed_ports'.`,
+			},
+			"ttl": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `[Optional] Lease of the credential, e.g. "5m". Defaults to
+				the 'ttl' of the role, or to the lease configured at 'config/lease'. It
+				can't exceed the 'max_ttl' of the role, or the default lease if the
+				role has no 'max_ttl'.`,
+			},
 		},
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.WriteOperation: b.pathCredsCreateWrite,
@@ -43,67 +143,100 @@ func pathCredsCreate(b *backend) *framework.Path {
 
 func (b *backend) pathCredsCreateWrite(
 	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	namespace := d.Get("namespace").(string)
 	roleName := d.Get("role").(string)
 	if roleName == "" {
-		return logical.ErrorResponse("Missing role"), nil
+		return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, "Missing role"), nil
 	}
 
 	ipRaw := d.Get("ip").(string)
-	if ipRaw == "" {
-		return logical.ErrorResponse("Missing ip"), nil
+	ipList := d.Get("ip_list").(string)
+	hostname := strings.ToLower(strings.TrimSuffix(d.Get("hostname").(string), "."))
+	given := 0
+	for _, v := range []string{ipRaw, ipList, hostname} {
+		if v != "" {
+			given++
+		}
 	}
-
-	role, err := b.getRole(req.Storage, roleName)
-	if err != nil {
-		return nil, fmt.Errorf("error retrieving role: %s", err)
+	if given == 0 {
+		return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, "Missing ip"), nil
 	}
-	if role == nil {
-		return logical.ErrorResponse(fmt.Sprintf("Role '%s' not found", roleName)), nil
+	if given > 1 {
+		return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, "Only one of 'ip', 'ip_list' and 'hostname' can be specified"), nil
 	}
 
-	// username is an optional parameter.
-	username := d.Get("username").(string)
+	role, resp, err := b.credsRole(req, namespace, roleName)
+	if role == nil {
+		return resp, err
+	}
 
-	// Set the default username
-	if username == "" {
-		if role.DefaultUser == "" {
-			return logical.ErrorResponse("No default username registered. Use 'username' option"), nil
+	// The role is a copy loaded for this request, so the requested port
+	// replaces the one of the role in everything returned below.
+	if port := d.Get("port").(int); port != 0 && port != role.Port {
+		if role.KeyType != KeyTypeOTP || !portAllowed(port, role.AllowedPorts) {
+			return logical.ErrorCodeResponse(ErrorCodePortNotAllowed, fmt.Sprintf("Port %d is not allowed by role '%s'", port, roleName)), nil
 		}
-		username = role.DefaultUser
+		role.Port = port
+	}
+
+	ttl, grace, resp := b.requestedCredsLease(req, d, role)
+	if resp != nil {
+		return resp, nil
 	}
 
-	if role.AllowedUsers != "" {
-		// Check if the username is present in allowed users list.
-		err := validateUsername(username, role.AllowedUsers)
+	// username is an optional parameter.
+	username, err := resolveUsername(req, role, d.Get("username").(string))
+	if err != nil {
+		return logical.ErrorCodeResponse(errorCode(err, ErrorCodeUserNotAllowed), err.Error()), nil
+	}
 
-		// If username is not present in allowed users list, check if it
-		// is the default username in the role. If neither is true, then
-		// that username is not allowed to generate a credential.
-		if err != nil && username != role.DefaultUser {
-			return logical.ErrorResponse("Username is not present is allowed users list."), nil
+	// OTP roles listed at 'config/zeroaddress' issue credentials for any IP.
+	zeroAddress := false
+	if role.KeyType == KeyTypeOTP {
+		zeroAddress, err = b.isZeroAddressRole(req.Storage, namespace, roleName)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	// Validate the IP address
-	ipAddr := net.ParseIP(ipRaw)
-	if ipAddr == nil {
-		return logical.ErrorResponse(fmt.Sprintf("Invalid IP '%s'", ipRaw)), nil
+	// Multiple IPs are handled separately since each of them is validated
+	// and issued a credential independently.
+	if ipList != "" {
+		if role.KeyType != KeyTypeOTP {
+			return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, "'ip_list' is only supported for OTP type roles"), nil
+		}
+		if role.RestrictToClientIP {
+			return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, "'ip_list' is not supported for roles restricted to the client IP"), nil
+		}
+		result, err := b.createOTPBatch(req, role, namespace, roleName, username, ipList, zeroAddress, ttl)
+		if err != nil {
+			return nil, err
+		}
+		otps, _ := result.Secret.InternalData["otps"].([]string)
+		b.incrMetric(namespace, roleName, metricCredsIssued, len(otps))
+		result.Secret.TTL, result.Secret.GracePeriod = ttl, grace
+		return result, nil
 	}
 
-	// Check if the IP belongs to the registered list of CIDR blocks under the role
-	ip := ipAddr.String()
-	ipMatched, err := cidrContainsIP(ip, role.CIDRList)
+	var ip string
+	if hostname != "" {
+		ip, err = b.resolveRoleHostname(role, roleName, hostname, zeroAddress)
+	} else {
+		ip, err = validateRoleIP(role, roleName, ipRaw, zeroAddress)
+	}
 	if err != nil {
-		return logical.ErrorResponse(fmt.Sprintf("Error validating IP: %s", err)), nil
+		return logical.ErrorCodeResponse(errorCode(err, ErrorCodeInvalidIP), err.Error()), nil
 	}
-	if !ipMatched {
-		return logical.ErrorResponse(fmt.Sprintf("IP[%s] does not belong to role[%s]", ip, roleName)), nil
+	if role.RestrictToClientIP {
+		if err := validateClientIP(req, ip); err != nil {
+			return logical.ErrorCodeResponse(ErrorCodeIPNotClientAddr, err.Error()), nil
+		}
 	}
 
 	var result *logical.Response
 	if role.KeyType == KeyTypeOTP {
 		// Generate an OTP
-		otp, err := b.GenerateOTPCredential(req, username, ip)
+		otp, err := b.GenerateOTPCredential(req, namespace, roleName, role, username, ip, time.Now().Add(ttl))
 		if err != nil {
 			return nil, err
 		}
@@ -119,12 +252,21 @@ func (b *backend) pathCredsCreateWrite(
 			"ip":       ip,
 			"port":     role.Port,
 		}, map[string]interface{}{
-			"otp": otp,
+			"otp":       otp,
+			"namespace": namespace,
+			"role_name": roleName,
 		})
 	} else if role.KeyType == KeyTypeDynamic {
+		// Use the cached effective install script of the role.
+		role.InstallScript = b.roleInstallScript(rolePath(namespace, roleName), role).Script
+
 		// Generate an RSA key pair. This also installs the newly generated
 		// public key in the remote host.
-		dynamicPublicKey, dynamicPrivateKey, err := b.GenerateDynamicCredential(req, role, username, ip)
+		var comment string
+		if role.KeyComment != "" {
+			comment = renderKeyComment(role.KeyComment, roleName, req.DisplayName, time.Now())
+		}
+		dynamicPublicKey, dynamicPrivateKey, issuedID, err := b.GenerateDynamicCredential(req, namespace, roleName, role, username, ip, comment, ttl)
 		if err != nil {
 			return nil, err
 		}
@@ -137,77 +279,426 @@ func (b *backend) pathCredsCreateWrite(
 			"username": username,
 			"ip":       ip,
 			"port":     role.Port,
-		}, map[string]interface{}{
-			"admin_user":         role.AdminUser,
-			"username":           username,
-			"ip":                 ip,
-			"host_key_name":      role.KeyName,
-			"dynamic_public_key": dynamicPublicKey,
-			"port":               role.Port,
-			"install_script":     role.InstallScript,
-		})
+		}, dynamicKeyInternalData(namespace, roleName, issuedID, role, username, ip, dynamicPublicKey))
 	} else {
 		return nil, fmt.Errorf("key type unknown")
 	}
+	if hostname != "" {
+		result.Data["hostname"] = hostname
+	}
+	result.Data["ssh_config"] = sshConfigSnippet(role.KeyType, hostname, ip, role.Port, username)
+
+	issuanceID, err := b.putIssuance(req, namespace, roleName, &issuance{
+		KeyType:   role.KeyType,
+		Username:  username,
+		IP:        ip,
+		Port:      role.Port,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return nil, b.discardCredential(req.Storage, role.KeyType, result.Secret.InternalData, err)
+	}
+	result.Data["issuance_id"] = issuanceID
+	result.Secret.InternalData["issuance_id"] = issuanceID
+	b.incrMetric(namespace, roleName, metricCredsIssued, 1)
+
+	result.Secret.TTL, result.Secret.GracePeriod = ttl, grace
+	return result, nil
+}
+
+// Returns the internal data of the secret of a dynamic key, from which the
+// key is renewed and uninstalled.
+func dynamicKeyInternalData(namespace, roleName, issuedID string, role *sshRole, username, ip, dynamicPublicKey string) map[string]interface{} {
+	return map[string]interface{}{
+		"namespace":          namespace,
+		"role_name":          roleName,
+		"issued_id":          issuedID,
+		"admin_user":         role.AdminUser,
+		"username":           username,
+		"ip":                 ip,
+		"host_key_name":      role.KeyName,
+		"dynamic_public_key": dynamicPublicKey,
+		"port":               role.Port,
+		"install_script":     role.InstallScript,
+
+		"install_script_interpreter": role.InstallScriptInterpreter,
+		"install_script_type":        role.installScriptType(),
+		"host_key_fingerprint":       role.HostKeyFingerprint,
+		"verify_on_renew":            role.VerifyOnRenew,
+		"key_expiry":                 role.KeyExpiry,
+		"bastion_host":               role.BastionHost,
+		"bastion_port":               role.BastionPort,
+		"bastion_user":               role.BastionUser,
+		"bastion_key_name":           role.BastionKeyName,
+	}
+}
+
+// Removes a credential that was issued but not handed out, because the
+// issued credential couldn't be recorded with the given error. Without a
+// lease nothing would revoke it. The returned error reports the failure to
+// record it, and the failure to remove it if any.
+func (b *backend) discardCredential(s logical.Storage, keyType string, internalData map[string]interface{}, cause error) error {
+	var err error
+	switch keyType {
+	case KeyTypeOTP:
+		otp, _ := internalData["otp"].(string)
+		err = b.deleteOTP(s, otp)
+	case KeyTypeDynamic:
+		_, _, err = b.removeDynamicKey(s, &logical.Secret{InternalData: internalData})
+	}
+	if err != nil {
+		return fmt.Errorf("error recording the issued credential: %s; error removing it: %s", cause, err)
+	}
+	return fmt.Errorf("error recording the issued credential: %s", cause)
+}
+
+// Issues OTPs for each of the comma separated IPs. Each IP is validated
+// against the role independently and a failure for one IP is reported in
+// its entry without affecting the others. All the OTPs are tied to a
+// single lease with the given TTL.
+func (b *backend) createOTPBatch(req *logical.Request, role *sshRole, namespace, roleName, username, ipList string, zeroAddress bool, ttl time.Duration) (*logical.Response, error) {
+	expiresAt := time.Now().Add(ttl)
+
+	var creds []map[string]interface{}
+	var otps []string
+	var issuanceIDs []string
+	for _, ipRaw := range strings.Split(ipList, ",") {
+		ipRaw = strings.TrimSpace(ipRaw)
+		ip, err := validateRoleIP(role, roleName, ipRaw, zeroAddress)
+		if err != nil {
+			creds = append(creds, map[string]interface{}{
+				"ip":         ipRaw,
+				"error":      err.Error(),
+				"error_code": errorCode(err, ErrorCodeInvalidIP),
+			})
+			continue
+		}
+
+		// OTPs already stored for other IPs are tied to the lease, so
+		// failures from here on are reported for the IP without an error
+		// code, as they may be retried.
+		otp, err := b.GenerateOTPCredential(req, namespace, roleName, role, username, ip, expiresAt)
+		if err != nil {
+			creds = append(creds, map[string]interface{}{
+				"ip":    ip,
+				"error": err.Error(),
+			})
+			continue
+		}
+		issuanceID, err := b.putIssuance(req, namespace, roleName, &issuance{
+			KeyType:   role.KeyType,
+			Username:  username,
+			IP:        ip,
+			Port:      role.Port,
+			ExpiresAt: expiresAt,
+		})
+		if err != nil {
+			err = b.discardCredential(req.Storage, role.KeyType, map[string]interface{}{"otp": otp}, err)
+			creds = append(creds, map[string]interface{}{
+				"ip":    ip,
+				"error": err.Error(),
+			})
+			continue
+		}
+		otps = append(otps, otp)
+		issuanceIDs = append(issuanceIDs, issuanceID)
+		creds = append(creds, map[string]interface{}{
+			"key_type":    role.KeyType,
+			"key":         otp,
+			"username":    username,
+			"ip":          ip,
+			"port":        role.Port,
+			"issuance_id": issuanceID,
+		})
+	}
+
+	return b.Secret(SecretOTPType).Response(map[string]interface{}{
+		"credentials": creds,
+	}, map[string]interface{}{
+		"otps":         otps,
+		"issuance_ids": issuanceIDs,
+		"namespace":    namespace,
+		"role_name":    roleName,
+	}), nil
+}
+
+// Validates the IP address and checks that it belongs to the registered
+// list of CIDR blocks under the role, unless the role is a zero-address
+// role, and that it is not excluded by the role. The normalized IP is
+// returned.
+func validateRoleIP(role *sshRole, roleName, ipRaw string, zeroAddress bool) (string, error) {
+	ipAddr := net.ParseIP(ipRaw)
+	if ipAddr == nil {
+		return "", &codeError{ErrorCodeInvalidIP, fmt.Sprintf("Invalid IP '%s'", ipRaw)}
+	}
+
+	ip := ipAddr.String()
+	if !zeroAddress {
+		if role.CIDRList == "" {
+			return "", &codeError{ErrorCodeIPNotInCIDR, fmt.Sprintf("IP[%s] does not belong to role[%s]", ip, roleName)}
+		}
+		ipMatched, err := cidrContainsIP(ip, role.CIDRList)
+		if err != nil {
+			return "", fmt.Errorf("Error validating IP: %s", err)
+		}
+		if !ipMatched {
+			return "", &codeError{ErrorCodeIPNotInCIDR, fmt.Sprintf("IP[%s] does not belong to role[%s]", ip, roleName)}
+		}
+	}
+
+	if role.ExcludeCIDRList != "" {
+		ipExcluded, err := cidrContainsIP(ip, role.ExcludeCIDRList)
+		if err != nil {
+			return "", fmt.Errorf("Error validating IP: %s", err)
+		}
+		if ipExcluded {
+			return "", &codeError{ErrorCodeIPNotInCIDR, fmt.Sprintf("IP[%s] is excluded from role[%s]", ip, roleName)}
+		}
+	}
+	return ip, nil
+}
+
+// Returns the role that credentials are requested for, after checking that
+// it issues them and that the client is allowed to request them. If the
+// role is nil, the returned response or error is returned to the client.
+func (b *backend) credsRole(req *logical.Request, namespace, roleName string) (*sshRole, *logical.Response, error) {
+	role, err := b.getRole(req.Storage, namespace, roleName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error retrieving role: %s", err)
+	}
+	if role == nil {
+		return nil, logical.ErrorCodeResponse(ErrorCodeUnknownRole, fmt.Sprintf("Role '%s' not found", roleName)), nil
+	}
+	if role.KeyType == KeyTypeCA {
+		return nil, logical.ErrorCodeResponse(ErrorCodeInvalidRequest, fmt.Sprintf("Role '%s' is of 'ca' type; use the 'sign' endpoint", roleName)), nil
+	}
+
+	// If the role restricts where requests can come from, check the
+	// address of the client making this request.
+	if role.RequestCIDRList != "" {
+		if err := validateRequestAddr(req, role.RequestCIDRList); err != nil {
+			return nil, logical.ErrorCodeResponse(ErrorCodeRequestAddrNotAllowed, err.Error()), nil
+		}
+	}
+	return role, nil, nil
+}
 
+// Returns the TTL and grace period of the credentials requested with the
+// 'ttl' field, or an error response if the field is invalid.
+func (b *backend) requestedCredsLease(req *logical.Request, d *framework.FieldData, role *sshRole) (time.Duration, time.Duration, *logical.Response) {
+	requestedTTL, err := d.GetDuration("ttl")
+	if err != nil {
+		return 0, 0, logical.ErrorCodeResponse(ErrorCodeInvalidRequest, err.Error())
+	}
+	if requestedTTL < 0 {
+		return 0, 0, logical.ErrorCodeResponse(ErrorCodeInvalidRequest, "Invalid ttl: it must be positive")
+	}
+	ttl, grace := b.credsLease(req.Storage, role)
+	if requestedTTL > 0 {
+		ttl = limitCredsTTL(role, ttl, requestedTTL)
+	}
+	return ttl, grace, nil
+}
+
+// Returns the TTL and the grace period of the credentials issued for the
+// role, based on the lease configured for the backend.
+func (b *backend) credsLease(s logical.Storage, role *sshRole) (time.Duration, time.Duration) {
 	// Change the lease information to reflect user's choice
-	lease, _ := b.Lease(req.Storage)
+	lease, _ := b.Lease(s)
 
-	// If the lease information is set, update it in secret.
+	// If lease information is not set, set it to 10 minutes.
+	ttl, grace := 10*time.Minute, 2*time.Minute
+
+	// If the lease information is set, use it.
 	if lease != nil {
-		result.Secret.TTL = lease.Lease
-		result.Secret.GracePeriod = lease.LeaseMax
+		ttl, grace = lease.Lease, lease.LeaseMax
 	}
 
-	// If lease information is not set, set it to 10 minutes.
-	if lease == nil {
-		result.Secret.TTL = 10 * time.Minute
-		result.Secret.GracePeriod = 2 * time.Minute
+	// The lifetimes of the role take precedence over the ones of the mount.
+	if role.TTL > 0 {
+		ttl = role.TTL
+	}
+	if role.MaxTTL > 0 && ttl > role.MaxTTL {
+		ttl = role.MaxTTL
 	}
+	return ttl, grace
+}
 
-	return result, nil
+// Returns the TTL requested for a credential, limited to the maximum TTL of
+// the role, or to its default TTL if the role has no maximum. Requests can
+// shorten the lease of their credentials but not extend it past what the
+// role allows.
+func limitCredsTTL(role *sshRole, defaultTTL, requested time.Duration) time.Duration {
+	limit := defaultTTL
+	if role.MaxTTL > 0 {
+		limit = role.MaxTTL
+	}
+	if requested > limit {
+		return limit
+	}
+	return requested
 }
 
-// Generates a RSA key pair and installs it in the remote target
-func (b *backend) GenerateDynamicCredential(req *logical.Request, role *sshRole, username, ip string) (string, string, error) {
+// Generates a key pair with the key algorithm and size configured for the
+// role and installs it in the remote target. The comment, if not empty, is
+// appended to the installed public key. Roles with key_expiry install the
+// key with an 'expiry-time' option set to the expiry of its lease, which has
+// the given TTL.
+func (b *backend) GenerateDynamicCredential(req *logical.Request, namespace, roleName string, role *sshRole, username, ip, comment string, ttl time.Duration) (string, string, string, error) {
 	// Fetch the host key to be used for dynamic key installation
-	keyEntry, err := req.Storage.Get(fmt.Sprintf("keys/%s", role.KeyName))
+	keyEntry, err := req.Storage.Get(keyPath(namespace, role.KeyName))
 	if err != nil {
-		return "", "", fmt.Errorf("key '%s' not found. err:%s", role.KeyName, err)
+		return "", "", "", fmt.Errorf("key '%s' not found. err:%s", role.KeyName, err)
 	}
 
 	if keyEntry == nil {
-		return "", "", fmt.Errorf("key '%s' not found", role.KeyName)
+		return "", "", "", fmt.Errorf("key '%s' not found", role.KeyName)
 	}
 
 	var hostKey sshHostKey
 	if err := keyEntry.DecodeJSON(&hostKey); err != nil {
-		return "", "", fmt.Errorf("error reading the host key: %s", err)
+		return "", "", "", fmt.Errorf("error reading the host key: %s", err)
+	}
+
+	// Generate a new key pair with the algorithm of the role.
+	dynamicPublicKey, dynamicPrivateKey, err := generateDynamicKeys(role.keyAlgorithm(), role.KeyBits)
+	if err != nil {
+		return "", "", "", fmt.Errorf("error generating key: %s", err)
+	}
+	if comment != "" {
+		dynamicPublicKey = dynamicPublicKey + " " + comment
+	}
+	if role.KeyOptionSpecs != "" {
+		dynamicPublicKey = role.KeyOptionSpecs + " " + dynamicPublicKey
+	}
+	expiresAt := time.Now().Add(ttl)
+	if role.KeyExpiry {
+		dynamicPublicKey = setKeyExpiry(dynamicPublicKey, expiresAt)
 	}
 
-	// Generate a new RSA key pair with the given key length.
-	dynamicPublicKey, dynamicPrivateKey, err := generateRSAKeys(role.KeyBits)
+	defaults, err := b.DefaultsConfig(req.Storage)
 	if err != nil {
-		return "", "", fmt.Errorf("error generating key: %s", err)
+		return "", "", "", err
+	}
+
+	// Record the key in the WAL before installing it so that a key which is
+	// partially installed gets removed even if Vault fails in between.
+	walEntry := &walDynamicKey{
+		Namespace:                namespace,
+		AdminUser:                role.AdminUser,
+		HostKeyName:              role.KeyName,
+		Username:                 username,
+		IP:                       ip,
+		Port:                     role.Port,
+		DynamicPublicKey:         dynamicPublicKey,
+		InstallScript:            role.InstallScript,
+		InstallScriptInterpreter: role.InstallScriptInterpreter,
+		InstallScriptType:        role.installScriptType(),
+		HostKeyFingerprint:       role.HostKeyFingerprint,
+		BastionHost:              role.BastionHost,
+		BastionPort:              role.BastionPort,
+		BastionUser:              role.BastionUser,
+		BastionKeyName:           role.BastionKeyName,
+	}
+	walID, err := framework.PutWAL(req.Storage, walDynamicKeyKind, walEntry)
+	if err != nil {
+		return "", "", "", fmt.Errorf("error writing WAL entry: %s", err)
 	}
 
 	// Add the public key to authorized_keys file in target machine
-	err = b.installPublicKeyInTarget(role.AdminUser, username, ip, role.Port, hostKey.Key, dynamicPublicKey, role.InstallScript, true)
+	opts := &installOptions{
+		AdminUser:                role.AdminUser,
+		HostKey:                  hostKey.Key,
+		HostPassword:             hostKey.Password,
+		HostKeyboardInteractive:  hostKey.KeyboardInteractive,
+		Username:                 username,
+		IP:                       ip,
+		Port:                     role.Port,
+		DynamicPublicKey:         dynamicPublicKey,
+		InstallScript:            role.InstallScript,
+		InstallScriptInterpreter: role.InstallScriptInterpreter,
+		InstallScriptType:        role.installScriptType(),
+		HostKeyFingerprint:       role.HostKeyFingerprint,
+		BastionHost:              role.BastionHost,
+		BastionPort:              role.BastionPort,
+		BastionUser:              role.BastionUser,
+		DialTimeout:              defaults.DialTimeout,
+		DialRetries:              defaults.DialRetries,
+		DialBackoff:              defaults.DialBackoff,
+		MaxConnections:           defaults.MaxConnectionsPerHost,
+		IdleTimeout:              defaults.ConnectionIdleTimeout,
+		Install:                  true,
+	}
+	opts.HostKeyCertificate, err = b.keyCertificate(req.Storage, &hostKey, role.AdminUser)
+	if err == nil {
+		err = b.setBastionKey(req.Storage, namespace, opts, role.BastionKeyName)
+	}
+	if err == nil {
+		err = b.installKey(opts)
+	}
 	if err != nil {
-		return "", "", fmt.Errorf("error adding public key to authorized_keys file in target")
+		// Remove whatever got installed right away. If that fails too, the
+		// WAL entry is left for the key to be removed on rollback.
+		if uerr := b.uninstallWALDynamicKey(req.Storage, walEntry); uerr == nil {
+			framework.DeleteWAL(req.Storage, walID)
+		}
+		b.incrMetric(namespace, roleName, metricInstallsFailed, 1)
+		return "", "", "", fmt.Errorf("error adding public key to authorized_keys file in target")
 	}
-	return dynamicPublicKey, dynamicPrivateKey, nil
+
+	// Record the installed key under the role so that all the keys issued
+	// by the role can be revoked at once.
+	issuedID := uuid.GenerateUUID()
+	issuedEntry, err := logical.StorageEntryJSON(issuedKeysPath(namespace, roleName)+issuedID, &issuedDynamicKey{
+		walDynamicKey: *walEntry,
+		ExpiresAt:     expiresAt,
+	})
+	if err == nil {
+		err = req.Storage.Put(issuedEntry)
+	}
+	if err != nil {
+		if uerr := b.uninstallWALDynamicKey(req.Storage, walEntry); uerr == nil {
+			framework.DeleteWAL(req.Storage, walID)
+		}
+		return "", "", "", fmt.Errorf("error recording the issued key: %s", err)
+	}
+
+	// The key is installed and is tracked by the secret from here on.
+	if err := framework.DeleteWAL(req.Storage, walID); err != nil {
+		return "", "", "", fmt.Errorf("failed to commit WAL entry: %s", err)
+	}
+	return dynamicPublicKey, dynamicPrivateKey, issuedID, nil
 }
 
 // Generates a UUID OTP and its salted value based on the salt of the backend.
 func (b *backend) GenerateSaltedOTP() (string, string) {
 	str := uuid.GenerateUUID()
-	return str, b.salt.SaltID(str)
+	return str, b.saltOTP(str)
 }
 
-// Generates an UUID OTP and creates an entry for the same in storage backend with its salted string.
-func (b *backend) GenerateOTPCredential(req *logical.Request, username, ip string) (string, error) {
-	otp, otpSalted := b.GenerateSaltedOTP()
+// Generates an OTP in the format of the role and returns it along with
+// its salted value. Without a role, an UUID OTP is generated.
+func (b *backend) generateRoleOTP(role *sshRole) (string, string, error) {
+	if role == nil || role.otpFormat() == OTPFormatUUID {
+		otp, otpSalted := b.GenerateSaltedOTP()
+		return otp, otpSalted, nil
+	}
+	otp, err := generateOTP(role.otpFormat(), role.otpLength())
+	if err != nil {
+		return "", "", err
+	}
+	return otp, b.saltOTP(otp), nil
+}
+
+// Generates an OTP in the format of the role and creates an entry for the
+// same in storage backend with its salted string. The role can be nil for
+// OTPs of deleted roles, in which case an UUID OTP is generated. The expiry
+// of the lease of the OTP is recorded for the entry to be tidied up.
+func (b *backend) GenerateOTPCredential(req *logical.Request, namespace, roleName string, role *sshRole, username, ip string, expiresAt time.Time) (string, error) {
+	otp, otpSalted, err := b.generateRoleOTP(role)
+	if err != nil {
+		return "", err
+	}
 
 	// Check if there is an entry already created for the newly generated OTP.
 	entry, err := b.getOTP(req.Storage, otpSalted)
@@ -217,7 +708,10 @@ func (b *backend) GenerateOTPCredential(req *logical.Request, username, ip strin
 	// OTP is generated. It is very unlikely that this is the case and this
 	// code is just for safety.
 	for err == nil && entry != nil {
-		otp, otpSalted = b.GenerateSaltedOTP()
+		otp, otpSalted, err = b.generateRoleOTP(role)
+		if err != nil {
+			return "", err
+		}
 		entry, err = b.getOTP(req.Storage, otpSalted)
 		if err != nil {
 			return "", err
@@ -226,8 +720,11 @@ func (b *backend) GenerateOTPCredential(req *logical.Request, username, ip strin
 
 	// Store an entry for the salt of OTP.
 	newEntry, err := logical.StorageEntryJSON("otp/"+otpSalted, sshOTP{
-		Username: username,
-		IP:       ip,
+		Username:  username,
+		IP:        ip,
+		ExpiresAt: expiresAt,
+		Namespace: namespace,
+		RoleName:  roleName,
 	})
 	if err != nil {
 		return "", err
@@ -238,18 +735,169 @@ func (b *backend) GenerateOTPCredential(req *logical.Request, username, ip strin
 	return otp, nil
 }
 
+// Determines the username that the credential is issued for. The rules are:
+//
+//   - If no username is requested, the default user of the role is used.
+//   - The default user of the role can always be requested.
+//   - If the role has allowed users, any other requested username, including
+//     the admin user, must be present in that list. Templated entries are
+//     resolved from the token making the request first.
+//   - If the role has no allowed users, any username can be requested.
+//   - Whichever the username, it must not be in the denied users of the role.
+func resolveUsername(req *logical.Request, role *sshRole, requested string) (string, error) {
+	username := requested
+	if username == "" {
+		if role.DefaultUser == "" {
+			return "", &codeError{ErrorCodeInvalidRequest, "No default username registered. Use 'username' option"}
+		}
+		username = role.DefaultUser
+	} else if username != role.DefaultUser && role.AllowedUsers != "" {
+		if err := validateUsername(req, username, role.AllowedUsers, role.allowedUsersTemplate()); err != nil {
+			return "", &codeError{ErrorCodeUserNotAllowed, fmt.Sprintf("Username '%s' is not present in allowed users list", username)}
+		}
+	}
+
+	if userDenied(username, role.DenyUsers) {
+		return "", &codeError{ErrorCodeUserNotAllowed, fmt.Sprintf("Username '%s' is denied by the role", username)}
+	}
+	return username, nil
+}
+
+// Checks if the username is one of the comma separated denied users, or
+// matches one of the glob entries among them. Unlike allowed users, glob
+// entries match any username.
+func userDenied(username, denyUsers string) bool {
+	if denyUsers == "" {
+		return false
+	}
+	for _, user := range strings.Split(denyUsers, ",") {
+		if user == username {
+			return true
+		}
+		if matched, _ := path.Match(user, username); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches the usernames that glob entries of allowed users can match.
+var usernameRegex = regexp.MustCompile("^" + usernamePattern + "$")
+
+// Checks that the hostname belongs to the allowed domains of the role and
+// resolves it. The first address of the hostname that is allowed by the
+// role is returned.
+func (b *backend) resolveRoleHostname(role *sshRole, roleName, hostname string, zeroAddress bool) (string, error) {
+	if !domainAllowed(hostname, role.AllowedDomains) {
+		return "", &codeError{ErrorCodeHostnameNotAllowed, fmt.Sprintf("Hostname '%s' is not in the allowed domains of role[%s]", hostname, roleName)}
+	}
+
+	addrs, err := b.lookupHost(hostname)
+	if err != nil || len(addrs) == 0 {
+		return "", &codeError{ErrorCodeHostnameNotAllowed, fmt.Sprintf("Hostname '%s' could not be resolved", hostname)}
+	}
+
+	var lastErr error
+	for _, addr := range addrs {
+		ip, err := validateRoleIP(role, roleName, addr, zeroAddress)
+		if err == nil {
+			return ip, nil
+		}
+		lastErr = err
+	}
+	return "", lastErr
+}
+
+// Checks if the hostname is one of the comma separated domains or one of
+// their subdomains.
+func domainAllowed(hostname, allowedDomains string) bool {
+	if allowedDomains == "" {
+		return false
+	}
+	for _, domain := range strings.Split(allowedDomains, ",") {
+		if hostname == domain || strings.HasSuffix(hostname, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
 // Checks if the username supplied by the user is present in the list of
-// allowed users registered which creation of role.
-func validateUsername(username, allowedUsers string) error {
+// allowed users registered which creation of role. Glob entries only match
+// usernames in the portable format, so that a wildcard can't let usernames
+// with unexpected characters through. The entries are only rendered from the
+// token if they are templated.
+func validateUsername(req *logical.Request, username, allowedUsers string, template bool) error {
 	userList := strings.Split(allowedUsers, ",")
 	for _, user := range userList {
-		if user == username {
+		user = strings.TrimSpace(user)
+		glob := isAllowedUserGlob(user, template)
+		if template {
+			var ok bool
+			if user, ok = renderAllowedUser(req, user, glob); !ok {
+				continue
+			}
+		}
+		if !glob && user == username {
 			return nil
 		}
+		if glob && usernameRegex.MatchString(username) {
+			if matched, _ := path.Match(user, username); matched {
+				return nil
+			}
+		}
 	}
 	return fmt.Errorf("username not in allowed users list")
 }
 
+// Checks if the address of the client making the request belongs to the
+// comma separated CIDR blocks. Requests without connection information
+// are rejected since their origin can't be verified.
+func validateRequestAddr(req *logical.Request, cidrList string) error {
+	addr, err := requestClientIP(req)
+	if err != nil {
+		return err
+	}
+
+	matched, err := cidrContainsIP(addr, cidrList)
+	if err != nil {
+		return err
+	}
+	if !matched {
+		return fmt.Errorf("Client address '%s' is not allowed to request credentials for this role", addr)
+	}
+	return nil
+}
+
+// Checks that the IP is the address of the client making the request.
+func validateClientIP(req *logical.Request, ip string) error {
+	addr, err := requestClientIP(req)
+	if err != nil {
+		return err
+	}
+	if !net.ParseIP(addr).Equal(net.ParseIP(ip)) {
+		return fmt.Errorf("IP '%s' is not the address of the client; role only issues credentials for the client IP", ip)
+	}
+	return nil
+}
+
+// Returns the IP of the client making the request. Requests without
+// connection information fail since their origin can't be verified.
+func requestClientIP(req *logical.Request) (string, error) {
+	if req.Connection == nil || req.Connection.RemoteAddr == "" {
+		return "", fmt.Errorf("Client address unknown; role restricts request origin")
+	}
+
+	addr := req.Connection.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if net.ParseIP(addr) == nil {
+		return "", fmt.Errorf("Invalid client address '%s'", addr)
+	}
+	return addr, nil
+}
+
 const pathCredsCreateHelpSyn = `
 Creates a credential for establishing SSH connection with the remote host.
 `
@@ -263,6 +911,42 @@ Create named key using the 'keys/' endpoint, and this represents the
 shared SSH key of target host. If this backend is mounted at 'ssh',
 then "ssh/creds/web" would generate a key for 'web' role.
 
+The credential is issued for the 'username' given in the request, or for
+the 'default_user' of the role if it is omitted. The default user can always
+be requested. If the role has 'allowed_users', any other username, including
+the admin user, must be in that list; otherwise any username is accepted.
+Templated entries of 'allowed_users' are resolved from the token making the
+request and entries can be glob patterns, see the 'roles/' endpoint.
+Usernames in the 'deny_users' of the role are refused even if they are allowed.
+The username the credential was issued for is returned in the response,
+along with an 'ssh_config' Host block to connect to the host with it. The
+private key of dynamic credentials has to be passed to ssh, e.g. with '-i'.
+
+Roles with 'restrict_to_client_ip' only issue credentials for the IP that the
+request comes from, so a client can only get credentials for itself.
+
 Keys will have a lease associated with them. The access keys can be
-revoked by using the lease ID.
+revoked by using the lease ID. The lease defaults to the 'ttl' of the role,
+and requests can ask for a shorter one with 'ttl', or for a longer one up to
+the 'max_ttl' of the role.
+
+Error responses include an 'error_code' field along with the message, so
+that clients can tell failures apart without parsing the message:
+
+  invalid_request          required parameters are missing or conflicting
+  unknown_role             the role doesn't exist
+  request_addr_not_allowed the client is not in 'request_cidr_list'
+  user_not_allowed         the username is not allowed by the role
+  invalid_ip               the IP can't be parsed
+  ip_not_in_cidr           the IP is not in 'cidr_list' of the role
+  hostname_not_allowed     the hostname is not in 'allowed_domains' of the
+                           role or it doesn't resolve
+  ip_not_client_addr       the role only issues credentials for the client
+                           IP and the IP is another one
+  port_not_allowed         the port is not in 'allowed_ports' of the role
+  public_key_not_allowed   the type or the size of the public key to sign is
+                           not allowed by the role, for the 'sign' endpoint
+
+These failures are permanent for the given request and role. Failures
+without an error code are internal errors and may be retried.
 `
@@ -0,0 +1,293 @@
+package ssh
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/helper/uuid"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/mitchellh/mapstructure"
+)
+
+// issuanceLogSize is the number of issued credentials that are kept in the
+// issuance log of each role. The oldest ones are deleted first.
+const issuanceLogSize = 1000
+
+// issuance is the entry of the issuance log for a credential issued by a
+// role.
+type issuance struct {
+	KeyType  string `json:"key_type"`
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+	Port     int    `json:"port"`
+
+	// DisplayName and ClientAddr identify who requested the credential.
+	DisplayName string `json:"display_name"`
+	ClientAddr  string `json:"client_addr"`
+
+	// LeasePath is the path the credential was requested at. Vault assigns
+	// the lease ID after the credential is issued, and it is made of this
+	// path followed by a random suffix.
+	LeasePath string `json:"lease_path"`
+
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// RevokedAt is zero until the credential is revoked.
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// Returns whether the credential can still be used at the given time.
+func (i *issuance) live(now time.Time) bool {
+	return i.RevokedAt.IsZero() && now.Before(i.ExpiresAt)
+}
+
+func pathIssued(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "issued/" + namespacePathRegex + framework.GenericNameRegex("role") + "/?",
+		Fields: map[string]*framework.FieldSchema{
+			"namespace": namespaceField,
+			"role": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "[Required] Name of the role whose issued credentials are listed.",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathIssuedList,
+			logical.ReadOperation: b.pathIssuedList,
+		},
+
+		HelpSynopsis:    pathIssuedHelpSyn,
+		HelpDescription: pathIssuedHelpDesc,
+	}
+}
+
+// Records a credential issued by the role in its issuance log, and deletes
+// the oldest entries beyond the size of the log. The ID of the entry is
+// returned. IDs start with the time of issuance so that they sort in the
+// order the credentials were issued.
+func (b *backend) putIssuance(req *logical.Request, namespace, roleName string, entry *issuance) (string, error) {
+	entry.DisplayName = req.DisplayName
+	if req.Connection != nil {
+		entry.ClientAddr = req.Connection.RemoteAddr
+	}
+	entry.LeasePath = req.MountPoint + req.Path
+	entry.IssuedAt = time.Now().UTC()
+
+	id := fmt.Sprintf("%019d-%s", entry.IssuedAt.UnixNano(), uuid.GenerateUUID())
+	prefix := issuanceLogPath(namespace, roleName)
+	storageEntry, err := logical.StorageEntryJSON(prefix+id, entry)
+	if err != nil {
+		return "", err
+	}
+
+	b.issuanceLock.Lock()
+	defer b.issuanceLock.Unlock()
+
+	if err := req.Storage.Put(storageEntry); err != nil {
+		return "", err
+	}
+	ids, err := issuanceIDs(req.Storage, namespace, roleName)
+	if err != nil {
+		return "", err
+	}
+	for len(ids) > issuanceLogSize {
+		if err := req.Storage.Delete(prefix + ids[0]); err != nil {
+			return "", err
+		}
+		ids = ids[1:]
+	}
+	return id, nil
+}
+
+// Returns the IDs of the issuance log of the role, oldest first.
+func issuanceIDs(s logical.Storage, namespace, roleName string) ([]string, error) {
+	prefix := issuanceLogPath(namespace, roleName)
+	keys, err := s.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		ids = append(ids, strings.TrimPrefix(key, prefix))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Returns the entry of the issuance log, or nil if it was deleted.
+func getIssuance(s logical.Storage, namespace, roleName, id string) (*issuance, error) {
+	entry, err := s.Get(issuanceLogPath(namespace, roleName) + id)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result issuance
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Applies update to the entries of the issuance log of the credentials of
+// the secret. Entries that were deleted from the log are skipped, as are
+// secrets issued before the log was kept.
+func (b *backend) updateIssuances(s logical.Storage, secret *logical.Secret, update func(*issuance)) error {
+	namespace, _ := secret.InternalData["namespace"].(string)
+	roleName, _ := secret.InternalData["role_name"].(string)
+
+	var ids []string
+	if id, ok := secret.InternalData["issuance_id"].(string); ok {
+		ids = append(ids, id)
+	}
+	if idsRaw, ok := secret.InternalData["issuance_ids"]; ok {
+		var batch []string
+		if err := mapstructure.Decode(idsRaw, &batch); err != nil {
+			return fmt.Errorf("secret is missing internal data")
+		}
+		ids = append(ids, batch...)
+	}
+	if roleName == "" || len(ids) == 0 {
+		return nil
+	}
+
+	b.issuanceLock.Lock()
+	defer b.issuanceLock.Unlock()
+
+	for _, id := range ids {
+		if err := b.updateIssuance(s, namespace, roleName, id, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Applies update to the entry of the issuance log, if it still exists. The
+// caller must hold the issuanceLock.
+func (b *backend) updateIssuance(s logical.Storage, namespace, roleName, id string, update func(*issuance)) error {
+	entry, err := getIssuance(s, namespace, roleName, id)
+	if err != nil || entry == nil {
+		return err
+	}
+	update(entry)
+	storageEntry, err := logical.StorageEntryJSON(issuanceLogPath(namespace, roleName)+id, entry)
+	if err != nil {
+		return err
+	}
+	return s.Put(storageEntry)
+}
+
+// Marks the credentials of the secret as revoked in the issuance log.
+func (b *backend) revokeIssuances(s logical.Storage, secret *logical.Secret) error {
+	revokedAt := time.Now().UTC()
+	return b.updateIssuances(s, secret, func(entry *issuance) {
+		if entry.RevokedAt.IsZero() {
+			entry.RevokedAt = revokedAt
+		}
+	})
+}
+
+// Marks every credential in the issuance log of the role as revoked at the
+// given time, unless it was already revoked. The dynamic keys for the same
+// username and IP as the failed keys are left alone, since they may still
+// be installed.
+func (b *backend) revokeRoleIssuances(s logical.Storage, namespace, roleName string, revokedAt time.Time, failed []*walDynamicKey) error {
+	b.issuanceLock.Lock()
+	defer b.issuanceLock.Unlock()
+
+	ids, err := issuanceIDs(s, namespace, roleName)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err := b.updateIssuance(s, namespace, roleName, id, func(entry *issuance) {
+			if !entry.RevokedAt.IsZero() {
+				return
+			}
+			for _, key := range failed {
+				if entry.KeyType == KeyTypeDynamic && entry.Username == key.Username && entry.IP == key.IP {
+					return
+				}
+			}
+			entry.RevokedAt = revokedAt
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *backend) pathIssuedList(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	namespace := d.Get("namespace").(string)
+	roleName := d.Get("role").(string)
+
+	ids, err := issuanceIDs(req.Storage, namespace, roleName)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	names := make([]string, 0, len(ids))
+	keyInfo := make(map[string]interface{}, len(ids))
+	for _, id := range ids {
+		entry, err := getIssuance(req.Storage, namespace, roleName, id)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue
+		}
+		info := map[string]interface{}{
+			"key_type":     entry.KeyType,
+			"username":     entry.Username,
+			"ip":           entry.IP,
+			"port":         entry.Port,
+			"display_name": entry.DisplayName,
+			"client_addr":  entry.ClientAddr,
+			"lease_path":   entry.LeasePath,
+			"issued_at":    entry.IssuedAt.Format(time.RFC3339),
+			"expires_at":   entry.ExpiresAt.Format(time.RFC3339),
+			"live":         entry.live(now),
+		}
+		if !entry.RevokedAt.IsZero() {
+			info["revoked_at"] = entry.RevokedAt.Format(time.RFC3339)
+		}
+		names = append(names, id)
+		keyInfo[id] = info
+	}
+
+	resp := logical.ListResponse(names)
+	resp.Data["key_info"] = keyInfo
+	return resp, nil
+}
+
+const pathIssuedHelpSyn = `
+List the credentials issued by a role.
+`
+
+const pathIssuedHelpDesc = `
+Every OTP and dynamic key issued by a role is recorded in the issuance log of
+the role, along with who requested it, for which username, IP and port, and
+when it was issued and expires. The log keeps the last 1000 credentials of
+each role.
+
+Listing 'issued/<role>' returns the IDs of the recorded credentials, oldest
+first, and 'key_info' holds the details of each of them. 'live' tells whether
+the credential can still be used, which is until its lease expires or it is
+revoked, so the credentials that are live for a host are the live ones with
+its IP. The 'issuance_id' returned along with a credential is its ID in the
+log.
+
+Vault assigns the lease ID of a credential after the role issued it, so the
+log records 'lease_path' instead, which the lease ID starts with. The log is
+kept after the role is deleted. Credentials issued before the log was added
+are not recorded.
+`
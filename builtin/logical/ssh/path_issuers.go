@@ -0,0 +1,274 @@
+package ssh
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// configIssuers points to the issuer that signs for the CA roles that don't
+// name one.
+type configIssuers struct {
+	Default string `json:"default"`
+}
+
+func pathIssuers(b *backend) *framework.Path {
+	fields := caKeyFields()
+	fields["issuer"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "[Required] Name of the issuer.",
+	}
+
+	return &framework.Path{
+		Pattern: "issuers/" + framework.GenericNameRegex("issuer"),
+		Fields:  fields,
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:   b.pathIssuerRead,
+			logical.WriteOperation:  b.pathIssuerWrite,
+			logical.DeleteOperation: b.pathIssuerDelete,
+		},
+
+		HelpSynopsis:    pathIssuersHelpSyn,
+		HelpDescription: pathIssuersHelpDesc,
+	}
+}
+
+func pathIssuersList(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "issuers/?",
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathIssuersList,
+			logical.ReadOperation: b.pathIssuersList,
+		},
+
+		HelpSynopsis:    pathIssuersListHelpSyn,
+		HelpDescription: pathIssuersListHelpDesc,
+	}
+}
+
+func pathConfigIssuers(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/issuers",
+		Fields: map[string]*framework.FieldSchema{
+			"default": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `[Optional] Name of the issuer that signs for the CA roles that
+				don't name one. If not set, they use the key configured at 'config/ca'.`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:  b.pathConfigIssuersRead,
+			logical.WriteOperation: b.pathConfigIssuersWrite,
+		},
+
+		HelpSynopsis:    pathConfigIssuersHelpSyn,
+		HelpDescription: pathConfigIssuersHelpDesc,
+	}
+}
+
+func issuerPath(name string) string {
+	return "issuers/" + name
+}
+
+func (b *backend) pathIssuerRead(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	ca, err := readCA(req.Storage, issuerPath(d.Get("issuer").(string)))
+	if err != nil {
+		return nil, err
+	}
+	if ca == nil {
+		return nil, nil
+	}
+
+	// The private key is never returned.
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"public_key": ca.PublicKey,
+		},
+	}, nil
+}
+
+func (b *backend) pathIssuerWrite(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("issuer").(string)
+	if name == "" {
+		return logical.ErrorResponse("Missing issuer"), nil
+	}
+	return writeCA(req.Storage, d, issuerPath(name))
+}
+
+func (b *backend) pathIssuerDelete(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("issuer").(string)
+
+	b.issuersLock.Lock()
+	defer b.issuersLock.Unlock()
+
+	// The default issuer must be replaced before it can be deleted, or CA
+	// roles without an issuer would silently fall back to 'config/ca'.
+	conf, err := b.IssuersConfig(req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Default == name {
+		return logical.ErrorResponse(fmt.Sprintf("Issuer '%s' is the default issuer", name)), nil
+	}
+
+	return nil, req.Storage.Delete(issuerPath(name))
+}
+
+func (b *backend) pathIssuersList(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	prefix := issuerPath("")
+	entries, err := req.Storage.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	keyInfo := make(map[string]interface{}, len(entries))
+	for _, name := range entries {
+		name = strings.TrimPrefix(name, prefix)
+		ca, err := readCA(req.Storage, issuerPath(name))
+		if err != nil {
+			return nil, err
+		}
+		if ca == nil {
+			continue
+		}
+		names = append(names, name)
+		keyInfo[name] = map[string]interface{}{
+			"public_key": ca.PublicKey,
+		}
+	}
+	sort.Strings(names)
+
+	resp := logical.ListResponse(names)
+	resp.Data["key_info"] = keyInfo
+	return resp, nil
+}
+
+func (b *backend) pathConfigIssuersRead(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	conf, err := b.IssuersConfig(req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"default": conf.Default,
+		},
+	}, nil
+}
+
+func (b *backend) pathConfigIssuersWrite(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("default").(string)
+
+	b.issuersLock.Lock()
+	defer b.issuersLock.Unlock()
+
+	if name != "" {
+		ca, err := readCA(req.Storage, issuerPath(name))
+		if err != nil {
+			return nil, err
+		}
+		if ca == nil {
+			return logical.ErrorResponse(fmt.Sprintf("Issuer '%s' not found", name)), nil
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON("config/issuers", &configIssuers{
+		Default: name,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create storage entry JSON: %s", err)
+	}
+	if err := req.Storage.Put(entry); err != nil {
+		return nil, fmt.Errorf("could not store JSON: %s", err)
+	}
+
+	return nil, nil
+}
+
+// IssuersConfig returns the configuration of the issuers of the backend.
+func (b *backend) IssuersConfig(s logical.Storage) (*configIssuers, error) {
+	entry, err := s.Get("config/issuers")
+	if err != nil {
+		return nil, err
+	}
+
+	var result configIssuers
+	if entry != nil {
+		if err := entry.DecodeJSON(&result); err != nil {
+			return nil, err
+		}
+	}
+
+	return &result, nil
+}
+
+// Returns the CA key that signs for the role and the name of its issuer. The
+// issuer of the role is used if it names one, then the default issuer, and
+// then the key configured at 'config/ca', whose issuer name is empty. A nil
+// key is returned if the issuer doesn't exist.
+func (b *backend) roleCA(s logical.Storage, role *sshRole) (*configCA, string, error) {
+	return b.issuerCA(s, role.Issuer)
+}
+
+// Returns the CA key of the named issuer, or of the default issuer if the
+// name is empty, along with the name of the issuer. See roleCA.
+func (b *backend) issuerCA(s logical.Storage, name string) (*configCA, string, error) {
+	if name == "" {
+		conf, err := b.IssuersConfig(s)
+		if err != nil {
+			return nil, "", err
+		}
+		name = conf.Default
+	}
+	if name == "" {
+		ca, err := b.CA(s)
+		return ca, "", err
+	}
+
+	ca, err := readCA(s, issuerPath(name))
+	return ca, name, err
+}
+
+const pathIssuersHelpSyn = `
+Manage the named CA keys of the backend.
+`
+
+const pathIssuersHelpDesc = `
+Besides the CA key configured at 'config/ca', the backend can hold several
+named CA keys, called issuers. Their keys are imported or generated like the
+one of 'config/ca'. CA roles sign with the issuer they name, or else with the
+default issuer set at 'config/issuers', or else with the key of 'config/ca'.
+
+Issuers allow rotating the CA gradually: a new issuer is created and its public
+key distributed to the hosts next to the old one, then the default issuer is
+switched to it, and the old issuer is deleted once the certificates it signed
+have expired. The default issuer can't be deleted.
+
+Reading an issuer returns its public key. The private key is never returned.
+`
+
+const pathIssuersListHelpSyn = `
+List the issuers of the backend.
+`
+
+const pathIssuersListHelpDesc = `
+Lists the names of the issuers, along with their public keys, so that all the
+keys that the hosts should trust can be distributed to them.
+`
+
+const pathConfigIssuersHelpSyn = `
+Configure the default issuer of the CA roles.
+`
+
+const pathConfigIssuersHelpDesc = `
+The default issuer signs for the CA roles that don't name an issuer. Switching
+it moves all of them to another CA key at once, without rewriting the roles.
+If it isn't set, they sign with the key configured at 'config/ca'.
+`
@@ -1,22 +1,47 @@
 package ssh
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/hashicorp/go-multierror"
 	"golang.org/x/crypto/ssh"
 
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 )
 
+// adminCertTTL is the validity of the certificates that Vault signs for the
+// keys that log in to remote hosts with 'sign_with_ca'.
+const adminCertTTL = 5 * time.Minute
+
 type sshHostKey struct {
 	Key string `json:"key"`
+
+	// Certificate is the SSH certificate presented along with the key, and
+	// SignWithCA has Vault sign a short-lived one with the CA of the mount
+	// every time the key is used instead.
+	Certificate string `json:"certificate"`
+	SignWithCA  bool   `json:"sign_with_ca"`
+
+	// Password is used instead of a private key to login to hosts that
+	// don't accept public keys, optionally through keyboard-interactive
+	// prompts.
+	Password            string `json:"password"`
+	KeyboardInteractive bool   `json:"keyboard_interactive"`
 }
 
 func pathKeys(b *backend) *framework.Path {
 	return &framework.Path{
-		Pattern: "keys/" + framework.GenericNameRegex("key_name"),
+		Pattern: "keys/" + namespacePathRegex + framework.GenericNameRegex("key_name"),
 		Fields: map[string]*framework.FieldSchema{
+			"namespace": namespaceField,
 			"key_name": &framework.FieldSchema{
 				Type:        framework.TypeString,
 				Description: "[Required] Name of the key",
@@ -25,6 +50,27 @@ func pathKeys(b *backend) *framework.Path {
 				Type:        framework.TypeString,
 				Description: "[Required] SSH private key with super user privileges in host",
 			},
+			"certificate": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `[Optional] SSH user certificate of the key, in OpenSSH format.
+				It is presented along with the key to hosts that trust its CA.`,
+			},
+			"sign_with_ca": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `[Optional] Have Vault sign a short-lived certificate of the key
+				with the CA of the mount every time it logs in with it, for the user it
+				logs in as. Can't be combined with 'certificate'.`,
+			},
+			"password": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `[Optional] Password of the admin user, used instead of 'key' for
+				hosts that don't accept public key logins.`,
+			},
+			"keyboard_interactive": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `[Optional] Also answer the keyboard-interactive prompts of the
+				hosts with the password. Only applicable with 'password'.`,
+			},
 		},
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.ReadOperation:   b.pathKeysRead,
@@ -36,8 +82,31 @@ func pathKeys(b *backend) *framework.Path {
 	}
 }
 
-func (b *backend) getKey(s logical.Storage, n string) (*sshHostKey, error) {
-	entry, err := s.Get("keys/" + n)
+func pathKeysBulk(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "keys" + namespaceListPathRegex,
+		Fields: map[string]*framework.FieldSchema{
+			"namespace": namespaceField,
+			"keys": &framework.FieldSchema{
+				Type:        framework.TypeMap,
+				Description: "[Required] Map of key names to SSH private keys with super user privileges in host",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation:  b.pathKeysList,
+			logical.ReadOperation:  b.pathKeysList,
+			logical.WriteOperation: b.pathKeysBulkWrite,
+		},
+		HelpSynopsis:    pathKeysBulkSyn,
+		HelpDescription: pathKeysBulkDesc,
+	}
+}
+
+// Key names must be usable in the 'keys/' endpoint.
+var keyNameRegex = regexp.MustCompile("^" + framework.GenericNameRegex("key_name") + "$")
+
+func (b *backend) getKey(s logical.Storage, namespace, n string) (*sshHostKey, error) {
+	entry, err := s.Get(keyPath(namespace, n))
 	if err != nil {
 		return nil, err
 	}
@@ -52,8 +121,57 @@ func (b *backend) getKey(s logical.Storage, n string) (*sshHostKey, error) {
 	return &result, nil
 }
 
+// Returns the certificate to present along with the key when logging in as
+// the user, or an empty string if there is none. Keys with 'sign_with_ca'
+// get a new certificate signed by the default issuer of the mount, valid
+// for a few minutes and only for the user.
+func (b *backend) keyCertificate(s logical.Storage, key *sshHostKey, username string) (string, error) {
+	if !key.SignWithCA {
+		return key.Certificate, nil
+	}
+
+	ca, _, err := b.issuerCA(s, "")
+	if err != nil {
+		return "", err
+	}
+	if ca == nil {
+		return "", fmt.Errorf("CA key not configured to sign the certificate of the key")
+	}
+	caKey, err := ssh.ParseRawPrivateKey([]byte(ca.PrivateKey))
+	if err != nil {
+		return "", fmt.Errorf("error reading the CA key: %s", err)
+	}
+	caSigner, err := newCertSigner(caKey, "")
+	if err != nil {
+		return "", err
+	}
+	signer, err := ssh.ParsePrivateKey([]byte(key.Key))
+	if err != nil {
+		return "", err
+	}
+
+	var serial uint64
+	if err := binary.Read(rand.Reader, binary.BigEndian, &serial); err != nil {
+		return "", fmt.Errorf("error generating serial number: %s", err)
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           "vault-admin-" + fingerprintSHA256(signer.PublicKey()),
+		ValidPrincipals: []string{username},
+		ValidAfter:      uint64(now.Add(-30 * time.Second).Unix()),
+		ValidBefore:     uint64(now.Add(adminCertTTL).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		return "", fmt.Errorf("error signing the certificate of the key: %s", err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert))), nil
+}
+
 func (b *backend) pathKeysRead(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	key, err := b.getKey(req.Storage, d.Get("key_name").(string))
+	key, err := b.getKey(req.Storage, d.Get("namespace").(string), d.Get("key_name").(string))
 	if err != nil {
 		return nil, err
 	}
@@ -63,15 +181,65 @@ func (b *backend) pathKeysRead(req *logical.Request, d *framework.FieldData) (*l
 
 	return &logical.Response{
 		Data: map[string]interface{}{
-			"key": key.Key,
+			"key":                  key.Key,
+			"certificate":          key.Certificate,
+			"sign_with_ca":         key.SignWithCA,
+			"password":             key.Password,
+			"keyboard_interactive": key.KeyboardInteractive,
 		},
 	}, nil
 }
 
+// Lists the names of the keys along with the fingerprints of their public
+// keys. The private keys are never returned.
+func (b *backend) pathKeysList(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	namespace := d.Get("namespace").(string)
+	prefix := keyPath(namespace, "")
+	entries, err := req.Storage.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	keyInfo := make(map[string]interface{}, len(entries))
+	for _, name := range entries {
+		name = strings.TrimPrefix(name, prefix)
+		if strings.Contains(name, "/") {
+			continue
+		}
+
+		key, err := b.getKey(req.Storage, namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			continue
+		}
+
+		// Keys are validated when they are registered, so this is not
+		// expected to fail. Passwords have no fingerprint.
+		var fingerprint string
+		if signer, err := ssh.ParsePrivateKey([]byte(key.Key)); err == nil {
+			fingerprint = fingerprintSHA256(signer.PublicKey())
+		}
+
+		names = append(names, name)
+		keyInfo[name] = map[string]interface{}{
+			"fingerprint": fingerprint,
+		}
+	}
+	sort.Strings(names)
+
+	resp := logical.ListResponse(names)
+	resp.Data["key_info"] = keyInfo
+	return resp, nil
+}
+
 func (b *backend) pathKeysDelete(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	keyName := d.Get("key_name").(string)
-	keyPath := fmt.Sprintf("keys/%s", keyName)
-	err := req.Storage.Delete(keyPath)
+	b.keyLock.Lock()
+	defer b.keyLock.Unlock()
+	err := req.Storage.Delete(keyPath(d.Get("namespace").(string), keyName))
 	if err != nil {
 		return nil, err
 	}
@@ -85,6 +253,28 @@ func (b *backend) pathKeysWrite(req *logical.Request, d *framework.FieldData) (*
 	}
 
 	keyString := d.Get("key").(string)
+	password := d.Get("password").(string)
+	keyboardInteractive := d.Get("keyboard_interactive").(bool)
+	certificate := strings.TrimSpace(d.Get("certificate").(string))
+	signWithCA := d.Get("sign_with_ca").(bool)
+
+	b.keyLock.Lock()
+	defer b.keyLock.Unlock()
+
+	// Passwords are stored like private keys, and only used instead of
+	// them.
+	if password != "" {
+		if keyString != "" || certificate != "" || signWithCA {
+			return logical.ErrorResponse("password can't be combined with key, certificate or sign_with_ca"), nil
+		}
+		return b.putKey(req.Storage, keyPath(d.Get("namespace").(string), keyName), &sshHostKey{
+			Password:            password,
+			KeyboardInteractive: keyboardInteractive,
+		})
+	}
+	if keyboardInteractive {
+		return logical.ErrorResponse("keyboard_interactive is only applicable with password"), nil
+	}
 
 	// Check if the key provided is infact a private key
 	signer, err := ssh.ParsePrivateKey([]byte(keyString))
@@ -96,21 +286,128 @@ func (b *backend) pathKeysWrite(req *logical.Request, d *framework.FieldData) (*
 		return logical.ErrorResponse("Missing key"), nil
 	}
 
-	keyPath := fmt.Sprintf("keys/%s", keyName)
+	if certificate != "" && signWithCA {
+		return logical.ErrorResponse("certificate and sign_with_ca can't both be set"), nil
+	}
+	if certificate != "" {
+		cert, err := parseKeyCertificate(certificate)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid certificate: %s", err)), nil
+		}
+		if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+			return logical.ErrorResponse("Invalid certificate: it doesn't certify the key"), nil
+		}
+	}
 
 	// Store the key
-	entry, err := logical.StorageEntryJSON(keyPath, map[string]interface{}{
-		"key": keyString,
+	return b.putKey(req.Storage, keyPath(d.Get("namespace").(string), keyName), &sshHostKey{
+		Key:         keyString,
+		Certificate: certificate,
+		SignWithCA:  signWithCA,
 	})
+}
+
+// Stores the key at the path. The caller must hold the keyLock.
+func (b *backend) putKey(s logical.Storage, path string, key *sshHostKey) (*logical.Response, error) {
+	entry, err := logical.StorageEntryJSON(path, key)
 	if err != nil {
 		return nil, err
 	}
-	if err := req.Storage.Put(entry); err != nil {
+	if err := s.Put(entry); err != nil {
 		return nil, err
 	}
 	return nil, nil
 }
 
+func (b *backend) pathKeysBulkWrite(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	namespace := d.Get("namespace").(string)
+	keysRaw := d.Get("keys").(map[string]interface{})
+	if len(keysRaw) == 0 {
+		return logical.ErrorResponse("Missing keys"), nil
+	}
+
+	names := make([]string, 0, len(keysRaw))
+	for name := range keysRaw {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Validate every key before writing any of them, so that an invalid key
+	// doesn't leave the keys half registered.
+	var merr error
+	keys := make(map[string]string, len(keysRaw))
+	for _, name := range names {
+		if !keyNameRegex.MatchString(name) {
+			merr = multierror.Append(merr, fmt.Errorf("%s: invalid key name", name))
+			continue
+		}
+		keyString, ok := keysRaw[name].(string)
+		if !ok || keyString == "" {
+			merr = multierror.Append(merr, fmt.Errorf("%s: missing key", name))
+			continue
+		}
+		if signer, err := ssh.ParsePrivateKey([]byte(keyString)); err != nil || signer == nil {
+			merr = multierror.Append(merr, fmt.Errorf("%s: invalid key", name))
+			continue
+		}
+		keys[name] = keyString
+	}
+	if merr != nil {
+		return logical.ErrorResponse(merr.Error()), nil
+	}
+
+	b.keyLock.Lock()
+	defer b.keyLock.Unlock()
+
+	// Remember the existing keys so that they can be restored if any of
+	// the writes fail.
+	previous := make(map[string]*logical.StorageEntry, len(names))
+	for _, name := range names {
+		entry, err := req.Storage.Get(keyPath(namespace, name))
+		if err != nil {
+			return nil, err
+		}
+		previous[name] = entry
+	}
+
+	var written []string
+	for _, name := range names {
+		entry, err := logical.StorageEntryJSON(keyPath(namespace, name), map[string]interface{}{
+			"key": keys[name],
+		})
+		if err == nil {
+			err = req.Storage.Put(entry)
+		}
+		if err != nil {
+			if rerr := restoreKeys(req.Storage, namespace, written, previous); rerr != nil {
+				return nil, fmt.Errorf("error writing key '%s': %s; restoring keys failed: %s", name, err, rerr)
+			}
+			return nil, fmt.Errorf("error writing key '%s': %s", name, err)
+		}
+		written = append(written, name)
+	}
+
+	return nil, nil
+}
+
+// Restores the given keys to their previous state. Keys that didn't exist
+// before are deleted.
+func restoreKeys(s logical.Storage, namespace string, names []string, previous map[string]*logical.StorageEntry) error {
+	var merr error
+	for _, name := range names {
+		var err error
+		if entry := previous[name]; entry != nil {
+			err = s.Put(entry)
+		} else {
+			err = s.Delete(keyPath(namespace, name))
+		}
+		if err != nil {
+			merr = multierror.Append(merr, err)
+		}
+	}
+	return merr
+}
+
 const pathKeysSyn = `
 Register a shared private key with Vault.
 `
@@ -123,4 +420,37 @@ for unprivileged usernames.
 If this backend is mounted as "ssh", then the endpoint for registering shared key
 is "ssh/keys/webrack", if "webrack" is the user coined name for the key. The name
 given here can be associated with any number of roles via the endpoint "ssh/roles/".
+Keys are rotated by writing to "ssh/keys/webrack/rotate", which can also install
+the new key in the hosts before it replaces the current one.
+
+Hosts that trust an SSH CA can be logged in to with a certificate of the key
+instead of having the key in their authorized_keys files. The 'certificate' of
+the key is then presented along with it. With 'sign_with_ca', Vault signs a
+certificate of the key with the CA of the mount each time it logs in, valid
+for a few minutes and only for the admin user, so that no long-lived
+credential of the key is trusted by the hosts.
+
+Legacy appliances that don't accept public key logins can be given the
+'password' of the admin user instead of a key. It is stored and protected like
+the keys. With 'keyboard_interactive', the password also answers the
+keyboard-interactive prompts of hosts that only offer those.
+`
+
+const pathKeysBulkSyn = `
+List the registered shared keys or register multiple keys at once.
+`
+
+const pathKeysBulkDesc = `
+Reading this path lists the names of the registered keys, along with the
+SHA256 fingerprints of their public keys under 'key_info'. The private keys
+are not returned.
+
+Writing to this path registers multiple keys at once. The 'keys' parameter is
+a map of key names to private keys. All of the keys are validated before any
+of them is stored. If any key is invalid, none of them are registered and the
+problems with each of the keys are reported. If storing one of the keys fails,
+the keys that were already stored are restored to their previous state.
+
+The keys of a namespace are listed and registered by adding the namespace to
+the path, e.g. "ssh/keys/ns/tenant1/".
 `
@@ -0,0 +1,276 @@
+package ssh
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathKeysRotate(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "keys/" + namespacePathRegex + framework.GenericNameRegex("key_name") + "/rotate",
+		Fields: map[string]*framework.FieldSchema{
+			"namespace": namespaceField,
+			"key_name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "[Required] Name of the key to rotate",
+			},
+			"hosts": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `[Optional] Comma separated list of the IPs of the hosts that the new
+				key is installed in before it replaces the current key. Requires 'role'.
+				If not set, the key is replaced right away and its public key is to be
+				installed in the hosts out-of-band.`,
+			},
+			"role": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `[Optional] Name of a dynamic role that uses the key. The new key is
+				installed in the 'hosts' for its 'admin_user', with the connection
+				settings and the install script of the role. The hosts must belong to
+				the role.`,
+			},
+			"key_algorithm": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `[Optional] Algorithm of the new key, 'rsa' or 'ecdsa-p256'.
+				Defaults to the one configured at 'config/defaults'.`,
+			},
+			"key_bits": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `[Optional] Length of the new RSA key in bits. Defaults to the one
+				configured at 'config/defaults'.`,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.WriteOperation: b.pathKeysRotateWrite,
+		},
+		HelpSynopsis:    pathKeysRotateSyn,
+		HelpDescription: pathKeysRotateDesc,
+	}
+}
+
+func (b *backend) pathKeysRotateWrite(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	namespace := d.Get("namespace").(string)
+	keyName := d.Get("key_name").(string)
+
+	hostKey, err := b.getKey(req.Storage, namespace, keyName)
+	if err != nil {
+		return nil, err
+	}
+	if hostKey == nil {
+		return logical.ErrorResponse(fmt.Sprintf("Key '%s' not found", keyName)), nil
+	}
+	if hostKey.Password != "" {
+		return logical.ErrorResponse("Passwords can't be rotated"), nil
+	}
+	if hostKey.Certificate != "" {
+		return logical.ErrorResponse("Keys with a certificate can't be rotated, since the certificate doesn't certify the new key"), nil
+	}
+	oldSigner, err := ssh.ParsePrivateKey([]byte(hostKey.Key))
+	if err != nil {
+		return nil, fmt.Errorf("error reading the key: %s", err)
+	}
+
+	var hosts []string
+	for _, host := range strings.Split(d.Get("hosts").(string), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	var role *sshRole
+	roleName := d.Get("role").(string)
+	if len(hosts) > 0 {
+		if roleName == "" {
+			return logical.ErrorResponse("Missing role to install the new key in the hosts"), nil
+		}
+		role, err = b.getRole(req.Storage, namespace, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			return logical.ErrorResponse(fmt.Sprintf("Role '%s' not found", roleName)), nil
+		}
+		if role.KeyType != KeyTypeDynamic || role.KeyName != keyName {
+			return logical.ErrorResponse(fmt.Sprintf("Role '%s' is not a dynamic role that uses key '%s'", roleName, keyName)), nil
+		}
+		for i, host := range hosts {
+			ip, err := validateRoleIP(role, roleName, host, false)
+			if err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+			hosts[i] = ip
+		}
+	}
+
+	defaults, err := b.DefaultsConfig(req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	keyAlgorithm := strings.ToLower(d.Get("key_algorithm").(string))
+	if keyAlgorithm == "" {
+		keyAlgorithm = defaults.KeyAlgorithm
+	}
+	keyBits := d.Get("key_bits").(int)
+	if keyBits == 0 {
+		keyBits = defaults.KeyBits
+	}
+	if keyAlgorithm == KeyAlgorithmRSA {
+		if err := validateRSAKeyBits(keyBits); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid key_bits field. %s", err)), nil
+		}
+	}
+	newPublicKey, newPrivateKey, err := generateDynamicKeys(keyAlgorithm, keyBits)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	oldPublicKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(oldSigner.PublicKey())))
+
+	// Install the new key with the current one. If it can't be installed
+	// in every host, it is removed from the others and the key is kept.
+	failures := []map[string]interface{}{}
+	var installed []string
+	for i, err := range b.rotateKeyInHosts(req.Storage, namespace, role, hostKey, hosts, newPublicKey, true) {
+		if err != nil {
+			failures = append(failures, map[string]interface{}{
+				"ip":    hosts[i],
+				"error": err.Error(),
+			})
+			continue
+		}
+		installed = append(installed, hosts[i])
+	}
+	if len(failures) > 0 {
+		resp := &logical.Response{
+			Data: map[string]interface{}{
+				"rotated":  false,
+				"failures": failures,
+			},
+		}
+		for i, err := range b.rotateKeyInHosts(req.Storage, namespace, role, hostKey, installed, newPublicKey, false) {
+			if err != nil {
+				resp.AddWarning(fmt.Sprintf("error removing the new key from %s: %s", installed[i], err))
+			}
+		}
+		return resp, nil
+	}
+
+	// Replace the key, unless it was changed while the new key was being
+	// installed.
+	newHostKey := &sshHostKey{
+		Key:        newPrivateKey,
+		SignWithCA: hostKey.SignWithCA,
+	}
+	b.keyLock.Lock()
+	current, err := b.getKey(req.Storage, namespace, keyName)
+	if err == nil && (current == nil || current.Key != hostKey.Key) {
+		err = fmt.Errorf("key '%s' was changed during the rotation", keyName)
+	}
+	if err == nil {
+		_, err = b.putKey(req.Storage, keyPath(namespace, keyName), newHostKey)
+	}
+	b.keyLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// The previous key no longer has to be trusted by the hosts.
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"rotated":    true,
+			"public_key": newPublicKey,
+			"hosts":      hosts,
+		},
+	}
+	for i, err := range b.rotateKeyInHosts(req.Storage, namespace, role, newHostKey, hosts, oldPublicKey, false) {
+		if err != nil {
+			resp.AddWarning(fmt.Sprintf("error removing the previous key from %s: %s", hosts[i], err))
+		}
+	}
+	return resp, nil
+}
+
+// Installs or uninstalls the public key for the admin user of the role in
+// the hosts, logging in with the host key, several hosts at once. The error
+// of each host is returned in the same order.
+func (b *backend) rotateKeyInHosts(s logical.Storage, namespace string, role *sshRole, hostKey *sshHostKey, hosts []string, publicKey string, install bool) []error {
+	if len(hosts) == 0 {
+		return nil
+	}
+	errs := make([]error, len(hosts))
+	defaults, err := b.DefaultsConfig(s)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	script := newInstallScript(role).Script
+
+	sem := make(chan struct{}, maxParallelInstalls)
+	var wg sync.WaitGroup
+	for i, ip := range hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, ip string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			opts := &installOptions{
+				AdminUser:                role.AdminUser,
+				HostKey:                  hostKey.Key,
+				Username:                 role.AdminUser,
+				IP:                       ip,
+				Port:                     role.Port,
+				DynamicPublicKey:         publicKey,
+				InstallScript:            script,
+				InstallScriptInterpreter: role.InstallScriptInterpreter,
+				InstallScriptType:        role.installScriptType(),
+				HostKeyFingerprint:       role.HostKeyFingerprint,
+				BastionHost:              role.BastionHost,
+				BastionPort:              role.BastionPort,
+				BastionUser:              role.BastionUser,
+				DialTimeout:              defaults.DialTimeout,
+				DialRetries:              defaults.DialRetries,
+				DialBackoff:              defaults.DialBackoff,
+				MaxConnections:           defaults.MaxConnectionsPerHost,
+				IdleTimeout:              defaults.ConnectionIdleTimeout,
+				Install:                  install,
+			}
+			var err error
+			opts.HostKeyCertificate, err = b.keyCertificate(s, hostKey, role.AdminUser)
+			if err == nil {
+				err = b.setBastionKey(s, namespace, opts, role.BastionKeyName)
+			}
+			if err == nil {
+				err = b.installKey(opts)
+			}
+			errs[i] = err
+		}(i, ip)
+	}
+	wg.Wait()
+	return errs
+}
+
+const pathKeysRotateSyn = `
+Replace a shared key with a newly generated one.
+`
+
+const pathKeysRotateDesc = `
+Writing to this path generates a new private key and replaces the shared key
+with it. The new key keeps 'sign_with_ca' of the current key. Passwords and
+keys with a 'certificate' can't be rotated.
+
+When 'hosts' are given, the new public key is first installed in each of them
+for the admin user of 'role', logging in with the current key. The key is only
+replaced if the new one was installed in all the hosts; otherwise the new key
+is removed from the hosts it was installed in and the failures are returned.
+Once the key is replaced, the previous public key is removed from the hosts
+with the new key, and a warning is returned for the hosts it can't be removed
+from.
+
+Without 'hosts', the key is replaced right away. The public key of the new key
+is returned so that it can be installed in the hosts out-of-band.
+`
@@ -3,6 +3,7 @@ package ssh
 import (
 	"fmt"
 	"net"
+	"strings"
 
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
@@ -12,10 +13,15 @@ func pathLookup(b *backend) *framework.Path {
 	return &framework.Path{
 		Pattern: "lookup",
 		Fields: map[string]*framework.FieldSchema{
+			"namespace": namespaceField,
 			"ip": &framework.FieldSchema{
 				Type:        framework.TypeString,
 				Description: "[Required] IP address of remote host",
 			},
+			"username": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "[Optional] Username in remote host. If given, only roles that allow it are returned",
+			},
 		},
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.WriteOperation: b.pathLookupWrite,
@@ -35,19 +41,42 @@ func (b *backend) pathLookupWrite(req *logical.Request, d *framework.FieldData)
 		return logical.ErrorResponse(fmt.Sprintf("Invalid IP '%s'", ip.String())), nil
 	}
 
-	// Get all the roles created in the backend.
-	keys, err := req.Storage.List("roles/")
+	username := d.Get("username").(string)
+	namespace := d.Get("namespace").(string)
+
+	// Get all the roles created in the namespace.
+	prefix := rolePath(namespace, "")
+	keys, err := req.Storage.List(prefix)
 	if err != nil {
 		return nil, err
 	}
 
 	// Look for roles which has CIDR blocks that encompasses the given IP
-	// and create a list out of it.
+	// and create a list out of it. If a username is given, the roles must
+	// also allow a credential to be issued for it.
 	var matchingRoles []string
-	for _, role := range keys {
-		if contains, _ := roleContainsIP(req.Storage, role, ip.String()); contains {
-			matchingRoles = append(matchingRoles, role)
+	for _, roleName := range keys {
+		roleName = strings.TrimPrefix(roleName, prefix)
+		role, err := b.getRole(req.Storage, namespace, roleName)
+		if err != nil || role == nil {
+			continue
+		}
+		if role.KeyType == KeyTypeCA {
+			continue
 		}
+		zeroAddress := false
+		if role.KeyType == KeyTypeOTP {
+			zeroAddress, _ = b.isZeroAddressRole(req.Storage, namespace, roleName)
+		}
+		if _, err := validateRoleIP(role, roleName, ip.String(), zeroAddress); err != nil {
+			continue
+		}
+		if username != "" {
+			if _, err := resolveUsername(req, role, username); err != nil {
+				continue
+			}
+		}
+		matchingRoles = append(matchingRoles, roleName)
 	}
 
 	// This list may potentially reveal more information than it is supposed to.
@@ -77,5 +106,10 @@ specifying the 'role' name. The roles that can be used to generate the key for
 a particular IP, are listed via this endpoint. For example, if this backend is
 mounted at "ssh", then "ssh/lookup" lists the roles associated with keys can be
 generated for a target IP, if the CIDR block encompassing the IP is registered
-with vault.
+with vault. Only the roles of the given 'namespace' are searched, or the roles
+of the default namespace if it is not given.
+
+If a 'username' is given as well, only the roles that would issue a credential
+for that username are listed. No credential is issued by this endpoint, so it
+can be used to troubleshoot why a credential request is denied.
 `
@@ -0,0 +1,117 @@
+package ssh
+
+import (
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// Names of the counters kept for each role.
+const (
+	metricCredsIssued    = "creds_issued"
+	metricOTPsVerified   = "otps_verified"
+	metricInstallsFailed = "installs_failed"
+	metricRevocations    = "revocations"
+)
+
+func pathMetrics(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "metrics",
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathMetricsRead,
+		},
+
+		HelpSynopsis:    pathMetricsHelpSyn,
+		HelpDescription: pathMetricsHelpDesc,
+	}
+}
+
+// Returns the name under which the counters of the role are kept.
+func metricsRoleKey(namespace, roleName string) string {
+	return namespacePrefix(namespace) + roleName
+}
+
+// Adds n to the counter of the role, and emits it to the telemetry sink of
+// the server. The sink only gets the total of all the roles, since each name
+// emitted to it is kept as a series of its own. The counters of the role are
+// kept only if the role is known.
+func (b *backend) incrMetric(namespace, roleName, name string, n int) {
+	if n <= 0 {
+		return
+	}
+	metrics.IncrCounter([]string{"ssh", name}, float32(n))
+	if roleName == "" {
+		return
+	}
+
+	key := metricsRoleKey(namespace, roleName)
+	b.metricsLock.Lock()
+	defer b.metricsLock.Unlock()
+	if b.metrics == nil {
+		b.metrics = make(map[string]map[string]int)
+	}
+	counters, ok := b.metrics[key]
+	if !ok {
+		counters = make(map[string]int)
+		b.metrics[key] = counters
+	}
+	counters[name] += n
+}
+
+// Drops the counters of the role, once the role is deleted.
+func (b *backend) deleteRoleMetrics(namespace, roleName string) {
+	b.metricsLock.Lock()
+	defer b.metricsLock.Unlock()
+	delete(b.metrics, metricsRoleKey(namespace, roleName))
+}
+
+func (b *backend) pathMetricsRead(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.metricsLock.Lock()
+	defer b.metricsLock.Unlock()
+
+	roles := make(map[string]interface{}, len(b.metrics))
+	for key, counters := range b.metrics {
+		role := map[string]interface{}{
+			metricCredsIssued:    0,
+			metricOTPsVerified:   0,
+			metricInstallsFailed: 0,
+			metricRevocations:    0,
+		}
+		for name, n := range counters {
+			role[name] = n
+		}
+		roles[key] = role
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"roles":           roles,
+			"connection_pool": b.pool.stats(),
+		},
+	}, nil
+}
+
+const pathMetricsHelpSyn = `
+Read the counters of the credentials issued and revoked by each role, and of
+the connections to remote hosts.
+`
+
+const pathMetricsHelpDesc = `
+Reading this path returns, for each role, the number of credentials issued,
+OTPs verified, dynamic keys that failed to be installed and credentials
+revoked. The roles of other namespaces than the default one are prefixed by
+'ns/<namespace>/'.
+
+The counters are kept in memory since the backend was mounted or Vault was
+last unsealed, and each Vault server counts only the requests it handled.
+The counters of a role are dropped when the role is deleted. The totals of
+the counters over all the roles are also emitted to the telemetry sink of the
+server, under 'ssh.<counter>', for alerting on failed installs or runaway
+issuance.
+
+The 'connection_pool' holds the number of connections to remote hosts opened
+and reused to install and remove dynamic keys, the number of requests that
+waited for a connection to be released, and the number of connections in use
+and idle.
+`
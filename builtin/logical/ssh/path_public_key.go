@@ -0,0 +1,53 @@
+package ssh
+
+import (
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathPublicKey(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "public_key",
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathPublicKeyRead,
+		},
+
+		HelpSynopsis:    pathPublicKeyHelpSyn,
+		HelpDescription: pathPublicKeyHelpDesc,
+	}
+}
+
+func (b *backend) pathPublicKeyRead(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	ca, _, err := b.issuerCA(req.Storage, "")
+	if err != nil {
+		return nil, err
+	}
+	if ca == nil {
+		return nil, nil
+	}
+
+	// The key is returned as is, so that it can be written to the file of
+	// 'TrustedUserCAKeys' directly.
+	return &logical.Response{
+		Data: map[string]interface{}{
+			logical.HTTPContentType: "text/plain",
+			logical.HTTPRawBody:     []byte(ca.PublicKey + "\n"),
+			logical.HTTPStatusCode:  200,
+		},
+	}, nil
+}
+
+const pathPublicKeyHelpSyn = `
+Retrieve the public key of the CA.
+`
+
+const pathPublicKeyHelpDesc = `
+Reading this path returns the public key of the CA that signs for the roles
+that don't name an issuer, which is the default issuer, or else the key of
+'config/ca'. The key is returned as plain text in the authorized_keys format,
+so that it can be written to the 'TrustedUserCAKeys' file of the hosts.
+
+This path doesn't require a token, so that hosts can fetch the key when they
+are set up. Nothing is returned if no CA key is configured.
+`
@@ -0,0 +1,131 @@
+package ssh
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathRoleConnectionTest(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/" + namespacePathRegex + framework.GenericNameRegex("role") + "/test",
+		Fields: map[string]*framework.FieldSchema{
+			"namespace": namespaceField,
+			"role": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "[Required] Name of the dynamic role whose admin credentials are tested.",
+			},
+			"ip": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "[Required] IP of the remote host. It must belong to the role.",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.WriteOperation: b.pathRoleConnectionTestWrite,
+		},
+
+		HelpSynopsis:    pathRoleConnectionTestHelpSyn,
+		HelpDescription: pathRoleConnectionTestHelpDesc,
+	}
+}
+
+func (b *backend) pathRoleConnectionTestWrite(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	namespace := d.Get("namespace").(string)
+	roleName := d.Get("role").(string)
+	ipRaw := d.Get("ip").(string)
+	if ipRaw == "" {
+		return logical.ErrorResponse("Missing ip"), nil
+	}
+
+	role, err := b.getRole(req.Storage, namespace, roleName)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving role: %s", err)
+	}
+	if role == nil {
+		return logical.ErrorResponse(fmt.Sprintf("Role '%s' not found", roleName)), nil
+	}
+	if role.KeyType != KeyTypeDynamic {
+		return logical.ErrorResponse("Only roles of 'dynamic' type have admin credentials to test"), nil
+	}
+
+	// The admin key is only used against hosts that the role could issue
+	// credentials for.
+	ip, err := validateRoleIP(role, roleName, ipRaw, false)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	hostKey, err := b.getKey(req.Storage, namespace, role.KeyName)
+	if err != nil {
+		return nil, err
+	}
+	if hostKey == nil {
+		return logical.ErrorResponse(fmt.Sprintf("Key '%s' not found", role.KeyName)), nil
+	}
+
+	defaults, err := b.DefaultsConfig(req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &installOptions{
+		AdminUser:               role.AdminUser,
+		HostKey:                 hostKey.Key,
+		HostPassword:            hostKey.Password,
+		HostKeyboardInteractive: hostKey.KeyboardInteractive,
+		IP:                      ip,
+		Port:                    role.Port,
+		HostKeyFingerprint:      role.HostKeyFingerprint,
+		BastionHost:             role.BastionHost,
+		BastionPort:             role.BastionPort,
+		BastionUser:             role.BastionUser,
+		DialTimeout:             defaults.DialTimeout,
+		DialRetries:             defaults.DialRetries,
+		DialBackoff:             defaults.DialBackoff,
+		MaxConnections:          defaults.MaxConnectionsPerHost,
+		IdleTimeout:             defaults.ConnectionIdleTimeout,
+	}
+
+	// Failing to connect is a result of the test rather than an error of
+	// the request.
+	start := time.Now()
+	opts.HostKeyCertificate, err = b.keyCertificate(req.Storage, hostKey, role.AdminUser)
+	if err == nil {
+		err = b.setBastionKey(req.Storage, namespace, opts, role.BastionKeyName)
+	}
+	if err == nil {
+		err = b.testConnection(opts)
+	}
+	latency := time.Since(start)
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"success": err == nil,
+			"ip":      ip,
+			"port":    role.Port,
+			"latency": latency.String(),
+		},
+	}
+	if err != nil {
+		resp.Data["error"] = err.Error()
+	}
+	return resp, nil
+}
+
+const pathRoleConnectionTestHelpSyn = `
+Test the connection to a remote host with the admin credentials of a role.
+`
+
+const pathRoleConnectionTestHelpDesc = `
+Writing to this path logs in to the remote host with the given IP using the
+admin user and the named key of a dynamic role, through the bastion host of
+the role if it has one. No credential is issued and nothing is changed in the
+remote host. The IP must belong to the role.
+
+The response tells whether the login succeeded and how long it took, and the
+error if it failed. Use it to check the admin key and the reachability of the
+hosts before requesting credentials for them.
+`
@@ -0,0 +1,121 @@
+package ssh
+
+import (
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathRoleRevokeAll(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/" + namespacePathRegex + framework.GenericNameRegex("role") + "/revoke-all",
+		Fields: map[string]*framework.FieldSchema{
+			"namespace": namespaceField,
+			"role": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "[Required] Name of the role whose credentials are revoked.",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.WriteOperation: b.pathRoleRevokeAllWrite,
+		},
+
+		HelpSynopsis:    pathRoleRevokeAllHelpSyn,
+		HelpDescription: pathRoleRevokeAllHelpDesc,
+	}
+}
+
+func (b *backend) pathRoleRevokeAllWrite(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	namespace := d.Get("namespace").(string)
+	roleName := d.Get("role").(string)
+
+	// Remove the dynamic keys issued by the role from their hosts. Keys
+	// that can't be removed stay recorded so that the request can be
+	// retried.
+	prefix := issuedKeysPath(namespace, roleName)
+	ids, err := req.Storage.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var found []string
+	var keys []*walDynamicKey
+	for _, id := range ids {
+		id = strings.TrimPrefix(id, prefix)
+		entry, err := req.Storage.Get(prefix + id)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue
+		}
+		var issued walDynamicKey
+		if err := entry.DecodeJSON(&issued); err != nil {
+			return nil, err
+		}
+		found = append(found, id)
+		keys = append(keys, &issued)
+	}
+
+	revokedKeys := 0
+	failures := []map[string]interface{}{}
+	var failed []*walDynamicKey
+	for i, err := range b.uninstallWALDynamicKeys(req.Storage, keys) {
+		if err != nil {
+			failed = append(failed, keys[i])
+			failures = append(failures, map[string]interface{}{
+				"id":       found[i],
+				"username": keys[i].Username,
+				"ip":       keys[i].IP,
+				"error":    err.Error(),
+			})
+			continue
+		}
+		if err := req.Storage.Delete(prefix + found[i]); err != nil {
+			return nil, err
+		}
+		revokedKeys++
+	}
+
+	b.otpLock.Lock()
+	revokedOTPs, err := b.deleteRoleOTPs(req.Storage, namespace, roleName)
+	b.otpLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.revokeRoleIssuances(req.Storage, namespace, roleName, time.Now().UTC(), failed); err != nil {
+		return nil, err
+	}
+	b.incrMetric(namespace, roleName, metricRevocations, revokedKeys+revokedOTPs)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"revoked_keys": revokedKeys,
+			"revoked_otps": revokedOTPs,
+			"failures":     failures,
+		},
+	}, nil
+}
+
+const pathRoleRevokeAllHelpSyn = `
+Revoke all the outstanding credentials issued by a role.
+`
+
+const pathRoleRevokeAllHelpDesc = `
+Writing to this path revokes every outstanding credential that was issued for
+the role, without waiting for their leases to expire. The dynamic keys are
+removed from the hosts they were installed in, several at once, and the OTPs that were not used
+yet are deleted. The role itself is not changed, and it also works for roles
+that were deleted.
+
+The response holds the number of dynamic keys and OTPs that were revoked, and
+a list of the dynamic keys that couldn't be removed along with the error. The
+keys that couldn't be removed are revoked by writing to this path again.
+
+The leases of the revoked credentials are not revoked. Their credentials no
+longer work and revoking them, or letting them expire, does nothing more.
+Dynamic keys issued before this path was added are not revoked.
+`
@@ -0,0 +1,336 @@
+package ssh
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// roleVersionsKept is the number of versions of each role that are kept,
+// including the current one.
+const roleVersionsKept = 10
+
+func pathRoleVersionsList(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/" + namespacePathRegex + framework.GenericNameRegex("role") + "/versions/?",
+		Fields: map[string]*framework.FieldSchema{
+			"namespace": namespaceField,
+			"role": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "[Required] Name of the role whose versions are listed.",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation:   b.pathRoleVersionsList,
+			logical.ReadOperation:   b.pathRoleVersionsList,
+			logical.DeleteOperation: b.pathRoleVersionsDelete,
+		},
+
+		HelpSynopsis:    pathRoleVersionsHelpSyn,
+		HelpDescription: pathRoleVersionsHelpDesc,
+	}
+}
+
+func pathRoleVersions(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/" + namespacePathRegex + framework.GenericNameRegex("role") + "/versions/(?P<version>[0-9]+)",
+		Fields: map[string]*framework.FieldSchema{
+			"namespace": namespaceField,
+			"role": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "[Required] Name of the role.",
+			},
+			"version": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: "[Required] Version of the role to read.",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathRoleVersionRead,
+		},
+
+		HelpSynopsis:    pathRoleVersionsHelpSyn,
+		HelpDescription: pathRoleVersionsHelpDesc,
+	}
+}
+
+func pathRoleRollback(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/" + namespacePathRegex + framework.GenericNameRegex("role") + "/rollback",
+		Fields: map[string]*framework.FieldSchema{
+			"namespace": namespaceField,
+			"role": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "[Required] Name of the role to roll back.",
+			},
+			"version": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: "[Required] Version of the role to restore.",
+			},
+			"cas": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `[Optional] Check-and-set. If set, the role is only rolled back
+				if its current version matches this value.`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.WriteOperation: b.pathRoleRollbackWrite,
+		},
+
+		HelpSynopsis:    pathRoleRollbackHelpSyn,
+		HelpDescription: pathRoleRollbackHelpDesc,
+	}
+}
+
+// Records the role as one of its versions, and deletes the versions that
+// are too old to be kept. The caller must hold the roleLock.
+func (b *backend) putRoleVersion(s logical.Storage, namespace, roleName string, role *sshRole) error {
+	prefix := roleVersionsPath(namespace, roleName)
+	entry, err := logical.StorageEntryJSON(prefix+strconv.Itoa(role.Version), role)
+	if err != nil {
+		return err
+	}
+	if err := s.Put(entry); err != nil {
+		return err
+	}
+
+	versions, err := roleVersions(s, namespace, roleName)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if version > role.Version-roleVersionsKept {
+			continue
+		}
+		if err := s.Delete(prefix + strconv.Itoa(version)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the recorded versions of the role, in increasing order.
+func roleVersions(s logical.Storage, namespace, roleName string) ([]int, error) {
+	prefix := roleVersionsPath(namespace, roleName)
+	keys, err := s.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var versions []int
+	for _, key := range keys {
+		version, err := strconv.Atoi(strings.TrimPrefix(key, prefix))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// Returns the latest recorded version of the role, which is the current
+// version of the role unless it was deleted, or 0 if none is recorded.
+func latestRoleVersion(s logical.Storage, namespace, roleName string) (int, error) {
+	versions, err := roleVersions(s, namespace, roleName)
+	if err != nil || len(versions) == 0 {
+		return 0, err
+	}
+	return versions[len(versions)-1], nil
+}
+
+// Returns the given version of the role, or nil if it isn't recorded.
+func getRoleVersion(s logical.Storage, namespace, roleName string, version int) (*sshRole, error) {
+	entry, err := s.Get(roleVersionsPath(namespace, roleName) + strconv.Itoa(version))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result sshRole
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Deletes the recorded versions of the role other than the given one. The
+// caller must hold the roleLock.
+func deleteRoleVersions(s logical.Storage, namespace, roleName string, keep int) error {
+	versions, err := roleVersions(s, namespace, roleName)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if version == keep {
+			continue
+		}
+		if err := s.Delete(roleVersionsPath(namespace, roleName) + strconv.Itoa(version)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *backend) pathRoleVersionsList(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	namespace := d.Get("namespace").(string)
+	roleName := d.Get("role").(string)
+
+	role, err := b.getRole(req.Storage, namespace, roleName)
+	if err != nil {
+		return nil, err
+	}
+
+	// The versions of deleted roles are listed too, so that the role can
+	// be restored.
+	versions, err := roleVersions(req.Storage, namespace, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil && len(versions) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(versions))
+	keyInfo := make(map[string]interface{}, len(versions))
+	for _, version := range versions {
+		name := strconv.Itoa(version)
+		names = append(names, name)
+		keyInfo[name] = map[string]interface{}{
+			"current": role != nil && version == role.Version,
+		}
+	}
+
+	resp := logical.ListResponse(names)
+	resp.Data["key_info"] = keyInfo
+	return resp, nil
+}
+
+func (b *backend) pathRoleVersionsDelete(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	namespace := d.Get("namespace").(string)
+	roleName := d.Get("role").(string)
+
+	b.roleLock.Lock()
+	defer b.roleLock.Unlock()
+
+	role, err := b.getRole(req.Storage, namespace, roleName)
+	if err != nil {
+		return nil, err
+	}
+	keep := 0
+	if role != nil {
+		keep = role.Version
+	}
+	return nil, deleteRoleVersions(req.Storage, namespace, roleName, keep)
+}
+
+func (b *backend) pathRoleVersionRead(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	role, err := getRoleVersion(req.Storage, d.Get("namespace").(string), d.Get("role").(string), d.Get("version").(int))
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, nil
+	}
+	return roleResponse(role, newInstallScript(role)), nil
+}
+
+func (b *backend) pathRoleRollbackWrite(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	namespace := d.Get("namespace").(string)
+	roleName := d.Get("role").(string)
+	version := d.Get("version").(int)
+	if version <= 0 {
+		return logical.ErrorResponse("Missing version"), nil
+	}
+
+	b.roleLock.Lock()
+	defer b.roleLock.Unlock()
+
+	// Deleted roles can be restored as well, and have no current version.
+	current, err := b.getRole(req.Storage, namespace, roleName)
+	if err != nil {
+		return nil, err
+	}
+	currentVersion := 0
+	if current != nil {
+		currentVersion = current.Version
+	}
+	if cas, ok := d.GetOk("cas"); ok && cas.(int) != currentVersion {
+		return nil, logical.CodedError(409, fmt.Sprintf(
+			"check-and-set failed: expected version %d, current version is %d", cas.(int), currentVersion))
+	}
+	latest, err := latestRoleVersion(req.Storage, namespace, roleName)
+	if err != nil {
+		return nil, err
+	}
+
+	role, err := getRoleVersion(req.Storage, namespace, roleName, version)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return logical.ErrorResponse(fmt.Sprintf("Version %d of role '%s' not found", version, roleName)), nil
+	}
+
+	// The restored role becomes a new version, so that the rollback can be
+	// undone as well.
+	role.Version = latest + 1
+	entry, err := logical.StorageEntryJSON(rolePath(namespace, roleName), role)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(entry); err != nil {
+		return nil, err
+	}
+	b.invalidateInstallScript(rolePath(namespace, roleName))
+	if err := b.putRoleVersion(req.Storage, namespace, roleName, role); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"version": role.Version,
+		},
+	}, nil
+}
+
+const pathRoleVersionsHelpSyn = `
+List and read the previous versions of a role.
+`
+
+const pathRoleVersionsHelpDesc = `
+Every time a role is written, the new version of the role is recorded along
+with it. The last 10 versions of each role are kept, including the current
+one. Listing 'roles/<role>/versions' returns the recorded version numbers, and
+'key_info' tells which of them is the current one. Reading
+'roles/<role>/versions/<version>' returns the role as it was in that version.
+
+The versions are kept when the role is deleted, so that a deleted role can be
+restored with 'roles/<role>/rollback'; none of them is then the current one.
+A role written again with the same name continues from the last version.
+Deleting 'roles/<role>/versions' purges the versions other than the current
+one, or all of them if the role was deleted. Versions written before this
+path was added are not recorded.
+`
+
+const pathRoleRollbackHelpSyn = `
+Restore a previous version of a role.
+`
+
+const pathRoleRollbackHelpDesc = `
+Writing to this path replaces the role with one of its recorded versions, to
+undo an accidental overwrite or deletion. The restored role is written as a new version,
+which is returned, so that the rollback can be undone as well. As with writes
+of the role, 'cas' can be set to only roll back if the current version of the
+role matches it.
+
+The restored version is not validated again, so the keys and issuers that it
+refers to must still exist for it to be used.
+`
@@ -1,8 +1,14 @@
 package ssh
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"path"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
@@ -11,27 +17,164 @@ import (
 const (
 	KeyTypeOTP     = "otp"
 	KeyTypeDynamic = "dynamic"
+	KeyTypeCA      = "ca"
 )
 
+// Algorithms of the keys generated for dynamic roles. The SSH library used
+// by Vault doesn't support Ed25519 keys yet.
+const (
+	KeyAlgorithmRSA       = "rsa"
+	KeyAlgorithmECDSAP256 = "ecdsa-p256"
+)
+
+// Bounds and default of the length of RSA dynamic keys. Generating keys
+// longer than the maximum takes too long to be done on every request.
+const (
+	minRSAKeyBits     = 1024
+	maxRSAKeyBits     = 8192
+	defaultRSAKeyBits = 2048
+)
+
+// Checks that the length of RSA keys is within the bounds and is a
+// multiple of 256.
+func validateRSAKeyBits(keyBits int) error {
+	if keyBits < minRSAKeyBits || keyBits > maxRSAKeyBits || keyBits%256 != 0 {
+		return fmt.Errorf("RSA keys must be a multiple of 256 bits between %d and %d", minRSAKeyBits, maxRSAKeyBits)
+	}
+	return nil
+}
+
+// Formats of the OTPs issued by OTP roles. Numeric and base62 OTPs have a
+// configurable length.
+const (
+	OTPFormatUUID    = "uuid"
+	OTPFormatNumeric = "numeric"
+	OTPFormatBase62  = "base62"
+)
+
+// Types of the install scripts of dynamic roles. PowerShell scripts are
+// meant for Windows hosts running OpenSSH.
+const (
+	InstallScriptTypeShell      = "shell"
+	InstallScriptTypePowerShell = "powershell"
+)
+
+// Matches the domain names of allowed_domains.
+var domainRegex = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// Pattern that usernames at the remote hosts are expected to follow. This is
+// a relaxed version of the POSIX portable username format.
+const usernamePattern = `[a-zA-Z0-9_][a-zA-Z0-9_.-]*\$?`
+
 // Structure that represents a role in SSH backend. This is a common role structure
 // for both OTP and Dynamic roles. Not all the fields are mandatory for both type.
 // Some are applicable for one and not for other. It doesn't matter.
 type sshRole struct {
-	KeyType       string `mapstructure:"key_type" json:"key_type"`
-	KeyName       string `mapstructure:"key" json:"key"`
-	KeyBits       int    `mapstructure:"key_bits" json:"key_bits"`
-	AdminUser     string `mapstructure:"admin_user" json:"admin_user"`
-	DefaultUser   string `mapstructure:"default_user" json:"default_user"`
-	CIDRList      string `mapstructure:"cidr_list" json:"cidr_list"`
-	Port          int    `mapstructure:"port" json:"port"`
-	InstallScript string `mapstructure:"install_script" json:"install_script"`
-	AllowedUsers  string `mapstructure:"allowed_users" json:"allowed_users"`
+	KeyType         string `mapstructure:"key_type" json:"key_type"`
+	KeyName         string `mapstructure:"key" json:"key"`
+	KeyBits         int    `mapstructure:"key_bits" json:"key_bits"`
+	KeyAlgorithm    string `mapstructure:"key_algorithm" json:"key_algorithm"`
+	AdminUser       string `mapstructure:"admin_user" json:"admin_user"`
+	DefaultUser     string `mapstructure:"default_user" json:"default_user"`
+	CIDRList        string `mapstructure:"cidr_list" json:"cidr_list"`
+	Port            int    `mapstructure:"port" json:"port"`
+	InstallScript   string `mapstructure:"install_script" json:"install_script"`
+	AllowedUsers    string `mapstructure:"allowed_users" json:"allowed_users"`
+	RequestCIDRList string `mapstructure:"request_cidr_list" json:"request_cidr_list"`
+	ExcludeCIDRList string `mapstructure:"exclude_cidr_list" json:"exclude_cidr_list"`
+	AllowedDomains  string `mapstructure:"allowed_domains" json:"allowed_domains"`
+
+	// AllowedPorts are the comma separated ports and port ranges that
+	// credentials of OTP roles can be requested for, besides Port.
+	AllowedPorts string `mapstructure:"allowed_ports" json:"allowed_ports"`
+
+	// RestrictToClientIP only allows credentials for the IP of the client
+	// making the request.
+	RestrictToClientIP bool `mapstructure:"restrict_to_client_ip" json:"restrict_to_client_ip"`
+
+	OTPFormat string `mapstructure:"otp_format" json:"otp_format"`
+	OTPLength int    `mapstructure:"otp_length" json:"otp_length"`
+
+	InstallScriptInterpreter string `mapstructure:"install_script_interpreter" json:"install_script_interpreter"`
+	InstallScriptType        string `mapstructure:"install_script_type" json:"install_script_type"`
+	HostKeyFingerprint       string `mapstructure:"host_key_fingerprint" json:"host_key_fingerprint"`
+	KeyComment               string `mapstructure:"key_comment" json:"key_comment"`
+	KeyOptionSpecs           string `mapstructure:"key_option_specs" json:"key_option_specs"`
+	VerifyOnRenew            bool   `mapstructure:"verify_on_renew" json:"verify_on_renew"`
+	KeyExpiry                bool   `mapstructure:"key_expiry" json:"key_expiry"`
+
+	// DenyUsers are the comma separated usernames, or glob patterns, that
+	// credentials are never issued for, even if they are allowed.
+	DenyUsers string `mapstructure:"deny_users" json:"deny_users"`
+
+	// AllowedUsersTemplate, if set, resolves the variables in the entries
+	// of AllowedUsers from the token making the request. Roles stored
+	// without it were written when the entries were always resolved.
+	AllowedUsersTemplate *bool `mapstructure:"allowed_users_template" json:"allowed_users_template"`
+
+	// BastionHost, if set, is the jump host through which the remote hosts
+	// are reached to install dynamic keys.
+	BastionHost    string `mapstructure:"bastion_host" json:"bastion_host"`
+	BastionPort    int    `mapstructure:"bastion_port" json:"bastion_port"`
+	BastionUser    string `mapstructure:"bastion_user" json:"bastion_user"`
+	BastionKeyName string `mapstructure:"bastion_key" json:"bastion_key"`
+
+	// AllowHostCertificates lets CA roles sign host certificates for the
+	// hostnames in AllowedDomains.
+	AllowHostCertificates bool `mapstructure:"allow_host_certificates" json:"allow_host_certificates"`
+
+	// AllowedCriticalOptions and AllowedExtensions are the comma separated
+	// critical options and extensions that sign requests to CA roles can
+	// ask for. '*' allows any.
+	AllowedCriticalOptions string `mapstructure:"allowed_critical_options" json:"allowed_critical_options"`
+	AllowedExtensions      string `mapstructure:"allowed_extensions" json:"allowed_extensions"`
+
+	// DefaultCriticalOptions and DefaultExtensions are set on the user
+	// certificates signed by CA roles when the request sets none. Their
+	// values can refer to the token making the request.
+	DefaultCriticalOptions map[string]string `mapstructure:"default_critical_options" json:"default_critical_options"`
+	DefaultExtensions      map[string]string `mapstructure:"default_extensions" json:"default_extensions"`
+
+	// KeyIDFormat is the template of the key IDs of the certificates signed
+	// by CA roles.
+	KeyIDFormat string `mapstructure:"key_id_format" json:"key_id_format"`
+
+	// AllowedUserKeyTypes are the comma separated types of the public keys
+	// that CA roles sign. All types are signed if it is empty.
+	AllowedUserKeyTypes string `mapstructure:"allowed_user_key_types" json:"allowed_user_key_types"`
+
+	// AllowedUserKeyTypesAndLengths maps the types of the public keys that
+	// CA roles sign to their minimum size in bits. All types and sizes are
+	// signed if it is empty.
+	AllowedUserKeyTypesAndLengths map[string]int `mapstructure:"allowed_user_key_types_and_lengths" json:"allowed_user_key_types_and_lengths"`
+
+	// AlgorithmSigner is the signature algorithm of the certificates signed
+	// by CA roles. Roles stored without it sign with 'ssh-rsa'.
+	AlgorithmSigner string `mapstructure:"algorithm_signer" json:"algorithm_signer"`
+
+	// NotBeforeDuration backdates the start of the validity of the
+	// certificates signed by CA roles, to tolerate clock skew.
+	NotBeforeDuration time.Duration `mapstructure:"not_before_duration" json:"not_before_duration"`
+
+	// Issuer is the name of the issuer whose key signs the certificates of
+	// CA roles. If empty, the default issuer signs them.
+	Issuer string `mapstructure:"issuer" json:"issuer"`
+
+	// TTL and MaxTTL override the lease configured for the mount for the
+	// credentials issued by the role.
+	TTL    time.Duration `mapstructure:"ttl" json:"ttl"`
+	MaxTTL time.Duration `mapstructure:"max_ttl" json:"max_ttl"`
+
+	// Version is incremented every time the role is written. It is used
+	// for check-and-set writes.
+	Version int `mapstructure:"version" json:"version"`
 }
 
 func pathRoles(b *backend) *framework.Path {
 	return &framework.Path{
-		Pattern: "roles/" + framework.GenericNameRegex("role"),
+		Pattern: "roles/" + namespacePathRegex + framework.GenericNameRegex("role"),
 		Fields: map[string]*framework.FieldSchema{
+			"namespace": namespaceField,
 			"role": &framework.FieldSchema{
 				Type: framework.TypeString,
 				Description: `
@@ -46,7 +189,8 @@ func pathRoles(b *backend) *framework.Path {
 				'keys/' endpoint to create a named key.`,
 			},
 			"admin_user": &framework.FieldSchema{
-				Type: framework.TypeString,
+				Type:    framework.TypeString,
+				Pattern: usernamePattern,
 				Description: `
 				[Required for Dynamic type] [Not applicable for OTP type]
 				Admin user at remote host. The shared key being registered should be
@@ -56,7 +200,9 @@ func pathRoles(b *backend) *framework.Path {
 				for the other user.`,
 			},
 			"default_user": &framework.FieldSchema{
-				Type: framework.TypeString,
+				Type:     framework.TypeString,
+				Pattern:  usernamePattern,
+				Required: true,
 				Description: `
 				[Required for both types]
 				Default username for which a credential will be generated.
@@ -66,9 +212,11 @@ func pathRoles(b *backend) *framework.Path {
 			"cidr_list": &framework.FieldSchema{
 				Type: framework.TypeString,
 				Description: `
-				[Required for both types]
+				[Required for OTP and Dynamic types][Not applicable for CA type]
 				Comma separated list of CIDR blocks for which the role is applicable for.
-				CIDR blocks can belong to more than one role.`,
+				Optional for OTP roles listed at 'config/zeroaddress'.
+				CIDR blocks can belong to more than one role. The list is stored with
+				its entries trimmed, deduplicated and sorted.`,
 			},
 			"port": &framework.FieldSchema{
 				Type: framework.TypeInt,
@@ -77,20 +225,41 @@ func pathRoles(b *backend) *framework.Path {
 				Port number for SSH connection. Default is '22'. Port number does not
 				play any role in creation of OTP. For 'otp' type, this is just a way
 				to inform client about the port number to use. Port number will be
-				returned to client by Vault server along with OTP.`,
+				returned to client by Vault server along with OTP. For 'otp' type roles
+				with allowed_ports, it is the port used when the request doesn't ask
+				for one, and defaults to the lowest allowed port.`,
 			},
-			"key_type": &framework.FieldSchema{
+			"allowed_ports": &framework.FieldSchema{
 				Type: framework.TypeString,
 				Description: `
+				[Optional for OTP type][Not applicable for Dynamic and CA types]
+				Comma separated list of ports and port ranges, such as '22,2200-2299',
+				that credentials can be requested for, for roles whose hosts run sshd
+				on several ports. If not set, credentials are only issued for 'port'.`,
+			},
+			"key_type": &framework.FieldSchema{
+				Type:     framework.TypeString,
+				Required: true,
+				Description: `
 				[Required for both types] 
-				Type of key used to login to hosts. It can be either 'otp' or 'dynamic'.
-				'otp' type requires agent to be installed in remote hosts.`,
+				Type of key used to login to hosts. It can be 'otp', 'dynamic' or 'ca'.
+				'otp' type requires agent to be installed in remote hosts. 'ca' type
+				roles sign public keys of users with the CA key of the backend, for
+				hosts that trust the CA.`,
 			},
 			"key_bits": &framework.FieldSchema{
 				Type: framework.TypeInt,
 				Description: `
 				[Optional for Dynamic type] [Not applicable for OTP type]
-				Length of the RSA dynamic key in bits. It is 1024 by default or it can be 2048.`,
+				Length of the RSA dynamic key in bits. It is 2048 by default and it can
+				be any multiple of 256 from 1024 to 8192, such as 3072 or 4096.`,
+			},
+			"key_algorithm": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for Dynamic type] [Not applicable for OTP type]
+				Algorithm of the dynamic keys. It is 'rsa' by default or it can be
+				'ecdsa-p256'. 'key_bits' only applies to 'rsa' keys.`,
 			},
 			"install_script": &framework.FieldSchema{
 				Type: framework.TypeString,
@@ -98,7 +267,100 @@ func pathRoles(b *backend) *framework.Path {
 				[Optional for Dynamic type][Not-applicable for OTP type]
 				Script used to install and uninstall public keys in the target machine.
 				The inbuilt default install script will be for Linux hosts. For sample
-				script, refer the project documentation website.`,
+				script, refer the project documentation website. Custom scripts are
+				validated according to the 'config/install_script' endpoint.
+				The script can contain the variables '{{username}}' (the target
+				user), '{{auth_keys_file}}' (the path of its authorized_keys file),
+				'{{key_marker}}' (the SHA256 fingerprint of the dynamic key) and
+				'{{port}}', which are rendered before the script is run.`,
+			},
+			"install_script_interpreter": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for Dynamic type][Not-applicable for OTP type]
+				Command used to run the install script on the target machine, for
+				example '/bin/sh' or 'rbash'. The script is passed to it as the first
+				argument. By default the script is made executable and run directly.`,
+			},
+			"bastion_host": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for Dynamic type][Not-applicable for OTP and CA types]
+				Address of a bastion host through which Vault connects to the remote
+				hosts that are not directly reachable from it. Requires 'bastion_user'
+				and 'bastion_key'.`,
+			},
+			"bastion_port": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `
+				[Optional for Dynamic type][Not-applicable for OTP and CA types]
+				Port number of the SSH service of the bastion host. Default is '22'.`,
+			},
+			"bastion_user": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for Dynamic type][Not-applicable for OTP and CA types]
+				Username used to login to the bastion host.`,
+			},
+			"bastion_key": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for Dynamic type][Not-applicable for OTP and CA types]
+				Name of the registered key used to login to the bastion host.`,
+			},
+			"install_script_type": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for Dynamic type][Not-applicable for OTP type]
+				Type of the install script. It is 'shell' by default or it can be
+				'powershell' for Windows hosts running OpenSSH, in which case the
+				default install script is a PowerShell script and the interpreter,
+				if set, is the PowerShell executable.`,
+			},
+			"host_key_fingerprint": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for Dynamic type][Not-applicable for OTP type]
+				SHA256 fingerprint of the host key of the remote hosts, in the format
+				printed by 'ssh-keygen -l' (e.g. 'SHA256:...'). If set, Vault refuses
+				to install or uninstall keys on hosts presenting a different host key.
+				If not set, the host key is not verified.`,
+			},
+			"key_comment": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for Dynamic type][Not-applicable for OTP type]
+				Comment appended to the dynamic public keys installed in the
+				authorized_keys file of the target machine. It can contain the
+				variables {{role_name}}, {{display_name}} (of the requesting token)
+				and {{timestamp}} (time of issue in RFC3339 format).`,
+			},
+			"key_option_specs": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for Dynamic type][Not-applicable for OTP type]
+				Comma separated authorized_keys options prepended to the dynamic public
+				keys installed in the target machine, to restrict what the keys can do.
+				For example: 'no-port-forwarding,no-X11-forwarding,from="10.0.0.0/8"'.`,
+			},
+			"key_expiry": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `
+				[Optional for Dynamic type][Not-applicable for OTP type]
+				If set, the dynamic public keys are installed with an 'expiry-time'
+				option set to the expiry of their lease, in UTC. Hosts stop accepting
+				the keys once they expire even if Vault fails to remove them. Renewing
+				the lease installs the key again with the new expiry. Requires OpenSSH
+				8.9 or later in the target machine. Defaults to false.`,
+			},
+			"verify_on_renew": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `
+				[Optional for Dynamic type][Not-applicable for OTP type]
+				If set, renewing a dynamic key connects to the target machine and
+				checks that the key is still in the authorized_keys file of the
+				user. The renewal fails if the key is no longer there. Defaults
+				to false.`,
 			},
 			"allowed_users": &framework.FieldSchema{
 				Type: framework.TypeString,
@@ -108,11 +370,218 @@ func pathRoles(b *backend) *framework.Path {
 				any valid user at the remote host, including the admin user. If only certain
 				usernames are to be allowed, then this list enforces it. If this field is
 				set, then credentials can only be created for default_user and usernames
-				present in this list.
+				present in this list. If allowed_users_template is set, entries can be
+				templated to derive the username from the token requesting the credential,
+				using the variables {{display_name}} (display name of the token) and
+				{{token.metadata.<key>}} (the value of <key> in the metadata of the token).
+				A templated entry doesn't match any username if a variable has no value for
+				the token. Entries can also be glob patterns such as 'svc-*', or '*' to allow any
+				username; patterns only match usernames made of letters, digits, '_',
+				'.' and '-'. The list is stored with its entries trimmed, deduplicated and sorted.
 				`,
 			},
+			"deny_users": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for all types]
+				Comma separated list of usernames that credentials are never issued for,
+				even if they are allowed by allowed_users, such as 'root'. Entries can be
+				glob patterns such as 'svc-*'. The default_user can't be denied.`,
+			},
+			"allowed_users_template": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `
+				[Optional for all types]
+				If set, the variables in the entries of allowed_users are resolved from
+				the token requesting the credential. Defaults to false, in which case
+				entries with variables are rejected.`,
+			},
+			"exclude_cidr_list": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for OTP and Dynamic types][Not applicable for CA type]
+				Comma separated list of CIDR blocks excluded from the role. Credentials
+				are not issued for IPs in these blocks, even if they belong to the
+				'cidr_list' of the role or if the role is a zero-address role.`,
+			},
+			"otp_format": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for OTP type][Not applicable for Dynamic and CA types]
+				Format of the OTPs. It is 'uuid' by default or it can be 'numeric'
+				(digits only) or 'base62' (letters and digits), whose length is set
+				by 'otp_length'.`,
+			},
+			"otp_length": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `
+				[Optional for OTP type][Not applicable for Dynamic and CA types]
+				Length of the 'numeric' and 'base62' OTPs. Defaults to 12 for 'numeric'
+				and to 20 for 'base62'. It can't be more than 64, or less than 12 for
+				'numeric' and 6 for 'base62'.`,
+			},
+			"allowed_domains": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for all types]
+				Comma separated list of domains. If set, credentials can be requested
+				with the 'hostname' of the remote host instead of its IP, if the
+				hostname is one of these domains or one of their subdomains. The
+				hostname is resolved and its address must still be allowed by the
+				role. For CA type, these are the domains that host certificates can
+				be signed for.`,
+			},
+			"allow_host_certificates": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `
+				[Optional for CA type][Not applicable for OTP and Dynamic types]
+				If set, the role signs host certificates, requested with 'cert_type'
+				set to 'host', for the hostnames in 'allowed_domains' and their
+				subdomains. Requires 'allowed_domains'. Defaults to false.`,
+			},
+			"allowed_critical_options": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for CA type][Not applicable for OTP and Dynamic types]
+				Comma separated list of the critical options, such as 'force-command'
+				and 'source-address', that sign requests can set on user certificates.
+				Use '*' to allow any. If not set, requests can't set critical options.`,
+			},
+			"allowed_extensions": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for CA type][Not applicable for OTP and Dynamic types]
+				Comma separated list of the extensions, such as 'permit-pty', that sign
+				requests can set on user certificates. Use '*' to allow any. If not
+				set, requests can't set extensions and the certificates get the
+				default extensions.`,
+			},
+			"key_id_format": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for CA type][Not applicable for OTP and Dynamic types]
+				Template of the key ID of the signed certificates, which sshd logs
+				when they are used. It can contain the variables {{token_display_name}},
+				{{role_name}} and {{public_key_hash}}. Defaults to
+				'vault-{{token_display_name}}-{{public_key_hash}}'.`,
+			},
+			"allowed_user_key_types": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for CA type][Not applicable for OTP and Dynamic types]
+				Comma separated list of the types of the public keys that can be
+				signed, such as 'ssh-rsa' or 'sk-ssh-ed25519@openssh.com' for FIDO
+				security keys. If not set, keys of any type are signed.`,
+			},
+			"allowed_user_key_types_and_lengths": &framework.FieldSchema{
+				Type: framework.TypeMap,
+				Description: `
+				[Optional for CA type][Not applicable for OTP and Dynamic types]
+				Map of the types of the public keys that can be signed to their
+				minimum size in bits, such as 'ssh-rsa=2048', to refuse weak keys. The
+				size of ECDSA and security keys is the size of their curve, and 0
+				allows any size. If not set, keys of any size are signed.`,
+			},
+			"algorithm_signer": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: signingAlgorithmRSA,
+				Description: `
+				[Optional for CA type][Not applicable for OTP and Dynamic types]
+				Algorithm of the signatures of the certificates: 'ssh-rsa',
+				'rsa-sha2-256' or 'rsa-sha2-512'. Recent OpenSSH versions refuse
+				'ssh-rsa' signatures, which use SHA-1. The SHA-2 algorithms require an
+				RSA CA key and OpenSSH 7.2 or later on the hosts. Defaults to 'ssh-rsa'.`,
+			},
+			"not_before_duration": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "30s",
+				Description: `
+				[Optional for CA type][Not applicable for OTP and Dynamic types]
+				Duration by which the start of the validity of the certificates is
+				backdated, e.g. "1m", so that hosts whose clocks are behind the one of
+				Vault accept them. It doesn't extend the end of the validity. Defaults
+				to 30s.`,
+			},
+			"issuer": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for CA type][Not applicable for OTP and Dynamic types]
+				Name of the issuer, created at 'issuers/', whose key signs the
+				certificates. Defaults to the default issuer set at 'config/issuers',
+				or to the key configured at 'config/ca'.`,
+			},
+			"default_critical_options": &framework.FieldSchema{
+				Type: framework.TypeMap,
+				Description: `
+				[Optional for CA type][Not applicable for OTP and Dynamic types]
+				Map of the critical options set on user certificates when the sign
+				request sets none. The values can contain the variables
+				{{display_name}} and {{token.metadata.<key>}} of the requesting token.`,
+			},
+			"default_extensions": &framework.FieldSchema{
+				Type: framework.TypeMap,
+				Description: `
+				[Optional for CA type][Not applicable for OTP and Dynamic types]
+				Map of the extensions set on user certificates when the sign request
+				sets none, such as 'login@example.com={{display_name}}'. The values can
+				contain the variables {{display_name}} and {{token.metadata.<key>}} of
+				the requesting token. Defaults to the extensions OpenSSH grants to
+				keys without options.`,
+			},
+			"request_cidr_list": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for both types]
+				Comma separated list of CIDR blocks from which credential requests for
+				this role are allowed to originate. If this is not specified, requests
+				are allowed from any address. Requests for which Vault doesn't know the
+				client's address are rejected when this is set.`,
+			},
+			"restrict_to_client_ip": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `
+				[Optional for OTP and Dynamic types][Not applicable for CA type]
+				If set, credentials are only issued for the IP that the request
+				originates from, so that a leaked token can't be used to get credentials
+				for other hosts. Requests for which Vault doesn't know the client's
+				address are rejected. Defaults to false.`,
+			},
+			"ttl": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for all types]
+				Lease of the credentials issued by the role, e.g. "30m". Defaults to
+				the lease configured at 'config/lease'. For CA type it is the default
+				validity of the certificates.`,
+			},
+			"max_ttl": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+				[Optional for all types]
+				Maximum lifetime of the credentials issued by the role, including
+				renewals, e.g. "24h". Defaults to the maximum lease configured at
+				'config/lease'. For CA type it is the maximum validity of the
+				certificates.`,
+			},
+			"cas": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `
+				[Optional for both types]
+				Check-and-set. If set, the role is only written if its current version
+				matches this value. Use 0 to only allow creating a new role. The current
+				version is returned when reading the role.`,
+			},
+			"validate_only": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `
+				[Optional for both types]
+				If set, the role is validated as it would be when written but it
+				is not stored. Any validation error is returned as usual.`,
+			},
 		},
 
+		PreRequest: normalizeRoleRequest,
+
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.ReadOperation:   b.pathRoleRead,
 			logical.WriteOperation:  b.pathRoleWrite,
@@ -124,41 +593,207 @@ func pathRoles(b *backend) *framework.Path {
 	}
 }
 
+func pathRolesList(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles" + namespaceListPathRegex,
+		Fields: map[string]*framework.FieldSchema{
+			"namespace": namespaceField,
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathRolesList,
+			logical.ReadOperation: b.pathRolesList,
+		},
+
+		HelpSynopsis:    pathRolesListHelpSyn,
+		HelpDescription: pathRolesListHelpDesc,
+	}
+}
+
+// Key types and key algorithms are case insensitive.
+func normalizeRoleRequest(req *logical.Request, d *framework.FieldData) error {
+	for _, field := range []string{"key_type", "key_algorithm"} {
+		if value, ok := d.Raw[field].(string); ok {
+			d.Raw[field] = strings.ToLower(value)
+		}
+	}
+	return nil
+}
+
 func (b *backend) pathRoleWrite(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	namespace := d.Get("namespace").(string)
 	roleName := d.Get("role").(string)
 	if roleName == "" {
 		return logical.ErrorResponse("Missing role name"), nil
 	}
 
 	// Allowed users is an optional field, applicable for both OTP and Dynamic types.
+	// An empty list allows any user, so a list made of blank entries is
+	// rejected rather than normalized to an empty one.
 	allowedUsers := d.Get("allowed_users").(string)
+	if allowedUsers != "" {
+		allowedUsers = normalizeList(allowedUsers)
+		if allowedUsers == "" {
+			return logical.ErrorResponse("Invalid allowed_users field. No users listed"), nil
+		}
+	}
+	denyUsers := normalizeList(d.Get("deny_users").(string))
+	for _, entry := range strings.Split(denyUsers, ",") {
+		if _, err := path.Match(entry, ""); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid deny_users field. Invalid pattern '%s'", entry)), nil
+		}
+	}
+
+	allowedUsersTemplate := d.Get("allowed_users_template").(bool)
+	if err := validateAllowedUsers(allowedUsers, allowedUsersTemplate); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid allowed_users field. %s", err)), nil
+	}
 
 	defaultUser := d.Get("default_user").(string)
-	if defaultUser == "" {
-		return logical.ErrorResponse("Missing default user"), nil
+	if userDenied(defaultUser, denyUsers) {
+		return logical.ErrorResponse(fmt.Sprintf("Default user '%s' is in deny_users", defaultUser)), nil
+	}
+
+	keyType := d.Get("key_type").(string)
+
+	// Certificates are not restricted to hosts, so CA roles don't take
+	// CIDR blocks.
+	cidrList := normalizeList(d.Get("cidr_list").(string))
+	if keyType == KeyTypeCA {
+		if cidrList != "" {
+			return logical.ErrorResponse("CIDR blocks not applicable for CA type"), nil
+		}
+	} else if cidrList != "" {
+		// Check if all the CIDR entries are infact valid entries
+		if err := validateCIDRList(cidrList); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid cidr_list entry. %s", err)), nil
+		}
+	} else {
+		// OTP roles that issue credentials for any IP don't need them
+		zeroAddress, err := b.isZeroAddressRole(req.Storage, namespace, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if keyType != KeyTypeOTP || !zeroAddress {
+			return logical.ErrorResponse("Missing CIDR blocks"), nil
+		}
+	}
+
+	if keyType != KeyTypeOTP && (d.Get("otp_format").(string) != "" || d.Get("otp_length").(int) != 0) {
+		return logical.ErrorResponse("OTP format is only applicable for OTP type"), nil
+	}
+	if keyType != KeyTypeDynamic && d.Get("key_option_specs").(string) != "" {
+		return logical.ErrorResponse("Key option specs are only applicable for Dynamic type"), nil
+	}
+	if keyType != KeyTypeDynamic && d.Get("key_expiry").(bool) {
+		return logical.ErrorResponse("Key expiry is only applicable for Dynamic type"), nil
+	}
+	if keyType != KeyTypeDynamic && d.Get("bastion_host").(string) != "" {
+		return logical.ErrorResponse("Bastion host is only applicable for Dynamic type"), nil
+	}
+	if keyType != KeyTypeCA && d.Get("allow_host_certificates").(bool) {
+		return logical.ErrorResponse("Host certificates are only applicable for CA type"), nil
+	}
+	if keyType != KeyTypeCA && (d.Get("allowed_critical_options").(string) != "" || d.Get("allowed_extensions").(string) != "") {
+		return logical.ErrorResponse("Allowed critical options and extensions are only applicable for CA type"), nil
+	}
+	if keyType != KeyTypeCA && (len(d.Get("default_critical_options").(map[string]interface{})) != 0 || len(d.Get("default_extensions").(map[string]interface{})) != 0) {
+		return logical.ErrorResponse("Default critical options and extensions are only applicable for CA type"), nil
+	}
+	if keyType != KeyTypeCA && d.Get("key_id_format").(string) != "" {
+		return logical.ErrorResponse("Key ID format is only applicable for CA type"), nil
+	}
+	if keyType != KeyTypeCA && (d.Get("allowed_user_key_types").(string) != "" || len(d.Get("allowed_user_key_types_and_lengths").(map[string]interface{})) != 0) {
+		return logical.ErrorResponse("Allowed user key types are only applicable for CA type"), nil
+	}
+	if _, ok := d.Raw["algorithm_signer"]; ok && keyType != KeyTypeCA {
+		return logical.ErrorResponse("Signing algorithm is only applicable for CA type"), nil
+	}
+	if _, ok := d.Raw["not_before_duration"]; ok && keyType != KeyTypeCA {
+		return logical.ErrorResponse("Not before duration is only applicable for CA type"), nil
+	}
+	if keyType != KeyTypeCA && d.Get("issuer").(string) != "" {
+		return logical.ErrorResponse("Issuer is only applicable for CA type"), nil
+	}
+	restrictToClientIP := d.Get("restrict_to_client_ip").(bool)
+	if keyType == KeyTypeCA && restrictToClientIP {
+		return logical.ErrorResponse("Restricting to the client IP is not applicable for CA type"), nil
+	}
+
+	excludeCIDRList := d.Get("exclude_cidr_list").(string)
+	if excludeCIDRList != "" {
+		if keyType == KeyTypeCA {
+			return logical.ErrorResponse("Excluded CIDR blocks not applicable for CA type"), nil
+		}
+		excludeCIDRList = normalizeList(excludeCIDRList)
+		if err := validateCIDRList(excludeCIDRList); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid exclude_cidr_list entry. %s", err)), nil
+		}
 	}
 
-	cidrList := d.Get("cidr_list").(string)
-	if cidrList == "" {
-		return logical.ErrorResponse("Missing CIDR blocks"), nil
+	allowedDomains := d.Get("allowed_domains").(string)
+	if allowedDomains != "" {
+		allowedDomains = normalizeList(strings.ToLower(allowedDomains))
+		for _, domain := range strings.Split(allowedDomains, ",") {
+			if !domainRegex.MatchString(domain) {
+				return logical.ErrorResponse(fmt.Sprintf("Invalid allowed_domains entry '%s'", domain)), nil
+			}
+		}
 	}
 
-	// Check if all the CIDR entries are infact valid entries
-	err := validateCIDRList(cidrList)
+	// Request CIDR list is an optional field, applicable for both types.
+	requestCIDRList := d.Get("request_cidr_list").(string)
+	if requestCIDRList != "" {
+		requestCIDRList = normalizeList(requestCIDRList)
+		if err := validateCIDRList(requestCIDRList); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid request_cidr_list entry. %s", err)), nil
+		}
+	}
+
+	// Fields that are not set are inherited from 'config/defaults'.
+	defaults, err := b.DefaultsConfig(req.Storage)
 	if err != nil {
-		return logical.ErrorResponse(fmt.Sprintf("Invalid cidr_list entry. %s", err)), nil
+		return nil, err
+	}
+
+	var defaultPort int
+	allowedPorts := d.Get("allowed_ports").(string)
+	if allowedPorts != "" {
+		if keyType != KeyTypeOTP {
+			return logical.ErrorResponse("Allowed ports are only applicable for OTP type"), nil
+		}
+		allowedPorts = normalizeList(allowedPorts)
+		ranges, err := parsePortRanges(allowedPorts)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid allowed_ports field. %s", err)), nil
+		}
+		for _, r := range ranges {
+			if defaultPort == 0 || r[0] < defaultPort {
+				defaultPort = r[0]
+			}
+		}
 	}
 
 	port := d.Get("port").(int)
-	if port == 0 {
-		port = 22
+	if port == 0 && defaultPort != 0 {
+		port = defaultPort
+	} else if port == 0 {
+		port = defaults.Port
+	} else if allowedPorts != "" && !portAllowed(port, allowedPorts) {
+		return logical.ErrorResponse(fmt.Sprintf("Port %d is not in allowed_ports", port)), nil
 	}
 
-	keyType := d.Get("key_type").(string)
-	if keyType == "" {
-		return logical.ErrorResponse("Missing key type"), nil
+	ttl, err := d.GetDuration("ttl")
+	if err != nil || ttl < 0 {
+		return logical.ErrorResponse("Invalid ttl field"), nil
+	}
+	maxTTL, err := d.GetDuration("max_ttl")
+	if err != nil || maxTTL < 0 {
+		return logical.ErrorResponse("Invalid max_ttl field"), nil
+	}
+	if maxTTL > 0 && ttl > maxTTL {
+		return logical.ErrorResponse("ttl can't be greater than max_ttl"), nil
 	}
-	keyType = strings.ToLower(keyType)
 
 	var roleEntry sshRole
 	if keyType == KeyTypeOTP {
@@ -169,13 +804,37 @@ func (b *backend) pathRoleWrite(req *logical.Request, d *framework.FieldData) (*
 			return logical.ErrorResponse("Admin user not required for OTP type"), nil
 		}
 
+		otpFormat := d.Get("otp_format").(string)
+		if otpFormat == "" {
+			otpFormat = OTPFormatUUID
+		}
+		otpLength := d.Get("otp_length").(int)
+		switch otpFormat {
+		case OTPFormatUUID:
+			if otpLength != 0 {
+				return logical.ErrorResponse("otp_length is not applicable to 'uuid' OTPs"), nil
+			}
+		case OTPFormatNumeric, OTPFormatBase62:
+			if otpLength == 0 {
+				otpLength = defaultOTPLengths[otpFormat]
+			}
+			if minLength := minOTPLengths[otpFormat]; otpLength < minLength || otpLength > maxOTPLength {
+				return logical.ErrorResponse(fmt.Sprintf("otp_length of '%s' OTPs must be between %d and %d", otpFormat, minLength, maxOTPLength)), nil
+			}
+		default:
+			return logical.ErrorResponse(fmt.Sprintf("Invalid otp_format '%s'", otpFormat)), nil
+		}
+
 		// Below are the only fields used from the role structure for OTP type.
 		roleEntry = sshRole{
-			DefaultUser:  defaultUser,
-			CIDRList:     cidrList,
-			KeyType:      KeyTypeOTP,
-			Port:         port,
-			AllowedUsers: allowedUsers,
+			DefaultUser:     defaultUser,
+			CIDRList:        cidrList,
+			KeyType:         KeyTypeOTP,
+			OTPFormat:       otpFormat,
+			OTPLength:       otpLength,
+			Port:            port,
+			AllowedUsers:    allowedUsers,
+			RequestCIDRList: requestCIDRList,
 		}
 	} else if keyType == KeyTypeDynamic {
 		// Key name is required by dynamic type and not by OTP type.
@@ -183,17 +842,49 @@ func (b *backend) pathRoleWrite(req *logical.Request, d *framework.FieldData) (*
 		if keyName == "" {
 			return logical.ErrorResponse("Missing key name"), nil
 		}
-		keyEntry, err := req.Storage.Get(fmt.Sprintf("keys/%s", keyName))
+		keyEntry, err := req.Storage.Get(keyPath(namespace, keyName))
 		if err != nil || keyEntry == nil {
 			return logical.ErrorResponse(fmt.Sprintf("Invalid 'key': '%s'", keyName)), nil
 		}
 
+		installScriptType := d.Get("install_script_type").(string)
+		if installScriptType == "" {
+			installScriptType = InstallScriptTypeShell
+		}
+		if installScriptType != InstallScriptTypeShell && installScriptType != InstallScriptTypePowerShell {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid install_script_type '%s'", installScriptType)), nil
+		}
+		defaultInstallScript := defaultInstallScript(installScriptType)
+		if installScriptType == InstallScriptTypeShell {
+			defaultInstallScript = defaults.InstallScript
+		}
+
 		installScript := d.Get("install_script").(string)
 
 		// Setting the default script here. The script will install the
-		// generated public key in the authorized_keys file of linux host.
+		// generated public key in the authorized_keys file of linux host,
+		// or of Windows host for PowerShell scripts. Custom scripts are
+		// validated here rather than failing on the remote host when a
+		// credential is issued.
 		if installScript == "" {
-			installScript = DefaultPublicKeyInstallScript
+			installScript = defaultInstallScript
+		} else if installScript != defaultInstallScript {
+			conf, err := b.InstallScriptConfig(req.Storage)
+			if err != nil {
+				return nil, err
+			}
+			if err := validateInstallScript(installScript, installScriptType, conf); err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("Invalid install_script field. %s", err)), nil
+			}
+		}
+
+		// The interpreter is optional but it can't be blank if it is given.
+		var installScriptInterpreter string
+		if raw, ok := d.GetOk("install_script_interpreter"); ok {
+			installScriptInterpreter = strings.TrimSpace(raw.(string))
+			if installScriptInterpreter == "" {
+				return logical.ErrorResponse("Invalid install_script_interpreter field"), nil
+			}
 		}
 
 		adminUser := d.Get("admin_user").(string)
@@ -201,46 +892,415 @@ func (b *backend) pathRoleWrite(req *logical.Request, d *framework.FieldData) (*
 			return logical.ErrorResponse("Missing admin username"), nil
 		}
 
-		// This defaults to 1024 and it can also be 2048.
-		keyBits := d.Get("key_bits").(int)
-		if keyBits != 0 && keyBits != 1024 && keyBits != 2048 {
-			return logical.ErrorResponse("Invalid key_bits field"), nil
+		hostKeyFingerprint := strings.TrimSpace(d.Get("host_key_fingerprint").(string))
+		if hostKeyFingerprint != "" {
+			if err := validateFingerprint(hostKeyFingerprint); err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("Invalid host_key_fingerprint field. %s", err)), nil
+			}
 		}
 
-		// If user has not set this field, default it to 1024
-		if keyBits == 0 {
-			keyBits = 1024
+		keyComment := d.Get("key_comment").(string)
+		if keyComment != "" {
+			if err := validateKeyComment(keyComment); err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("Invalid key_comment field. %s", err)), nil
+			}
+		}
+
+		keyOptionSpecs := strings.TrimSpace(d.Get("key_option_specs").(string))
+		if keyOptionSpecs != "" {
+			if err := validateKeyOptionSpecs(keyOptionSpecs); err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("Invalid key_option_specs field. %s", err)), nil
+			}
+		}
+		keyExpiry := d.Get("key_expiry").(bool)
+		if keyExpiry && strings.Contains(strings.ToLower(keyOptionSpecs), "expiry-time=") {
+			return logical.ErrorResponse("key_option_specs can't contain 'expiry-time' when key_expiry is set"), nil
+		}
+
+		bastionHost := strings.TrimSpace(d.Get("bastion_host").(string))
+		bastionPort := d.Get("bastion_port").(int)
+		bastionUser := d.Get("bastion_user").(string)
+		bastionKeyName := d.Get("bastion_key").(string)
+		if bastionHost != "" {
+			if bastionUser == "" {
+				return logical.ErrorResponse("Missing bastion_user"), nil
+			}
+			if bastionKeyName == "" {
+				return logical.ErrorResponse("Missing bastion_key"), nil
+			}
+			keyEntry, err := req.Storage.Get(keyPath(namespace, bastionKeyName))
+			if err != nil || keyEntry == nil {
+				return logical.ErrorResponse(fmt.Sprintf("Invalid 'bastion_key': '%s'", bastionKeyName)), nil
+			}
+			if bastionPort == 0 {
+				bastionPort = 22
+			}
+		} else if bastionPort != 0 || bastionUser != "" || bastionKeyName != "" {
+			return logical.ErrorResponse("bastion_port, bastion_user and bastion_key require bastion_host"), nil
+		}
+
+		keyAlgorithm := d.Get("key_algorithm").(string)
+		if keyAlgorithm == "" {
+			keyAlgorithm = defaults.KeyAlgorithm
+		}
+		keyBits := d.Get("key_bits").(int)
+		switch keyAlgorithm {
+		case KeyAlgorithmRSA:
+			if keyBits != 0 {
+				if err := validateRSAKeyBits(keyBits); err != nil {
+					return logical.ErrorResponse(fmt.Sprintf("Invalid key_bits field. %s", err)), nil
+				}
+			}
+
+			// If user has not set this field, default it to the configured
+			// length, which is 2048 unless configured otherwise.
+			if keyBits == 0 {
+				keyBits = defaults.KeyBits
+			}
+		case KeyAlgorithmECDSAP256:
+			if keyBits != 0 {
+				return logical.ErrorResponse("key_bits is only applicable to 'rsa' keys"), nil
+			}
+		default:
+			return logical.ErrorResponse(fmt.Sprintf("Invalid key_algorithm '%s'", keyAlgorithm)), nil
 		}
 
 		// Store all the fields required by dynamic key type
 		roleEntry = sshRole{
-			KeyName:       keyName,
-			AdminUser:     adminUser,
-			DefaultUser:   defaultUser,
-			CIDRList:      cidrList,
-			Port:          port,
-			KeyType:       KeyTypeDynamic,
-			KeyBits:       keyBits,
-			InstallScript: installScript,
-			AllowedUsers:  allowedUsers,
+			KeyName:         keyName,
+			AdminUser:       adminUser,
+			DefaultUser:     defaultUser,
+			CIDRList:        cidrList,
+			Port:            port,
+			KeyType:         KeyTypeDynamic,
+			KeyBits:         keyBits,
+			KeyAlgorithm:    keyAlgorithm,
+			InstallScript:   installScript,
+			AllowedUsers:    allowedUsers,
+			RequestCIDRList: requestCIDRList,
+
+			InstallScriptInterpreter: installScriptInterpreter,
+			InstallScriptType:        installScriptType,
+			HostKeyFingerprint:       hostKeyFingerprint,
+			KeyComment:               keyComment,
+			KeyOptionSpecs:           keyOptionSpecs,
+			VerifyOnRenew:            d.Get("verify_on_renew").(bool),
+			KeyExpiry:                keyExpiry,
+			BastionHost:              bastionHost,
+			BastionPort:              bastionPort,
+			BastionUser:              bastionUser,
+			BastionKeyName:           bastionKeyName,
+		}
+	} else if keyType == KeyTypeCA {
+		adminUser := d.Get("admin_user").(string)
+		if adminUser != "" {
+			return logical.ErrorResponse("Admin user not required for CA type"), nil
+		}
+
+		allowHostCertificates := d.Get("allow_host_certificates").(bool)
+		if allowHostCertificates && allowedDomains == "" {
+			return logical.ErrorResponse("allowed_domains is required to sign host certificates"), nil
+		}
+
+		allowedCriticalOptions := normalizeList(d.Get("allowed_critical_options").(string))
+		if err := validateCertPermissionList(allowedCriticalOptions, knownCriticalOptions); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid allowed_critical_options field. %s", err)), nil
+		}
+		allowedExtensions := normalizeList(d.Get("allowed_extensions").(string))
+		if err := validateCertPermissionList(allowedExtensions, nil); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid allowed_extensions field. %s", err)), nil
+		}
+
+		defaultCriticalOptions, err := defaultCertPermissions(d.Get("default_critical_options").(map[string]interface{}), knownCriticalOptions)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid default_critical_options field. %s", err)), nil
+		}
+		defaultExtensions, err := defaultCertPermissions(d.Get("default_extensions").(map[string]interface{}), nil)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid default_extensions field. %s", err)), nil
+		}
+
+		keyIDFormat := d.Get("key_id_format").(string)
+		if err := validateKeyIDFormat(keyIDFormat); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid key_id_format field. %s", err)), nil
+		}
+
+		allowedUserKeyTypes := normalizeList(d.Get("allowed_user_key_types").(string))
+		if allowedUserKeyTypes != "" {
+			for _, keyType := range strings.Split(allowedUserKeyTypes, ",") {
+				if !signableKeyTypes[keyType] {
+					return logical.ErrorResponse(fmt.Sprintf("Invalid allowed_user_key_types field. Unknown key type '%s'", keyType)), nil
+				}
+			}
+		}
+
+		allowedUserKeyTypesAndLengths, err := keyTypesAndLengths(d.Get("allowed_user_key_types_and_lengths").(map[string]interface{}))
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid allowed_user_key_types_and_lengths field. %s", err)), nil
+		}
+
+		algorithmSigner := d.Get("algorithm_signer").(string)
+		if _, ok := signingAlgorithms[algorithmSigner]; !ok {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid algorithm_signer field. Unknown algorithm '%s'", algorithmSigner)), nil
+		}
+
+		notBeforeDuration, err := d.GetDuration("not_before_duration")
+		if err != nil || notBeforeDuration < 0 {
+			return logical.ErrorResponse("Invalid not_before_duration field"), nil
+		}
+
+		issuer := d.Get("issuer").(string)
+		if issuer != "" {
+			ca, err := readCA(req.Storage, issuerPath(issuer))
+			if err != nil {
+				return nil, err
+			}
+			if ca == nil {
+				return logical.ErrorResponse(fmt.Sprintf("Issuer '%s' not found", issuer)), nil
+			}
+		}
+
+		// The principals of the user certificates are limited to the
+		// default user and the allowed users, and those of the host
+		// certificates to the allowed domains.
+		roleEntry = sshRole{
+			DefaultUser:     defaultUser,
+			KeyType:         KeyTypeCA,
+			AllowedUsers:    allowedUsers,
+			RequestCIDRList: requestCIDRList,
+
+			AllowHostCertificates:  allowHostCertificates,
+			AllowedCriticalOptions: allowedCriticalOptions,
+			AllowedExtensions:      allowedExtensions,
+			DefaultCriticalOptions: defaultCriticalOptions,
+			DefaultExtensions:      defaultExtensions,
+			KeyIDFormat:            keyIDFormat,
+			AllowedUserKeyTypes:    allowedUserKeyTypes,
+			AlgorithmSigner:        algorithmSigner,
+			NotBeforeDuration:      notBeforeDuration,
+			Issuer:                 issuer,
+
+			AllowedUserKeyTypesAndLengths: allowedUserKeyTypesAndLengths,
 		}
 	} else {
 		return logical.ErrorResponse("Invalid key type"), nil
 	}
 
-	entry, err := logical.StorageEntryJSON(fmt.Sprintf("roles/%s", roleName), roleEntry)
+	// The existing role is read and replaced under the lock so that a
+	// check-and-set write can't race with another write.
+	b.roleLock.Lock()
+	defer b.roleLock.Unlock()
+
+	existing, err := b.getRole(req.Storage, namespace, roleName)
 	if err != nil {
 		return nil, err
 	}
+	currentVersion := 0
+	if existing != nil {
+		currentVersion = existing.Version
+	}
+	if cas, ok := d.GetOk("cas"); ok && cas.(int) != currentVersion {
+		return nil, logical.CodedError(409, fmt.Sprintf(
+			"check-and-set failed: expected version %d, current version is %d", cas.(int), currentVersion))
+	}
+	roleEntry.ExcludeCIDRList = excludeCIDRList
+	roleEntry.AllowedDomains = allowedDomains
+	roleEntry.AllowedUsersTemplate = &allowedUsersTemplate
+	roleEntry.DenyUsers = denyUsers
+	roleEntry.AllowedPorts = allowedPorts
+	roleEntry.RestrictToClientIP = restrictToClientIP
+	roleEntry.TTL = ttl
+	roleEntry.MaxTTL = maxTTL
+	roleEntry.Version = currentVersion + 1
+
+	// A role written again after it was deleted continues the versions
+	// that were kept for it.
+	if existing == nil {
+		latest, err := latestRoleVersion(req.Storage, namespace, roleName)
+		if err != nil {
+			return nil, err
+		}
+		roleEntry.Version = latest + 1
+	}
+
+	entry, err := logical.StorageEntryJSON(rolePath(namespace, roleName), roleEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	// The role is accepted as is but let the operator know about settings
+	// that weaken its security.
+	warnings := roleWarnings(&roleEntry)
+
+	// All the validations have passed at this point. In validate only mode
+	// report that without storing the role.
+	if d.Get("validate_only").(bool) {
+		resp := &logical.Response{
+			Data: map[string]interface{}{
+				"valid": true,
+			},
+		}
+		for _, w := range warnings {
+			resp.AddWarning(w)
+		}
+		return resp, nil
+	}
 
 	if err := req.Storage.Put(entry); err != nil {
 		return nil, err
 	}
-	return nil, nil
+	b.invalidateInstallScript(rolePath(namespace, roleName))
+	if err := b.putRoleVersion(req.Storage, namespace, roleName, &roleEntry); err != nil {
+		return nil, err
+	}
+
+	if len(warnings) == 0 {
+		return nil, nil
+	}
+	resp := &logical.Response{}
+	for _, w := range warnings {
+		resp.AddWarning(w)
+	}
+	return resp, nil
+}
+
+// Returns the algorithm of the dynamic keys of the role. Roles written
+// before the algorithm was configurable use RSA keys.
+func (r *sshRole) keyAlgorithm() string {
+	if r.KeyAlgorithm == "" {
+		return KeyAlgorithmRSA
+	}
+	return r.KeyAlgorithm
+}
+
+// Returns the format of the OTPs of the role. Roles written before the
+// format was configurable issue UUID OTPs.
+func (r *sshRole) otpFormat() string {
+	if r.OTPFormat == "" {
+		return OTPFormatUUID
+	}
+	return r.OTPFormat
+}
+
+// Returns the length of the OTPs of the role. Roles written when shorter
+// OTPs were allowed issue OTPs of the minimum length of their format.
+func (r *sshRole) otpLength() int {
+	if minLength := minOTPLengths[r.otpFormat()]; r.OTPLength < minLength {
+		return minLength
+	}
+	return r.OTPLength
+}
+
+// Returns whether the entries of the allowed users of the role are templated.
+// Roles written before it was configurable always resolved them.
+func (r *sshRole) allowedUsersTemplate() bool {
+	if r.AllowedUsersTemplate == nil {
+		return true
+	}
+	return *r.AllowedUsersTemplate
+}
+
+// Returns the type of the install script of the role. Roles written before
+// the type was configurable have shell scripts.
+func (r *sshRole) installScriptType() string {
+	if r.InstallScriptType == "" {
+		return InstallScriptTypeShell
+	}
+	return r.InstallScriptType
+}
+
+// Returns the built-in install script of the given type.
+func defaultInstallScript(scriptType string) string {
+	if scriptType == InstallScriptTypePowerShell {
+		return DefaultPublicKeyInstallScriptPowerShell
+	}
+	return DefaultPublicKeyInstallScript
+}
+
+// Returns the lease of the credentials issued by the role, which is the
+// given lease of the mount with the lifetimes set by the role replacing it.
+func (r *sshRole) lease(base *configLease) *configLease {
+	result := *base
+	if r.TTL > 0 {
+		result.Lease = r.TTL
+	}
+	if r.MaxTTL > 0 {
+		result.LeaseMax = r.MaxTTL
+	}
+	return &result
+}
+
+// Returns warnings about insecure settings in the role.
+func roleWarnings(role *sshRole) []string {
+	var warnings []string
+	if role.KeyType == KeyTypeDynamic && role.keyAlgorithm() == KeyAlgorithmRSA && role.KeyBits == 1024 {
+		warnings = append(warnings, "1024-bit keys are deprecated; consider setting key_bits to 2048")
+	}
+	if role.KeyType == KeyTypeDynamic && role.HostKeyFingerprint == "" {
+		warnings = append(warnings, "host_key_fingerprint is not set; host keys of remote hosts will not be verified")
+	}
+	if role.AllowedUsers == "" {
+		warnings = append(warnings, "allowed_users is empty; credentials can be requested for any user, including the admin user")
+	} else if strings.Contains(","+role.AllowedUsers+",", ",*,") {
+		warnings = append(warnings, "allowed_users contains '*'; credentials can be requested for any user, including the admin user")
+	}
+	return warnings
+}
+
+// installScript is the effective install script of a dynamic role along
+// with its checksum.
+type installScript struct {
+	Script   string
+	Checksum string
+
+	// version is the version of the role the script was computed for.
+	version int
+}
+
+// Returns the effective install script of the role stored at the given
+// path. The script is computed once per role version and cached until the
+// role is written or deleted.
+func (b *backend) roleInstallScript(path string, role *sshRole) *installScript {
+	b.scriptLock.RLock()
+	script, ok := b.scripts[path]
+	b.scriptLock.RUnlock()
+	if ok && script.version == role.Version {
+		return script
+	}
+
+	script = newInstallScript(role)
+	b.scriptLock.Lock()
+	defer b.scriptLock.Unlock()
+	if b.scripts == nil {
+		b.scripts = make(map[string]*installScript)
+	}
+	b.scripts[path] = script
+	return script
+}
+
+// Computes the effective install script of the role, without caching it.
+func newInstallScript(role *sshRole) *installScript {
+	content := role.InstallScript
+	if content == "" {
+		content = defaultInstallScript(role.installScriptType())
+	}
+	sum := sha256.Sum256([]byte(content))
+	return &installScript{
+		Script:   content,
+		Checksum: hex.EncodeToString(sum[:]),
+		version:  role.Version,
+	}
+}
+
+// Removes the cached install script of the role stored at the given path.
+func (b *backend) invalidateInstallScript(path string) {
+	b.scriptLock.Lock()
+	defer b.scriptLock.Unlock()
+	delete(b.scripts, path)
 }
 
-func (b *backend) getRole(s logical.Storage, n string) (*sshRole, error) {
-	entry, err := s.Get("roles/" + n)
+func (b *backend) getRole(s logical.Storage, namespace, n string) (*sshRole, error) {
+	entry, err := s.Get(rolePath(namespace, n))
 	if err != nil {
 		return nil, err
 	}
@@ -257,7 +1317,9 @@ func (b *backend) getRole(s logical.Storage, n string) (*sshRole, error) {
 }
 
 func (b *backend) pathRoleRead(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	role, err := b.getRole(req.Storage, d.Get("role").(string))
+	namespace := d.Get("namespace").(string)
+	roleName := d.Get("role").(string)
+	role, err := b.getRole(req.Storage, namespace, roleName)
 	if err != nil {
 		return nil, err
 	}
@@ -265,47 +1327,181 @@ func (b *backend) pathRoleRead(req *logical.Request, d *framework.FieldData) (*l
 		return nil, nil
 	}
 
+	return roleResponse(role, b.roleInstallScript(rolePath(namespace, roleName), role)), nil
+}
+
+// Returns the response to a read of the role. The install script is only
+// used for dynamic roles.
+func roleResponse(role *sshRole, script *installScript) *logical.Response {
 	// Return information should be based on the key type of the role
 	if role.KeyType == KeyTypeOTP {
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"default_user":          role.DefaultUser,
+				"cidr_list":             role.CIDRList,
+				"exclude_cidr_list":     role.ExcludeCIDRList,
+				"restrict_to_client_ip": role.RestrictToClientIP,
+				"allowed_domains":       role.AllowedDomains,
+				"key_type":              role.KeyType,
+				"otp_format":            role.otpFormat(),
+				"otp_length":            role.otpLength(),
+				"port":                  role.Port,
+				"allowed_ports":         role.AllowedPorts,
+				"allowed_users":         role.AllowedUsers,
+
+				"allowed_users_template": role.allowedUsersTemplate(),
+				"deny_users":             role.DenyUsers,
+				"request_cidr_list":      role.RequestCIDRList,
+				"ttl":                    role.TTL.String(),
+				"max_ttl":                role.MaxTTL.String(),
+				"version":                role.Version,
+			},
+		}
+	} else if role.KeyType == KeyTypeCA {
 		return &logical.Response{
 			Data: map[string]interface{}{
 				"default_user":  role.DefaultUser,
-				"cidr_list":     role.CIDRList,
 				"key_type":      role.KeyType,
-				"port":          role.Port,
 				"allowed_users": role.AllowedUsers,
+
+				"allowed_users_template": role.allowedUsersTemplate(),
+				"deny_users":             role.DenyUsers,
+				"request_cidr_list":      role.RequestCIDRList,
+				"allowed_domains":        role.AllowedDomains,
+				"ttl":                    role.TTL.String(),
+				"max_ttl":                role.MaxTTL.String(),
+				"version":                role.Version,
+
+				"allow_host_certificates":  role.AllowHostCertificates,
+				"allowed_critical_options": role.AllowedCriticalOptions,
+				"allowed_extensions":       role.AllowedExtensions,
+				"default_critical_options": role.DefaultCriticalOptions,
+				"default_extensions":       role.DefaultExtensions,
+				"key_id_format":            role.KeyIDFormat,
+				"allowed_user_key_types":   role.AllowedUserKeyTypes,
+				"algorithm_signer":         role.AlgorithmSigner,
+				"not_before_duration":      role.NotBeforeDuration.String(),
+				"issuer":                   role.Issuer,
+
+				"allowed_user_key_types_and_lengths": role.AllowedUserKeyTypesAndLengths,
 			},
-		}, nil
+		}
 	} else {
 		return &logical.Response{
 			Data: map[string]interface{}{
-				"key":           role.KeyName,
-				"admin_user":    role.AdminUser,
-				"default_user":  role.DefaultUser,
-				"cidr_list":     role.CIDRList,
-				"port":          role.Port,
-				"key_type":      role.KeyType,
-				"key_bits":      role.KeyBits,
-				"allowed_users": role.AllowedUsers,
+				"key":                   role.KeyName,
+				"admin_user":            role.AdminUser,
+				"default_user":          role.DefaultUser,
+				"cidr_list":             role.CIDRList,
+				"exclude_cidr_list":     role.ExcludeCIDRList,
+				"restrict_to_client_ip": role.RestrictToClientIP,
+				"allowed_domains":       role.AllowedDomains,
+				"port":                  role.Port,
+				"key_type":              role.KeyType,
+				"key_bits":              role.KeyBits,
+				"key_algorithm":         role.keyAlgorithm(),
+				"allowed_users":         role.AllowedUsers,
+
+				"allowed_users_template": role.allowedUsersTemplate(),
+				"deny_users":             role.DenyUsers,
+				"request_cidr_list":      role.RequestCIDRList,
 				// Returning install script will make the output look messy.
 				// But this is one way for clients to see the script that is
 				// being used to install the key. If there is some problem,
 				// the script can be modified and configured by clients.
 				"install_script": role.InstallScript,
+
+				"install_script_checksum":    script.Checksum,
+				"install_script_interpreter": role.InstallScriptInterpreter,
+				"install_script_type":        role.installScriptType(),
+				"host_key_fingerprint":       role.HostKeyFingerprint,
+				"key_comment":                role.KeyComment,
+				"key_option_specs":           role.KeyOptionSpecs,
+				"verify_on_renew":            role.VerifyOnRenew,
+				"key_expiry":                 role.KeyExpiry,
+				"bastion_host":               role.BastionHost,
+				"bastion_port":               role.BastionPort,
+				"bastion_user":               role.BastionUser,
+				"bastion_key":                role.BastionKeyName,
+				"ttl":                        role.TTL.String(),
+				"max_ttl":                    role.MaxTTL.String(),
+				"version":                    role.Version,
 			},
-		}, nil
+		}
+	}
+}
+
+func (b *backend) pathRolesList(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	namespace := d.Get("namespace").(string)
+	prefix := rolePath(namespace, "")
+	entries, err := req.Storage.List(prefix)
+	if err != nil {
+		return nil, err
 	}
+
+	var names []string
+	keyInfo := make(map[string]interface{}, len(entries))
+	for _, name := range entries {
+		name = strings.TrimPrefix(name, prefix)
+		if strings.Contains(name, "/") {
+			continue
+		}
+
+		role, err := b.getRole(req.Storage, namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			continue
+		}
+
+		names = append(names, name)
+		keyInfo[name] = map[string]interface{}{
+			"key_type": role.KeyType,
+		}
+	}
+	sort.Strings(names)
+
+	resp := logical.ListResponse(names)
+	resp.Data["key_info"] = keyInfo
+	return resp, nil
 }
 
 func (b *backend) pathRoleDelete(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.roleLock.Lock()
+	defer b.roleLock.Unlock()
+
+	namespace := d.Get("namespace").(string)
 	roleName := d.Get("role").(string)
-	err := req.Storage.Delete(fmt.Sprintf("roles/%s", roleName))
+	err := req.Storage.Delete(rolePath(namespace, roleName))
 	if err != nil {
 		return nil, err
 	}
+	b.invalidateInstallScript(rolePath(namespace, roleName))
+
+	if err := b.removeZeroAddressRole(req.Storage, namespace, roleName); err != nil {
+		return nil, err
+	}
+	b.deleteRoleMetrics(namespace, roleName)
+
+	// Outstanding OTPs of the role shouldn't be usable once the role is gone
+	b.otpLock.Lock()
+	defer b.otpLock.Unlock()
+	if _, err := b.deleteRoleOTPs(req.Storage, namespace, roleName); err != nil {
+		return nil, err
+	}
 	return nil, nil
 }
 
+const pathRolesListHelpSyn = `
+List the roles of the backend.
+`
+
+const pathRolesListHelpDesc = `
+This path lists the names of the roles of the namespace given in the path, or of
+the default namespace. The key type of each role is returned under 'key_info'.
+`
+
 const pathRoleHelpSyn = `
 Manage the 'roles' that can be created with this backend.
 `
@@ -321,4 +1517,16 @@ If the backend is mounted at "ssh" and the role is created at "ssh/roles/web",
 then a user could request for a credential at "ssh/creds/web" for an IP that
 belongs to the role. The credential will be for the 'default_user' registered
 with the role. There is also an optional parameter 'username' for 'creds/' endpoint.
+
+Deleting a role also invalidates the outstanding OTPs that were issued for it.
+
+The last versions of each role are kept, and can be read and restored at
+'roles/<role>/versions' and 'roles/<role>/rollback'.
+
+Roles can be created in a namespace to keep them apart from the roles of other
+namespaces, by adding 'ns/' and the namespace to the path, e.g.
+"ssh/roles/ns/tenant1/web". Credentials for such a role are requested at
+"ssh/creds/ns/tenant1/web" and the role can only use keys registered in the
+same namespace. Roles and keys that are not in a namespace are in the default
+namespace.
 `
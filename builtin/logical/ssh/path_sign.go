@@ -0,0 +1,563 @@
+package ssh
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"golang.org/x/crypto/ssh"
+)
+
+// Extensions granted to user certificates. These are the permissions
+// OpenSSH grants to keys in authorized_keys files without options.
+var defaultUserCertExtensions = []string{
+	"permit-X11-forwarding",
+	"permit-agent-forwarding",
+	"permit-port-forwarding",
+	"permit-pty",
+	"permit-user-rc",
+}
+
+// Signature algorithms of the certificates signed by CA roles.
+const (
+	signingAlgorithmRSA       = "ssh-rsa"
+	signingAlgorithmRSASHA256 = "rsa-sha2-256"
+	signingAlgorithmRSASHA512 = "rsa-sha2-512"
+)
+
+// Hashes of the signature algorithms. The one of 'ssh-rsa' is left to the ssh
+// package.
+var signingAlgorithms = map[string]crypto.Hash{
+	signingAlgorithmRSA:       crypto.SHA1,
+	signingAlgorithmRSASHA256: crypto.SHA256,
+	signingAlgorithmRSASHA512: crypto.SHA512,
+}
+
+// Critical options that OpenSSH knows. Hosts refuse certificates with
+// critical options they don't know.
+var knownCriticalOptions = map[string]bool{
+	"force-command":   true,
+	"source-address":  true,
+	"verify-required": true,
+}
+
+// Matches the names of certificate extensions, including the vendor
+// extensions of the form 'name@domain'.
+var certExtensionRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9@._-]*$`)
+
+func pathSign(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "sign/" + namespacePathRegex + framework.GenericNameRegex("role"),
+		Fields: map[string]*framework.FieldSchema{
+			"namespace": namespaceField,
+			"role": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "[Required] Name of the role",
+			},
+			"public_key": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "[Required] SSH public key to sign, in the authorized_keys format",
+			},
+			"cert_type": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "user",
+				Description: `[Optional] Type of the certificate, 'user' or 'host'. Host
+				certificates can only be signed by roles with 'allow_host_certificates'.
+				Defaults to 'user'.`,
+			},
+			"valid_principals": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `[Optional] Comma separated list of usernames the certificate
+				is valid for. Defaults to the default user of the role. For host
+				certificates, it is the list of hostnames of the host and it is
+				required.`,
+			},
+			"critical_options": &framework.FieldSchema{
+				Type: framework.TypeMap,
+				Description: `[Optional] Critical options of the user certificate, as a map
+				of names to values. They must be allowed by the role. Defaults to the
+				default critical options of the role.`,
+			},
+			"extensions": &framework.FieldSchema{
+				Type: framework.TypeMap,
+				Description: `[Optional] Extensions of the user certificate, as a map of
+				names to values, which are usually empty. They must be allowed by the
+				role. Defaults to the default extensions of the role, or to the
+				extensions OpenSSH grants to keys without options.`,
+			},
+			"ttl": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `[Optional] How long the certificate is valid for, e.g. "30m".
+				Defaults to the 'ttl' of the role, or to the lease configured at
+				'config/lease', and is limited by the corresponding maximum.`,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.WriteOperation: b.pathSignWrite,
+		},
+		HelpSynopsis:    pathSignHelpSyn,
+		HelpDescription: pathSignHelpDesc,
+	}
+}
+
+func (b *backend) pathSignWrite(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	namespace := d.Get("namespace").(string)
+	roleName := d.Get("role").(string)
+
+	role, err := b.getRole(req.Storage, namespace, roleName)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving role: %s", err)
+	}
+	if role == nil {
+		return logical.ErrorCodeResponse(ErrorCodeUnknownRole, fmt.Sprintf("Role '%s' not found", roleName)), nil
+	}
+	if role.KeyType != KeyTypeCA {
+		return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, fmt.Sprintf("Role '%s' is not of 'ca' type", roleName)), nil
+	}
+
+	if role.RequestCIDRList != "" {
+		if err := validateRequestAddr(req, role.RequestCIDRList); err != nil {
+			return logical.ErrorCodeResponse(ErrorCodeRequestAddrNotAllowed, err.Error()), nil
+		}
+	}
+
+	publicKeyRaw := d.Get("public_key").(string)
+	if publicKeyRaw == "" {
+		return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, "Missing public_key"), nil
+	}
+	publicKey, err := parseSignPublicKey(publicKeyRaw)
+	if err != nil {
+		return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, fmt.Sprintf("Invalid public_key: %s", err)), nil
+	}
+	if _, ok := publicKey.(*ssh.Certificate); ok {
+		return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, "Invalid public_key: certificates can't be signed"), nil
+	}
+	if !keyTypeAllowed(publicKey.Type(), role.AllowedUserKeyTypes) {
+		return logical.ErrorCodeResponse(ErrorCodePublicKeyNotAllowed, fmt.Sprintf("Key type '%s' is not allowed by role '%s'", publicKey.Type(), roleName)), nil
+	}
+	if len(role.AllowedUserKeyTypesAndLengths) != 0 {
+		minBits, ok := role.AllowedUserKeyTypesAndLengths[publicKey.Type()]
+		if !ok {
+			return logical.ErrorCodeResponse(ErrorCodePublicKeyNotAllowed, fmt.Sprintf("Key type '%s' is not allowed by role '%s'", publicKey.Type(), roleName)), nil
+		}
+		bits, err := publicKeyBits(publicKey)
+		if err != nil {
+			return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, fmt.Sprintf("Invalid public_key: %s", err)), nil
+		}
+		if bits < minBits {
+			return logical.ErrorCodeResponse(ErrorCodePublicKeyNotAllowed, fmt.Sprintf("Key of type '%s' has %d bits, role '%s' requires at least %d", publicKey.Type(), bits, roleName, minBits)), nil
+		}
+	}
+
+	var certType uint32
+	switch d.Get("cert_type").(string) {
+	case "user":
+		certType = ssh.UserCert
+	case "host":
+		if !role.AllowHostCertificates {
+			return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, fmt.Sprintf("Role '%s' doesn't sign host certificates", roleName)), nil
+		}
+		certType = ssh.HostCert
+	default:
+		return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, fmt.Sprintf("Invalid cert_type '%s'", d.Get("cert_type").(string))), nil
+	}
+
+	var principals []string
+	if certType == ssh.HostCert {
+		// Every principal must be a hostname in the allowed domains.
+		validPrincipals := normalizeList(strings.ToLower(d.Get("valid_principals").(string)))
+		if validPrincipals == "" {
+			return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, "Missing valid_principals"), nil
+		}
+		principals = strings.Split(validPrincipals, ",")
+		for _, principal := range principals {
+			if !domainAllowed(strings.TrimSuffix(principal, "."), role.AllowedDomains) {
+				return logical.ErrorCodeResponse(ErrorCodeHostnameNotAllowed, fmt.Sprintf("Hostname '%s' is not allowed by role '%s'", principal, roleName)), nil
+			}
+		}
+	} else {
+		// Every principal must be a username the role issues credentials for.
+		principals = []string{role.DefaultUser}
+		if validPrincipals := normalizeList(d.Get("valid_principals").(string)); validPrincipals != "" {
+			principals = strings.Split(validPrincipals, ",")
+		}
+		for _, principal := range principals {
+			if _, err := resolveUsername(req, role, principal); err != nil {
+				return logical.ErrorCodeResponse(errorCode(err, ErrorCodeUserNotAllowed), err.Error()), nil
+			}
+		}
+	}
+
+	ttl, err := d.GetDuration("ttl")
+	if err != nil {
+		return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, err.Error()), nil
+	}
+	if ttl < 0 {
+		return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, "Invalid ttl: it must be positive"), nil
+	}
+	lease, err := b.Lease(req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if lease == nil {
+		lease = &configLease{Lease: 1 * time.Hour}
+	}
+	lease = role.lease(lease)
+	if ttl == 0 {
+		ttl = lease.Lease
+	}
+	if lease.LeaseMax > 0 && ttl > lease.LeaseMax {
+		ttl = lease.LeaseMax
+	}
+
+	ca, issuer, err := b.roleCA(req.Storage, role)
+	if err != nil {
+		return nil, err
+	}
+	if ca == nil && issuer != "" {
+		return logical.ErrorResponse(fmt.Sprintf("Issuer '%s' of role '%s' not found", issuer, roleName)), nil
+	}
+	if ca == nil {
+		return logical.ErrorResponse("CA key not configured; configure it at 'config/ca'"), nil
+	}
+	caKey, err := ssh.ParseRawPrivateKey([]byte(ca.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("error reading the CA key: %s", err)
+	}
+	signer, err := newCertSigner(caKey, role.AlgorithmSigner)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Role '%s' can't sign with the CA key: %s", roleName, err)), nil
+	}
+
+	var serial uint64
+	if err := binary.Read(rand.Reader, binary.BigEndian, &serial); err != nil {
+		return nil, fmt.Errorf("error generating serial number: %s", err)
+	}
+
+	// Critical options and extensions only apply to user certificates.
+	criticalOptions, err := certPermissions(d.Get("critical_options").(map[string]interface{}), role.AllowedCriticalOptions)
+	if err != nil {
+		return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, fmt.Sprintf("Invalid critical_options: %s", err)), nil
+	}
+	extensions, err := certPermissions(d.Get("extensions").(map[string]interface{}), role.AllowedExtensions)
+	if err != nil {
+		return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, fmt.Sprintf("Invalid extensions: %s", err)), nil
+	}
+	if certType == ssh.HostCert && (len(criticalOptions) != 0 || len(extensions) != 0) {
+		return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, "Host certificates can't have critical options or extensions"), nil
+	}
+	if sourceAddress, ok := criticalOptions["source-address"]; ok {
+		if err := validateCIDRList(normalizeList(sourceAddress)); err != nil {
+			return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, fmt.Sprintf("Invalid source-address critical option: %s", err)), nil
+		}
+	}
+	if certType == ssh.UserCert && criticalOptions == nil {
+		criticalOptions, err = renderCertPermissions(req, role.DefaultCriticalOptions)
+		if err != nil {
+			return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, fmt.Sprintf("Error rendering default_critical_options of role '%s': %s", roleName, err)), nil
+		}
+	}
+	if certType == ssh.UserCert && extensions == nil {
+		extensions, err = renderCertPermissions(req, role.DefaultExtensions)
+		if err != nil {
+			return logical.ErrorCodeResponse(ErrorCodeInvalidRequest, fmt.Sprintf("Error rendering default_extensions of role '%s': %s", roleName, err)), nil
+		}
+	}
+	if certType == ssh.UserCert && extensions == nil {
+		extensions = make(map[string]string, len(defaultUserCertExtensions))
+		for _, extension := range defaultUserCertExtensions {
+			extensions[extension] = ""
+		}
+	}
+
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             publicKey,
+		Serial:          serial,
+		CertType:        certType,
+		KeyId:           certKeyID(req, roleName, role.KeyIDFormat, publicKey),
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-role.NotBeforeDuration).Unix()),
+		ValidBefore:     uint64(now.Add(ttl).Unix()),
+		Permissions: ssh.Permissions{
+			CriticalOptions: criticalOptions,
+			Extensions:      extensions,
+		},
+	}
+	var signedKey string
+	if _, ok := publicKey.(*securityKey); ok {
+		signedKey, err = signSecurityKeyCert(cert, rand.Reader, signer)
+	} else if err = cert.SignCert(rand.Reader, signer); err == nil {
+		signedKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert)))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error signing the public key: %s", err)
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"signed_key":    signedKey,
+			"serial_number": strconv.FormatUint(serial, 16),
+			"issuer":        issuer,
+			"known_hosts":   knownHostsCertAuthority(role.AllowedDomains, signer.PublicKey()) + "\n",
+		},
+	}
+	if certType == ssh.UserCert {
+		resp.Data["ssh_config"] = certSSHConfigSnippet(role.AllowedDomains, principals[0])
+	}
+	return resp, nil
+}
+
+// Renders an ssh_config Host block to log in to the hosts of the domains, or
+// to any host if there are none, as the user. The certificate is loaded by
+// ssh when it is stored next to the private key with a '-cert.pub' suffix.
+func certSSHConfigSnippet(allowedDomains, username string) string {
+	return "Host " + strings.Replace(knownHostsPatterns(allowedDomains), ",", " ", -1) + "\n" +
+		"  User " + username + "\n"
+}
+
+// Checks the critical options or extensions requested for a certificate
+// against the comma separated list allowed by the role, and returns them.
+// Nil is returned if none were requested.
+func certPermissions(requested map[string]interface{}, allowed string) (map[string]string, error) {
+	if len(requested) == 0 {
+		return nil, nil
+	}
+	allowAll := false
+	allowedNames := make(map[string]bool)
+	for _, name := range strings.Split(allowed, ",") {
+		if name == "*" {
+			allowAll = true
+		}
+		allowedNames[name] = true
+	}
+
+	permissions := make(map[string]string, len(requested))
+	for name, valueRaw := range requested {
+		value, ok := valueRaw.(string)
+		if !ok {
+			return nil, fmt.Errorf("value of '%s' must be a string", name)
+		}
+		if !certExtensionRegex.MatchString(name) {
+			return nil, fmt.Errorf("invalid name '%s'", name)
+		}
+		if !allowAll && !allowedNames[name] {
+			return nil, fmt.Errorf("'%s' is not allowed by the role", name)
+		}
+		permissions[name] = value
+	}
+	return permissions, nil
+}
+
+// Checks the default critical options or extensions of a role and returns
+// them. If known is given, the names must be in it. Nil is returned if there
+// are none.
+func defaultCertPermissions(defaults map[string]interface{}, known map[string]bool) (map[string]string, error) {
+	if len(defaults) == 0 {
+		return nil, nil
+	}
+	permissions := make(map[string]string, len(defaults))
+	for name, valueRaw := range defaults {
+		value, ok := valueRaw.(string)
+		if !ok {
+			return nil, fmt.Errorf("value of '%s' must be a string", name)
+		}
+		if !certExtensionRegex.MatchString(name) {
+			return nil, fmt.Errorf("invalid name '%s'", name)
+		}
+		if known != nil && !known[name] {
+			return nil, fmt.Errorf("unknown name '%s'", name)
+		}
+		if err := validateTokenTemplate(value); err != nil {
+			return nil, fmt.Errorf("invalid value of '%s': %s", name, err)
+		}
+		permissions[name] = value
+	}
+	return permissions, nil
+}
+
+// Renders the values of the default critical options or extensions of a
+// role for the token making the request. Nil is returned if there are none.
+func renderCertPermissions(req *logical.Request, defaults map[string]string) (map[string]string, error) {
+	if len(defaults) == 0 {
+		return nil, nil
+	}
+	permissions := make(map[string]string, len(defaults))
+	for name, tmpl := range defaults {
+		value, err := renderTokenTemplate(req, tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %s", name, err)
+		}
+		permissions[name] = value
+	}
+	return permissions, nil
+}
+
+// Checks that the entries of the normalized list of critical options or
+// extensions are well formed. If known is given, the entries must be in it.
+func validateCertPermissionList(list string, known map[string]bool) error {
+	if list == "" {
+		return nil
+	}
+	for _, name := range strings.Split(list, ",") {
+		if name == "*" {
+			continue
+		}
+		if !certExtensionRegex.MatchString(name) {
+			return fmt.Errorf("invalid name '%s'", name)
+		}
+		if known != nil && !known[name] {
+			return fmt.Errorf("unknown name '%s'", name)
+		}
+	}
+	return nil
+}
+
+// Returns the signer of the certificates for the CA key and the signature
+// algorithm of the role. The SHA-2 algorithms are only defined for RSA keys.
+func newCertSigner(key interface{}, algorithm string) (ssh.Signer, error) {
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if algorithm == "" || algorithm == signingAlgorithmRSA {
+		return signer, nil
+	}
+	hash, ok := signingAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing algorithm '%s'", algorithm)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing algorithm '%s' requires an RSA key", algorithm)
+	}
+	return &rsaAlgorithmSigner{
+		Signer:    signer,
+		key:       rsaKey,
+		algorithm: algorithm,
+		hash:      hash,
+	}, nil
+}
+
+// Signs with an RSA key using one of the SHA-2 signature algorithms of RFC
+// 8332. The ssh package only implements the SHA-1 one, 'ssh-rsa'.
+type rsaAlgorithmSigner struct {
+	ssh.Signer
+	key       *rsa.PrivateKey
+	algorithm string
+	hash      crypto.Hash
+}
+
+func (s *rsaAlgorithmSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	h := s.hash.New()
+	h.Write(data)
+	blob, err := rsa.SignPKCS1v15(rand, s.key, s.hash, h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.Signature{
+		Format: s.algorithm,
+		Blob:   blob,
+	}, nil
+}
+
+// Variables that the key ID format of a role can contain.
+var keyIDFormatVars = map[string]bool{
+	"token_display_name": true,
+	"role_name":          true,
+	"public_key_hash":    true,
+}
+
+// Checks that the key ID format only refers to known variables.
+func validateKeyIDFormat(format string) error {
+	for _, match := range templateVarRegex.FindAllStringSubmatch(format, -1) {
+		if !keyIDFormatVars[match[1]] {
+			return fmt.Errorf("unknown variable '%s'", match[0])
+		}
+	}
+	return nil
+}
+
+// Returns the key ID of a certificate, which identifies it in the logs of
+// the hosts. Without a format, the key ID is made of the display name of the
+// token and the fingerprint of the key.
+func certKeyID(req *logical.Request, roleName, format string, publicKey ssh.PublicKey) string {
+	if format == "" {
+		if req.DisplayName == "" {
+			return "vault-" + fingerprintSHA256(publicKey)
+		}
+		return fmt.Sprintf("vault-%s-%s", req.DisplayName, fingerprintSHA256(publicKey))
+	}
+	return templateVarRegex.ReplaceAllStringFunc(format, func(match string) string {
+		switch match[2 : len(match)-2] {
+		case "token_display_name":
+			return req.DisplayName
+		case "role_name":
+			return roleName
+		case "public_key_hash":
+			return fingerprintSHA256(publicKey)
+		}
+		return ""
+	})
+}
+
+const pathSignHelpSyn = `
+Sign an SSH public key with the CA key.
+`
+
+const pathSignHelpDesc = `
+This path signs the given public key with the CA key of the issuer of the role,
+or of the default issuer, or else the one configured at 'config/ca', and
+returns an SSH user certificate. The role must be of 'ca' type. The
+certificate is valid for the requested principals, which must be allowed by the
+role, and can be used to login to the hosts that trust the CA. Nothing is
+installed in the hosts and there is no agent involved.
+
+User certificates get the 'default_extensions' and 'default_critical_options'
+of the role, rendered for the requesting token, or else the extensions that
+OpenSSH grants to keys without options. Requests can set other 'extensions' and
+'critical_options' instead, such as 'force-command', if they are in the
+'allowed_extensions' and 'allowed_critical_options' of the role.
+
+With 'cert_type' set to 'host', the host key of a host is signed instead, for
+roles with 'allow_host_certificates'. The principals are the hostnames of the
+host, which must be in the 'allowed_domains' of the role. Clients that trust
+the CA, through a '@cert-authority' line in their known_hosts file, accept the
+host without its key having to be known in advance.
+
+The response includes that 'known_hosts' line for the CA key, limited to the
+'allowed_domains' of the role if it has any. For user certificates it also
+includes an 'ssh_config' Host block that logs in to the same hosts as the first
+principal. ssh uses the certificate when it is saved next to the private key,
+with the same name and a '-cert.pub' suffix.
+
+The key ID of the certificate, which sshd logs when it is used, follows the
+'key_id_format' of the role. By default it holds the display name of the token
+and the fingerprint of the signed key, to correlate the logins to the requests.
+
+The certificate is signed with the 'algorithm_signer' of the role. Hosts
+running recent OpenSSH versions refuse the default 'ssh-rsa' signatures, and
+need roles that sign with 'rsa-sha2-256' or 'rsa-sha2-512'.
+
+Besides RSA, DSA and ECDSA keys, the keys of FIDO security keys can be signed,
+of types 'sk-ecdsa-sha2-nistp256@openssh.com' and 'sk-ssh-ed25519@openssh.com'.
+Roles can restrict the types of the keys they sign with 'allowed_user_key_types',
+and refuse weak keys with 'allowed_user_key_types_and_lengths', which maps the
+allowed types to their minimum sizes in bits. Other keys are refused with the
+'public_key_not_allowed' error code.
+
+The certificate is valid for the requested 'ttl' and it can't be revoked, so
+short TTLs are recommended. The start of its validity is backdated by the
+'not_before_duration' of the role, for hosts whose clocks are behind.
+`
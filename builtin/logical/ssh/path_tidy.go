@@ -0,0 +1,188 @@
+package ssh
+
+import (
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathTidy(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "tidy",
+		Fields: map[string]*framework.FieldSchema{
+			"safety_buffer": &framework.FieldSchema{
+				Type:    framework.TypeDurationSecond,
+				Default: 259200,
+				Description: `[Optional] The amount of time that must pass after the expiry
+				of the lease of an entry before it is removed. Defaults to 72 hours.`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.WriteOperation: b.pathTidyWrite,
+		},
+
+		HelpSynopsis:    pathTidyHelpSyn,
+		HelpDescription: pathTidyHelpDesc,
+	}
+}
+
+func (b *backend) pathTidyWrite(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	safetyBuffer := time.Duration(d.Get("safety_buffer").(int)) * time.Second
+	if safetyBuffer < 0 {
+		return logical.ErrorResponse("safety_buffer can't be negative"), nil
+	}
+	cutoff := time.Now().Add(-safetyBuffer)
+
+	b.otpLock.Lock()
+	deletedOTPs, err := tidyOTPs(req.Storage, "otp/", cutoff)
+	if err == nil {
+		var deletedUsed int
+		deletedUsed, err = tidyOTPs(req.Storage, "otp_used/", cutoff)
+		deletedOTPs += deletedUsed
+	}
+	b.otpLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// Records of dynamic keys are kept under each role, in every namespace.
+	// Their keys are removed from the hosts before the records are deleted.
+	keys, err := collectKeys(req.Storage, "issued/")
+	if err != nil {
+		return nil, err
+	}
+	nsKeys, err := collectKeys(req.Storage, "ns/")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range nsKeys {
+		parts := strings.SplitN(key, "/", 4)
+		if len(parts) == 4 && parts[2] == "issued" {
+			keys = append(keys, key)
+		}
+	}
+
+	var expired []string
+	var expiredKeys []*walDynamicKey
+	for _, key := range keys {
+		entry, err := req.Storage.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue
+		}
+		var issued issuedDynamicKey
+		if err := entry.DecodeJSON(&issued); err != nil {
+			return nil, err
+		}
+		if issued.ExpiresAt.IsZero() || issued.ExpiresAt.After(cutoff) {
+			continue
+		}
+		expired = append(expired, key)
+		expiredKeys = append(expiredKeys, &issued.walDynamicKey)
+	}
+
+	revokedKeys := 0
+	failures := []map[string]interface{}{}
+	for i, err := range b.uninstallWALDynamicKeys(req.Storage, expiredKeys) {
+		if err != nil {
+			failures = append(failures, map[string]interface{}{
+				"path":     expired[i],
+				"username": expiredKeys[i].Username,
+				"ip":       expiredKeys[i].IP,
+				"error":    err.Error(),
+			})
+			continue
+		}
+		if err := req.Storage.Delete(expired[i]); err != nil {
+			return nil, err
+		}
+		revokedKeys++
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"deleted_otps": deletedOTPs,
+			"revoked_keys": revokedKeys,
+			"failures":     failures,
+		},
+	}, nil
+}
+
+// Deletes the OTP entries under the prefix whose lease expired before the
+// cutoff, and returns how many were deleted. Entries that don't record the
+// expiry of their lease are kept. The caller must hold the otpLock.
+func tidyOTPs(s logical.Storage, prefix string, cutoff time.Time) (int, error) {
+	keys, err := s.List(prefix)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, key := range keys {
+		key = prefix + strings.TrimPrefix(key, prefix)
+		entry, err := s.Get(key)
+		if err != nil {
+			return deleted, err
+		}
+		if entry == nil || len(entry.Value) == 0 {
+			continue
+		}
+		var otp sshOTP
+		if err := entry.DecodeJSON(&otp); err != nil {
+			return deleted, err
+		}
+		if otp.ExpiresAt.IsZero() || otp.ExpiresAt.After(cutoff) {
+			continue
+		}
+		if err := s.Delete(key); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// Returns the full paths of all the entries under the prefix, descending
+// into the folders that the storage lists.
+func collectKeys(s logical.Storage, prefix string) ([]string, error) {
+	keys, err := s.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, key := range keys {
+		key = strings.TrimPrefix(key, prefix)
+		if strings.HasSuffix(key, "/") {
+			subKeys, err := collectKeys(s, prefix+key)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, subKeys...)
+			continue
+		}
+		result = append(result, prefix+key)
+	}
+	return result, nil
+}
+
+const pathTidyHelpSyn = `
+Remove the entries of expired credentials that were left in storage.
+`
+
+const pathTidyHelpDesc = `
+Credentials are removed from storage when their leases are revoked. Entries
+whose revocation didn't complete are left behind and accumulate over time.
+Writing to this path removes the entries of OTPs, used or not, and of dynamic
+keys whose leases expired longer than 'safety_buffer' ago. The dynamic keys
+are removed from their hosts before their entries are deleted.
+
+The response holds the number of OTP entries deleted and of dynamic keys
+revoked, and a list of the dynamic keys that couldn't be removed from their
+hosts along with the error. Their entries are kept, to be retried by the next
+tidy. Entries of credentials issued before the expiry of their leases was
+recorded are never removed.
+`
@@ -40,6 +40,19 @@ func (b *backend) getOTP(s logical.Storage, n string) (*sshOTP, error) {
 	return &result, nil
 }
 
+// Salts the OTP the way it is stored. OTPs are stored under the HMAC of the
+// OTP keyed by the salt of the backend, so the OTPs can't be recovered from
+// storage.
+func (b *backend) saltOTP(otp string) string {
+	return b.salt.GetHMAC(otp)
+}
+
+// Returns the salted values under which the OTP could be stored. OTPs issued
+// before HMACs were used are stored under the salted SHA1 hash of the OTP.
+func (b *backend) saltedOTPs(otp string) []string {
+	return []string{b.saltOTP(otp), b.salt.SaltID(otp)}
+}
+
 func (b *backend) pathVerifyWrite(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	otp := d.Get("otp").(string)
 
@@ -54,25 +67,56 @@ func (b *backend) pathVerifyWrite(req *logical.Request, d *framework.FieldData)
 		}, nil
 	}
 
-	// Create the salt of OTP because entry would have been create with the
-	// salt and not directly of the OTP. Salt will yield the same value which
-	// because the seed is the same, the backend salt.
-	otpSalted := b.salt.SaltID(otp)
+	// Looking up and consuming the OTP must happen as one step, otherwise
+	// concurrent requests could both validate the same OTP.
+	b.otpLock.Lock()
+	defer b.otpLock.Unlock()
 
-	// Return nil if there is no entry found for the OTP
-	otpEntry, err := b.getOTP(req.Storage, otpSalted)
-	if err != nil {
-		return nil, err
+	// Entries are stored under the salted OTP and not under the OTP itself,
+	// so look up every form in which the OTP could have been stored.
+	var otpSalted string
+	var otpEntry *sshOTP
+	for _, id := range b.saltedOTPs(otp) {
+		entry, err := b.getOTP(req.Storage, id)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			otpSalted, otpEntry = id, entry
+			break
+		}
 	}
 	if otpEntry == nil {
-		return nil, nil
+		// Tell apart an OTP that was already used from an unknown one
+		for _, id := range b.saltedOTPs(otp) {
+			used, err := req.Storage.Get("otp_used/" + id)
+			if err != nil {
+				return nil, err
+			}
+			if used != nil {
+				return logical.ErrorResponse("OTP has already been used"), nil
+			}
+		}
+		return logical.ErrorResponse("OTP not found"), nil
 	}
 
-	// Delete the OTP if found. This is what makes the key an OTP.
-	err = req.Storage.Delete("otp/" + otpSalted)
+	// Delete the OTP if found. This is what makes the key an OTP. A marker
+	// is left behind until the lease of the OTP is revoked, to recognize
+	// replays of the OTP. The marker holds the entry of the OTP so that it
+	// can be tidied up once the lease expires.
+	err := req.Storage.Delete("otp/" + otpSalted)
 	if err != nil {
 		return nil, err
 	}
+	usedEntry, err := logical.StorageEntryJSON("otp_used/"+otpSalted, otpEntry)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(usedEntry); err != nil {
+		return nil, err
+	}
+
+	b.incrMetric(otpEntry.Namespace, otpEntry.RoleName, metricOTPsVerified, 1)
 
 	// Return username and IP only if there were no problems uptill this point.
 	return &logical.Response{
@@ -92,5 +136,6 @@ This path will be used by Vault SSH Agent runnin in the remote hosts. The OTP
 provided by the client is sent to Vault for validation by the agent. If Vault
 finds an entry for the OTP, it responds with the username and IP it is associated
 with. Agent uses this information to authenticate the client. Vault deletes the
-OTP after validating it once.
+OTP after validating it once. Presenting an OTP that was already used results in
+an error which is distinct from the error for an unknown OTP.
 `
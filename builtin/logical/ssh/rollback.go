@@ -0,0 +1,150 @@
+package ssh
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/mitchellh/mapstructure"
+)
+
+// walDynamicKeyKind is the kind of the WAL entries written before a dynamic
+// key is installed in a remote host.
+const walDynamicKeyKind = "dynamic_key"
+
+// maxParallelUninstalls is the number of dynamic keys that are uninstalled
+// at once when many of them are revoked together.
+const maxParallelUninstalls = 16
+
+// walDynamicKey holds what is needed to uninstall a dynamic key whose
+// installation didn't complete. The shared key is referred to by name so
+// that it isn't copied into the WAL. Installed keys are recorded under
+// their role in the same form, see issuedDynamicKey.
+type walDynamicKey struct {
+	Namespace                string
+	AdminUser                string
+	HostKeyName              string
+	Username                 string
+	IP                       string
+	Port                     int
+	DynamicPublicKey         string
+	InstallScript            string
+	InstallScriptInterpreter string
+	InstallScriptType        string
+	HostKeyFingerprint       string
+	BastionHost              string
+	BastionPort              int
+	BastionUser              string
+	BastionKeyName           string
+}
+
+// issuedDynamicKey is the record of an installed dynamic key, kept under its
+// role until the key is revoked. ExpiresAt is the expiry of the lease of the
+// key when it was last issued or renewed. It is zero for keys issued before
+// it was recorded.
+type issuedDynamicKey struct {
+	walDynamicKey
+	ExpiresAt time.Time
+}
+
+// Uninstalls a dynamic key that was being installed when the WAL entry
+// was written. Uninstalling a key that isn't installed is harmless.
+func (b *backend) dynamicKeyRollback(req *logical.Request, kind string, data interface{}) error {
+	var entry walDynamicKey
+	if err := mapstructure.Decode(data, &entry); err != nil {
+		return err
+	}
+	return b.uninstallWALDynamicKey(req.Storage, &entry)
+}
+
+// Uninstalls the dynamic key of the WAL entry and verifies that it is no
+// longer in the authorized_keys file of the remote host, so that a key that
+// couldn't be removed, for example because the host is down, isn't taken for
+// removed.
+func (b *backend) uninstallWALDynamicKey(s logical.Storage, entry *walDynamicKey) error {
+	opts, err := b.walInstallOptions(s, entry)
+	if err != nil {
+		return err
+	}
+	if err := b.installKey(opts); err != nil {
+		return err
+	}
+
+	installed, err := b.verifyKey(opts)
+	if err != nil {
+		return fmt.Errorf("error verifying the removal of the public key: %s", err)
+	}
+	if installed {
+		return fmt.Errorf("public key is still installed in the target host")
+	}
+	return nil
+}
+
+// Uninstalls the dynamic keys from their hosts in parallel, and returns the
+// error of each key in the same order. The connections to each host are
+// still limited by the pool.
+func (b *backend) uninstallWALDynamicKeys(s logical.Storage, entries []*walDynamicKey) []error {
+	errs := make([]error, len(entries))
+	sem := make(chan struct{}, maxParallelUninstalls)
+	var wg sync.WaitGroup
+	for i, entry := range entries {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, entry *walDynamicKey) {
+			defer wg.Done()
+			errs[i] = b.uninstallWALDynamicKey(s, entry)
+			<-sem
+		}(i, entry)
+	}
+	wg.Wait()
+	return errs
+}
+
+// Builds the options to uninstall the dynamic key of the WAL entry.
+func (b *backend) walInstallOptions(s logical.Storage, entry *walDynamicKey) (*installOptions, error) {
+	hostKey, err := b.getKey(s, entry.Namespace, entry.HostKeyName)
+	if err != nil {
+		return nil, fmt.Errorf("key '%s' not found error:%s", entry.HostKeyName, err)
+	}
+	if hostKey == nil {
+		return nil, fmt.Errorf("key '%s' not found", entry.HostKeyName)
+	}
+
+	opts := &installOptions{
+		AdminUser:                entry.AdminUser,
+		HostKey:                  hostKey.Key,
+		HostPassword:             hostKey.Password,
+		HostKeyboardInteractive:  hostKey.KeyboardInteractive,
+		Username:                 entry.Username,
+		IP:                       entry.IP,
+		Port:                     entry.Port,
+		DynamicPublicKey:         entry.DynamicPublicKey,
+		InstallScript:            entry.InstallScript,
+		InstallScriptInterpreter: entry.InstallScriptInterpreter,
+		InstallScriptType:        entry.InstallScriptType,
+		HostKeyFingerprint:       entry.HostKeyFingerprint,
+		BastionHost:              entry.BastionHost,
+		BastionPort:              entry.BastionPort,
+		BastionUser:              entry.BastionUser,
+		Install:                  false,
+	}
+	opts.HostKeyCertificate, err = b.keyCertificate(s, hostKey, entry.AdminUser)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.setBastionKey(s, entry.Namespace, opts, entry.BastionKeyName); err != nil {
+		return nil, err
+	}
+
+	defaults, err := b.DefaultsConfig(s)
+	if err != nil {
+		return nil, err
+	}
+	opts.DialTimeout = defaults.DialTimeout
+	opts.DialRetries = defaults.DialRetries
+	opts.DialBackoff = defaults.DialBackoff
+	opts.MaxConnections = defaults.MaxConnectionsPerHost
+	opts.IdleTimeout = defaults.ConnectionIdleTimeout
+	return opts, nil
+}
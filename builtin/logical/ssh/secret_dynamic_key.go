@@ -6,6 +6,7 @@ import (
 
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
+	"github.com/mitchellh/mapstructure"
 )
 
 const SecretDynamicKeyType = "secret_dynamic_key_type"
@@ -31,6 +32,27 @@ func secretDynamicKey(b *backend) *framework.Secret {
 }
 
 func (b *backend) secretDynamicKeyRenew(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if _, ok := req.Secret.InternalData["keys"]; ok {
+		return logical.ErrorResponse("Renewing dynamic keys issued in a batch is not supported"), nil
+	}
+
+	// The key may have been removed from the host since it was installed.
+	// If the role asked for it, check that the key is still there before
+	// extending the lease of a credential that no longer works.
+	if verify, _ := req.Secret.InternalData["verify_on_renew"].(bool); verify {
+		opts, err := b.dynamicKeyOptions(req)
+		if err != nil {
+			return nil, err
+		}
+		installed, err := b.verifyKey(opts)
+		if err != nil {
+			return nil, fmt.Errorf("error verifying public key in target: %s", err)
+		}
+		if !installed {
+			return b.expireDynamicKey(req.Storage, req.Secret)
+		}
+	}
+
 	lease, err := b.Lease(req.Storage)
 	if err != nil {
 		return nil, err
@@ -38,12 +60,301 @@ func (b *backend) secretDynamicKeyRenew(req *logical.Request, d *framework.Field
 	if lease == nil {
 		lease = &configLease{Lease: 1 * time.Hour}
 	}
+
+	// Secrets of roles that were deleted, or that were issued before the
+	// role was recorded, keep the lease of the mount.
+	namespace, _ := req.Secret.InternalData["namespace"].(string)
+	if roleName, _ := req.Secret.InternalData["role_name"].(string); roleName != "" {
+		role, err := b.getRole(req.Storage, namespace, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role != nil {
+			lease = role.lease(lease)
+		}
+	}
+
+	// Keys installed with an expiry no longer recorded under their role
+	// were revoked, so they are not installed again.
+	keyExpiry, _ := req.Secret.InternalData["key_expiry"].(bool)
+	issuedPath := issuedKeySecretPath(req.Secret)
+	var issued *issuedDynamicKey
+	if issuedPath != "" {
+		entry, err := req.Storage.Get(issuedPath)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			issued = &issuedDynamicKey{}
+			if err := entry.DecodeJSON(issued); err != nil {
+				return nil, err
+			}
+		} else if keyExpiry {
+			return logical.ErrorResponse("Dynamic key was revoked"), nil
+		}
+	}
+
 	f := framework.LeaseExtend(lease.Lease, lease.LeaseMax, false)
-	return f(req, d)
+	resp, err := f(req, d)
+	if err != nil || resp.IsError() {
+		return resp, err
+	}
+	expiresAt := time.Now().Add(resp.Secret.TTL)
+	err = b.updateIssuances(req.Storage, req.Secret, func(entry *issuance) {
+		entry.ExpiresAt = expiresAt
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !keyExpiry {
+		// Record the new expiry of the lease for the key to be tidied up
+		// after it.
+		if issued != nil {
+			if err := b.putIssuedKey(req.Storage, req.Secret, &issued.walDynamicKey, expiresAt); err != nil {
+				return nil, err
+			}
+		}
+		return resp, nil
+	}
+
+	// Push back the expiry of the key in the host along with the lease.
+	warning, err := b.renewKeyExpiry(req.Storage, resp.Secret, expiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("error extending the expiry of public key in target: %s", err)
+	}
+	if warning != "" {
+		resp.AddWarning(warning)
+	}
+	return resp, nil
+}
+
+// Installs the dynamic key of the secret again with the given expiry and
+// removes the key with the previous expiry. The new key is installed first
+// so that the credential keeps working throughout. The internal data of the
+// secret and the record of the key are updated to the new key. A previous
+// key that can't be removed expires on its own, and is removed by the
+// rollback; a warning is returned for it.
+func (b *backend) renewKeyExpiry(s logical.Storage, secret *logical.Secret, expiry time.Time) (string, error) {
+	oldEntry, err := dynamicKeyWALEntry(secret)
+	if err != nil {
+		return "", err
+	}
+	newEntry := *oldEntry
+	newEntry.DynamicPublicKey = setKeyExpiry(oldEntry.DynamicPublicKey, expiry)
+	if newEntry.DynamicPublicKey == oldEntry.DynamicPublicKey {
+		return "", b.putIssuedKey(s, secret, &newEntry, expiry)
+	}
+
+	walID, err := framework.PutWAL(s, walDynamicKeyKind, &newEntry)
+	if err != nil {
+		return "", fmt.Errorf("error writing WAL entry: %s", err)
+	}
+	opts, err := b.walInstallOptions(s, &newEntry)
+	if err == nil {
+		opts.Install = true
+		err = b.installKey(opts)
+	}
+	if err != nil {
+		if uerr := b.uninstallWALDynamicKey(s, &newEntry); uerr == nil {
+			framework.DeleteWAL(s, walID)
+		}
+		return "", err
+	}
+
+	if err := b.putIssuedKey(s, secret, &newEntry, expiry); err != nil {
+		if uerr := b.uninstallWALDynamicKey(s, &newEntry); uerr == nil {
+			framework.DeleteWAL(s, walID)
+		}
+		return "", fmt.Errorf("error recording the issued key: %s", err)
+	}
+	secret.InternalData["dynamic_public_key"] = newEntry.DynamicPublicKey
+	if err := framework.DeleteWAL(s, walID); err != nil {
+		return "", fmt.Errorf("failed to commit WAL entry: %s", err)
+	}
+
+	if err := b.uninstallWALDynamicKey(s, oldEntry); err != nil {
+		if _, werr := framework.PutWAL(s, walDynamicKeyKind, oldEntry); werr != nil {
+			return "", fmt.Errorf("error removing the previous public key from target: %s", err)
+		}
+		return fmt.Sprintf("error removing the previous public key from target, it will be retried: %s", err), nil
+	}
+	return "", nil
 }
 
 func (b *backend) secretDynamicKeyRevoke(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	adminUserRaw, ok := req.Secret.InternalData["admin_user"]
+	secrets, err := batchKeySecrets(req.Secret)
+	if err != nil {
+		return nil, err
+	}
+	if secrets == nil {
+		secrets = []*logical.Secret{req.Secret}
+	}
+
+	var resp *logical.Response
+	for _, secret := range secrets {
+		warning, err := b.revokeDynamicKey(req.Storage, secret)
+		if err != nil {
+			return nil, err
+		}
+		if warning != "" {
+			if resp == nil {
+				resp = &logical.Response{}
+			}
+			resp.AddWarning(warning)
+		}
+	}
+	return resp, nil
+}
+
+// Returns a secret for each of the dynamic keys of a secret issued in a
+// batch, with the internal data that the secret of a single key has. Nil
+// is returned for secrets of a single key.
+func batchKeySecrets(secret *logical.Secret) ([]*logical.Secret, error) {
+	keysRaw, ok := secret.InternalData["keys"]
+	if !ok {
+		return nil, nil
+	}
+	var keys []map[string]interface{}
+	if err := mapstructure.Decode(keysRaw, &keys); err != nil {
+		return nil, fmt.Errorf("secret is missing internal data")
+	}
+	secrets := make([]*logical.Secret, 0, len(keys))
+	for _, key := range keys {
+		secrets = append(secrets, &logical.Secret{InternalData: key})
+	}
+	return secrets, nil
+}
+
+// Revokes the dynamic key of the secret: the key is removed from its host
+// and the credential is marked as revoked in the issuance log. If the key
+// can't be verifiably removed, for example because the host is down, a WAL
+// entry is left for the rollback to retry removing it, and a warning is
+// returned.
+func (b *backend) revokeDynamicKey(s logical.Storage, secret *logical.Secret) (string, error) {
+	removed, warning, err := b.removeDynamicKey(s, secret)
+	if err != nil || !removed {
+		return "", err
+	}
+	if err := b.revokeIssuances(s, secret); err != nil {
+		return "", err
+	}
+
+	namespace, _ := secret.InternalData["namespace"].(string)
+	roleName, _ := secret.InternalData["role_name"].(string)
+	b.incrMetric(namespace, roleName, metricRevocations, 1)
+	return warning, nil
+}
+
+// Removes the dynamic key of the secret from its host and deletes the record
+// of the key. Keys that are no longer recorded under their role were already
+// removed by revoking all the keys of the role, and false is returned for
+// them. Secrets issued before keys were recorded don't have a record. A key
+// that can't be removed is left to the rollback, with a warning.
+func (b *backend) removeDynamicKey(s logical.Storage, secret *logical.Secret) (bool, string, error) {
+	issuedPath := issuedKeySecretPath(secret)
+	if issuedPath != "" {
+		entry, err := s.Get(issuedPath)
+		if err != nil {
+			return false, "", err
+		}
+		if entry == nil {
+			return false, "", nil
+		}
+	}
+
+	walEntry, err := dynamicKeyWALEntry(secret)
+	if err != nil {
+		return false, "", err
+	}
+
+	var warning string
+	if err := b.uninstallWALDynamicKey(s, walEntry); err != nil {
+		if _, werr := framework.PutWAL(s, walDynamicKeyKind, walEntry); werr != nil {
+			return false, "", fmt.Errorf("error removing public key from authorized_keys file in target %s: %s", walEntry.IP, err)
+		}
+		warning = fmt.Sprintf("error removing public key from authorized_keys file in target %s, it will be retried: %s", walEntry.IP, err)
+	}
+
+	if issuedPath != "" {
+		if err := s.Delete(issuedPath); err != nil {
+			return false, "", err
+		}
+	}
+	return true, warning, nil
+}
+
+// Revokes the dynamic key of a secret whose key is no longer installed in
+// its host. The record of the key is removed and the credential is marked
+// as revoked in the issuance log. The returned error response carries the
+// secret with the shortest lease, so that the lease expires right away
+// instead of being extended; revoking it later finds no record and does
+// nothing.
+func (b *backend) expireDynamicKey(s logical.Storage, secret *logical.Secret) (*logical.Response, error) {
+	if issuedPath := issuedKeySecretPath(secret); issuedPath != "" {
+		if err := s.Delete(issuedPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.revokeIssuances(s, secret); err != nil {
+		return nil, err
+	}
+
+	namespace, _ := secret.InternalData["namespace"].(string)
+	roleName, _ := secret.InternalData["role_name"].(string)
+	b.incrMetric(namespace, roleName, metricRevocations, 1)
+
+	resp := logical.ErrorResponse("Dynamic key is no longer installed in the target host")
+	resp.Secret = secret
+	// A zero TTL or grace period would be replaced by the defaults of the
+	// secret type.
+	resp.Secret.TTL = time.Second
+	resp.Secret.GracePeriod = time.Nanosecond
+	return resp, nil
+}
+
+// Writes the record of the dynamic key of the secret, if the key is recorded.
+func (b *backend) putIssuedKey(s logical.Storage, secret *logical.Secret, key *walDynamicKey, expiresAt time.Time) error {
+	issuedPath := issuedKeySecretPath(secret)
+	if issuedPath == "" {
+		return nil
+	}
+	entry, err := logical.StorageEntryJSON(issuedPath, &issuedDynamicKey{
+		walDynamicKey: *key,
+		ExpiresAt:     expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+	return s.Put(entry)
+}
+
+// Returns the storage path of the record of the dynamic key of the secret,
+// or an empty string if the key wasn't recorded.
+func issuedKeySecretPath(secret *logical.Secret) string {
+	issuedID, _ := secret.InternalData["issued_id"].(string)
+	if issuedID == "" {
+		return ""
+	}
+	namespace, _ := secret.InternalData["namespace"].(string)
+	roleName, _ := secret.InternalData["role_name"].(string)
+	return issuedKeysPath(namespace, roleName) + issuedID
+}
+
+// Builds the options to uninstall the dynamic key of the secret from the
+// internal data of the secret.
+func (b *backend) dynamicKeyOptions(req *logical.Request) (*installOptions, error) {
+	entry, err := dynamicKeyWALEntry(req.Secret)
+	if err != nil {
+		return nil, err
+	}
+	return b.walInstallOptions(req.Storage, entry)
+}
+
+// Builds the record of the dynamic key of the secret, in the form written
+// to the WAL, from the internal data of the secret.
+func dynamicKeyWALEntry(secret *logical.Secret) (*walDynamicKey, error) {
+	adminUserRaw, ok := secret.InternalData["admin_user"]
 	if !ok {
 		return nil, fmt.Errorf("secret is missing internal data")
 	}
@@ -52,7 +363,7 @@ func (b *backend) secretDynamicKeyRevoke(req *logical.Request, d *framework.Fiel
 		return nil, fmt.Errorf("secret is missing internal data")
 	}
 
-	usernameRaw, ok := req.Secret.InternalData["username"]
+	usernameRaw, ok := secret.InternalData["username"]
 	if !ok {
 		return nil, fmt.Errorf("secret is missing internal data")
 	}
@@ -61,7 +372,7 @@ func (b *backend) secretDynamicKeyRevoke(req *logical.Request, d *framework.Fiel
 		return nil, fmt.Errorf("secret is missing internal data")
 	}
 
-	ipRaw, ok := req.Secret.InternalData["ip"]
+	ipRaw, ok := secret.InternalData["ip"]
 	if !ok {
 		return nil, fmt.Errorf("secret is missing internal data")
 	}
@@ -70,7 +381,7 @@ func (b *backend) secretDynamicKeyRevoke(req *logical.Request, d *framework.Fiel
 		return nil, fmt.Errorf("secret is missing internal data")
 	}
 
-	hostKeyNameRaw, ok := req.Secret.InternalData["host_key_name"]
+	hostKeyNameRaw, ok := secret.InternalData["host_key_name"]
 	if !ok {
 		return nil, fmt.Errorf("secret is missing internal data")
 	}
@@ -79,7 +390,7 @@ func (b *backend) secretDynamicKeyRevoke(req *logical.Request, d *framework.Fiel
 		return nil, fmt.Errorf("secret is missing internal data")
 	}
 
-	dynamicPublicKeyRaw, ok := req.Secret.InternalData["dynamic_public_key"]
+	dynamicPublicKeyRaw, ok := secret.InternalData["dynamic_public_key"]
 	if !ok {
 		return nil, fmt.Errorf("secret is missing internal data")
 	}
@@ -88,7 +399,7 @@ func (b *backend) secretDynamicKeyRevoke(req *logical.Request, d *framework.Fiel
 		return nil, fmt.Errorf("secret is missing internal data")
 	}
 
-	installScriptRaw, ok := req.Secret.InternalData["install_script"]
+	installScriptRaw, ok := secret.InternalData["install_script"]
 	if !ok {
 		return nil, fmt.Errorf("secret is missing internal data")
 	}
@@ -97,26 +408,63 @@ func (b *backend) secretDynamicKeyRevoke(req *logical.Request, d *framework.Fiel
 		return nil, fmt.Errorf("secret is missing internal data")
 	}
 
-	portRaw, ok := req.Secret.InternalData["port"]
+	// The interpreter is absent for secrets issued before it was
+	// configurable, in which case the script is run directly.
+	installScriptInterpreter, _ := secret.InternalData["install_script_interpreter"].(string)
+
+	// Likewise, secrets issued before the type was configurable have shell
+	// install scripts.
+	installScriptType, _ := secret.InternalData["install_script_type"].(string)
+	if installScriptType == "" {
+		installScriptType = InstallScriptTypeShell
+	}
+
+	// Likewise, without a fingerprint the host key is not verified.
+	hostKeyFingerprint, _ := secret.InternalData["host_key_fingerprint"].(string)
+
+	port, ok := internalDataInt(secret.InternalData["port"])
 	if !ok {
 		return nil, fmt.Errorf("secret is missing internal data")
 	}
-	port := int(portRaw.(float64))
 
-	// Fetch the host key using the key name
-	hostKey, err := b.getKey(req.Storage, hostKeyName)
-	if err != nil {
-		return nil, fmt.Errorf("key '%s' not found error:%s", hostKeyName, err)
+	// Secrets issued before namespaces were supported are in the
+	// default namespace.
+	namespace, _ := secret.InternalData["namespace"].(string)
+
+	entry := &walDynamicKey{
+		Namespace:                namespace,
+		AdminUser:                adminUser,
+		HostKeyName:              hostKeyName,
+		Username:                 username,
+		IP:                       ip,
+		Port:                     port,
+		DynamicPublicKey:         dynamicPublicKey,
+		InstallScript:            installScript,
+		InstallScriptInterpreter: installScriptInterpreter,
+		InstallScriptType:        installScriptType,
+		HostKeyFingerprint:       hostKeyFingerprint,
 	}
-	if hostKey == nil {
-		return nil, fmt.Errorf("key '%s' not found", hostKeyName)
+
+	// Secrets issued before bastion hosts were supported connect to the
+	// remote host directly.
+	entry.BastionHost, _ = secret.InternalData["bastion_host"].(string)
+	if entry.BastionHost != "" {
+		entry.BastionPort, _ = internalDataInt(secret.InternalData["bastion_port"])
+		entry.BastionUser, _ = secret.InternalData["bastion_user"].(string)
+		entry.BastionKeyName, _ = secret.InternalData["bastion_key_name"].(string)
 	}
+	return entry, nil
+}
 
-	// Remove the public key from authorized_keys file in target machine
-	// The last param 'false' indicates that the key should be uninstalled.
-	err = b.installPublicKeyInTarget(adminUser, username, ip, port, hostKey.Key, dynamicPublicKey, installScript, false)
-	if err != nil {
-		return nil, fmt.Errorf("error removing public key from authorized_keys file in target")
+// Returns the integer in the internal data of a secret. Numbers are decoded
+// as float64 when the secret is read back from storage.
+func internalDataInt(raw interface{}) (int, bool) {
+	switch v := raw.(type) {
+	case float64:
+		return int(v), true
+	case int:
+		return v, true
+	default:
+		return 0, false
 	}
-	return nil, nil
 }
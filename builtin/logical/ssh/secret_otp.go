@@ -2,10 +2,12 @@ package ssh
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
+	"github.com/mitchellh/mapstructure"
 )
 
 const SecretOTPType = "secret_otp_type"
@@ -18,14 +20,128 @@ func secretOTP(b *backend) *framework.Secret {
 				Type:        framework.TypeString,
 				Description: "One time password",
 			},
+			"username": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Username in host",
+			},
+			"ip": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "IP address of host",
+			},
 		},
 		DefaultDuration:    10 * time.Minute,
 		DefaultGracePeriod: 2 * time.Minute,
+		Renew:              b.secretOTPRenew,
 		Revoke:             b.secretOTPRevoke,
 	}
 }
 
+// Renewing an OTP secret issues a new OTP for the same username and IP and
+// invalidates the OTP that was previously issued with the lease.
+func (b *backend) secretOTPRenew(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if _, ok := req.Secret.InternalData["otps"]; ok {
+		return logical.ErrorResponse("Renewing OTPs issued for multiple IPs is not supported"), nil
+	}
+
+	otpRaw, ok := req.Secret.InternalData["otp"]
+	if !ok {
+		return nil, fmt.Errorf("secret is missing internal data")
+	}
+	oldOTP, ok := otpRaw.(string)
+	if !ok {
+		return nil, fmt.Errorf("secret is missing internal data")
+	}
+
+	username := d.Get("username").(string)
+	ip := d.Get("ip").(string)
+	if username == "" || ip == "" {
+		return nil, fmt.Errorf("secret is missing data")
+	}
+
+	// OTPs can't be renewed once their role is deleted. The role is not
+	// known for secrets issued before it was recorded.
+	namespace, _ := req.Secret.InternalData["namespace"].(string)
+	roleName, _ := req.Secret.InternalData["role_name"].(string)
+	var role *sshRole
+	if roleName != "" {
+		var err error
+		role, err = b.getRole(req.Storage, namespace, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			return logical.ErrorResponse(fmt.Sprintf("Role '%s' not found", roleName)), nil
+		}
+	}
+
+	lease, err := b.Lease(req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if lease == nil {
+		lease = &configLease{Lease: 1 * time.Hour}
+	}
+	if role != nil {
+		lease = role.lease(lease)
+	}
+	f := framework.LeaseExtend(lease.Lease, lease.LeaseMax, false)
+	resp, err := f(req, d)
+	if err != nil || resp.IsError() {
+		return resp, err
+	}
+
+	// Rotate the OTP under the lock so that the old OTP can't be verified
+	// once the new one is issued.
+	b.otpLock.Lock()
+	defer b.otpLock.Unlock()
+
+	otp, err := b.GenerateOTPCredential(req, namespace, roleName, role, username, ip, time.Now().Add(resp.Secret.TTL))
+	if err != nil {
+		return nil, err
+	}
+	if err := b.deleteOTP(req.Storage, oldOTP); err != nil {
+		return nil, err
+	}
+
+	resp.Data = make(map[string]interface{}, len(req.Data))
+	for k, v := range req.Data {
+		resp.Data[k] = v
+	}
+	resp.Data["key"] = otp
+	resp.Secret.InternalData["otp"] = otp
+
+	expiresAt := time.Now().Add(resp.Secret.TTL)
+	err = b.updateIssuances(req.Storage, req.Secret, func(entry *issuance) {
+		entry.ExpiresAt = expiresAt
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
 func (b *backend) secretOTPRevoke(req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	namespace, _ := req.Secret.InternalData["namespace"].(string)
+	roleName, _ := req.Secret.InternalData["role_name"].(string)
+
+	// Secrets issued for multiple IPs at once hold a list of OTPs
+	if otpsRaw, ok := req.Secret.InternalData["otps"]; ok {
+		var otps []string
+		if err := mapstructure.Decode(otpsRaw, &otps); err != nil {
+			return nil, fmt.Errorf("secret is missing internal data")
+		}
+		for _, otp := range otps {
+			if err := b.deleteOTP(req.Storage, otp); err != nil {
+				return nil, err
+			}
+		}
+		if err := b.revokeIssuances(req.Storage, req.Secret); err != nil {
+			return nil, err
+		}
+		b.incrMetric(namespace, roleName, metricRevocations, len(otps))
+		return nil, nil
+	}
+
 	otpRaw, ok := req.Secret.InternalData["otp"]
 	if !ok {
 		return nil, fmt.Errorf("secret is missing internal data")
@@ -35,9 +151,54 @@ func (b *backend) secretOTPRevoke(req *logical.Request, d *framework.FieldData)
 		return nil, fmt.Errorf("secret is missing internal data")
 	}
 
-	err := req.Storage.Delete("otp/" + b.salt.SaltID(otp))
-	if err != nil {
+	if err := b.deleteOTP(req.Storage, otp); err != nil {
+		return nil, err
+	}
+	if err := b.revokeIssuances(req.Storage, req.Secret); err != nil {
 		return nil, err
 	}
+	b.incrMetric(namespace, roleName, metricRevocations, 1)
 	return nil, nil
 }
+
+// Deletes the OTP along with the marker left behind if it was used.
+func (b *backend) deleteOTP(s logical.Storage, otp string) error {
+	for _, otpSalted := range b.saltedOTPs(otp) {
+		if err := deleteSaltedOTP(s, otpSalted); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteSaltedOTP(s logical.Storage, otpSalted string) error {
+	if err := s.Delete("otp/" + otpSalted); err != nil {
+		return err
+	}
+	return s.Delete("otp_used/" + otpSalted)
+}
+
+// Deletes the outstanding OTPs that were issued for the role and returns
+// how many were deleted. The caller must hold the otpLock.
+func (b *backend) deleteRoleOTPs(s logical.Storage, namespace, roleName string) (int, error) {
+	keys, err := s.List("otp/")
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, otpSalted := range keys {
+		otpSalted = strings.TrimPrefix(otpSalted, "otp/")
+		otpEntry, err := b.getOTP(s, otpSalted)
+		if err != nil {
+			return deleted, err
+		}
+		if otpEntry == nil || otpEntry.Namespace != namespace || otpEntry.RoleName != roleName {
+			continue
+		}
+		if err := deleteSaltedOTP(s, otpSalted); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
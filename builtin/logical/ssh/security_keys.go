@@ -0,0 +1,281 @@
+package ssh
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"golang.org/x/crypto/ssh"
+)
+
+// Types of the public keys of FIDO security keys, as generated by OpenSSH
+// with 'ssh-keygen -t ecdsa-sk' and 'ssh-keygen -t ed25519-sk'.
+const (
+	KeyAlgoSKECDSA256 = "sk-ecdsa-sha2-nistp256@openssh.com"
+	KeyAlgoSKED25519  = "sk-ssh-ed25519@openssh.com"
+)
+
+// Certificate types of the security key types.
+var securityKeyCertAlgos = map[string]string{
+	KeyAlgoSKECDSA256: "sk-ecdsa-sha2-nistp256-cert-v01@openssh.com",
+	KeyAlgoSKED25519:  "sk-ssh-ed25519-cert-v01@openssh.com",
+}
+
+// Types of the public keys that CA roles can sign, which are the ones
+// 'allowed_user_key_types' can list.
+var signableKeyTypes = map[string]bool{
+	ssh.KeyAlgoRSA:      true,
+	ssh.KeyAlgoDSA:      true,
+	ssh.KeyAlgoECDSA256: true,
+	ssh.KeyAlgoECDSA384: true,
+	ssh.KeyAlgoECDSA521: true,
+	KeyAlgoSKECDSA256:   true,
+	KeyAlgoSKED25519:    true,
+}
+
+// Validates the minimum sizes of the key types allowed by a role, which can
+// be numbers or strings of numbers. Nil is returned if there are none.
+func keyTypesAndLengths(raw map[string]interface{}) (map[string]int, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var lengths map[string]int
+	if err := mapstructure.WeakDecode(raw, &lengths); err != nil {
+		return nil, err
+	}
+	for keyType, bits := range lengths {
+		if !signableKeyTypes[keyType] {
+			return nil, fmt.Errorf("unknown key type '%s'", keyType)
+		}
+		if bits < 0 {
+			return nil, fmt.Errorf("minimum size of '%s' must not be negative", keyType)
+		}
+	}
+	return lengths, nil
+}
+
+// Checks the type of the public key against the comma separated list of
+// types allowed by the role. All types are allowed if the list is empty.
+func keyTypeAllowed(keyType, allowedTypes string) bool {
+	if allowedTypes == "" {
+		return true
+	}
+	for _, allowed := range strings.Split(allowedTypes, ",") {
+		if allowed == keyType {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the size in bits of the public key, which for RSA and DSA keys is
+// the size of their modulus and for the others the size of their curve.
+func publicKeyBits(publicKey ssh.PublicKey) (int, error) {
+	switch publicKey.Type() {
+	case ssh.KeyAlgoRSA:
+		var w struct {
+			Type string
+			E, N *big.Int
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(publicKey.Marshal(), &w); err != nil {
+			return 0, err
+		}
+		return w.N.BitLen(), nil
+	case ssh.KeyAlgoDSA:
+		var w struct {
+			Type       string
+			P, Q, G, Y *big.Int
+			Rest       []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(publicKey.Marshal(), &w); err != nil {
+			return 0, err
+		}
+		return w.P.BitLen(), nil
+	case ssh.KeyAlgoECDSA256, KeyAlgoSKECDSA256, KeyAlgoSKED25519:
+		return 256, nil
+	case ssh.KeyAlgoECDSA384:
+		return 384, nil
+	case ssh.KeyAlgoECDSA521:
+		return 521, nil
+	}
+	return 0, fmt.Errorf("unknown key type '%s'", publicKey.Type())
+}
+
+// securityKey is the public key of a FIDO security key. The ssh package
+// doesn't know these keys, so they are kept in their wire format. Vault only
+// signs them, so their signatures can't be verified.
+type securityKey struct {
+	keyType string
+	blob    []byte
+}
+
+func (k *securityKey) Type() string {
+	return k.keyType
+}
+
+func (k *securityKey) Marshal() []byte {
+	return k.blob
+}
+
+func (k *securityKey) Verify(data []byte, sig *ssh.Signature) error {
+	return fmt.Errorf("ssh: verifying signatures of %s keys is not supported", k.keyType)
+}
+
+// Parses the public key to sign, in the authorized_keys format. Security key
+// types are parsed here, and all the others by the ssh package.
+func parseSignPublicKey(raw string) (ssh.PublicKey, error) {
+	fields := strings.Fields(raw)
+	if len(fields) < 2 || securityKeyCertAlgos[fields[0]] == "" {
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(raw))
+		return publicKey, err
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("ssh: invalid base64 in public key")
+	}
+
+	// The key is made of its type, the public key of its algorithm, and the
+	// application the security key was registered for.
+	in := bytes.NewReader(blob)
+	keyType, err := readSSHString(in)
+	if err != nil || string(keyType) != fields[0] {
+		return nil, fmt.Errorf("ssh: key type doesn't match the public key")
+	}
+	switch fields[0] {
+	case KeyAlgoSKECDSA256:
+		curve, err := readSSHString(in)
+		if err != nil || string(curve) != "nistp256" {
+			return nil, fmt.Errorf("ssh: invalid curve in %s key", fields[0])
+		}
+		point, err := readSSHString(in)
+		if err != nil || len(point) != 65 || point[0] != 4 {
+			return nil, fmt.Errorf("ssh: invalid point in %s key", fields[0])
+		}
+	case KeyAlgoSKED25519:
+		point, err := readSSHString(in)
+		if err != nil || len(point) != 32 {
+			return nil, fmt.Errorf("ssh: invalid point in %s key", fields[0])
+		}
+	}
+	if _, err := readSSHString(in); err != nil || in.Len() != 0 {
+		return nil, fmt.Errorf("ssh: invalid application in %s key", fields[0])
+	}
+
+	return &securityKey{keyType: fields[0], blob: blob}, nil
+}
+
+// Reads a length-prefixed string of the SSH wire format.
+func readSSHString(in *bytes.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(in, length[:]); err != nil {
+		return nil, err
+	}
+	n := int(length[0])<<24 | int(length[1])<<16 | int(length[2])<<8 | int(length[3])
+	if n > in.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	s := make([]byte, n)
+	_, err := io.ReadFull(in, s)
+	return s, err
+}
+
+// Signs the certificate of a security key and returns it in the
+// authorized_keys format. The ssh package can't sign certificates of keys it
+// doesn't know, so the certificate is encoded here the way the ssh package
+// encodes the others.
+func signSecurityKeyCert(cert *ssh.Certificate, rand io.Reader, authority ssh.Signer) (string, error) {
+	certAlgo := securityKeyCertAlgos[cert.Key.Type()]
+	cert.Nonce = make([]byte, 32)
+	if _, err := io.ReadFull(rand, cert.Nonce); err != nil {
+		return "", err
+	}
+	cert.SignatureKey = authority.PublicKey()
+
+	unsigned := marshalSecurityKeyCert(certAlgo, cert)
+	sig, err := authority.Sign(rand, unsigned[:len(unsigned)-4])
+	if err != nil {
+		return "", err
+	}
+	cert.Signature = sig
+
+	return certAlgo + " " + base64.StdEncoding.EncodeToString(marshalSecurityKeyCert(certAlgo, cert)), nil
+}
+
+// Encodes the certificate in the wire format of OpenSSH certificates. The
+// signature is encoded as an empty string if the certificate isn't signed.
+func marshalSecurityKeyCert(certAlgo string, cert *ssh.Certificate) []byte {
+	var principals []byte
+	for _, principal := range cert.ValidPrincipals {
+		principals = append(principals, ssh.Marshal(&struct{ N string }{principal})...)
+	}
+	var signature []byte
+	if cert.Signature != nil {
+		signature = ssh.Marshal(cert.Signature)
+	}
+
+	// The public key is encoded without its type.
+	keyBytes := cert.Key.Marshal()
+	keyBytes = keyBytes[4+len(cert.Key.Type()):]
+
+	prefix := ssh.Marshal(&struct {
+		Name  string
+		Nonce []byte
+		Key   []byte `ssh:"rest"`
+	}{certAlgo, cert.Nonce, keyBytes})
+	generic := ssh.Marshal(&struct {
+		Serial          uint64
+		CertType        uint32
+		KeyId           string
+		ValidPrincipals []byte
+		ValidAfter      uint64
+		ValidBefore     uint64
+		CriticalOptions []byte
+		Extensions      []byte
+		Reserved        []byte
+		SignatureKey    []byte
+		Signature       []byte
+	}{
+		Serial:          cert.Serial,
+		CertType:        cert.CertType,
+		KeyId:           cert.KeyId,
+		ValidPrincipals: principals,
+		ValidAfter:      cert.ValidAfter,
+		ValidBefore:     cert.ValidBefore,
+		CriticalOptions: marshalCertTuples(cert.CriticalOptions),
+		Extensions:      marshalCertTuples(cert.Extensions),
+		Reserved:        cert.Reserved,
+		SignatureKey:    cert.SignatureKey.Marshal(),
+		Signature:       signature,
+	})
+	return append(prefix, generic...)
+}
+
+// Encodes critical options or extensions, sorted by name. Values that are
+// not empty are encoded as a string within the string of the value.
+func marshalCertTuples(tuples map[string]string) []byte {
+	names := make([]string, 0, len(tuples))
+	for name := range tuples {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result []byte
+	for _, name := range names {
+		var value []byte
+		if tuples[name] != "" {
+			value = ssh.Marshal(&struct{ V string }{tuples[name]})
+		}
+		result = append(result, ssh.Marshal(&struct {
+			Name  string
+			Value []byte
+		}{name, value})...)
+	}
+	return result
+}
@@ -2,59 +2,684 @@ package ssh
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
 	"fmt"
+	"math/big"
 	"net"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf16"
 
 	"github.com/hashicorp/vault/logical"
 
 	"golang.org/x/crypto/ssh"
 )
 
-// Creates a SSH session object which can be used to run commands
-// in the target machine. The session will use public key authentication
-// method with port 22.
-func createSSHPublicKeysSession(username, ipAddr string, port int, hostKey string) (*ssh.Session, error) {
-	if username == "" {
+// Parameters to connect to a remote host and install or uninstall a
+// dynamic public key on it.
+type installOptions struct {
+	// AdminUser and HostKey are the username and the shared private key
+	// used to login to the remote host.
+	AdminUser string
+	HostKey   string
+
+	// HostKeyCertificate, if set, is the SSH certificate of the host key
+	// that is presented along with it.
+	HostKeyCertificate string
+
+	// HostPassword, if set, is used to login to the remote host instead of
+	// the host key. With HostKeyboardInteractive, it is also given as the
+	// answer to keyboard-interactive prompts.
+	HostPassword            string
+	HostKeyboardInteractive bool
+
+	// Username is the user whose authorized_keys file is modified.
+	Username string
+	IP       string
+	Port     int
+
+	DynamicPublicKey         string
+	InstallScript            string
+	InstallScriptInterpreter string
+
+	// InstallScriptType is either 'shell' or 'powershell'. PowerShell
+	// scripts are run on Windows hosts, whose commands and paths differ.
+	InstallScriptType string
+
+	// HostKeyFingerprint, if set, is the SHA256 fingerprint that the
+	// host key presented by the remote host must have.
+	HostKeyFingerprint string
+
+	// BastionHost, if set, is the jump host through which the connection
+	// to the remote host is tunneled. BastionUser and BastionKey are the
+	// username and the private key used to login to it.
+	BastionHost string
+	BastionPort int
+	BastionUser string
+	BastionKey  string
+
+	// BastionKeyCertificate, if set, is the SSH certificate of the bastion
+	// key that is presented along with it.
+	BastionKeyCertificate string
+
+	// BastionPassword and BastionKeyboardInteractive are the equivalents of
+	// HostPassword and HostKeyboardInteractive for the bastion host.
+	BastionPassword            string
+	BastionKeyboardInteractive bool
+
+	// DialTimeout is the timeout of the connections to the remote host and
+	// to the bastion host. The default timeout is used if it is not set.
+	DialTimeout time.Duration
+
+	// DialRetries is the number of times that a failed connection to the
+	// remote host is retried. The first retry waits for DialBackoff, and
+	// the wait doubles after each retry.
+	DialRetries int
+	DialBackoff time.Duration
+
+	// MaxConnections is the number of connections to the remote host that
+	// can be used at once, and IdleTimeout how long they are kept open
+	// once they are released. The defaults are used if they are not set.
+	MaxConnections int
+	IdleTimeout    time.Duration
+
+	// Install, if false, uninstalls the key.
+	Install bool
+}
+
+// Matches the variables in templates such as the key comment
+var templateVarRegex = regexp.MustCompile(`{{([^{}]*)}}`)
+
+// Prefix of the template variables that refer to token metadata
+const tokenMetadataVarPrefix = "token.metadata."
+
+// Checks that the key comment template only refers to known variables and
+// fits on a single line.
+func validateKeyComment(tmpl string) error {
+	if strings.ContainsAny(tmpl, "\r\n") {
+		return fmt.Errorf("comment must be a single line")
+	}
+	for _, match := range templateVarRegex.FindAllStringSubmatch(tmpl, -1) {
+		switch match[1] {
+		case "role_name", "display_name", "timestamp":
+		default:
+			return fmt.Errorf("unknown variable '%s'", match[0])
+		}
+	}
+	return nil
+}
+
+// Renders the key comment template. Control characters are dropped from the
+// substituted values so that they can't break the authorized_keys line.
+func renderKeyComment(tmpl, roleName, displayName string, now time.Time) string {
+	comment := strings.NewReplacer(
+		"{{role_name}}", roleName,
+		"{{display_name}}", displayName,
+		"{{timestamp}}", now.UTC().Format(time.RFC3339),
+	).Replace(tmpl)
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, comment)
+}
+
+// Options which OpenSSH accepts for keys in authorized_keys files. The
+// options with values are followed by '='.
+var authorizedKeysOptions = map[string]bool{
+	"agent-forwarding":    true,
+	"cert-authority":      true,
+	"command=":            true,
+	"environment=":        true,
+	"expiry-time=":        true,
+	"from=":               true,
+	"no-agent-forwarding": true,
+	"no-port-forwarding":  true,
+	"no-pty":              true,
+	"no-user-rc":          true,
+	"no-x11-forwarding":   true,
+	"permitlisten=":       true,
+	"permitopen=":         true,
+	"port-forwarding":     true,
+	"principals=":         true,
+	"pty":                 true,
+	"restrict":            true,
+	"tunnel=":             true,
+	"user-rc":             true,
+	"x11-forwarding":      true,
+}
+
+// Checks that the key option specs are a comma separated list of known
+// authorized_keys options, whose values are double quoted and which fit on
+// a single line.
+func validateKeyOptionSpecs(specs string) error {
+	if strings.ContainsAny(specs, "\r\n") {
+		return fmt.Errorf("options must be a single line")
+	}
+
+	// Split the options on the commas outside of quoted values. A space
+	// outside of quotes would end the options in the authorized_keys line.
+	var options []string
+	var current []rune
+	inQuotes, escaped := false, false
+	for _, r := range specs {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && inQuotes:
+			escaped = true
+		case r == '"':
+			inQuotes = !inQuotes
+		case r == ',' && !inQuotes:
+			options = append(options, string(current))
+			current = nil
+			continue
+		case (r == ' ' || r == '\t') && !inQuotes:
+			return fmt.Errorf("options can't contain spaces outside of quoted values")
+		}
+		current = append(current, r)
+	}
+	if inQuotes {
+		return fmt.Errorf("unterminated quoted value")
+	}
+	options = append(options, string(current))
+
+	for _, option := range options {
+		name := option
+		if i := strings.IndexByte(option, '='); i != -1 {
+			name = option[:i+1]
+			value := option[i+1:]
+			if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+				return fmt.Errorf("value of option '%s' must be double quoted", option[:i])
+			}
+		}
+		if !authorizedKeysOptions[strings.ToLower(name)] {
+			return fmt.Errorf("unknown option '%s'", option)
+		}
+	}
+	return nil
+}
+
+// Format of the 'expiry-time' option of the dynamic keys. The trailing 'Z'
+// makes OpenSSH read the time as UTC.
+const keyExpiryFormat = "20060102150405Z"
+
+// Matches the 'expiry-time' option set on a dynamic key, followed by the
+// separator from the rest of the authorized_keys line.
+var keyExpiryRegex = regexp.MustCompile(`^expiry-time="[0-9]{14}Z"([ ,])`)
+
+// Sets the 'expiry-time' option at the start of the authorized_keys line of
+// the dynamic public key, replacing the one set before if there is one.
+func setKeyExpiry(publicKey string, expiry time.Time) string {
+	option := fmt.Sprintf(`expiry-time="%s"`, expiry.UTC().Format(keyExpiryFormat))
+	if match := keyExpiryRegex.FindStringSubmatch(publicKey); match != nil {
+		return option + match[1] + publicKey[len(match[0]):]
+	}
+
+	// Lines without options start with the algorithm of the key
+	for _, algorithm := range []string{ssh.KeyAlgoRSA, ssh.KeyAlgoECDSA256} {
+		if strings.HasPrefix(publicKey, algorithm+" ") {
+			return option + " " + publicKey
+		}
+	}
+	return option + "," + publicKey
+}
+
+// Checks that the template only refers to the variables that are resolved
+// from the token making the request: {{display_name}} and
+// {{token.metadata.<key>}}.
+func validateTokenTemplate(tmpl string) error {
+	for _, match := range templateVarRegex.FindAllStringSubmatch(tmpl, -1) {
+		name := match[1]
+		if name == "display_name" {
+			continue
+		}
+		if strings.HasPrefix(name, tokenMetadataVarPrefix) && len(name) > len(tokenMetadataVarPrefix) {
+			continue
+		}
+		return fmt.Errorf("unknown variable '%s'", match[0])
+	}
+	return nil
+}
+
+// Returns the value of the template variable for the token making the
+// request, or an empty string if it has none.
+func tokenTemplateValue(req *logical.Request, name string) string {
+	switch {
+	case name == "display_name":
+		return req.DisplayName
+	case strings.HasPrefix(name, tokenMetadataVarPrefix):
+		return req.Metadata[strings.TrimPrefix(name, tokenMetadataVarPrefix)]
+	}
+	return ""
+}
+
+// Renders the template with the values of the token making the request. It
+// fails if any of the variables doesn't have a value for the request.
+func renderTokenTemplate(req *logical.Request, tmpl string) (string, error) {
+	var missing string
+	result := templateVarRegex.ReplaceAllStringFunc(tmpl, func(match string) string {
+		value := tokenTemplateValue(req, match[2:len(match)-2])
+		if value == "" && missing == "" {
+			missing = match
+		}
+		return value
+	})
+	if missing != "" {
+		return "", fmt.Errorf("no value for '%s'", missing)
+	}
+	return result, nil
+}
+
+// Checks that the templated entries of the comma separated allowed users
+// only refer to known variables and that the glob entries are well formed.
+// Variables are only accepted if the entries are templated.
+func validateAllowedUsers(allowedUsers string, template bool) error {
+	if !template && templateVarRegex.MatchString(allowedUsers) {
+		return fmt.Errorf("variables are only allowed if allowed_users_template is set")
+	}
+	if err := validateTokenTemplate(allowedUsers); err != nil {
+		return err
+	}
+	for _, entry := range strings.Split(allowedUsers, ",") {
+		if _, err := path.Match(entry, ""); err != nil {
+			return fmt.Errorf("invalid pattern '%s'", entry)
+		}
+	}
+	return nil
+}
+
+// Checks if the allowed users entry is a glob pattern, such as 'svc-*'.
+// Glob characters in the values of the variables of templated entries don't
+// count.
+func isAllowedUserGlob(entry string, template bool) bool {
+	if template {
+		entry = templateVarRegex.ReplaceAllString(entry, "")
+	}
+	return strings.ContainsAny(entry, `*?[\`)
+}
+
+// Resolves the variables of an allowed users entry from the token making
+// the request. Entries without variables are returned as is. If any of the
+// variables doesn't have a value for the request, false is returned and the
+// entry shouldn't match any username. If escape is set, the glob characters
+// in the values are escaped so that they only match themselves.
+func renderAllowedUser(req *logical.Request, entry string, escape bool) (string, bool) {
+	ok := true
+	result := templateVarRegex.ReplaceAllStringFunc(entry, func(match string) string {
+		value := tokenTemplateValue(req, match[2:len(match)-2])
+		if value == "" {
+			ok = false
+		}
+		if escape {
+			value = globEscaper.Replace(value)
+		}
+		return value
+	})
+	return result, ok
+}
+
+// Escapes the characters that have a special meaning in glob patterns.
+var globEscaper = strings.NewReplacer(`*`, `\*`, `?`, `\?`, `[`, `\[`, `\`, `\\`)
+
+// Bounds and defaults of the length of numeric and base62 OTPs. OTPs can
+// be checked on the unauthenticated 'verify' endpoint, so the minimum
+// length of numeric OTPs keeps them about as hard to guess as the
+// shortest base62 OTPs.
+const maxOTPLength = 64
+
+var minOTPLengths = map[string]int{
+	OTPFormatNumeric: 12,
+	OTPFormatBase62:  6,
+}
+
+var defaultOTPLengths = map[string]int{
+	OTPFormatNumeric: 12,
+	OTPFormatBase62:  20,
+}
+
+// Characters of the numeric and base62 OTPs.
+var otpCharsets = map[string]string{
+	OTPFormatNumeric: "0123456789",
+	OTPFormatBase62:  "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
+}
+
+// Generates a random OTP of the given length made of the characters of
+// the format.
+func generateOTP(format string, length int) (string, error) {
+	charset, ok := otpCharsets[format]
+	if !ok {
+		return "", fmt.Errorf("unsupported OTP format '%s'", format)
+	}
+
+	max := big.NewInt(int64(len(charset)))
+	otp := make([]byte, length)
+	for i := range otp {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("error generating OTP: %s", err)
+		}
+		otp[i] = charset[n.Int64()]
+	}
+	return string(otp), nil
+}
+
+// Returns the SHA256 fingerprint of the public key in the format used
+// by OpenSSH.
+func fingerprintSHA256(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "SHA256:" + strings.TrimRight(base64.StdEncoding.EncodeToString(sum[:]), "=")
+}
+
+// Returns a callback that verifies the host key of the remote host against
+// the given fingerprint. If the fingerprint is empty, any host key is
+// accepted.
+func hostKeyCallback(fingerprint string) func(string, net.Addr, ssh.PublicKey) error {
+	if fingerprint == "" {
+		return nil
+	}
+	if !strings.HasPrefix(fingerprint, "SHA256:") {
+		fingerprint = "SHA256:" + fingerprint
+	}
+	fingerprint = strings.TrimRight(fingerprint, "=")
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if actual := fingerprintSHA256(key); actual != fingerprint {
+			return fmt.Errorf("host key fingerprint mismatch for %s: got %s", hostname, actual)
+		}
+		return nil
+	}
+}
+
+// Checks if the fingerprint is a valid SHA256 fingerprint of a key.
+func validateFingerprint(fingerprint string) error {
+	encoded := strings.TrimRight(strings.TrimPrefix(fingerprint, "SHA256:"), "=")
+	decoded, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(decoded) != sha256.Size {
+		return fmt.Errorf("invalid SHA256 fingerprint '%s'", fingerprint)
+	}
+	return nil
+}
+
+// Opens a connection to the remote host. If a bastion host is given, the
+// connection is tunneled through it.
+func dialTarget(opts *installOptions) (net.Conn, error) {
+	timeout := dialTimeout(opts)
+
+	target := net.JoinHostPort(opts.IP, strconv.Itoa(opts.Port))
+	if opts.BastionHost == "" {
+		return dialTCP(target, timeout)
+	}
+
+	auth, err := authMethods(opts.BastionKey, opts.BastionKeyCertificate, opts.BastionPassword, opts.BastionKeyboardInteractive)
+	if err != nil {
+		return nil, fmt.Errorf("parsing bastion Private Key failed: %s", err)
+	}
+	bastionAddr := net.JoinHostPort(opts.BastionHost, strconv.Itoa(opts.BastionPort))
+	conn, err := dialTCP(bastionAddr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to bastion host: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, bastionAddr, &ssh.ClientConfig{
+		User: opts.BastionUser,
+		Auth: auth,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error connecting to bastion host: %s", err)
+	}
+	conn.SetDeadline(time.Time{})
+	bastion := ssh.NewClient(clientConn, chans, reqs)
+	c, err := bastion.Dial("tcp", target)
+	if err != nil {
+		bastion.Close()
+		return nil, fmt.Errorf("error connecting to target through bastion host: %s", err)
+	}
+	return &bastionConn{Conn: c, bastion: bastion}, nil
+}
+
+// Returns the timeout of the connections of the options, or the default
+// timeout if it is not set.
+func dialTimeout(opts *installOptions) time.Duration {
+	if opts.DialTimeout == 0 {
+		return defaultDialTimeout
+	}
+	return opts.DialTimeout
+}
+
+// Sets the private key used to login to the bastion host of the options, if
+// the options have a bastion host.
+func (b *backend) setBastionKey(s logical.Storage, namespace string, opts *installOptions, keyName string) error {
+	if opts.BastionHost == "" {
+		return nil
+	}
+	bastionKey, err := b.getKey(s, namespace, keyName)
+	if err != nil {
+		return err
+	}
+	if bastionKey == nil {
+		return fmt.Errorf("bastion key '%s' not found", keyName)
+	}
+	opts.BastionKey = bastionKey.Key
+	opts.BastionPassword = bastionKey.Password
+	opts.BastionKeyboardInteractive = bastionKey.KeyboardInteractive
+	opts.BastionKeyCertificate, err = b.keyCertificate(s, bastionKey, opts.BastionUser)
+	return err
+}
+
+// Returns the signer that logs in with the private key, presenting the SSH
+// certificate of the key if one is given.
+func keySigner(privateKey, certificate string) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey([]byte(privateKey))
+	if err != nil {
+		return nil, err
+	}
+	if certificate == "" {
+		return signer, nil
+	}
+	cert, err := parseKeyCertificate(certificate)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// Returns the methods that authenticate with the password if one is given,
+// or else with the private key and its certificate.
+func authMethods(privateKey, certificate, password string, keyboardInteractive bool) ([]ssh.AuthMethod, error) {
+	if password == "" {
+		signer, err := keySigner(privateKey, certificate)
+		if err != nil {
+			return nil, err
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, nil
+	}
+
+	methods := []ssh.AuthMethod{ssh.Password(password)}
+	if keyboardInteractive {
+		// Appliances that only accept keyboard-interactive logins ask for
+		// the password through prompts.
+		methods = append(methods, ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range answers {
+				answers[i] = password
+			}
+			return answers, nil
+		}))
+	}
+	return methods, nil
+}
+
+// Parses an SSH user certificate in OpenSSH format.
+func parseKeyCertificate(certificate string) (*ssh.Certificate, error) {
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(certificate))
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("not a user certificate")
+	}
+	return cert, nil
+}
+
+// Opens a TCP connection to the address with the given timeout.
+func dialTCP(address string, timeout time.Duration) (net.Conn, error) {
+	c, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if tcpConn, ok := c.(*net.TCPConn); ok {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(5 * time.Second)
+	}
+
+	return c, nil
+}
+
+// Connection to a remote host tunneled through a bastion host. Closing it
+// also closes the connection to the bastion host.
+type bastionConn struct {
+	net.Conn
+	bastion *ssh.Client
+}
+
+func (c *bastionConn) Close() error {
+	err := c.Conn.Close()
+	c.bastion.Close()
+	return err
+}
+
+// Connects to the target machine and logs in with the admin user and the
+// host key.
+func createSSHPublicKeysClient(opts *installOptions) (*ssh.Client, error) {
+	if opts.AdminUser == "" {
 		return nil, fmt.Errorf("missing username")
 	}
-	if ipAddr == "" {
+	if opts.IP == "" {
 		return nil, fmt.Errorf("missing ip address")
 	}
-	if hostKey == "" {
+	if opts.HostKey == "" && opts.HostPassword == "" {
 		return nil, fmt.Errorf("missing host key")
 	}
-	signer, err := ssh.ParsePrivateKey([]byte(hostKey))
+	auth, err := authMethods(opts.HostKey, opts.HostKeyCertificate, opts.HostPassword, opts.HostKeyboardInteractive)
 	if err != nil {
 		return nil, fmt.Errorf("parsing Private Key failed: %s", err)
 	}
 
 	config := &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
+		User:            opts.AdminUser,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback(opts.HostKeyFingerprint),
 	}
 
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", ipAddr, port), config)
+	conn, err := dialTarget(opts)
 	if err != nil {
 		return nil, err
 	}
-	if client == nil {
-		return nil, fmt.Errorf("invalid client object: %s", err)
+
+	// A host that accepts the connection but doesn't answer would otherwise
+	// block the login forever. Connections tunneled through a bastion host
+	// don't support deadlines, and rely on the one of the bastion host.
+	conn.SetDeadline(time.Now().Add(dialTimeout(opts)))
+	address := net.JoinHostPort(opts.IP, strconv.Itoa(opts.Port))
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(clientConn, chans, reqs), nil
+}
+
+// Connects to the target machine like createSSHPublicKeysClient, retrying
+// the connection as many times as the options allow.
+func dialSSHPublicKeysClient(opts *installOptions) (*ssh.Client, error) {
+	return retryDial(opts.DialRetries, opts.DialBackoff, func() (*ssh.Client, error) {
+		return createSSHPublicKeysClient(opts)
+	})
+}
+
+// Calls dial until it succeeds or it has been retried the given number of
+// times, and returns the error of the last attempt. The wait between the
+// attempts starts at the backoff and doubles after each retry.
+func retryDial(retries int, backoff time.Duration, dial func() (*ssh.Client, error)) (*ssh.Client, error) {
+	client, err := dial()
+	for i := 0; err != nil && i < retries; i++ {
+		time.Sleep(backoff)
+		backoff *= 2
+		client, err = dial()
+	}
+	return client, err
+}
+
+// Logs in to the target machine with the admin user and the host key and
+// opens a session, without running any command in it.
+func testSSHConnection(opts *installOptions) error {
+	client, err := createSSHPublicKeysClient(opts)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
 
 	session, err := client.NewSession()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	return session.Close()
+}
+
+// Creates a new key pair for a dynamic key with the given algorithm. The key
+// length only applies to RSA keys. The private key will be of pem format
+// and the public key will be of OpenSSH format.
+func generateDynamicKeys(algorithm string, keyBits int) (publicKey string, privateKey string, err error) {
+	switch algorithm {
+	case KeyAlgorithmRSA:
+		return generateRSAKeys(keyBits)
+	case KeyAlgorithmECDSAP256:
+		return generateECDSAKeys(elliptic.P256())
+	default:
+		return "", "", fmt.Errorf("unsupported key algorithm '%s'", algorithm)
+	}
+}
+
+// Creates a new ECDSA key pair on the given curve. The private key will be
+// of pem format and the public key will be of OpenSSH format.
+func generateECDSAKeys(curve elliptic.Curve) (publicKeyEcdsa string, privateKeyEcdsa string, err error) {
+	privateKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("error generating ECDSA key-pair: %s", err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return "", "", fmt.Errorf("error generating ECDSA key-pair: %s", err)
 	}
-	return session, nil
+	privateKeyEcdsa = string(pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: der,
+	}))
+
+	sshPublicKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return "", "", fmt.Errorf("error generating ECDSA key-pair: %s", err)
+	}
+	publicKeyEcdsa = sshPublicKey.Type() + " " + base64.StdEncoding.EncodeToString(sshPublicKey.Marshal())
+	return
 }
 
 // Creates a new RSA key pair with the given key length. The private key will be
@@ -83,84 +708,369 @@ func generateRSAKeys(keyBits int) (publicKeyRsa string, privateKeyRsa string, er
 // script. Default script is for a Linux machine and hence the path of the
 // authorized_keys file is hard coded to resemble Linux.
 //
-// The last param 'install' if false, uninstalls the key.
-func (b *backend) installPublicKeyInTarget(adminUser, username, ip string, port int, hostkey, dynamicPublicKey, installScript string, install bool) error {
+// If an interpreter is given, the script is run with it instead of being
+// executed directly.
+//
+// If a host key fingerprint is given, connections to a remote host whose
+// host key doesn't match it are refused.
+//
+// The connection to the remote host is taken from the pool of the backend and
+// used for all the steps, then handed back for the next request. The steps
+// fail if they don't finish within remoteCommandTimeout.
+func (b *backend) installPublicKeyInTarget(opts *installOptions) (err error) {
+	client, err := b.pool.get(opts)
+	if err != nil {
+		return fmt.Errorf("error connecting to target: %s", err)
+	}
+	healthy := false
+	timedOut := closeAfter(client, remoteCommandTimeout)
+	defer func() {
+		if timedOut() {
+			healthy = false
+			if err != nil {
+				err = fmt.Errorf("timed out after %s: %s", remoteCommandTimeout, err)
+			}
+		}
+		b.pool.put(opts, client, healthy)
+	}()
+
 	// Transfer the newly generated public key to remote host under a random
 	// file name. This is to avoid name collisions from other requests.
 	_, publicKeyFileName := b.GenerateSaltedOTP()
-	err := scpUpload(adminUser, ip, port, hostkey, publicKeyFileName, dynamicPublicKey)
+	err = scpUpload(client, publicKeyFileName, opts.DynamicPublicKey)
 	if err != nil {
 		return fmt.Errorf("error uploading public key: %s", err)
 	}
 
+	script, err := renderInstallScript(opts)
+	if err != nil {
+		return fmt.Errorf("error rendering install script: %s", err)
+	}
+
 	// Transfer the script required to install or uninstall the key to the remote
 	// host under a random file name as well. This is to avoid name collisions
 	// from other requests.
 	scriptFileName := fmt.Sprintf("%s.sh", publicKeyFileName)
-	err = scpUpload(adminUser, ip, port, hostkey, scriptFileName, installScript)
+	if opts.InstallScriptType == InstallScriptTypePowerShell {
+		scriptFileName = fmt.Sprintf("%s.ps1", publicKeyFileName)
+	}
+	err = scpUpload(client, scriptFileName, script)
 	if err != nil {
 		return fmt.Errorf("error uploading install script: %s", err)
 	}
 
 	// Create a session to run remote command that triggers the script to install
 	// or uninstall the key.
-	session, err := createSSHPublicKeysSession(adminUser, ip, port, hostkey)
+	session, err := client.NewSession()
 	if err != nil {
 		return fmt.Errorf("unable to create SSH Session using public keys: %s", err)
 	}
-	if session == nil {
-		return fmt.Errorf("invalid session object")
-	}
 	defer session.Close()
 
-	authKeysFileName := fmt.Sprintf("/home/%s/.ssh/authorized_keys", username)
+	authKeysFileName := authorizedKeysPath(opts.InstallScriptType, opts.Username)
 
-	var installOption string
-	if install {
-		installOption = "install"
-	} else {
-		installOption = "uninstall"
+	targetCmd := installCommand(opts, scriptFileName, publicKeyFileName, authKeysFileName)
+	err = session.Run(targetCmd)
+	healthy = sessionHealthy(err)
+	if err != nil {
+		return fmt.Errorf("error running install script: %s", err)
 	}
+	return nil
+}
 
-	// Give execute permissions to install script, run and delete it.
-	chmodCmd := fmt.Sprintf("chmod +x %s", scriptFileName)
-	scriptCmd := fmt.Sprintf("./%s %s %s %s", scriptFileName, installOption, publicKeyFileName, authKeysFileName)
-	rmCmd := fmt.Sprintf("rm -f %s", scriptFileName)
-	targetCmd := fmt.Sprintf("%s;%s;%s", chmodCmd, scriptCmd, rmCmd)
+// Returns the command that runs the install script uploaded to the remote
+// host, to install or uninstall the public key in the authorized_keys file.
+// The script is made executable, run and deleted. When an interpreter is
+// configured, the script is handed to it instead. PowerShell scripts are run
+// and deleted by a single PowerShell command, which works whether the login
+// shell of the host is cmd or PowerShell. The command exits with the status
+// of the script, not of its removal.
+func installCommand(opts *installOptions, scriptFileName, publicKeyFileName, authKeysFileName string) string {
+	installOption := "uninstall"
+	if opts.Install {
+		installOption = "install"
+	}
 
-	session.Run(targetCmd)
-	return nil
+	if opts.InstallScriptType == InstallScriptTypePowerShell {
+		return powerShellCommand(opts.InstallScriptInterpreter, fmt.Sprintf(
+			"try { & .\\%s %s %s %s; $status = $LASTEXITCODE } catch { $status = 1 }; Remove-Item -Force %s; exit $status",
+			scriptFileName, installOption, publicKeyFileName, powerShellQuote(authKeysFileName), scriptFileName))
+	}
+	scriptCmd := fmt.Sprintf("chmod +x %s && ./%s %s %s %s", scriptFileName, scriptFileName, installOption, publicKeyFileName, authKeysFileName)
+	if opts.InstallScriptInterpreter != "" {
+		scriptCmd = fmt.Sprintf("%s %s %s %s %s", opts.InstallScriptInterpreter, scriptFileName, installOption, publicKeyFileName, authKeysFileName)
+	}
+	return fmt.Sprintf("%s; status=$?; rm -f %s; exit $status", scriptCmd, scriptFileName)
 }
 
-// Takes an IP address and role name and checks if the IP is part
-// of CIDR blocks belonging to the role.
-func roleContainsIP(s logical.Storage, roleName string, ip string) (bool, error) {
-	if roleName == "" {
-		return false, fmt.Errorf("missing role name")
+// remoteCommandTimeout bounds how long the steps run on a remote host over
+// one connection can take, so that a host that hangs fails the request
+// instead of holding on to the connection.
+const remoteCommandTimeout = 5 * time.Minute
+
+// Closes the client if the calls made on it haven't returned once the
+// timeout passes, which makes them fail. The returned function stops the
+// timer and tells whether the client was closed.
+func closeAfter(client *ssh.Client, timeout time.Duration) func() bool {
+	timer := time.AfterFunc(timeout, func() {
+		client.Close()
+	})
+	return func() bool {
+		return !timer.Stop()
 	}
+}
 
-	if ip == "" {
-		return false, fmt.Errorf("missing ip")
+// Tells whether the connection a command was run on can still be used
+// after the command returned the error. A command that ran and exited with
+// a failure status leaves the connection as it was.
+func sessionHealthy(err error) bool {
+	if err == nil {
+		return true
 	}
+	_, ok := err.(*ssh.ExitError)
+	return ok
+}
 
-	roleEntry, err := s.Get(fmt.Sprintf("roles/%s", roleName))
+// Checks whether the dynamic public key is present in the authorized_keys
+// file of the user in the remote host. The check fails if it doesn't finish
+// within remoteCommandTimeout.
+func (b *backend) verifyPublicKeyInTarget(opts *installOptions) (installed bool, err error) {
+	client, err := b.pool.get(opts)
 	if err != nil {
-		return false, fmt.Errorf("error retrieving role '%s'", err)
+		return false, fmt.Errorf("error connecting to target: %s", err)
 	}
-	if roleEntry == nil {
-		return false, fmt.Errorf("role '%s' not found", roleName)
+	session, err := client.NewSession()
+	if err != nil {
+		b.pool.put(opts, client, false)
+		return false, fmt.Errorf("unable to create SSH Session using public keys: %s", err)
 	}
+	healthy := false
+	timedOut := closeAfter(client, remoteCommandTimeout)
+	defer func() {
+		if timedOut() {
+			healthy = false
+			if err != nil {
+				err = fmt.Errorf("timed out after %s: %s", remoteCommandTimeout, err)
+			}
+		}
+		b.pool.put(opts, client, healthy)
+	}()
+	defer session.Close()
 
-	var role sshRole
-	if err := roleEntry.DecodeJSON(&role); err != nil {
-		return false, fmt.Errorf("error decoding role '%s'", roleName)
+	authKeysFileName := authorizedKeysPath(opts.InstallScriptType, opts.Username)
+
+	// grep exits with status 1 when no line matches and with a higher
+	// status when the file can't be read. The PowerShell command mimics it.
+	verifyCmd := fmt.Sprintf("sudo grep -qxF %s %s", shellQuote(opts.DynamicPublicKey), shellQuote(authKeysFileName))
+	if opts.InstallScriptType == InstallScriptTypePowerShell {
+		verifyCmd = powerShellCommand(opts.InstallScriptInterpreter, fmt.Sprintf(
+			"$ErrorActionPreference = 'Stop'; try { $lines = Get-Content -Path %s } catch { exit 2 }; if ($lines | Where-Object { $_.Trim() -eq %s }) { exit 0 }; exit 1",
+			powerShellQuote(authKeysFileName), powerShellQuote(opts.DynamicPublicKey)))
+	}
+	err = session.Run(verifyCmd)
+	healthy = sessionHealthy(err)
+	if err == nil {
+		return true, nil
 	}
+	if exitErr, ok := err.(*ssh.ExitError); ok && exitErr.ExitStatus() == 1 {
+		return false, nil
+	}
+	return false, err
+}
+
+// Returns the path of the authorized_keys file of the user in the remote host.
+// Hosts with PowerShell install scripts are expected to run Windows.
+func authorizedKeysPath(scriptType, username string) string {
+	if scriptType == InstallScriptTypePowerShell {
+		return fmt.Sprintf("C:\\Users\\%s\\.ssh\\authorized_keys", username)
+	}
+	return fmt.Sprintf("/home/%s/.ssh/authorized_keys", username)
+}
 
-	if matched, err := cidrContainsIP(ip, role.CIDRList); err != nil {
-		return false, err
+// Returns a command running the PowerShell script given to it. The script is
+// passed encoded, so that it is not interpreted by the login shell of the
+// host. The executable defaults to 'powershell'.
+func powerShellCommand(executable, script string) string {
+	if executable == "" {
+		executable = "powershell"
+	}
+	encoded := utf16.Encode([]rune(script))
+	buf := make([]byte, 2*len(encoded))
+	for i, c := range encoded {
+		buf[2*i] = byte(c)
+		buf[2*i+1] = byte(c >> 8)
+	}
+	return fmt.Sprintf("%s -NoProfile -NonInteractive -ExecutionPolicy Bypass -EncodedCommand %s",
+		executable, base64.StdEncoding.EncodeToString(buf))
+}
+
+// Quotes the string for use as a single argument in a PowerShell command.
+func powerShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// Variables which can be used in install scripts.
+var installScriptVars = map[string]bool{
+	"username":       true,
+	"auth_keys_file": true,
+	"key_marker":     true,
+	"port":           true,
+}
+
+// Matches the values which can be substituted in install scripts without
+// quoting.
+var installScriptValueRegex = regexp.MustCompile(`^[a-zA-Z0-9_.@:+/=-]*$`)
+
+// Same as installScriptValueRegex, for PowerShell scripts whose paths
+// contain backslashes.
+var installScriptPowerShellValueRegex = regexp.MustCompile(`^[a-zA-Z0-9_.@:+/=\\-]*$`)
+
+// Checks that the install script only refers to known variables.
+func validateInstallScriptVars(script string) error {
+	for _, match := range templateVarRegex.FindAllStringSubmatch(script, -1) {
+		if !installScriptVars[match[1]] {
+			return fmt.Errorf("unknown variable '%s'", match[0])
+		}
+	}
+	return nil
+}
+
+// Renders the variables of the install script. The key marker is the SHA256
+// fingerprint of the dynamic public key, which stays the same when the key is
+// installed and uninstalled. Values are substituted as is, so values that
+// could be interpreted by the shell are refused.
+func renderInstallScript(opts *installOptions) (string, error) {
+	if !templateVarRegex.MatchString(opts.InstallScript) {
+		return opts.InstallScript, nil
+	}
+
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(opts.DynamicPublicKey))
+	if err != nil {
+		return "", fmt.Errorf("error parsing dynamic public key: %s", err)
+	}
+	values := map[string]string{
+		"username":       opts.Username,
+		"auth_keys_file": authorizedKeysPath(opts.InstallScriptType, opts.Username),
+		"key_marker":     fingerprintSHA256(publicKey),
+		"port":           strconv.Itoa(opts.Port),
+	}
+	valueRegex := installScriptValueRegex
+	if opts.InstallScriptType == InstallScriptTypePowerShell {
+		valueRegex = installScriptPowerShellValueRegex
+	}
+	for name, value := range values {
+		if !valueRegex.MatchString(value) {
+			return "", fmt.Errorf("value of variable '%s' contains unsafe characters", name)
+		}
+	}
+
+	return templateVarRegex.ReplaceAllStringFunc(opts.InstallScript, func(match string) string {
+		if value, ok := values[match[2:len(match)-2]]; ok {
+			return value
+		}
+		return match
+	}), nil
+}
+
+// Renders an ssh_config Host block to connect to the remote host with a
+// credential of the key type. The block is named after the hostname if the
+// credential was requested for one, or after the IP otherwise.
+func sshConfigSnippet(keyType, hostname, ip string, port int, username string) string {
+	host := hostname
+	if host == "" {
+		host = ip
+	}
+	lines := []string{
+		"Host " + host,
+		"  HostName " + ip,
+		"  Port " + strconv.Itoa(port),
+		"  User " + username,
+	}
+	if keyType == KeyTypeOTP {
+		lines = append(lines, "  PreferredAuthentications keyboard-interactive,password")
 	} else {
-		return matched, nil
+		lines = append(lines, "  PreferredAuthentications publickey", "  IdentitiesOnly yes")
 	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Returns the known_hosts patterns of the hosts of the comma separated
+// domains and their subdomains, or a pattern of all hosts if there are no
+// domains.
+func knownHostsPatterns(allowedDomains string) string {
+	if allowedDomains == "" {
+		return "*"
+	}
+	var patterns []string
+	for _, domain := range strings.Split(allowedDomains, ",") {
+		patterns = append(patterns, domain, "*."+domain)
+	}
+	return strings.Join(patterns, ",")
+}
+
+// Renders a known_hosts line that trusts the host certificates signed by the
+// CA key for the hosts of the domains.
+func knownHostsCertAuthority(allowedDomains string, caKey ssh.PublicKey) string {
+	return "@cert-authority " + knownHostsPatterns(allowedDomains) + " " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(caKey)))
+}
+
+// Quotes the string for use as a single argument in a shell command.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Normalizes a comma separated list. The entries are trimmed, empty and
+// duplicate entries are dropped and the rest are sorted, so that equivalent
+// lists have the same representation.
+func normalizeList(list string) string {
+	seen := make(map[string]bool)
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || seen[entry] {
+			continue
+		}
+		seen[entry] = true
+		entries = append(entries, entry)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+// Parses a comma separated list of ports and port ranges, such as
+// '22,2200-2299', into the bounds of each range.
+func parsePortRanges(portRanges string) ([][2]int, error) {
+	var ranges [][2]int
+	for _, entry := range strings.Split(portRanges, ",") {
+		bounds := strings.SplitN(entry, "-", 2)
+		if len(bounds) == 1 {
+			bounds = append(bounds, bounds[0])
+		}
+		low, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port range '%s'", entry)
+		}
+		high, err := strconv.Atoi(strings.TrimSpace(bounds[1]))
+		if err != nil || low < 1 || high > 65535 || low > high {
+			return nil, fmt.Errorf("invalid port range '%s'", entry)
+		}
+		ranges = append(ranges, [2]int{low, high})
+	}
+	return ranges, nil
+}
+
+// Checks if the port is in one of the comma separated ports and port ranges.
+func portAllowed(port int, portRanges string) bool {
+	ranges, err := parsePortRanges(portRanges)
+	if err != nil {
+		return false
+	}
+	for _, r := range ranges {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
 }
 
 // Checks if the comma separated list of CIDR blocks are all valid.
@@ -189,39 +1099,9 @@ func cidrContainsIP(ip, cidrList string) (bool, error) {
 	return false, nil
 }
 
-// Uploads the file to the remote machine
-func scpUpload(username, ip string, port int, hostkey, fileName, fileContent string) error {
-	signer, err := ssh.ParsePrivateKey([]byte(hostkey))
-	clientConfig := &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-	}
-
-	connfunc := func() (net.Conn, error) {
-		c, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", ip, port), 15*time.Second)
-		if err != nil {
-			return nil, err
-		}
-
-		if tcpConn, ok := c.(*net.TCPConn); ok {
-			tcpConn.SetKeepAlive(true)
-			tcpConn.SetKeepAlivePeriod(5 * time.Second)
-		}
-
-		return c, nil
-	}
-	config := &SSHCommConfig{
-		SSHConfig:    clientConfig,
-		Connection:   connfunc,
-		Pty:          false,
-		DisableAgent: true,
-	}
-	comm, err := SSHCommNew(fmt.Sprintf("%s:%d", ip, port), config)
-	if err != nil {
-		return fmt.Errorf("error connecting to target: %s", err)
-	}
-	comm.Upload(fileName, bytes.NewBufferString(fileContent), nil)
-	return nil
+// Uploads the file to the remote machine over a client that is logged in
+// to it.
+func scpUpload(client *ssh.Client, fileName, fileContent string) error {
+	comm := sshCommFromClient(client)
+	return comm.Upload(fileName, bytes.NewBufferString(fileContent), nil)
 }
@@ -0,0 +1,63 @@
+package ssh
+
+const (
+	// This is a constant representing a PowerShell script to install and
+	// uninstall public key in remote Windows hosts running OpenSSH.
+	DefaultPublicKeyInstallScriptPowerShell = `
+#
+# This is a default script which installs or uninstalls a public key to/from
+# authorized_keys file in a typical Windows machine running OpenSSH.
+#
+# If the platform differs, use the 'install_script' parameter with 'roles/'
+# endpoint to register a custom script (applicable for Dynamic type only).
+#
+# Vault server runs this script on the target machine with PowerShell, with the
+# following params:
+#
+# InstallOption: "install" or "uninstall"
+#
+# PublicKeyFile: File name containing public key to be installed. Vault server
+# uses UUID as name to avoid collisions with public keys generated for other requests.
+#
+# AuthKeysFile: Absolute path of the authorized_keys file.
+# Currently, vault uses C:\Users\<username>\.ssh\authorized_keys as the path.
+#
+# [Note: This script will be run by Vault using the registered admin username,
+# which must be allowed to modify the authorized_keys file of the users.]
+
+param(
+	[string]$InstallOption,
+	[string]$PublicKeyFile,
+	[string]$AuthKeysFile
+)
+
+$ErrorActionPreference = "Stop"
+
+try {
+	# Return if the option is anything other than 'install' or 'uninstall'.
+	if ($InstallOption -ne "install" -and $InstallOption -ne "uninstall") {
+		exit 1
+	}
+
+	$publicKey = (Get-Content -Path $PublicKeyFile -Raw).Trim()
+
+	# Remove the key from authorized_keys file if it is already present.
+	# This step is common for both install and uninstall.
+	$lines = @()
+	if (Test-Path -Path $AuthKeysFile) {
+		$lines = @(Get-Content -Path $AuthKeysFile | Where-Object { $_.Trim() -ne $publicKey })
+	}
+
+	# Append the new public key to authorized_keys file
+	if ($InstallOption -eq "install") {
+		$lines += $publicKey
+	}
+
+	New-Item -ItemType Directory -Force -Path (Split-Path -Parent $AuthKeysFile) | Out-Null
+	Set-Content -Path $AuthKeysFile -Value $lines -Encoding ASCII
+} finally {
+	# Delete the public key file whether the script succeeds or not.
+	Remove-Item -Force -ErrorAction SilentlyContinue -Path $PublicKeyFile
+}
+`
+)
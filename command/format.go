@@ -68,5 +68,12 @@ func outputFormatTable(ui cli.Ui, s *api.Secret, whitespace bool) int {
 	}
 
 	ui.Output(columnize.Format(input, config))
+	outputWarnings(ui, s)
 	return 0
 }
+
+func outputWarnings(ui cli.Ui, s *api.Secret) {
+	for _, w := range s.Warnings {
+		ui.Warn(fmt.Sprintf("WARNING: %s", w))
+	}
+}
@@ -67,6 +67,13 @@ func (c *WriteCommand) Run(args []string) int {
 		return 0
 	}
 
+	// A response carrying nothing but warnings is still a plain success
+	if len(secret.Data) == 0 && secret.Auth == nil && secret.LeaseID == "" {
+		c.Ui.Output(fmt.Sprintf("Success! Data written to: %s", path))
+		outputWarnings(c.Ui, secret)
+		return 0
+	}
+
 	return OutputSecret(c.Ui, format, secret)
 }
 
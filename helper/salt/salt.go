@@ -1,6 +1,7 @@
 package salt
 
 import (
+	"crypto/hmac"
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/hex"
@@ -89,6 +90,13 @@ func (s *Salt) SaltID(id string) string {
 	return SaltID(s.salt, id, s.config.HashFunc)
 }
 
+// GetHMAC is used to apply the salt as the key of a HMAC-SHA256 of the
+// data. Unlike SaltID, the result can't be computed by extending a known
+// hash of the salt.
+func (s *Salt) GetHMAC(data string) string {
+	return GetHMAC(s.salt, data)
+}
+
 // DidGenerate returns if the underlying salt value was generated
 // on initialization or if an existing salt value was loaded
 func (s *Salt) DidGenerate() bool {
@@ -103,6 +111,13 @@ func SaltID(salt, id string, hash HashFunc) string {
 	return hex.EncodeToString(hashVal)
 }
 
+// GetHMAC returns the hex encoded HMAC-SHA256 of the data keyed by the salt
+func GetHMAC(salt, data string) string {
+	hm := hmac.New(sha256.New, []byte(salt))
+	hm.Write([]byte(data))
+	return hex.EncodeToString(hm.Sum(nil))
+}
+
 // SHA1Hash returns the SHA1 of the input
 func SHA1Hash(inp []byte) []byte {
 	hashed := sha1.Sum(inp)
@@ -82,3 +82,27 @@ func TestSaltID(t *testing.T) {
 		t.Fatalf("mismatch")
 	}
 }
+
+func TestGetHMAC(t *testing.T) {
+	salt := uuid.GenerateUUID()
+	data := "foobarbaz"
+
+	hm1 := GetHMAC(salt, data)
+	hm2 := GetHMAC(salt, data)
+
+	if len(hm1) != sha256.Size*2 {
+		t.Fatalf("Bad len: %d %s", len(hm1), hm1)
+	}
+
+	if hm1 != hm2 {
+		t.Fatalf("mismatch")
+	}
+
+	if hm1 == SaltID(salt, data, SHA256Hash) {
+		t.Fatalf("HMAC matches salted ID")
+	}
+
+	if hm1 == GetHMAC(uuid.GenerateUUID(), data) {
+		t.Fatalf("HMAC doesn't depend on the salt")
+	}
+}
@@ -146,6 +146,12 @@ func requestAuth(r *http.Request, req *logical.Request) *logical.Request {
 }
 
 func respondError(w http.ResponseWriter, status int, err error) {
+	respondErrorCode(w, status, err, "")
+}
+
+// respondErrorCode is like respondError but also includes the
+// machine-readable error code in the response, if one is given.
+func respondErrorCode(w http.ResponseWriter, status int, err error, code string) {
 	// Adjust status code when sealed
 	if err == vault.ErrSealed {
 		status = http.StatusServiceUnavailable
@@ -159,7 +165,7 @@ func respondError(w http.ResponseWriter, status int, err error) {
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(status)
 
-	resp := &ErrorResponse{Errors: make([]string, 0, 1)}
+	resp := &ErrorResponse{Errors: make([]string, 0, 1), ErrorCode: code}
 	if err != nil {
 		resp.Errors = append(resp.Errors, err.Error())
 	}
@@ -168,6 +174,16 @@ func respondError(w http.ResponseWriter, status int, err error) {
 	enc.Encode(resp)
 }
 
+// respondErrors is like respondError but reports several errors, one
+// per entry of the errors list of the response.
+func respondErrors(w http.ResponseWriter, status int, errs []string) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.Encode(&ErrorResponse{Errors: errs})
+}
+
 func respondCommon(w http.ResponseWriter, resp *logical.Response, err error) bool {
 	if resp == nil {
 		return false
@@ -183,14 +199,22 @@ func respondCommon(w http.ResponseWriter, resp *logical.Response, err error) boo
 			statusCode = http.StatusMethodNotAllowed
 		case logical.ErrUnsupportedPath:
 			statusCode = http.StatusNotFound
+		case logical.ErrNotFound:
+			statusCode = http.StatusNotFound
 		case logical.ErrInvalidRequest:
 			statusCode = http.StatusBadRequest
 		default:
 			statusCode = http.StatusBadRequest
 		}
 
+		if errs, ok := resp.Data["errors"].([]string); ok {
+			respondErrors(w, statusCode, errs)
+			return true
+		}
+
 		err := fmt.Errorf("%s", resp.Data["error"].(string))
-		respondError(w, statusCode, err)
+		code, _ := resp.Data["error_code"].(string)
+		respondErrorCode(w, statusCode, err, code)
 		return true
 	}
 
@@ -214,5 +238,6 @@ func proxySysRequest(core *vault.Core) http.Handler {
 }
 
 type ErrorResponse struct {
-	Errors []string `json:"errors"`
+	Errors    []string `json:"errors"`
+	ErrorCode string   `json:"error_code,omitempty"`
 }
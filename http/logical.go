@@ -30,6 +30,9 @@ func handleLogical(core *vault.Core, dataOnly bool) http.Handler {
 			op = logical.DeleteOperation
 		case "GET":
 			op = logical.ReadOperation
+			if r.URL.Query().Get("list") == "true" {
+				op = logical.ListOperation
+			}
 		case "POST":
 			fallthrough
 		case "PUT":
@@ -96,7 +99,10 @@ func respondLogical(w http.ResponseWriter, r *http.Request, path string, dataOnl
 			return
 		}
 
-		logicalResp := &LogicalResponse{Data: resp.Data}
+		logicalResp := &LogicalResponse{
+			Data:     resp.Data,
+			Warnings: resp.Warnings,
+		}
 		if resp.Secret != nil {
 			logicalResp.LeaseID = resp.Secret.LeaseID
 			logicalResp.Renewable = resp.Secret.Renewable
@@ -197,6 +203,7 @@ type LogicalResponse struct {
 	LeaseDuration int                    `json:"lease_duration"`
 	Data          map[string]interface{} `json:"data"`
 	Auth          *Auth                  `json:"auth"`
+	Warnings      []string               `json:"warnings,omitempty"`
 }
 
 type Auth struct {
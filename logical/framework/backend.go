@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"reflect"
 	"regexp"
 	"sort"
 	"strings"
@@ -26,9 +27,8 @@ type Backend struct {
 	Help string
 
 	// Paths are the various routes that the backend responds to.
-	// This cannot be modified after construction (i.e. dynamically changing
-	// paths, including adding or removing, is not allowed once the
-	// backend is in use).
+	// This cannot be modified directly after construction. Use ReloadPaths
+	// to change the paths once the backend is in use.
 	//
 	// PathsSpecial is the list of path patterns that denote the
 	// paths above that require special privileges. These can't be
@@ -51,23 +51,53 @@ type Backend struct {
 	Rollback       RollbackFunc
 	RollbackMinAge time.Duration
 
+	// RollbackHandlers maps a WAL entry kind to the callback that rolls
+	// back entries of that kind. Entries whose kind isn't in this map are
+	// given to Rollback, if it is set.
+	RollbackHandlers map[string]RollbackFunc
+
 	// AuthRenew is the callback to call when a RenewRequest for an
 	// authentication comes in. By default, renewal won't be allowed.
 	// See the built-in AuthRenew helpers in lease.go for common callbacks.
 	AuthRenew OperationFunc
 
-	logger  *log.Logger
-	once    sync.Once
-	pathsRe []*regexp.Regexp
+	// Instrument, if set, is called after every request that is dispatched
+	// to a path callback, with the pattern of the path, the operation, the
+	// time the callback took and the error it returned. This can be used
+	// to collect metrics about the backend.
+	Instrument InstrumentFunc
+
+	logger *log.Logger
+	once   sync.Once
+
+	// pathsLock protects Paths and pathsRe, which are swapped together
+	// when the paths are reloaded.
+	pathsLock sync.RWMutex
+	pathsRe   []*regexp.Regexp
 }
 
 // OperationFunc is the callback called for an operation on a path.
 type OperationFunc func(*logical.Request, *FieldData) (*logical.Response, error)
 
+// InstrumentFunc is the callback for instrumenting requests.
+type InstrumentFunc func(pattern string, op logical.Operation, d time.Duration, err error)
+
 // RollbackFunc is the callback for rollbacks.
 type RollbackFunc func(*logical.Request, string, interface{}) error
 
 // logical.Backend impl.
+//
+// There are three distinct "missing" cases that a request can result in:
+//
+//   - No path matches the request path. ErrUnsupportedPath is returned.
+//   - A path matches but has no callback for the operation.
+//     ErrUnsupportedOperation is returned.
+//   - The path and operation are supported but the item being referred
+//     to doesn't exist. Read callbacks signal this by returning a nil
+//     response and nil error; other callbacks return ErrNotFound.
+//
+// The first two cases are accompanied by an error response describing
+// the problem so that it can be reported to the client.
 func (b *Backend) HandleRequest(req *logical.Request) (*logical.Response, error) {
 	b.once.Do(b.init)
 
@@ -90,7 +120,15 @@ func (b *Backend) HandleRequest(req *logical.Request) (*logical.Response, error)
 	// Find the matching route
 	path, captures := b.route(req.Path)
 	if path == nil {
-		return nil, logical.ErrUnsupportedPath
+		return logical.ErrorResponse(fmt.Sprintf(
+			"no handler for route '%s'", req.Path)), logical.ErrUnsupportedPath
+	}
+
+	// Reject operations the path doesn't allow before anything else
+	if !path.operationAllowed(req.Operation) {
+		return logical.ErrorResponse(fmt.Sprintf(
+				"operation '%s' is not allowed on '%s'", req.Operation, req.Path)),
+			logical.ErrUnsupportedOperation
 	}
 
 	// Build up the data for the route, with the URL taking priority
@@ -115,23 +153,73 @@ func (b *Backend) HandleRequest(req *logical.Request) (*logical.Response, error)
 			ok = true
 		}
 	}
+	if !ok && req.Operation == logical.WriteOperation && path.ExistenceCheck != nil {
+		_, create := path.Callbacks[logical.CreateOperation]
+		_, update := path.Callbacks[logical.UpdateOperation]
+		ok = create || update
+	}
 	if !ok {
-		return nil, logical.ErrUnsupportedOperation
+		return logical.ErrorResponse(fmt.Sprintf(
+				"unsupported operation '%s' on '%s'", req.Operation, req.Path)),
+			logical.ErrUnsupportedOperation
 	}
-	
+
 	fd := FieldData{
 		Raw:    raw,
 		Schema: path.Fields}
-	
+
+	op := req.Operation
+
 	if req.Operation != logical.HelpOperation {
-	    err := fd.Validate()
-	    if err != nil {
-	        return nil, err
-	    }
+		err := fd.Validate()
+		if err != nil {
+			return logical.ErrorListResponse(validationErrors(err)), logical.ErrInvalidRequest
+		}
+
+		// Let the path normalize the data or reject the request before
+		// the required fields are checked.
+		if path.PreRequest != nil {
+			if err := path.PreRequest(req, &fd); err != nil {
+				return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+			}
+		}
+
+		// Route writes to the create or update callback depending on
+		// whether the item exists.
+		if op == logical.WriteOperation && path.ExistenceCheck != nil {
+			exists, err := path.ExistenceCheck(req, &fd)
+			if err != nil {
+				return nil, err
+			}
+			op = logical.CreateOperation
+			if exists {
+				op = logical.UpdateOperation
+			}
+			if cb, ok := path.Callbacks[op]; ok {
+				callback = cb
+			} else if callback == nil {
+				return logical.ErrorResponse(fmt.Sprintf(
+						"unsupported operation '%s' on '%s'", op, req.Path)),
+					logical.ErrUnsupportedOperation
+			}
+		}
+
+		if missing := path.missingFields(op, &fd); len(missing) > 0 {
+			return logical.ErrorResponse(fmt.Sprintf(
+					"missing required fields: %s", strings.Join(missing, ", "))),
+				logical.ErrInvalidRequest
+		}
 	}
 
 	// Call the callback with the request and the data
-	return callback(req, &fd)
+	if b.Instrument == nil {
+		return callback(req, &fd)
+	}
+
+	start := time.Now()
+	resp, err := callback(req, &fd)
+	b.Instrument(path.Pattern, op, time.Since(start), err)
+	return resp, err
 }
 
 // logical.Backend impl.
@@ -172,11 +260,42 @@ func (b *Backend) Secret(k string) *Secret {
 	return nil
 }
 
+// ReloadPaths replaces the paths of the backend with the given paths.
+// The patterns of the new paths are compiled before any of them are
+// used, so requests that are handled concurrently are routed either
+// entirely with the old paths or entirely with the new ones.
+func (b *Backend) ReloadPaths(paths []*Path) error {
+	b.once.Do(b.init)
+
+	pathsRe, err := compilePaths(paths)
+	if err != nil {
+		return err
+	}
+
+	b.pathsLock.Lock()
+	defer b.pathsLock.Unlock()
+	b.Paths = paths
+	b.pathsRe = pathsRe
+	return nil
+}
+
 func (b *Backend) init() {
-	b.pathsRe = make([]*regexp.Regexp, len(b.Paths))
-	for i, p := range b.Paths {
+	pathsRe, err := compilePaths(b.Paths)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	b.pathsLock.Lock()
+	defer b.pathsLock.Unlock()
+	b.pathsRe = pathsRe
+}
+
+// compilePaths anchors the patterns of the paths and compiles them.
+func compilePaths(paths []*Path) ([]*regexp.Regexp, error) {
+	pathsRe := make([]*regexp.Regexp, len(paths))
+	for i, p := range paths {
 		if len(p.Pattern) == 0 {
-			panic(fmt.Sprintf("Routing pattern cannot be blank"))
+			return nil, fmt.Errorf("Routing pattern cannot be blank")
 		}
 		// Automatically anchor the pattern
 		if p.Pattern[0] != '^' {
@@ -185,14 +304,29 @@ func (b *Backend) init() {
 		if p.Pattern[len(p.Pattern)-1] != '$' {
 			p.Pattern = p.Pattern + "$"
 		}
-		b.pathsRe[i] = regexp.MustCompile(p.Pattern)
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid routing pattern '%s': %s", p.Pattern, err)
+		}
+		pathsRe[i] = re
 	}
+	return pathsRe, nil
 }
 
-func (b *Backend) route(path string) (*Path, map[string]string) {
+// routes returns the paths and their compiled patterns. The slices must
+// not be modified.
+func (b *Backend) routes() ([]*Path, []*regexp.Regexp) {
 	b.once.Do(b.init)
 
-	for i, re := range b.pathsRe {
+	b.pathsLock.RLock()
+	defer b.pathsLock.RUnlock()
+	return b.Paths, b.pathsRe
+}
+
+func (b *Backend) route(path string) (*Path, map[string]string) {
+	paths, pathsRe := b.routes()
+
+	for i, re := range pathsRe {
 		matches := re.FindStringSubmatch(path)
 		if matches == nil {
 			continue
@@ -201,7 +335,7 @@ func (b *Backend) route(path string) (*Path, map[string]string) {
 		// We have a match, determine the mapping of the captures and
 		// store that for returning.
 		var captures map[string]string
-		path := b.Paths[i]
+		path := paths[i]
 		if captureNames := re.SubexpNames(); len(captureNames) > 1 {
 			captures = make(map[string]string, len(captureNames))
 			for i, name := range captureNames {
@@ -220,11 +354,12 @@ func (b *Backend) route(path string) (*Path, map[string]string) {
 func (b *Backend) handleRootHelp() (*logical.Response, error) {
 	// Build a mapping of the paths and get the paths alphabetized to
 	// make the output prettier.
+	routePaths, pathsRe := b.routes()
 	pathsMap := make(map[string]*Path)
-	paths := make([]string, 0, len(b.Paths))
-	for i, p := range b.pathsRe {
+	paths := make([]string, 0, len(routePaths))
+	for i, p := range pathsRe {
 		paths = append(paths, p.String())
-		pathsMap[p.String()] = b.Paths[i]
+		pathsMap[p.String()] = routePaths[i]
 	}
 	sort.Strings(paths)
 
@@ -295,10 +430,12 @@ func (b *Backend) handleAuthRenew(req *logical.Request) (*logical.Response, erro
 
 func (b *Backend) handleRollback(
 	req *logical.Request) (*logical.Response, error) {
-	if b.Rollback == nil {
+	if b.Rollback == nil && len(b.RollbackHandlers) == 0 {
 		return nil, logical.ErrUnsupportedOperation
 	}
 
+	// The whole WAL is listed at once, since storage can only list all
+	// the keys under a prefix.
 	var merr error
 	keys, err := ListWAL(req.Storage)
 	if err != nil {
@@ -319,6 +456,7 @@ func (b *Backend) handleRollback(
 		minAge = time.Now().UTC().Add(1000 * time.Hour)
 	}
 
+	now := time.Now().UTC()
 	for _, k := range keys {
 		entry, err := GetWAL(req.Storage, k)
 		if err != nil {
@@ -334,11 +472,27 @@ func (b *Backend) handleRollback(
 			continue
 		}
 
+		// If a previous attempt failed, back off until the next retry
+		if now.Before(entry.NextAttemptAt()) {
+			continue
+		}
+
 		// Attempt a rollback
-		err = b.Rollback(req, entry.Kind, entry.Data)
+		if f := b.rollbackFunc(entry.Kind); f != nil {
+			err = f(req, entry.Kind, entry.Data)
+		} else {
+			err = fmt.Errorf("unknown WAL entry kind")
+		}
 		if err != nil {
 			err = fmt.Errorf(
 				"Error rolling back '%s' entry: %s", entry.Kind, err)
+
+			// Record the failed attempt so the next retry backs off
+			entry.Attempts++
+			entry.LastAttemptAt = now.Unix()
+			if perr := putWALEntry(req.Storage, entry); perr != nil {
+				merr = multierror.Append(merr, perr)
+			}
 		}
 		if err == nil {
 			err = DeleteWAL(req.Storage, k)
@@ -355,11 +509,104 @@ func (b *Backend) handleRollback(
 	return logical.ErrorResponse(merr.Error()), nil
 }
 
+// rollbackFunc returns the callback used to roll back WAL entries of
+// the given kind, or nil if there is none.
+func (b *Backend) rollbackFunc(kind string) RollbackFunc {
+	if f, ok := b.RollbackHandlers[kind]; ok {
+		return f
+	}
+
+	return b.Rollback
+}
+
 // FieldSchema is a basic schema to describe the format of a path field.
 type FieldSchema struct {
 	Type        FieldType
 	Default     interface{}
 	Description string
+
+	// Pattern is an optional regular expression that string values of
+	// this field must match. It is automatically anchored and compiled
+	// the first time it is needed. Empty values are not checked so that
+	// optional fields can still be left blank.
+	Pattern string
+
+	// Schema optionally describes the contents of a TypeMap field. Values
+	// of the map for keys in this schema are validated and converted to
+	// their types recursively. Keys not in this schema are left as is.
+	Schema map[string]*FieldSchema
+
+	// Validator is an optional callback that checks the value of this
+	// field, after it is converted to the type of the field and checked
+	// against the AllowedValues. It is called for every value that is
+	// set, including empty strings.
+	Validator func(interface{}) error
+
+	// AllowedValues optionally restricts the values of this field to the
+	// given ones, compared after the value is converted to the type of
+	// the field. Empty strings are not checked so that optional fields
+	// can still be left blank.
+	AllowedValues []interface{}
+
+	// Required marks a field that must be set in write requests. Requests
+	// without it are rejected before the callback is called, like the
+	// fields listed in the RequiredFields of the path.
+	Required bool
+
+	patternOnce sync.Once
+	patternRe   *regexp.Regexp
+}
+
+// checkPattern verifies the given string value against the Pattern
+// of the schema, if one is set.
+func (s *FieldSchema) checkPattern(v string) error {
+	if s.Pattern == "" || v == "" {
+		return nil
+	}
+
+	s.patternOnce.Do(func() {
+		pattern := s.Pattern
+		if pattern[0] != '^' {
+			pattern = "^" + pattern
+		}
+		if pattern[len(pattern)-1] != '$' {
+			pattern = pattern + "$"
+		}
+		s.patternRe = regexp.MustCompile(pattern)
+	})
+
+	if !s.patternRe.MatchString(v) {
+		return fmt.Errorf("value '%s' does not match pattern '%s'", v, s.Pattern)
+	}
+
+	return nil
+}
+
+// checkAllowedValues verifies the given converted value against the
+// AllowedValues of the schema, if any are set.
+func (s *FieldSchema) checkAllowedValues(v interface{}) error {
+	if len(s.AllowedValues) == 0 || v == "" {
+		return nil
+	}
+
+	for _, allowed := range s.AllowedValues {
+		if reflect.DeepEqual(v, allowed) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("value '%v' is not one of the allowed values %s", v, s.allowedValuesString())
+}
+
+// allowedValuesString formats the AllowedValues of the schema for
+// error messages and help.
+func (s *FieldSchema) allowedValuesString() string {
+	values := make([]string, len(s.AllowedValues))
+	for i, v := range s.AllowedValues {
+		values[i] = fmt.Sprintf("'%v'", v)
+	}
+
+	return strings.Join(values, ", ")
 }
 
 // DefaultOrZero returns the default value if it is set, or otherwise
@@ -374,7 +621,7 @@ func (s *FieldSchema) DefaultOrZero() interface{} {
 
 func (t FieldType) Zero() interface{} {
 	switch t {
-	case TypeString:
+	case TypeString, TypeNameString, TypeLowerCaseString:
 		return ""
 	case TypeInt:
 		return 0
@@ -384,6 +631,14 @@ func (t FieldType) Zero() interface{} {
 		return map[string]interface{}{}
 	case TypeDurationSecond:
 		return 0
+	case TypeStringSlice, TypeCommaStringSlice:
+		return []string{}
+	case TypeKVPairs:
+		return map[string]string{}
+	case TypeFloat:
+		return 0.0
+	case TypeTime:
+		return time.Time{}
 	default:
 		panic("unknown type: " + t.String())
 	}
@@ -1,7 +1,10 @@
 package framework
 
 import (
+	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -77,6 +80,85 @@ func TestBackendHandleRequest(t *testing.T) {
 	}
 }
 
+func TestBackendHandleRequest_wrapTTL(t *testing.T) {
+	callback := func(req *logical.Request, data *FieldData) (*logical.Response, error) {
+		return &logical.Response{
+			Data:    map[string]interface{}{"value": "secret"},
+			WrapTTL: 5 * time.Minute,
+		}, nil
+	}
+
+	b := &Backend{
+		Paths: []*Path{
+			&Path{
+				Pattern: "foo/bar",
+				Callbacks: map[logical.Operation]OperationFunc{
+					logical.WriteOperation: callback,
+				},
+			},
+		},
+	}
+
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "foo/bar",
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if resp.WrapTTL != 5*time.Minute {
+		t.Fatalf("bad: %#v", resp)
+	}
+}
+
+func TestBackendHandleRequest_instrument(t *testing.T) {
+	callback := func(req *logical.Request, data *FieldData) (*logical.Response, error) {
+		return nil, logical.ErrPermissionDenied
+	}
+
+	var pattern string
+	var op logical.Operation
+	var hookErr error
+	var calls int
+	b := &Backend{
+		Paths: []*Path{
+			&Path{
+				Pattern: "foo/(?P<name>.+)",
+				Fields: map[string]*FieldSchema{
+					"name": &FieldSchema{Type: TypeString},
+				},
+				Callbacks: map[logical.Operation]OperationFunc{
+					logical.DeleteOperation: callback,
+				},
+			},
+		},
+		Instrument: func(p string, o logical.Operation, d time.Duration, err error) {
+			pattern, op, hookErr = p, o, err
+			calls++
+		},
+	}
+
+	_, err := b.HandleRequest(&logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "foo/bar",
+	})
+	if err != logical.ErrPermissionDenied {
+		t.Fatalf("err: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("bad: %d", calls)
+	}
+	if pattern != "^foo/(?P<name>.+)$" {
+		t.Fatalf("bad: %s", pattern)
+	}
+	if op != logical.DeleteOperation {
+		t.Fatalf("bad: %s", op)
+	}
+	if hookErr != logical.ErrPermissionDenied {
+		t.Fatalf("bad: %v", hookErr)
+	}
+}
+
 func TestBackendHandleRequest_badwrite(t *testing.T) {
 	callback := func(req *logical.Request, data *FieldData) (*logical.Response, error) {
 		return &logical.Response{
@@ -135,7 +217,7 @@ func TestBackendHandleRequest_404(t *testing.T) {
 		},
 	}
 
-	_, err := b.HandleRequest(&logical.Request{
+	resp, err := b.HandleRequest(&logical.Request{
 		Operation: logical.ReadOperation,
 		Path:      "foo/baz",
 		Data:      map[string]interface{}{"value": "84"},
@@ -143,6 +225,413 @@ func TestBackendHandleRequest_404(t *testing.T) {
 	if err != logical.ErrUnsupportedPath {
 		t.Fatalf("err: %s", err)
 	}
+	if !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+}
+
+func TestBackendHandleRequest_notFound(t *testing.T) {
+	callback := func(req *logical.Request, data *FieldData) (*logical.Response, error) {
+		return nil, nil
+	}
+
+	b := &Backend{
+		Paths: []*Path{
+			&Path{
+				Pattern: `foo/bar`,
+				Callbacks: map[logical.Operation]OperationFunc{
+					logical.ReadOperation: callback,
+				},
+			},
+		},
+	}
+
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "foo/bar",
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if resp != nil {
+		t.Fatalf("bad: %#v", resp)
+	}
+}
+
+func TestBackendHandleRequest_requiredFields(t *testing.T) {
+	callback := func(req *logical.Request, data *FieldData) (*logical.Response, error) {
+		return nil, nil
+	}
+
+	b := &Backend{
+		Paths: []*Path{
+			&Path{
+				Pattern: "foo/bar",
+				Fields: map[string]*FieldSchema{
+					"value": &FieldSchema{Type: TypeString},
+				},
+				RequiredFields: map[logical.Operation][]string{
+					logical.WriteOperation: []string{"value"},
+				},
+				Callbacks: map[logical.Operation]OperationFunc{
+					logical.WriteOperation:  callback,
+					logical.DeleteOperation: callback,
+				},
+			},
+		},
+	}
+
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "foo/bar",
+	})
+	if err != logical.ErrInvalidRequest {
+		t.Fatalf("err: %v", err)
+	}
+	if !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	_, err = b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "foo/bar",
+		Data:      map[string]interface{}{"value": "42"},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	_, err = b.HandleRequest(&logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "foo/bar",
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestBackendHandleRequest_requiredSchema(t *testing.T) {
+	callback := func(req *logical.Request, data *FieldData) (*logical.Response, error) {
+		return nil, nil
+	}
+
+	b := &Backend{
+		Paths: []*Path{
+			&Path{
+				Pattern: "foo/bar",
+				Fields: map[string]*FieldSchema{
+					"name":  &FieldSchema{Type: TypeString, Required: true},
+					"value": &FieldSchema{Type: TypeString, Required: true},
+					"other": &FieldSchema{Type: TypeString},
+				},
+				Callbacks: map[logical.Operation]OperationFunc{
+					logical.ReadOperation:  callback,
+					logical.WriteOperation: callback,
+				},
+			},
+		},
+	}
+
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "foo/bar",
+		Data:      map[string]interface{}{"value": "42"},
+	})
+	if err != logical.ErrInvalidRequest {
+		t.Fatalf("err: %v", err)
+	}
+	if resp.Data["error"] != "missing required fields: name" {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	_, err = b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "foo/bar",
+		Data:      map[string]interface{}{"name": "a", "value": "42"},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Required fields don't apply to reads
+	_, err = b.HandleRequest(&logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "foo/bar",
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestBackendHandleRequest_invalidFields(t *testing.T) {
+	var called bool
+	callback := func(req *logical.Request, data *FieldData) (*logical.Response, error) {
+		called = true
+		return nil, nil
+	}
+
+	b := &Backend{
+		Paths: []*Path{
+			&Path{
+				Pattern: "foo/bar",
+				Fields: map[string]*FieldSchema{
+					"count": &FieldSchema{Type: TypeInt},
+					"name": &FieldSchema{
+						Type: TypeString,
+						Validator: func(v interface{}) error {
+							if strings.Contains(v.(string), "/") {
+								return fmt.Errorf("name can't contain slashes")
+							}
+							return nil
+						},
+					},
+				},
+				Callbacks: map[logical.Operation]OperationFunc{
+					logical.WriteOperation: callback,
+				},
+			},
+		},
+	}
+
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "foo/bar",
+		Data:      map[string]interface{}{"count": "many", "name": "a/b"},
+	})
+	if err != logical.ErrInvalidRequest {
+		t.Fatalf("err: %v", err)
+	}
+	if called {
+		t.Fatal("callback should not be called")
+	}
+	if !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	errs := resp.Data["errors"].([]string)
+	if len(errs) != 2 || !strings.Contains(errs[0], "field count") || !strings.Contains(errs[1], "name can't contain slashes") {
+		t.Fatalf("bad: %#v", errs)
+	}
+}
+
+func TestBackendHandleRequest_existenceCheck(t *testing.T) {
+	items := map[string]bool{"existing": true}
+	var called logical.Operation
+	callback := func(op logical.Operation) OperationFunc {
+		return func(req *logical.Request, data *FieldData) (*logical.Response, error) {
+			called = op
+			return nil, nil
+		}
+	}
+	var instrumented logical.Operation
+
+	b := &Backend{
+		Paths: []*Path{
+			&Path{
+				Pattern: "items/(?P<name>.+)",
+				Fields: map[string]*FieldSchema{
+					"name":  &FieldSchema{Type: TypeString},
+					"value": &FieldSchema{Type: TypeString, Required: true},
+				},
+				ExistenceCheck: func(req *logical.Request, data *FieldData) (bool, error) {
+					if data.Get("name").(string) == "broken" {
+						return false, fmt.Errorf("storage error")
+					}
+					return items[data.Get("name").(string)], nil
+				},
+				Callbacks: map[logical.Operation]OperationFunc{
+					logical.CreateOperation: callback(logical.CreateOperation),
+					logical.UpdateOperation: callback(logical.UpdateOperation),
+				},
+			},
+			&Path{
+				Pattern: "other/(?P<name>.+)",
+				Fields: map[string]*FieldSchema{
+					"name": &FieldSchema{Type: TypeString},
+				},
+				ExistenceCheck: func(req *logical.Request, data *FieldData) (bool, error) {
+					return items[data.Get("name").(string)], nil
+				},
+				Callbacks: map[logical.Operation]OperationFunc{
+					logical.UpdateOperation: callback(logical.UpdateOperation),
+				},
+			},
+		},
+		Instrument: func(pattern string, op logical.Operation, d time.Duration, err error) {
+			instrumented = op
+		},
+	}
+
+	cases := []struct {
+		Path     string
+		Data     map[string]interface{}
+		Called   logical.Operation
+		ErrIsNil bool
+	}{
+		{"items/new", map[string]interface{}{"value": "42"}, logical.CreateOperation, true},
+		// Required fields don't apply to updates
+		{"items/existing", nil, logical.UpdateOperation, true},
+		{"items/new", nil, "", false},
+		{"items/broken", map[string]interface{}{"value": "42"}, "", false},
+		{"other/existing", nil, logical.UpdateOperation, true},
+		// There is neither a create nor a write callback
+		{"other/new", nil, "", false},
+	}
+	for _, tc := range cases {
+		called, instrumented = "", ""
+		_, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      tc.Path,
+			Data:      tc.Data,
+		})
+		if (err == nil) != tc.ErrIsNil {
+			t.Fatalf("bad: %s: %v", tc.Path, err)
+		}
+		if called != tc.Called {
+			t.Fatalf("bad: %s: expected %q, got %q", tc.Path, tc.Called, called)
+		}
+		if tc.Called != "" && instrumented != tc.Called {
+			t.Fatalf("bad: %s: %q", tc.Path, instrumented)
+		}
+	}
+	if _, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "other/new",
+	}); err != logical.ErrUnsupportedOperation {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Without create or update callbacks, writes fall back to the write
+	// callback.
+	b.Paths[1].Callbacks[logical.WriteOperation] = callback(logical.WriteOperation)
+	if _, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "other/new",
+	}); err != nil || called != logical.WriteOperation {
+		t.Fatalf("bad: %q: %v", called, err)
+	}
+}
+
+func TestBackendHandleRequest_allowedOperations(t *testing.T) {
+	var called bool
+	callback := func(req *logical.Request, data *FieldData) (*logical.Response, error) {
+		called = true
+		return nil, nil
+	}
+
+	b := &Backend{
+		Paths: []*Path{
+			&Path{
+				Pattern:           "foo/bar",
+				AllowedOperations: []logical.Operation{logical.ReadOperation},
+				Callbacks: map[logical.Operation]OperationFunc{
+					logical.ReadOperation:  callback,
+					logical.WriteOperation: callback,
+				},
+			},
+		},
+	}
+
+	_, err := b.HandleRequest(&logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "foo/bar",
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !called {
+		t.Fatal("callback should be called")
+	}
+
+	called = false
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "foo/bar",
+	})
+	if err != logical.ErrUnsupportedOperation {
+		t.Fatalf("err: %v", err)
+	}
+	if !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if called {
+		t.Fatal("callback should not be called")
+	}
+}
+
+func TestBackendHandleRequest_preRequest(t *testing.T) {
+	var called bool
+	var value string
+	callback := func(req *logical.Request, data *FieldData) (*logical.Response, error) {
+		called = true
+		value = data.Get("value").(string)
+		return nil, nil
+	}
+
+	b := &Backend{
+		Paths: []*Path{
+			&Path{
+				Pattern: "foo/bar",
+				Fields: map[string]*FieldSchema{
+					"value": &FieldSchema{Type: TypeString},
+				},
+				RequiredFields: map[logical.Operation][]string{
+					logical.WriteOperation: []string{"value"},
+				},
+				PreRequest: func(req *logical.Request, data *FieldData) error {
+					v := data.Get("value").(string)
+					if v == "reject" {
+						return fmt.Errorf("rejected")
+					}
+					if v == "" {
+						v = "default"
+					}
+					data.Raw["value"] = strings.ToLower(v)
+					return nil
+				},
+				Callbacks: map[logical.Operation]OperationFunc{
+					logical.WriteOperation: callback,
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		Data  map[string]interface{}
+		Value string
+	}{
+		{map[string]interface{}{"value": "FOO"}, "foo"},
+		// Data set by the hook counts towards the required fields
+		{nil, "default"},
+	}
+	for _, tc := range cases {
+		_, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      "foo/bar",
+			Data:      tc.Data,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if value != tc.Value {
+			t.Fatalf("bad: %#v: %q", tc.Data, value)
+		}
+	}
+
+	called = false
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "foo/bar",
+		Data:      map[string]interface{}{"value": "reject"},
+	})
+	if err != logical.ErrInvalidRequest {
+		t.Fatalf("err: %v", err)
+	}
+	if !resp.IsError() || resp.Data["error"] != "rejected" {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if called {
+		t.Fatal("callback should not be called")
+	}
 }
 
 func TestBackendHandleRequest_help(t *testing.T) {
@@ -152,6 +641,11 @@ func TestBackendHandleRequest_help(t *testing.T) {
 				Pattern: "foo/bar",
 				Fields: map[string]*FieldSchema{
 					"value": &FieldSchema{Type: TypeInt},
+					"type": &FieldSchema{
+						Type:          TypeString,
+						AllowedValues: []interface{}{"a", "b"},
+						Required:      true,
+					},
 				},
 				HelpSynopsis:    "foo",
 				HelpDescription: "bar",
@@ -167,9 +661,13 @@ func TestBackendHandleRequest_help(t *testing.T) {
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if resp.Data["help"] == nil {
+	help, ok := resp.Data["help"].(string)
+	if !ok {
 		t.Fatalf("bad: %#v", resp)
 	}
+	if !strings.Contains(help, "type (string, required)") || !strings.Contains(help, "Allowed values: 'a', 'b'") {
+		t.Fatalf("bad: %s", help)
+	}
 }
 
 func TestBackendHandleRequest_helpRoot(t *testing.T) {
@@ -366,6 +864,147 @@ func TestBackendHandleRequest_rollbackMinAge(t *testing.T) {
 	}
 }
 
+func TestBackendHandleRequest_rollbackBackoff(t *testing.T) {
+	var called uint32
+	callback := func(req *logical.Request, kind string, data interface{}) error {
+		atomic.AddUint32(&called, 1)
+		return fmt.Errorf("failed")
+	}
+
+	b := &Backend{
+		Rollback:       callback,
+		RollbackMinAge: 1 * time.Millisecond,
+	}
+
+	storage := new(logical.InmemStorage)
+	id, err := PutWAL(storage, "kind", "foo")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	// The first sweep fails and records the attempt
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.RollbackOperation,
+		Path:      "",
+		Storage:   storage,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if v := atomic.LoadUint32(&called); v != 1 {
+		t.Fatalf("bad: %#v", v)
+	}
+
+	entry, err := GetWAL(storage, id)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if entry == nil || entry.Attempts != 1 || entry.LastAttemptAt == 0 {
+		t.Fatalf("bad: %#v", entry)
+	}
+
+	// An immediate second sweep should skip the entry
+	_, err = b.HandleRequest(&logical.Request{
+		Operation: logical.RollbackOperation,
+		Path:      "",
+		Storage:   storage,
+		Data:      map[string]interface{}{"immediate": true},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if v := atomic.LoadUint32(&called); v != 1 {
+		t.Fatalf("bad: %#v", v)
+	}
+}
+
+func TestBackendHandleRequest_rollbackHandlers(t *testing.T) {
+	var fooCalled, fallbackCalled uint32
+	b := &Backend{
+		Rollback: func(req *logical.Request, kind string, data interface{}) error {
+			atomic.AddUint32(&fallbackCalled, 1)
+			return nil
+		},
+		RollbackHandlers: map[string]RollbackFunc{
+			"foo": func(req *logical.Request, kind string, data interface{}) error {
+				atomic.AddUint32(&fooCalled, 1)
+				return nil
+			},
+		},
+		RollbackMinAge: 1 * time.Millisecond,
+	}
+
+	storage := new(logical.InmemStorage)
+	if _, err := PutWAL(storage, "foo", "data"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := PutWAL(storage, "bar", "data"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	_, err := b.HandleRequest(&logical.Request{
+		Operation: logical.RollbackOperation,
+		Path:      "",
+		Storage:   storage,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if v := atomic.LoadUint32(&fooCalled); v != 1 {
+		t.Fatalf("bad: %#v", v)
+	}
+	if v := atomic.LoadUint32(&fallbackCalled); v != 1 {
+		t.Fatalf("bad: %#v", v)
+	}
+}
+
+func TestBackendHandleRequest_rollbackUnknownKind(t *testing.T) {
+	b := &Backend{
+		RollbackHandlers: map[string]RollbackFunc{
+			"foo": func(req *logical.Request, kind string, data interface{}) error {
+				return nil
+			},
+		},
+		RollbackMinAge: 1 * time.Millisecond,
+	}
+
+	storage := new(logical.InmemStorage)
+	id, err := PutWAL(storage, "bar", "data")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.RollbackOperation,
+		Path:      "",
+		Storage:   storage,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+
+	// The entry must be kept since it wasn't rolled back
+	entry, err := GetWAL(storage, id)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if entry == nil {
+		t.Fatalf("entry should not be deleted")
+	}
+}
+
 func TestBackendHandleRequest_unsupportedOperation(t *testing.T) {
 	callback := func(req *logical.Request, data *FieldData) (*logical.Response, error) {
 		return &logical.Response{
@@ -389,7 +1028,7 @@ func TestBackendHandleRequest_unsupportedOperation(t *testing.T) {
 		},
 	}
 
-	_, err := b.HandleRequest(&logical.Request{
+	resp, err := b.HandleRequest(&logical.Request{
 		Operation: logical.WriteOperation,
 		Path:      "foo/bar",
 		Data:      map[string]interface{}{"value": "84"},
@@ -397,6 +1036,9 @@ func TestBackendHandleRequest_unsupportedOperation(t *testing.T) {
 	if err != logical.ErrUnsupportedOperation {
 		t.Fatalf("err: %s", err)
 	}
+	if !resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
 }
 
 func TestBackendHandleRequest_urlPriority(t *testing.T) {
@@ -498,6 +1140,87 @@ func TestBackendRoute(t *testing.T) {
 	}
 }
 
+func TestBackendReloadPaths(t *testing.T) {
+	newPaths := func(value string) []*Path {
+		callback := func(req *logical.Request, data *FieldData) (*logical.Response, error) {
+			return &logical.Response{
+				Data: map[string]interface{}{"value": value},
+			}, nil
+		}
+		return []*Path{
+			&Path{
+				Pattern: "foo",
+				Callbacks: map[logical.Operation]OperationFunc{
+					logical.ReadOperation: callback,
+				},
+			},
+			&Path{
+				Pattern: value,
+				Callbacks: map[logical.Operation]OperationFunc{
+					logical.ReadOperation: callback,
+				},
+			},
+		}
+	}
+
+	b := &Backend{Paths: newPaths("old")}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				resp, err := b.HandleRequest(&logical.Request{
+					Operation: logical.ReadOperation,
+					Path:      "foo",
+				})
+				if err != nil {
+					errCh <- err
+					return
+				}
+				if v := resp.Data["value"]; v != "old" && v != "new" {
+					errCh <- fmt.Errorf("bad: %#v", resp)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		value := "old"
+		if i%2 == 0 {
+			value = "new"
+		}
+		if err := b.ReloadPaths(newPaths(value)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := b.ReloadPaths(newPaths("new")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p := b.Route("old"); p != nil {
+		t.Fatalf("bad: old path is still routed: %#v", p)
+	}
+	if p := b.Route("new"); p == nil {
+		t.Fatalf("bad: new path is not routed")
+	}
+
+	if err := b.ReloadPaths([]*Path{&Path{Pattern: "("}}); err == nil {
+		t.Fatalf("expected error for invalid pattern")
+	}
+	if p := b.Route("new"); p == nil {
+		t.Fatalf("bad: paths changed after failed reload")
+	}
+}
+
 func TestBackendSecret(t *testing.T) {
 	cases := map[string]struct {
 		Secrets []*Secret
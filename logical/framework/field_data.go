@@ -2,13 +2,21 @@ package framework
 
 import (
 	"fmt"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/mitchellh/mapstructure"
 )
 
+// nameRegex matches the values of TypeNameString fields: letters,
+// digits, '_', '-' and '.', starting and ending with a letter, a digit
+// or '_'.
+var nameRegex = regexp.MustCompile(`^\w([\w.-]*\w)?$`)
+
 // FieldData is the structure passed to the callback to handle a path
 // containing the populated parameters for fields. This should be used
 // instead of the raw (*vault.Request).Data to access data in a type-safe
@@ -22,27 +30,56 @@ type FieldData struct {
 // the schema, so we don't get an error/panic later when
 // trying to get data out.  Data not in the schema is not
 // an error at this point, so we don't worry about it.
+//
+// Every field is checked and all the problems found are
+// returned together as a *multierror.Error.
 func (d *FieldData) Validate() error {
-	for field, value := range d.Raw {
+	fields := make([]string, 0, len(d.Raw))
+	for field := range d.Raw {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
 
+	var merr error
+	for _, field := range fields {
+		value := d.Raw[field]
 		schema, ok := d.Schema[field]
 		if !ok {
 			continue
 		}
 
 		switch schema.Type {
-		case TypeBool, TypeInt, TypeMap, TypeDurationSecond, TypeString:
-			_, _, err := d.getPrimitive(field, schema)
+		case TypeBool, TypeInt, TypeMap, TypeDurationSecond, TypeString,
+			TypeStringSlice, TypeCommaStringSlice, TypeKVPairs,
+			TypeNameString, TypeLowerCaseString, TypeFloat, TypeTime:
+			_, _, err := d.getValue(field, schema)
 			if err != nil {
-				return fmt.Errorf("Error converting input %v for field %s", value, field)
+				merr = multierror.Append(merr, fmt.Errorf(
+					"Error converting input %v for field %s: %s", value, field, err))
 			}
 		default:
-			return fmt.Errorf("unknown field type %s for field %s",
-			    schema.Type, field)
+			merr = multierror.Append(merr, fmt.Errorf(
+				"unknown field type %s for field %s", schema.Type, field))
 		}
 	}
 
-	return nil
+	return merr
+}
+
+// validationErrors returns the messages of the errors found by Validate,
+// one per invalid field.
+func validationErrors(err error) []string {
+	merr, ok := err.(*multierror.Error)
+	if !ok {
+		return []string{err.Error()}
+	}
+
+	errs := make([]string, len(merr.Errors))
+	for i, e := range merr.Errors {
+		errs[i] = e.Error()
+	}
+
+	return errs
 }
 
 // Get gets the value for the given field. If the key is an invalid field,
@@ -83,6 +120,49 @@ func (d *FieldData) GetOk(k string) (interface{}, bool) {
 	return result, ok
 }
 
+// GetDuration gets the value of a TypeInt, TypeDurationSecond or
+// TypeString field as a duration. Integers are read as a number of
+// seconds and strings are parsed with time.ParseDuration, so "90m" and
+// "1h30m" are valid values. If the field is not set, the default value
+// (if set) is used, otherwise zero is returned. An error is returned if
+// the value can't be read as a duration.
+func (d *FieldData) GetDuration(k string) (time.Duration, error) {
+	schema, ok := d.Schema[k]
+	if !ok {
+		return 0, fmt.Errorf("unknown field: %s", k)
+	}
+
+	switch schema.Type {
+	case TypeInt, TypeDurationSecond, TypeString:
+	default:
+		return 0, fmt.Errorf("field %s of type %s can't be read as a duration", k, schema.Type)
+	}
+
+	value, ok, err := d.GetOkErr(k)
+	if err != nil {
+		return 0, fmt.Errorf("error reading %s: %s", k, err)
+	}
+	if !ok || value == nil {
+		value = schema.DefaultOrZero()
+	}
+
+	switch v := value.(type) {
+	case int:
+		return time.Duration(v) * time.Second, nil
+	case string:
+		if v == "" {
+			return 0, nil
+		}
+		dur, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration for %s: %s", k, err)
+		}
+		return dur, nil
+	default:
+		return 0, fmt.Errorf("invalid duration for %s: %v", k, value)
+	}
+}
+
 // GetOkErr is the most conservative of all the Get methods. It returns
 // whether key is set or not, but also an error value. The error value is
 // non-nil if the field doesn't exist or there was an error parsing the
@@ -94,14 +174,36 @@ func (d *FieldData) GetOkErr(k string) (interface{}, bool, error) {
 	}
 
 	switch schema.Type {
-	case TypeBool, TypeInt, TypeMap, TypeDurationSecond, TypeString:
-		return d.getPrimitive(k, schema)
+	case TypeBool, TypeInt, TypeMap, TypeDurationSecond, TypeString,
+		TypeStringSlice, TypeCommaStringSlice, TypeKVPairs,
+		TypeNameString, TypeLowerCaseString, TypeFloat, TypeTime:
+		return d.getValue(k, schema)
 	default:
 		return nil, false,
 			fmt.Errorf("unknown field type %s for field %s", schema.Type, k)
 	}
 }
 
+// getValue converts the value of the field and checks it against the
+// allowed values and the validator of the schema.
+func (d *FieldData) getValue(
+	k string, schema *FieldSchema) (interface{}, bool, error) {
+	result, ok, err := d.getPrimitive(k, schema)
+	if err != nil || !ok || result == nil {
+		return result, ok, err
+	}
+	if err := schema.checkAllowedValues(result); err != nil {
+		return nil, true, err
+	}
+	if schema.Validator != nil {
+		if err := schema.Validator(result); err != nil {
+			return nil, true, err
+		}
+	}
+
+	return result, true, nil
+}
+
 func (d *FieldData) getPrimitive(
 	k string, schema *FieldSchema) (interface{}, bool, error) {
 	raw, ok := d.Raw[k]
@@ -111,8 +213,8 @@ func (d *FieldData) getPrimitive(
 
 	switch schema.Type {
 	case TypeBool:
-		var result bool
-		if err := mapstructure.WeakDecode(raw, &result); err != nil {
+		result, err := parseBool(raw)
+		if err != nil {
 			return nil, true, err
 		}
 
@@ -123,12 +225,54 @@ func (d *FieldData) getPrimitive(
 			return nil, true, err
 		}
 
+		return result, true, nil
+	case TypeFloat:
+		var result float64
+		if err := mapstructure.WeakDecode(raw, &result); err != nil {
+			return nil, true, err
+		}
+
+		return result, true, nil
+	case TypeTime:
+		result, err := parseTime(raw)
+		if err != nil {
+			return nil, true, err
+		}
+
 		return result, true, nil
 	case TypeString:
 		var result string
 		if err := mapstructure.WeakDecode(raw, &result); err != nil {
 			return nil, true, err
 		}
+		if err := schema.checkPattern(result); err != nil {
+			return nil, true, err
+		}
+
+		return result, true, nil
+	case TypeNameString:
+		var result string
+		if err := mapstructure.WeakDecode(raw, &result); err != nil {
+			return nil, true, err
+		}
+		result = strings.TrimSpace(result)
+		if result != "" && !nameRegex.MatchString(result) {
+			return nil, true, fmt.Errorf("invalid name '%s'", result)
+		}
+		if err := schema.checkPattern(result); err != nil {
+			return nil, true, err
+		}
+
+		return result, true, nil
+	case TypeLowerCaseString:
+		var result string
+		if err := mapstructure.WeakDecode(raw, &result); err != nil {
+			return nil, true, err
+		}
+		result = strings.ToLower(strings.TrimSpace(result))
+		if err := schema.checkPattern(result); err != nil {
+			return nil, true, err
+		}
 
 		return result, true, nil
 	case TypeMap:
@@ -136,6 +280,11 @@ func (d *FieldData) getPrimitive(
 		if err := mapstructure.WeakDecode(raw, &result); err != nil {
 			return nil, true, err
 		}
+		if schema.Schema != nil {
+			if err := d.convertNested(result, schema.Schema); err != nil {
+				return nil, true, err
+			}
+		}
 
 		return result, true, nil
 
@@ -172,7 +321,169 @@ func (d *FieldData) getPrimitive(
 		}
 		return result, true, nil
 
+	case TypeStringSlice:
+		if s, ok := raw.(string); ok {
+			return []string{s}, true, nil
+		}
+
+		var result []string
+		if err := mapstructure.WeakDecode(raw, &result); err != nil {
+			return nil, true, err
+		}
+		if result == nil {
+			result = []string{}
+		}
+
+		return result, true, nil
+
+	case TypeCommaStringSlice:
+		var list []string
+		if s, ok := raw.(string); ok {
+			list = strings.Split(s, ",")
+		} else if err := mapstructure.WeakDecode(raw, &list); err != nil {
+			return nil, true, err
+		}
+
+		result := make([]string, 0, len(list))
+		for _, v := range list {
+			if v = strings.TrimSpace(v); v != "" {
+				result = append(result, v)
+			}
+		}
+		return result, true, nil
+
+	case TypeKVPairs:
+		result, err := parseKVPairs(raw)
+		if err != nil {
+			return nil, true, err
+		}
+
+		return result, true, nil
+
 	default:
 		panic(fmt.Sprintf("Unknown type: %s", schema.Type))
 	}
 }
+
+// convertNested validates and converts the values of a map field in place
+// according to the nested schema of the field.
+func (d *FieldData) convertNested(
+	m map[string]interface{}, schema map[string]*FieldSchema) error {
+	nested := &FieldData{
+		Raw:    m,
+		Schema: schema,
+	}
+
+	for k := range schema {
+		v, ok, err := nested.GetOkErr(k)
+		if err != nil {
+			return fmt.Errorf("error converting key %s: %s", k, err)
+		}
+		if ok {
+			m[k] = v
+		}
+	}
+
+	return nil
+}
+
+// parseKVPairs converts an object, a list of "key=value" strings or a
+// comma separated string of them to a map of strings. Keys and values
+// are trimmed, and keys can't be empty.
+func parseKVPairs(raw interface{}) (map[string]string, error) {
+	var pairs []string
+	switch v := raw.(type) {
+	case string:
+		pairs = strings.Split(v, ",")
+	case []interface{}, []string:
+		if err := mapstructure.WeakDecode(v, &pairs); err != nil {
+			return nil, err
+		}
+	default:
+		var result map[string]string
+		if err := mapstructure.WeakDecode(raw, &result); err != nil {
+			return nil, err
+		}
+		if result == nil {
+			result = map[string]string{}
+		}
+		return result, nil
+	}
+
+	result := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || key == "" {
+			return nil, fmt.Errorf("invalid pair '%s', expected 'key=value'", pair)
+		}
+		result[key] = strings.TrimSpace(kv[1])
+	}
+	return result, nil
+}
+
+// parseTime converts an RFC 3339 string, or a number of seconds since
+// the epoch given as a number or a string, to a time.
+func parseTime(raw interface{}) (time.Time, error) {
+	switch v := raw.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		if result, err := time.Parse(time.RFC3339, strings.TrimSpace(v)); err == nil {
+			return result, nil
+		}
+		seconds, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("cannot parse '%s' as an RFC 3339 time", v)
+		}
+		return time.Unix(seconds, 0).UTC(), nil
+	case int:
+		return time.Unix(int64(v), 0).UTC(), nil
+	case int64:
+		return time.Unix(v, 0).UTC(), nil
+	case float64:
+		return time.Unix(int64(v), 0).UTC(), nil
+	}
+
+	return time.Time{}, fmt.Errorf("cannot parse '%v' as a time", raw)
+}
+
+// parseBool converts the common representations of a boolean to a bool:
+// booleans, the strings accepted by strconv.ParseBool such as "true" and
+// "0", and the numbers 0 and 1.
+func parseBool(raw interface{}) (bool, error) {
+	switch v := raw.(type) {
+	case bool:
+		return v, nil
+	case string:
+		result, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return false, fmt.Errorf("cannot parse '%s' as bool", v)
+		}
+		return result, nil
+	case int:
+		return intBool(int64(v), raw)
+	case int64:
+		return intBool(v, raw)
+	case float64:
+		if v == float64(int64(v)) {
+			return intBool(int64(v), raw)
+		}
+	}
+
+	return false, fmt.Errorf("cannot parse '%v' as bool", raw)
+}
+
+func intBool(v int64, raw interface{}) (bool, error) {
+	switch v {
+	case 0:
+		return false, nil
+	case 1:
+		return true, nil
+	default:
+		return false, fmt.Errorf("cannot parse '%v' as bool", raw)
+	}
+}
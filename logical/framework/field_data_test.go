@@ -1,8 +1,13 @@
 package framework
 
 import (
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
 )
 
 func TestFieldDataGet(t *testing.T) {
@@ -92,6 +97,31 @@ func TestFieldDataGet(t *testing.T) {
 			},
 		},
 
+		"map type, nested schema": {
+			map[string]*FieldSchema{
+				"foo": &FieldSchema{
+					Type: TypeMap,
+					Schema: map[string]*FieldSchema{
+						"port": &FieldSchema{Type: TypeInt},
+						"user": &FieldSchema{Type: TypeString},
+					},
+				},
+			},
+			map[string]interface{}{
+				"foo": map[string]interface{}{
+					"port":  "22",
+					"user":  "root",
+					"other": true,
+				},
+			},
+			"foo",
+			map[string]interface{}{
+				"port":  22,
+				"user":  "root",
+				"other": true,
+			},
+		},
+
 		"duration type, string value": {
 			map[string]*FieldSchema{
 				"foo": &FieldSchema{Type: TypeDurationSecond},
@@ -146,6 +176,198 @@ func TestFieldDataGet(t *testing.T) {
 			"foo",
 			0,
 		},
+
+		"slice type, empty slice": {
+			map[string]*FieldSchema{
+				"foo": &FieldSchema{Type: TypeStringSlice},
+			},
+			map[string]interface{}{
+				"foo": []interface{}{},
+			},
+			"foo",
+			[]string{},
+		},
+
+		"slice type, string value": {
+			map[string]*FieldSchema{
+				"foo": &FieldSchema{Type: TypeStringSlice},
+			},
+			map[string]interface{}{
+				"foo": "a,b",
+			},
+			"foo",
+			[]string{"a,b"},
+		},
+
+		"slice type, slice value": {
+			map[string]*FieldSchema{
+				"foo": &FieldSchema{Type: TypeStringSlice},
+			},
+			map[string]interface{}{
+				"foo": []interface{}{"a", 42, true},
+			},
+			"foo",
+			[]string{"a", "42", "1"},
+		},
+
+		"slice type, default value": {
+			map[string]*FieldSchema{
+				"foo": &FieldSchema{Type: TypeStringSlice},
+			},
+			map[string]interface{}{},
+			"foo",
+			[]string{},
+		},
+
+		"comma string slice type, comma string value": {
+			map[string]*FieldSchema{
+				"foo": &FieldSchema{Type: TypeCommaStringSlice},
+			},
+			map[string]interface{}{
+				"foo": " a, b,,c ",
+			},
+			"foo",
+			[]string{"a", "b", "c"},
+		},
+
+		"comma string slice type, empty string value": {
+			map[string]*FieldSchema{
+				"foo": &FieldSchema{Type: TypeCommaStringSlice},
+			},
+			map[string]interface{}{
+				"foo": "",
+			},
+			"foo",
+			[]string{},
+		},
+
+		"comma string slice type, slice value": {
+			map[string]*FieldSchema{
+				"foo": &FieldSchema{Type: TypeCommaStringSlice},
+			},
+			map[string]interface{}{
+				"foo": []interface{}{"a ", " b", 42},
+			},
+			"foo",
+			[]string{"a", "b", "42"},
+		},
+
+		"kv pairs type, map value": {
+			map[string]*FieldSchema{
+				"foo": &FieldSchema{Type: TypeKVPairs},
+			},
+			map[string]interface{}{
+				"foo": map[string]interface{}{"a": "b", "c": 42},
+			},
+			"foo",
+			map[string]string{"a": "b", "c": "42"},
+		},
+
+		"kv pairs type, list value": {
+			map[string]*FieldSchema{
+				"foo": &FieldSchema{Type: TypeKVPairs},
+			},
+			map[string]interface{}{
+				"foo": []interface{}{"a=b", "c=d=e", "f="},
+			},
+			"foo",
+			map[string]string{"a": "b", "c": "d=e", "f": ""},
+		},
+
+		"kv pairs type, comma string value": {
+			map[string]*FieldSchema{
+				"foo": &FieldSchema{Type: TypeKVPairs},
+			},
+			map[string]interface{}{
+				"foo": "a=b, c = d,",
+			},
+			"foo",
+			map[string]string{"a": "b", "c": "d"},
+		},
+
+		"kv pairs type, default value": {
+			map[string]*FieldSchema{
+				"foo": &FieldSchema{Type: TypeKVPairs},
+			},
+			map[string]interface{}{},
+			"foo",
+			map[string]string{},
+		},
+
+		"name string type": {
+			map[string]*FieldSchema{
+				"foo": &FieldSchema{Type: TypeNameString},
+			},
+			map[string]interface{}{
+				"foo": " my-role.v2 ",
+			},
+			"foo",
+			"my-role.v2",
+		},
+
+		"lowercase string type": {
+			map[string]*FieldSchema{
+				"foo": &FieldSchema{Type: TypeLowerCaseString},
+			},
+			map[string]interface{}{
+				"foo": " OTP ",
+			},
+			"foo",
+			"otp",
+		},
+
+		"float type, float value": {
+			map[string]*FieldSchema{
+				"foo": &FieldSchema{Type: TypeFloat},
+			},
+			map[string]interface{}{
+				"foo": 0.75,
+			},
+			"foo",
+			0.75,
+		},
+
+		"float type, string value": {
+			map[string]*FieldSchema{
+				"foo": &FieldSchema{Type: TypeFloat},
+			},
+			map[string]interface{}{
+				"foo": "1.5",
+			},
+			"foo",
+			1.5,
+		},
+
+		"time type, RFC 3339 value": {
+			map[string]*FieldSchema{
+				"foo": &FieldSchema{Type: TypeTime},
+			},
+			map[string]interface{}{
+				"foo": "2030-01-02T03:04:05Z",
+			},
+			"foo",
+			time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+
+		"time type, epoch value": {
+			map[string]*FieldSchema{
+				"foo": &FieldSchema{Type: TypeTime},
+			},
+			map[string]interface{}{
+				"foo": float64(1893553445),
+			},
+			"foo",
+			time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+
+		"time type, default value": {
+			map[string]*FieldSchema{
+				"foo": &FieldSchema{Type: TypeTime},
+			},
+			map[string]interface{}{},
+			"foo",
+			time.Time{},
+		},
 	}
 
 	for name, tc := range cases {
@@ -162,3 +384,305 @@ func TestFieldDataGet(t *testing.T) {
 		}
 	}
 }
+
+func TestFieldDataValidate_pattern(t *testing.T) {
+	cases := map[string]struct {
+		Raw map[string]interface{}
+		Err bool
+	}{
+		"matching value": {
+			map[string]interface{}{"foo": "bar"},
+			false,
+		},
+
+		"non-matching value": {
+			map[string]interface{}{"foo": "Bar!"},
+			true,
+		},
+
+		"partially matching value": {
+			map[string]interface{}{"foo": "bar baz"},
+			true,
+		},
+
+		"empty value": {
+			map[string]interface{}{"foo": ""},
+			false,
+		},
+
+		"unset value": {
+			map[string]interface{}{},
+			false,
+		},
+	}
+
+	schema := map[string]*FieldSchema{
+		"foo": &FieldSchema{
+			Type:    TypeString,
+			Pattern: "[a-z]+",
+		},
+	}
+
+	for name, tc := range cases {
+		data := &FieldData{
+			Raw:    tc.Raw,
+			Schema: schema,
+		}
+
+		err := data.Validate()
+		if (err != nil) != tc.Err {
+			t.Fatalf("bad: %s\n\nerr: %v", name, err)
+		}
+
+		_, _, err = data.GetOkErr("foo")
+		if (err != nil) != tc.Err {
+			t.Fatalf("bad: %s\n\nerr: %v", name, err)
+		}
+	}
+}
+
+func TestFieldDataValidate_name(t *testing.T) {
+	cases := map[string]bool{
+		"web":        false,
+		"web-01.dev": false,
+		"a":          false,
+		"":           false,
+		"../root":    true,
+		"foo/bar":    true,
+		"-web":       true,
+		"web.":       true,
+		"web role":   true,
+	}
+
+	for name, shouldErr := range cases {
+		data := &FieldData{
+			Raw:    map[string]interface{}{"name": name},
+			Schema: map[string]*FieldSchema{"name": &FieldSchema{Type: TypeNameString}},
+		}
+		if err := data.Validate(); (err != nil) != shouldErr {
+			t.Fatalf("bad: %q: %v", name, err)
+		}
+	}
+}
+
+func TestFieldDataValidate_allowedValues(t *testing.T) {
+	schema := map[string]*FieldSchema{
+		"type": &FieldSchema{
+			Type:          TypeLowerCaseString,
+			AllowedValues: []interface{}{"otp", "dynamic", "ca"},
+		},
+		"bits": &FieldSchema{
+			Type:          TypeInt,
+			AllowedValues: []interface{}{2048, 4096},
+		},
+	}
+
+	cases := map[string]struct {
+		Raw map[string]interface{}
+		Err bool
+	}{
+		"allowed values": {
+			map[string]interface{}{"type": "OTP", "bits": "4096"},
+			false,
+		},
+		"empty value": {
+			map[string]interface{}{"type": ""},
+			false,
+		},
+		"unset values": {
+			map[string]interface{}{},
+			false,
+		},
+		"string not allowed": {
+			map[string]interface{}{"type": "password"},
+			true,
+		},
+		"int not allowed": {
+			map[string]interface{}{"bits": 1024},
+			true,
+		},
+	}
+
+	for name, tc := range cases {
+		data := &FieldData{
+			Raw:    tc.Raw,
+			Schema: schema,
+		}
+		if err := data.Validate(); (err != nil) != tc.Err {
+			t.Fatalf("bad: %s: %v", name, err)
+		}
+	}
+}
+
+func TestFieldDataValidate_validator(t *testing.T) {
+	var validated []interface{}
+	schema := map[string]*FieldSchema{
+		"port": &FieldSchema{
+			Type: TypeInt,
+			Validator: func(v interface{}) error {
+				validated = append(validated, v)
+				if port := v.(int); port < 1 || port > 65535 {
+					return fmt.Errorf("port %d is out of range", port)
+				}
+				return nil
+			},
+		},
+	}
+
+	data := &FieldData{
+		Raw:    map[string]interface{}{"port": "22"},
+		Schema: schema,
+	}
+	if err := data.Validate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The validator gets the converted value
+	if !reflect.DeepEqual(validated, []interface{}{22}) {
+		t.Fatalf("bad: %#v", validated)
+	}
+
+	data.Raw["port"] = 70000
+	err := data.Validate()
+	if err == nil || !strings.Contains(err.Error(), "port 70000 is out of range") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestFieldDataValidate_nestedMap(t *testing.T) {
+	data := &FieldData{
+		Raw: map[string]interface{}{
+			"foo": map[string]interface{}{
+				"port": "not a number",
+			},
+		},
+		Schema: map[string]*FieldSchema{
+			"foo": &FieldSchema{
+				Type: TypeMap,
+				Schema: map[string]*FieldSchema{
+					"port": &FieldSchema{Type: TypeInt},
+				},
+			},
+		},
+	}
+
+	if err := data.Validate(); err == nil {
+		t.Fatal("should have failed to convert nested value")
+	}
+}
+
+func TestFieldDataValidate_multipleErrors(t *testing.T) {
+	data := &FieldData{
+		Raw: map[string]interface{}{
+			"int":      "not a number",
+			"name":     "Not Valid!",
+			"duration": "forever",
+			"pairs":    "a=b,c",
+			"time":     "tomorrow",
+			"ok":       "fine",
+			"unknown":  "ignored",
+		},
+		Schema: map[string]*FieldSchema{
+			"int":      &FieldSchema{Type: TypeInt},
+			"name":     &FieldSchema{Type: TypeString, Pattern: "[a-z]+"},
+			"duration": &FieldSchema{Type: TypeDurationSecond},
+			"pairs":    &FieldSchema{Type: TypeKVPairs},
+			"time":     &FieldSchema{Type: TypeTime},
+			"ok":       &FieldSchema{Type: TypeString},
+		},
+	}
+
+	err := data.Validate()
+	if err == nil {
+		t.Fatal("should have failed validation")
+	}
+	merr, ok := err.(*multierror.Error)
+	if !ok {
+		t.Fatalf("bad: %#v", err)
+	}
+	if len(merr.Errors) != 5 {
+		t.Fatalf("bad: %#v", merr.Errors)
+	}
+}
+
+func TestFieldDataGet_bool(t *testing.T) {
+	cases := map[string]struct {
+		Raw   interface{}
+		Value bool
+		Err   bool
+	}{
+		"bool true":      {true, true, false},
+		"bool false":     {false, false, false},
+		"string true":    {"true", true, false},
+		"string false":   {"false", false, false},
+		"string TRUE":    {"TRUE", true, false},
+		"string 1":       {"1", true, false},
+		"string 0":       {"0", false, false},
+		"int 1":          {1, true, false},
+		"int 0":          {0, false, false},
+		"float 1":        {1.0, true, false},
+		"float 0":        {0.0, false, false},
+		"invalid string": {"3false3", false, true},
+		"invalid int":    {42, false, true},
+		"invalid float":  {0.5, false, true},
+		"invalid map":    {map[string]interface{}{}, false, true},
+	}
+
+	for name, tc := range cases {
+		data := &FieldData{
+			Raw: map[string]interface{}{
+				"foo": tc.Raw,
+			},
+			Schema: map[string]*FieldSchema{
+				"foo": &FieldSchema{Type: TypeBool},
+			},
+		}
+
+		actual, _, err := data.GetOkErr("foo")
+		if (err != nil) != tc.Err {
+			t.Fatalf("bad: %s: err: %v", name, err)
+		}
+		if err == nil && actual != tc.Value {
+			t.Fatalf("bad: %s: %#v", name, actual)
+		}
+	}
+}
+
+func TestFieldDataGetDuration(t *testing.T) {
+	cases := map[string]struct {
+		Schema *FieldSchema
+		Raw    interface{}
+		Value  time.Duration
+		Err    bool
+	}{
+		"int seconds":      {&FieldSchema{Type: TypeInt}, 300, 5 * time.Minute, false},
+		"float seconds":    {&FieldSchema{Type: TypeInt}, 300.0, 5 * time.Minute, false},
+		"string seconds":   {&FieldSchema{Type: TypeInt}, "300", 5 * time.Minute, false},
+		"duration string":  {&FieldSchema{Type: TypeString}, "1h30m", 90 * time.Minute, false},
+		"duration second":  {&FieldSchema{Type: TypeDurationSecond}, "5m", 5 * time.Minute, false},
+		"unset":            {&FieldSchema{Type: TypeString}, nil, 0, false},
+		"unset default":    {&FieldSchema{Type: TypeString, Default: "1h"}, nil, time.Hour, false},
+		"invalid string":   {&FieldSchema{Type: TypeString}, "forever", 0, true},
+		"string no unit":   {&FieldSchema{Type: TypeString}, "300", 0, true},
+		"invalid int":      {&FieldSchema{Type: TypeInt}, "five", 0, true},
+		"unsupported type": {&FieldSchema{Type: TypeBool}, true, 0, true},
+	}
+
+	for name, tc := range cases {
+		data := &FieldData{
+			Raw:    map[string]interface{}{},
+			Schema: map[string]*FieldSchema{"foo": tc.Schema},
+		}
+		if tc.Raw != nil {
+			data.Raw["foo"] = tc.Raw
+		}
+
+		actual, err := data.GetDuration("foo")
+		if (err != nil) != tc.Err {
+			t.Fatalf("bad: %s: err: %v", name, err)
+		}
+		if actual != tc.Value {
+			t.Fatalf("bad: %s: %s", name, actual)
+		}
+	}
+}
@@ -13,6 +13,35 @@ const (
 	// TypeDurationSecond represent as seconds, this can be either an
 	// integer or go duration format string (e.g. 24h)
 	TypeDurationSecond
+
+	// TypeStringSlice is a list of strings. A single string is read as
+	// a list with that string.
+	TypeStringSlice
+
+	// TypeCommaStringSlice is a list of strings that can also be given
+	// as a comma separated string. The entries are trimmed and empty
+	// ones are dropped.
+	TypeCommaStringSlice
+
+	// TypeKVPairs is a map of strings. It can be given as an object, as
+	// a list of 'key=value' strings or as a comma separated string of
+	// them.
+	TypeKVPairs
+
+	// TypeNameString is a string that names an object, such as a role or
+	// a key. It is trimmed and must be made of letters, digits, '_', '-'
+	// and '.', so it can't contain slashes.
+	TypeNameString
+
+	// TypeLowerCaseString is a string that is trimmed and lowercased.
+	TypeLowerCaseString
+
+	// TypeFloat is a floating point number, read as a float64.
+	TypeFloat
+
+	// TypeTime is an absolute time, read as a time.Time. It can be given
+	// as an RFC 3339 string or as a number of seconds since the epoch.
+	TypeTime
 )
 
 func (t FieldType) String() string {
@@ -27,6 +56,18 @@ func (t FieldType) String() string {
 		return "map"
 	case TypeDurationSecond:
 		return "duration (sec)"
+	case TypeStringSlice, TypeCommaStringSlice:
+		return "slice"
+	case TypeKVPairs:
+		return "map of strings"
+	case TypeNameString:
+		return "name string"
+	case TypeLowerCaseString:
+		return "lowercase string"
+	case TypeFloat:
+		return "float"
+	case TypeTime:
+		return "time"
 	default:
 		return "unknown type"
 	}
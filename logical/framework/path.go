@@ -43,16 +43,51 @@ type Path struct {
 	// whereas all fields are avaiable in the Write operation.
 	Fields map[string]*FieldSchema
 
+	// RequiredFields lists, per operation, the fields that must be set
+	// for a request with that operation. Requests missing any of them are
+	// rejected before the callback is called.
+	RequiredFields map[logical.Operation][]string
+
 	// Callbacks are the set of callbacks that are called for a given
 	// operation. If a callback for a specific operation is not present,
 	// then logical.ErrUnsupportedOperation is automatically generated.
 	//
+	// A read callback for an item that doesn't exist should return a nil
+	// response and a nil error. Other callbacks should return
+	// logical.ErrNotFound in that case. Either way the client sees the
+	// item as not found, which is distinct from an unsupported path or
+	// operation.
+	//
 	// The help operation is the only operation that the Path will
 	// automatically handle if the Help field is set. If both the Help
 	// field is set and there is a callback registered here, then the
 	// callback will be called.
 	Callbacks map[logical.Operation]OperationFunc
 
+	// ExistenceCheck, if set, tells whether the item a write request
+	// refers to exists. Write requests are then routed to the
+	// UpdateOperation callback if it exists and to the CreateOperation
+	// callback otherwise, falling back to the WriteOperation callback if
+	// the path has no callback for that operation. The RequiredFields of
+	// that operation apply instead of those of the write operation. It is
+	// called after PreRequest.
+	ExistenceCheck func(*logical.Request, *FieldData) (bool, error)
+
+	// PreRequest, if set, is called for every operation except help
+	// after the data has been validated against Fields and before the
+	// required fields are checked and the callback is called. It can
+	// modify the data seen by the callback through FieldData.Raw, in
+	// which case the values set must be of the type of their schema.
+	// If it returns an error, the request is rejected with the error
+	// message and the callback isn't called.
+	PreRequest func(*logical.Request, *FieldData) error
+
+	// AllowedOperations, if set, is the exhaustive list of operations
+	// that this path supports. Requests with any other operation are
+	// rejected with logical.ErrUnsupportedOperation before a callback is
+	// looked up. The help operation is always allowed.
+	AllowedOperations []logical.Operation
+
 	// Help is text describing how to use this path. This will be used
 	// to auto-generate the help operation. The Path will automatically
 	// generate a parameter listing and URL structure based on the
@@ -102,6 +137,8 @@ func (p *Path) helpCallback(
 			Key:         k,
 			Type:        schema.Type.String(),
 			Description: description,
+			Required:    schema.Required,
+			Allowed:     schema.allowedValuesString(),
 		}
 	}
 
@@ -113,6 +150,53 @@ func (p *Path) helpCallback(
 	return logical.HelpResponse(help, nil), nil
 }
 
+// operationAllowed returns whether the path allows the given operation.
+func (p *Path) operationAllowed(op logical.Operation) bool {
+	if p.AllowedOperations == nil || op == logical.HelpOperation {
+		return true
+	}
+
+	for _, allowed := range p.AllowedOperations {
+		if allowed == op {
+			return true
+		}
+	}
+
+	return false
+}
+
+// missingFields returns the names of the fields that are required for
+// the given operation but aren't set in the field data. Fields of the
+// schema marked as Required are required for write and create
+// operations, but not for updates of existing items.
+func (p *Path) missingFields(op logical.Operation, d *FieldData) []string {
+	required := p.RequiredFields[op]
+	if op == logical.WriteOperation || op == logical.CreateOperation {
+		listed := make(map[string]bool, len(required))
+		for _, k := range required {
+			listed[k] = true
+		}
+		var marked []string
+		for k, schema := range p.Fields {
+			if schema.Required && !listed[k] {
+				marked = append(marked, k)
+			}
+		}
+		sort.Strings(marked)
+		required = append(required[:len(required):len(required)], marked...)
+	}
+
+	var missing []string
+	for _, k := range required {
+		v, ok := d.Raw[k]
+		if !ok || v == nil || v == "" {
+			missing = append(missing, k)
+		}
+	}
+
+	return missing
+}
+
 type pathTemplateData struct {
 	Request      string
 	RoutePattern string
@@ -126,6 +210,8 @@ type pathTemplateFieldData struct {
 	Type        string
 	Description string
 	URL         bool
+	Required    bool
+	Allowed     string
 }
 
 const pathHelpTemplate = `
@@ -136,9 +222,10 @@ Matching Route: {{.RoutePattern}}
 
 ## PARAMETERS
 {{range .Fields}}
-{{indent 4 .Key}} ({{.Type}})
+{{indent 4 .Key}} ({{.Type}}{{if .Required}}, required{{end}})
 {{indent 8 .Description}}
-{{end}}
+{{if .Allowed}}{{indent 8 (printf "Allowed values: %s" .Allowed)}}
+{{end}}{{end}}
 ## DESCRIPTION
 
 {{.Description}}
@@ -23,6 +23,9 @@ type Secret struct {
 	// the duration of the lease for this secret and its grace period. These
 	// can be manually overwritten with the result of Response().
 	//
+	// The same defaults are applied to the secret returned from a Renew
+	// callback when the callback leaves the TTL or grace period unset.
+	//
 	// If these aren't set, Vault core will set a default lease period.
 	DefaultDuration    time.Duration
 	DefaultGracePeriod time.Duration
@@ -40,6 +43,21 @@ func (s *Secret) Renewable() bool {
 	return s.Renew != nil
 }
 
+// applyDefaults fills in the lease options of the secret in the response
+// with the defaults of this secret type if they weren't set.
+func (s *Secret) applyDefaults(resp *logical.Response) {
+	if resp == nil || resp.Secret == nil {
+		return
+	}
+
+	if resp.Secret.TTL == 0 {
+		resp.Secret.TTL = s.DefaultDuration
+	}
+	if resp.Secret.GracePeriod == 0 {
+		resp.Secret.GracePeriod = s.DefaultGracePeriod
+	}
+}
+
 func (s *Secret) Response(
 	data, internal map[string]interface{}) *logical.Response {
 	internalData := make(map[string]interface{})
@@ -73,7 +91,13 @@ func (s *Secret) HandleRenew(req *logical.Request) (*logical.Response, error) {
 		Schema: s.Fields,
 	}
 
-	return s.Renew(req, data)
+	resp, err := s.Renew(req, data)
+	if err != nil {
+		return resp, err
+	}
+
+	s.applyDefaults(resp)
+	return resp, nil
 }
 
 // HandleRevoke is the request handler for renewing this secret.
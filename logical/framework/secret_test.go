@@ -1 +1,76 @@
 package framework
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestSecretResponse_defaults(t *testing.T) {
+	s := &Secret{
+		Type:               "foo",
+		DefaultDuration:    10 * time.Minute,
+		DefaultGracePeriod: 2 * time.Minute,
+	}
+
+	resp := s.Response(nil, nil)
+	if resp.Secret.TTL != 10*time.Minute {
+		t.Fatalf("bad: %#v", resp.Secret)
+	}
+	if resp.Secret.GracePeriod != 2*time.Minute {
+		t.Fatalf("bad: %#v", resp.Secret)
+	}
+	if resp.Secret.InternalData["secret_type"] != "foo" {
+		t.Fatalf("bad: %#v", resp.Secret)
+	}
+}
+
+func TestSecretHandleRenew_defaults(t *testing.T) {
+	s := &Secret{
+		Type:               "foo",
+		DefaultDuration:    10 * time.Minute,
+		DefaultGracePeriod: 2 * time.Minute,
+		Renew: func(req *logical.Request, data *FieldData) (*logical.Response, error) {
+			return &logical.Response{Secret: &logical.Secret{}}, nil
+		},
+	}
+
+	resp, err := s.HandleRenew(logical.RenewRequest("/foo", &logical.Secret{}, nil))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if resp.Secret.TTL != 10*time.Minute {
+		t.Fatalf("bad: %#v", resp.Secret)
+	}
+	if resp.Secret.GracePeriod != 2*time.Minute {
+		t.Fatalf("bad: %#v", resp.Secret)
+	}
+}
+
+func TestSecretHandleRenew_explicit(t *testing.T) {
+	s := &Secret{
+		Type:               "foo",
+		DefaultDuration:    10 * time.Minute,
+		DefaultGracePeriod: 2 * time.Minute,
+		Renew: func(req *logical.Request, data *FieldData) (*logical.Response, error) {
+			return &logical.Response{Secret: &logical.Secret{
+				LeaseOptions: logical.LeaseOptions{
+					TTL:         time.Hour,
+					GracePeriod: time.Minute,
+				},
+			}}, nil
+		},
+	}
+
+	resp, err := s.HandleRenew(logical.RenewRequest("/foo", &logical.Secret{}, nil))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if resp.Secret.TTL != time.Hour {
+		t.Fatalf("bad: %#v", resp.Secret)
+	}
+	if resp.Secret.GracePeriod != time.Minute {
+		t.Fatalf("bad: %#v", resp.Secret)
+	}
+}
@@ -11,11 +11,42 @@ import (
 // WALPrefix is the prefix within Storage where WAL entries will be written.
 const WALPrefix = "wal/"
 
+const (
+	// walRetryBase and walRetryMax bound the exponential backoff used
+	// between attempts to roll back a WAL entry that previously failed.
+	walRetryBase = 30 * time.Second
+	walRetryMax  = 6 * time.Hour
+)
+
 type WALEntry struct {
 	ID        string      `json:"-"`
 	Kind      string      `json:"type"`
 	Data      interface{} `json:"data"`
 	CreatedAt int64       `json:"created_at"`
+
+	// Attempts is the number of failed rollback attempts of this entry
+	// and LastAttemptAt is the time of the most recent one.
+	Attempts      int   `json:"attempts"`
+	LastAttemptAt int64 `json:"last_attempt_at"`
+}
+
+// NextAttemptAt returns the earliest time that a rollback of this entry
+// should be attempted again, based on an exponential backoff from the
+// number of failed attempts. The zero time is returned if no attempt
+// has failed yet.
+func (e *WALEntry) NextAttemptAt() time.Time {
+	if e.Attempts == 0 {
+		return time.Time{}
+	}
+
+	backoff := walRetryMax
+	if e.Attempts < 32 {
+		if d := walRetryBase << uint(e.Attempts-1); d > 0 && d < walRetryMax {
+			backoff = d
+		}
+	}
+
+	return time.Unix(e.LastAttemptAt, 0).Add(backoff)
 }
 
 // PutWAL writes some data to the WAL.
@@ -34,22 +65,29 @@ type WALEntry struct {
 // WAL data cannot be modified. You can only add to the WAL and commit existing
 // WAL entries.
 func PutWAL(s logical.Storage, kind string, data interface{}) (string, error) {
-	value, err := json.Marshal(&WALEntry{
+	id, err := logical.UUID()
+	if err != nil {
+		return "", err
+	}
+
+	return id, putWALEntry(s, &WALEntry{
+		ID:        id,
 		Kind:      kind,
 		Data:      data,
 		CreatedAt: time.Now().UTC().Unix(),
 	})
-	if err != nil {
-		return "", err
-	}
+}
 
-	id, err := logical.UUID()
+// putWALEntry writes the entry to the WAL under its ID. This is used
+// internally to record rollback attempts of existing entries.
+func putWALEntry(s logical.Storage, e *WALEntry) error {
+	value, err := json.Marshal(e)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	return id, s.Put(&logical.StorageEntry{
-		Key:   WALPrefix + id,
+	return s.Put(&logical.StorageEntry{
+		Key:   WALPrefix + e.ID,
 		Value: value,
 	})
 }
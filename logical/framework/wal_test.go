@@ -3,6 +3,7 @@ package framework
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/vault/logical"
 )
@@ -58,3 +59,25 @@ func TestWAL(t *testing.T) {
 		t.Fatalf("bad: %#v", entry)
 	}
 }
+
+func TestWALEntry_NextAttemptAt(t *testing.T) {
+	entry := &WALEntry{}
+	if !entry.NextAttemptAt().IsZero() {
+		t.Fatalf("bad: %#v", entry.NextAttemptAt())
+	}
+
+	last := time.Now().UTC().Unix()
+	cases := map[int]time.Duration{
+		1:   walRetryBase,
+		2:   2 * walRetryBase,
+		3:   4 * walRetryBase,
+		100: walRetryMax,
+	}
+	for attempts, expected := range cases {
+		entry = &WALEntry{Attempts: attempts, LastAttemptAt: last}
+		actual := entry.NextAttemptAt().Sub(time.Unix(last, 0))
+		if actual != expected {
+			t.Fatalf("bad: %d: expected %s, got %s", attempts, expected, actual)
+		}
+	}
+}
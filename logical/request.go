@@ -48,6 +48,11 @@ type Request struct {
 	// name, but is useful for operators.
 	DisplayName string
 
+	// Metadata is the metadata of the token that made the request, as set
+	// by the credential backend that issued it. Like DisplayName, it is
+	// not sensitive.
+	Metadata map[string]string
+
 	// MountPoint is provided so that a logical backend can generate
 	// paths relative to itself. The `Path` is effectively the client
 	// request path with the MountPoint trimmed off.
@@ -127,6 +132,14 @@ const (
 	ListOperation             = "list"
 	HelpOperation             = "help"
 
+	// CreateOperation and UpdateOperation are the two kinds of writes.
+	// Backends that can tell whether the target of a write exists route
+	// writes to a new item as creates and the others as updates. Requests
+	// reach backends as writes, and the ACL only checks them as writes, so
+	// policies can't tell creates and updates apart.
+	CreateOperation Operation = "create"
+	UpdateOperation           = "update"
+
 	// The operations below are called globally, the path is less relevant.
 	RevokeOperation   Operation = "revoke"
 	RenewOperation              = "renew"
@@ -142,6 +155,12 @@ var (
 	// by the logical backend.
 	ErrUnsupportedPath = errors.New("unsupported path")
 
+	// ErrNotFound is returned if the path and operation are supported
+	// by the logical backend but the item the request refers to does
+	// not exist. Read operations may instead simply return a nil
+	// response, which is treated the same way.
+	ErrNotFound = errors.New("not found")
+
 	// ErrInvalidRequest is returned if the request is invalid
 	ErrInvalidRequest = errors.New("invalid request")
 
@@ -1,5 +1,10 @@
 package logical
 
+import (
+	"strings"
+	"time"
+)
+
 const (
 	// HTTPContentType can be specified in the Data field of a Response
 	// so that the HTTP front end can specify a custom Content-Type associated
@@ -40,11 +45,45 @@ type Response struct {
 	// This is only valid for credential backends. This will be blanked
 	// for any logical backend and ignored.
 	Redirect string
+
+	// WrapTTL, if non-zero, is a hint from the backend that this response
+	// is sensitive and should be response-wrapped with the given TTL
+	// rather than returned in plaintext. The hint is carried unchanged
+	// through the framework; it is up to the caller handling the response
+	// to honor it. Core and the HTTP API don't act on it yet, so responses
+	// that set it are still returned in plaintext.
+	WrapTTL time.Duration
+
+	// Warnings are messages that should be shown to the user alongside
+	// the response, such as notices about deprecated or insecure settings.
+	// They don't make the response an error. Use AddWarning to add one.
+	Warnings []string
+}
+
+// AddWarning adds a warning to the response.
+func (r *Response) AddWarning(warning string) {
+	r.Warnings = append(r.Warnings, warning)
 }
 
 // IsError returns true if this response seems to indicate an error.
+// An error response holds the error message and, optionally, an error code
+// or the list of the errors the message is made of.
 func (r *Response) IsError() bool {
-	return r != nil && len(r.Data) == 1 && r.Data["error"] != nil
+	if r == nil || r.Data["error"] == nil {
+		return false
+	}
+	switch len(r.Data) {
+	case 1:
+		return true
+	case 2:
+		_, ok := r.Data["error_code"]
+		if !ok {
+			_, ok = r.Data["errors"]
+		}
+		return ok
+	default:
+		return false
+	}
 }
 
 // HelpResponse is used to format a help response
@@ -66,6 +105,28 @@ func ErrorResponse(text string) *Response {
 	}
 }
 
+// ErrorCodeResponse is used to format an error response that carries
+// a machine-readable error code along with the message.
+func ErrorCodeResponse(code, text string) *Response {
+	return &Response{
+		Data: map[string]interface{}{
+			"error":      text,
+			"error_code": code,
+		},
+	}
+}
+
+// ErrorListResponse is used to format an error response that reports
+// several errors at once, such as every invalid field of a request.
+func ErrorListResponse(errs []string) *Response {
+	return &Response{
+		Data: map[string]interface{}{
+			"error":  strings.Join(errs, "; "),
+			"errors": errs,
+		},
+	}
+}
+
 // ListResponse is used to format a response to a list operation.
 func ListResponse(keys []string) *Response {
 	return &Response{
@@ -461,8 +461,9 @@ func (c *Core) handleRequest(req *logical.Request) (retResp *logical.Response, r
 		return logical.ErrorResponse(err.Error()), nil, errType
 	}
 
-	// Attach the display name
+	// Attach the display name and the token metadata
 	req.DisplayName = auth.DisplayName
+	req.Metadata = auth.Metadata
 
 	// Create an audit trail of the request
 	if err := c.auditBroker.LogRequest(auth, req, nil); err != nil {